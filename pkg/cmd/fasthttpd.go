@@ -73,6 +73,11 @@ type FastHttpd struct {
 	servers          []*fasthttp.Server
 	shutdownTimeouts []time.Duration
 
+	// reloadMu guards handlers, which maps each listen address to the
+	// SwapHandler serving it so that reload can install new handlers.
+	reloadMu sync.Mutex
+	handlers map[string]*handler.SwapHandler
+
 	hupMu    sync.Mutex
 	hupCh    chan os.Signal
 	hupClose sync.Once
@@ -105,6 +110,15 @@ func (d *FastHttpd) loadTreeMaps() ([]tree.Map, error) {
 	if d.configFile == "" {
 		return []tree.Map{minimalTreeMap()}, nil
 	}
+	// Resolve the path once so that a reload after the Chdir below still
+	// finds the same file.
+	if !filepath.IsAbs(d.configFile) {
+		abs, err := filepath.Abs(d.configFile)
+		if err != nil {
+			return nil, err
+		}
+		d.configFile = abs
+	}
 	dir, file := filepath.Split(d.configFile)
 	if dir != "" {
 		if err := os.Chdir(dir); err != nil {
@@ -150,26 +164,36 @@ func (d *FastHttpd) listen(listen string, cfgs []config.Config, server *fasthttp
 	return ln, nil
 }
 
-func (d *FastHttpd) run() error {
+// loadConfigs runs the config pipeline (Load → Edit → Validate →
+// FromTreeMaps) and groups the resulting configs by listen address.
+func (d *FastHttpd) loadConfigs() (map[string][]config.Config, error) {
 	ms, err := d.loadTreeMaps()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	ms, err = config.Edit(ms, d.editExprs)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if err := config.ValidateTreeMaps(ms); err != nil {
-		return err
+		return nil, err
 	}
 	cfgs, err := config.FromTreeMaps(ms)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	listenedCfgs := map[string][]config.Config{}
 	for _, cfg := range cfgs {
 		listenedCfgs[cfg.Listen] = append(listenedCfgs[cfg.Listen], cfg)
 	}
+	return listenedCfgs, nil
+}
+
+func (d *FastHttpd) run() error {
+	listenedCfgs, err := d.loadConfigs()
+	if err != nil {
+		return err
+	}
 
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
@@ -185,10 +209,11 @@ func (d *FastHttpd) run() error {
 
 	errChs := make(chan error, len(listenedCfgs))
 	for listen, cfgs := range listenedCfgs {
-		h, err := handler.NewServerHandler(cfgs)
+		sh, err := handler.NewServerHandler(cfgs)
 		if err != nil {
 			return err
 		}
+		h := handler.NewSwapHandler(sh)
 		defer func() { _ = h.Close() }()
 
 		server, err := d.newServer(h)
@@ -201,6 +226,12 @@ func (d *FastHttpd) run() error {
 		}
 
 		h.Logger().Printf("starting fasthttpd on %q", listen)
+		d.reloadMu.Lock()
+		if d.handlers == nil {
+			d.handlers = map[string]*handler.SwapHandler{}
+		}
+		d.handlers[listen] = h
+		d.reloadMu.Unlock()
 		d.servers = append(d.servers, server)
 		d.shutdownTimeouts = append(d.shutdownTimeouts, cfgs[0].ShutdownTimeoutDuration())
 
@@ -232,14 +263,60 @@ func (d *FastHttpd) handleHUP() {
 
 	go func() {
 		for range ch {
-			log.Println("received SIGHUP, rotating logs")
+			log.Println("received SIGHUP, rotating logs and reloading configuration")
 			if err := logger.RotateShared(); err != nil {
 				log.Printf("failed to rotate logs: %v", err)
 			}
+			if err := d.reload(); err != nil {
+				log.Printf("failed to reload configuration, keeping the current one: %v", err)
+			}
 		}
 	}()
 }
 
+// reload re-runs the config pipeline and swaps freshly built handlers into
+// the running servers. Nothing is swapped unless every handler builds, so a
+// broken config leaves the current one serving. Listeners are not reopened:
+// changes to the set of listen addresses, or to per-listener settings such
+// as ssl and server, require a restart.
+func (d *FastHttpd) reload() error {
+	d.reloadMu.Lock()
+	defer d.reloadMu.Unlock()
+
+	if len(d.handlers) == 0 {
+		return nil
+	}
+	listenedCfgs, err := d.loadConfigs()
+	if err != nil {
+		return err
+	}
+	if len(listenedCfgs) != len(d.handlers) {
+		return errors.New("listen addresses changed, restart required")
+	}
+	for listen := range listenedCfgs {
+		if _, ok := d.handlers[listen]; !ok {
+			return fmt.Errorf("listen address %q added, restart required", listen)
+		}
+	}
+
+	built := map[string]handler.ServerHandler{}
+	for listen, cfgs := range listenedCfgs {
+		h, err := handler.NewServerHandler(cfgs)
+		if err != nil {
+			for _, b := range built {
+				_ = b.Close()
+			}
+			return err
+		}
+		built[listen] = h
+	}
+	for listen, h := range built {
+		d.handlers[listen].Swap(h)
+		h.Logger().Printf("reloaded configuration on %q", listen)
+	}
+	return nil
+}
+
 func (d *FastHttpd) stopHUP() {
 	d.hupMu.Lock()
 	ch := d.hupCh
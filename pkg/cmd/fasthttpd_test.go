@@ -123,6 +123,89 @@ func TestFastHttpd_HandleHUP(t *testing.T) {
 	t.Fatal("rotation did not happen within deadline")
 }
 
+func TestFastHttpd_Reload(t *testing.T) {
+	// Note: no t.Parallel — loadTreeMaps changes the working directory.
+	t.Chdir(t.TempDir())
+
+	configYAML := func(body, handler string) []byte {
+		return []byte(`host: localhost
+handlers:
+  'hello':
+    type: content
+    body: ` + body + `
+routes:
+  - handler: ` + handler + "\n")
+	}
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configFile, configYAML("v1", "hello"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	netListenOrg := netListen
+	defer func() { netListen = netListenOrg }()
+
+	netListen = func(listen string) (net.Listener, error) {
+		return ln, nil
+	}
+
+	d := NewFastHttpd()
+	defer d.Shutdown() //nolint:errcheck
+
+	go func() {
+		if err := d.Main([]string{"fasthttpd", "-f", configFile}); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	br := bufio.NewReader(c)
+
+	// get sends a request on the same keep-alive connection every time so
+	// the test also proves that reloading does not drop it.
+	get := func() string {
+		t.Helper()
+		if _, err := c.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		var resp fasthttp.Response
+		if err := resp.Read(br); err != nil {
+			t.Fatal(err)
+		}
+		return string(resp.Body())
+	}
+
+	if got := get(); got != "v1" {
+		t.Fatalf("body = %q; want %q", got, "v1")
+	}
+
+	if err := os.WriteFile(configFile, configYAML("v2", "hello"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(); got != "v2" {
+		t.Errorf("body after reload = %q; want %q", got, "v2")
+	}
+
+	if err := os.WriteFile(configFile, configYAML("v3", "unknown"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.reload(); err == nil {
+		t.Error("reload of a broken config returned nil; want error")
+	}
+	if got := get(); got != "v2" {
+		t.Errorf("body after failed reload = %q; want %q", got, "v2")
+	}
+}
+
 func TestFastHttpd_Shutdown(t *testing.T) {
 	testCases := []struct {
 		caseName       string
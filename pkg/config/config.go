@@ -9,6 +9,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/fasthttpd/fasthttpd/pkg/util"
 	"github.com/mojatter/tree"
 	"github.com/valyala/fasthttp"
 	"go.yaml.in/yaml/v3"
@@ -26,23 +27,28 @@ const (
 	MatchPrefix = "prefix"
 	MatchEqual  = "equal"
 	MatchRegexp = "regexp"
+	// MatchPresent is only supported by RouteCondition.Match.
+	MatchPresent = "present"
 )
 
 // Config represents a configuration root of fasthttpd.
 type Config struct {
-	Host            string              `yaml:"host" json:"host"`
-	Listen          string              `yaml:"listen" json:"listen"`
-	SSL             SSL                 `yaml:"ssl" json:"ssl"`
-	Root            string              `yaml:"root" json:"root"`
-	Server          Server              `yaml:"server" json:"server"`
-	Log             Log                 `yaml:"log" json:"log"`
-	AccessLog       AccessLog           `yaml:"accessLog" json:"accessLog"`
-	ErrorPages      map[string]string   `yaml:"errorPages" json:"errorPages"`
-	Filters         map[string]tree.Map `yaml:"filters" json:"filters"`
-	Handlers        map[string]tree.Map `yaml:"handlers" json:"handlers"`
-	Routes          []Route             `yaml:"routes" json:"routes"`
-	RoutesCache     RoutesCache         `yaml:"routesCache" json:"routesCache"`
-	ShutdownTimeout string              `yaml:"shutdownTimeout" json:"shutdownTimeout"`
+	Host              string              `yaml:"host" json:"host"`
+	Aliases           []string            `yaml:"aliases" json:"aliases"`
+	DefaultServer     bool                `yaml:"defaultServer" json:"defaultServer"`
+	UnknownHostStatus int                 `yaml:"unknownHostStatus" json:"unknownHostStatus"`
+	Listen            string              `yaml:"listen" json:"listen"`
+	SSL               SSL                 `yaml:"ssl" json:"ssl"`
+	Root              string              `yaml:"root" json:"root"`
+	Server            Server              `yaml:"server" json:"server"`
+	Log               Log                 `yaml:"log" json:"log"`
+	AccessLog         AccessLog           `yaml:"accessLog" json:"accessLog"`
+	ErrorPages        map[string]string   `yaml:"errorPages" json:"errorPages"`
+	Filters           map[string]tree.Map `yaml:"filters" json:"filters"`
+	Handlers          map[string]tree.Map `yaml:"handlers" json:"handlers"`
+	Routes            []Route             `yaml:"routes" json:"routes"`
+	RoutesCache       RoutesCache         `yaml:"routesCache" json:"routesCache"`
+	ShutdownTimeout   string              `yaml:"shutdownTimeout" json:"shutdownTimeout"`
 }
 
 // SetDefaults sets default values.
@@ -67,12 +73,27 @@ func (cfg Config) Normalize() (Config, error) {
 			return cfg, fmt.Errorf("failed to parse shutdownTimeout: %w", err)
 		}
 	}
+	for _, host := range append([]string{cfg.Host}, cfg.Aliases...) {
+		if err := util.ValidateHostPattern(host); err != nil {
+			return cfg, err
+		}
+	}
+	if s := cfg.UnknownHostStatus; s != 0 && (s < 400 || s > 599) {
+		return cfg, fmt.Errorf("unknownHostStatus must be 4xx or 5xx: %d", s)
+	}
 	for _, route := range cfg.Routes {
 		if route.Handler != "" {
 			if _, ok := cfg.Handlers[route.Handler]; !ok {
 				return cfg, fmt.Errorf("unknown handler %q", route.Handler)
 			}
 		}
+		if route.Split != nil {
+			for _, h := range route.Split.Handlers {
+				if _, ok := cfg.Handlers[h.Handler]; !ok && h.Handler != "" {
+					return cfg, fmt.Errorf("unknown handler %q", h.Handler)
+				}
+			}
+		}
 	}
 	return cfg, nil
 }
@@ -330,6 +351,55 @@ type Route struct {
 	Status                   int      `yaml:"status" json:"status"`
 	StatusMessage            string   `yaml:"statusMessage" json:"statusMessage"`
 	NextIfNotFound           bool     `yaml:"nextIfNotFound" json:"nextIfNotFound"`
+	// Host, Headers, Queries, Cookies and RemoteIP are conditions on the
+	// request in addition to Path and Methods. All of them must hold.
+	Host     *RouteCondition   `yaml:"host" json:"host"`
+	Headers  []RouteCondition  `yaml:"headers" json:"headers"`
+	Queries  []RouteCondition  `yaml:"queries" json:"queries"`
+	Cookies  []RouteCondition  `yaml:"cookies" json:"cookies"`
+	RemoteIP *RouteIPCondition `yaml:"remoteIP" json:"remoteIP"`
+	// Split routes to one of weighted handlers in place of Handler.
+	Split *RouteSplit `yaml:"split" json:"split"`
+}
+
+// RouteCondition represents a condition on a request value of a route.
+// Match is one of "equal", "prefix", "regexp" or "present". If Match is
+// empty, it is "present" when Value is empty and "equal" otherwise. Name
+// is ignored for the host condition.
+type RouteCondition struct {
+	Name  string `yaml:"name" json:"name"`
+	Match string `yaml:"match" json:"match"`
+	Value string `yaml:"value" json:"value"`
+	Not   bool   `yaml:"not" json:"not"`
+}
+
+// RouteIPCondition represents a condition on the client IP address of a
+// route, which holds if the address is in one of CIDRs, or in none of
+// them if Not is true.
+type RouteIPCondition struct {
+	CIDRs []string `yaml:"cidrs" json:"cidrs"`
+	Not   bool     `yaml:"not" json:"not"`
+}
+
+// RouteSplit represents a weighted split of a route between handlers, such
+// as a canary release. Requests are assigned by the hash of the Sticky
+// cookie or header if the request has it, or at random otherwise.
+type RouteSplit struct {
+	Handlers []RouteSplitHandler `yaml:"handlers" json:"handlers"`
+	Sticky   *RouteSplitSticky   `yaml:"sticky" json:"sticky"`
+}
+
+// RouteSplitHandler represents a handler of a split and its weight.
+type RouteSplitHandler struct {
+	Handler string `yaml:"handler" json:"handler"`
+	Weight  int    `yaml:"weight" json:"weight"`
+}
+
+// RouteSplitSticky represents the request value a split is sticky by.
+// Cookie takes precedence over Header.
+type RouteSplitSticky struct {
+	Cookie string `yaml:"cookie" json:"cookie"`
+	Header string `yaml:"header" json:"header"`
 }
 
 // RoutesCache represents a configuration of route cache. MaxEntries
@@ -343,4 +413,3 @@ type RoutesCache struct {
 	Interval   int  `yaml:"interval" json:"interval"`
 	MaxEntries int  `yaml:"maxEntries" json:"maxEntries"`
 }
-
@@ -67,6 +67,39 @@ func TestConfig_Normalize(t *testing.T) {
 				},
 			},
 			errstr: `unknown handler "UNKNOWN"`,
+		}, {
+			cfg: Config{
+				Handlers: map[string]tree.Map{"stable": {}},
+				Routes: []Route{
+					{
+						Split: &RouteSplit{Handlers: []RouteSplitHandler{
+							{Handler: "stable", Weight: 95},
+							{Handler: "canary", Weight: 5},
+						}},
+					},
+				},
+			},
+			errstr: `unknown handler "canary"`,
+		}, {
+			cfg: Config{
+				Host:    "*.example.com",
+				Aliases: []string{`~^(www\.)?example\.org$`},
+			},
+			want: Config{
+				Host:    "*.example.com",
+				Aliases: []string{`~^(www\.)?example\.org$`},
+			},
+		}, {
+			cfg: Config{
+				Host:    "example.com",
+				Aliases: []string{"www.*.com"},
+			},
+			errstr: `invalid host pattern "www.*.com"`,
+		}, {
+			cfg: Config{
+				UnknownHostStatus: 200,
+			},
+			errstr: `unknownHostStatus must be 4xx or 5xx: 200`,
 		},
 	}
 	for i, test := range tests {
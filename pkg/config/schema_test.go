@@ -89,6 +89,52 @@ func TestValidateTreeMaps(t *testing.T) {
 			}},
 			wantErr: `.server.readBufferSize: invalid size "not-a-size"`,
 		},
+		{
+			caseName: "valid route conditions",
+			docs: []tree.Map{{
+				"routes": tree.Array{tree.Map{
+					"path":     tree.V("/api/"),
+					"host":     tree.Map{"value": tree.V("api.example.com")},
+					"headers":  tree.Array{tree.Map{"name": tree.V("X-Canary"), "value": tree.V("1")}},
+					"queries":  tree.Array{tree.Map{"name": tree.V("debug"), "match": tree.V("present")}},
+					"cookies":  tree.Array{tree.Map{"name": tree.V("beta"), "not": tree.V(true)}},
+					"remoteIP": tree.Map{"cidrs": tree.Array{tree.V("10.0.0.0/8")}},
+				}},
+			}},
+		},
+		{
+			caseName: "valid route split",
+			docs: []tree.Map{{
+				"routes": tree.Array{tree.Map{
+					"path": tree.V("/api/"),
+					"split": tree.Map{
+						"handlers": tree.Array{
+							tree.Map{"handler": tree.V("stable"), "weight": tree.V(95)},
+							tree.Map{"handler": tree.V("canary"), "weight": tree.V(5)},
+						},
+						"sticky": tree.Map{"cookie": tree.V("session")},
+					},
+				}},
+			}},
+		},
+		{
+			caseName: "unknown route split field",
+			docs: []tree.Map{{
+				"routes": tree.Array{tree.Map{
+					"split": tree.Map{"handlers": tree.Array{tree.Map{"name": tree.V("stable")}}},
+				}},
+			}},
+			wantErr: `.routes[0].split.handlers[0]: unknown key "name"`,
+		},
+		{
+			caseName: "unknown route condition field",
+			docs: []tree.Map{{
+				"routes": tree.Array{tree.Map{
+					"headers": tree.Array{tree.Map{"name": tree.V("X-Canary"), "equals": tree.V("1")}},
+				}},
+			}},
+			wantErr: `.routes[0].headers[0]: unknown key "equals"`,
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.caseName, func(t *testing.T) {
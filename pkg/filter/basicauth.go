@@ -2,11 +2,14 @@ package filter
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"encoding/base64"
+	"fmt"
 	"net/http"
 	"os"
 
 	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/fasthttpd/fasthttpd/pkg/util"
 	"github.com/mojatter/tree"
 	"github.com/mojatter/tree/schema"
 	"github.com/valyala/fasthttp"
@@ -15,20 +18,38 @@ import (
 
 const (
 	DefaultRealm = "Restricted"
+
+	// basicAuthCacheSize is the number of verified credentials of users
+	// with a SecretHash that are cached to skip rehashing.
+	basicAuthCacheSize = 1024
 )
 
-// BasicAuthUser represents a basic auth user.
+// BasicAuthUser represents a basic auth user. Either Secret (plain) or
+// SecretHash is set. SecretHash is a bcrypt, SHA-256-crypt, SHA-512-crypt,
+// MD5-crypt or APR1 hash as found in htpasswd files.
 type BasicAuthUser struct {
-	Name   string `yaml:"name"`
-	Secret string `yaml:"secret"`
-	auth   []byte
+	Name       string `yaml:"name"`
+	Secret     string `yaml:"secret"`
+	SecretHash string `yaml:"secretHash"`
+	auth       []byte
+	verify     func(password []byte) bool
 }
 
 // BasicAuthFilter implements Filter.
 type BasicAuthFilter struct {
-	Realm     string           `yaml:"realm"`
-	Users     []*BasicAuthUser `yaml:"users"`
-	UsersFile string           `yaml:"usersFile"`
+	Realm string           `yaml:"realm"`
+	Users []*BasicAuthUser `yaml:"users"`
+	// UsersFile is a YAML file of users or an Apache htpasswd file.
+	UsersFile string `yaml:"usersFile"`
+	// verified caches the credentials verified with a SecretHash. It is
+	// nil if no user has a SecretHash.
+	verified util.Cache
+}
+
+// basicAuthVerified is a cached credential of a user with a SecretHash.
+type basicAuthVerified struct {
+	auth []byte
+	user *BasicAuthUser
 }
 
 // NewBasicAuthFilter returns a new BasicAuthFilter.
@@ -52,12 +73,31 @@ func (f *BasicAuthFilter) init() error {
 			return err
 		}
 		var users []*BasicAuthUser
-		if err := yaml.Unmarshal(bin, &users); err != nil {
+		if isHtpasswd(bin) {
+			if users, err = parseHtpasswd(f.UsersFile, bin); err != nil {
+				return err
+			}
+		} else if err := yaml.Unmarshal(bin, &users); err != nil {
 			return err
 		}
 		f.Users = append(f.Users, users...)
 	}
 	for i, u := range f.Users {
+		if u.SecretHash != "" {
+			if u.Secret != "" {
+				return fmt.Errorf("basicAuth: user %q: both secret and secretHash are set", u.Name)
+			}
+			verify, err := newSecretVerifier(u.SecretHash)
+			if err != nil {
+				return fmt.Errorf("basicAuth: user %q: %w", u.Name, err)
+			}
+			u.verify = verify
+			u.SecretHash = ""
+			if f.verified == nil {
+				f.verified = util.NewCache(util.CacheConfig{MaxEntries: basicAuthCacheSize})
+			}
+			continue
+		}
 		plain := []byte(u.Name + ":" + u.Secret)
 		u.auth = make([]byte, base64.StdEncoding.EncodedLen(len(plain)))
 		base64.StdEncoding.Encode(u.auth, plain)
@@ -67,6 +107,31 @@ func (f *BasicAuthFilter) init() error {
 	return nil
 }
 
+// verifyHashed returns the user with a SecretHash that matches auth, the
+// base64 encoded credentials, or nil. Verified credentials are cached.
+func (f *BasicAuthFilter) verifyHashed(auth []byte) *BasicAuthUser {
+	key := util.CacheKeyOf(auth)
+	if v, ok := f.verified.Get(key).(*basicAuthVerified); ok && subtle.ConstantTimeCompare(v.auth, auth) == 1 {
+		return v.user
+	}
+	plain := make([]byte, base64.StdEncoding.DecodedLen(len(auth)))
+	n, err := base64.StdEncoding.Decode(plain, auth)
+	if err != nil {
+		return nil
+	}
+	name, password, ok := bytes.Cut(plain[:n], []byte{':'})
+	if !ok {
+		return nil
+	}
+	for _, u := range f.Users {
+		if u.verify != nil && u.Name == string(name) && u.verify(password) {
+			f.verified.Set(key, &basicAuthVerified{auth: bytes.Clone(auth), user: u})
+			return u
+		}
+	}
+	return nil
+}
+
 func (f *BasicAuthFilter) unauthorized(ctx *fasthttp.RequestCtx) {
 	ctx.Response.SetStatusCode(http.StatusUnauthorized)
 	ctx.Response.Header.Set("WWW-Authenticate", "Basic realm="+f.Realm)
@@ -89,7 +154,13 @@ func (f *BasicAuthFilter) Request(ctx *fasthttp.RequestCtx) bool {
 	}
 	auth := header[len(basicPrefix):]
 	for _, u := range f.Users {
-		if bytes.Equal(auth, u.auth) {
+		if u.auth != nil && subtle.ConstantTimeCompare(auth, u.auth) == 1 {
+			ctx.URI().SetUsername(u.Name)
+			return true
+		}
+	}
+	if f.verified != nil {
+		if u := f.verifyHashed(auth); u != nil {
 			ctx.URI().SetUsername(u.Name)
 			return true
 		}
@@ -109,7 +180,8 @@ func init() {
 }
 
 // basicAuthSchemas mirrors BasicAuthFilter's YAML-tagged fields.
-// Either users (inline) or usersFile (external YAML) may be set.
+// Either users (inline) or usersFile (external YAML or htpasswd) may be
+// set.
 // Every over .users runs the inner rules against each element so
 // missing sub-fields surface as `users[i].name: required` rather
 // than being silently absent.
@@ -120,8 +192,9 @@ var basicAuthSchemas = schema.QueryRules{
 		"usersFile": schema.String{},
 		"users": schema.Every{Rules: schema.QueryRules{
 			".": schema.Map{KeyedRules: map[string]schema.Rule{
-				"name":   schema.String{},
-				"secret": schema.String{},
+				"name":       schema.String{},
+				"secret":     schema.String{},
+				"secretHash": schema.String{},
 			}},
 		}},
 	}},
@@ -1,7 +1,10 @@
 package filter
 
 import (
+	"encoding/base64"
 	"net/http"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -9,6 +12,7 @@ import (
 	"github.com/fasthttpd/fasthttpd/pkg/config"
 	"github.com/mojatter/tree"
 	"github.com/valyala/fasthttp"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestNewBasicAuthFilter(t *testing.T) {
@@ -190,6 +194,102 @@ func TestBasicAuthFilter(t *testing.T) {
 	}
 }
 
+func TestBasicAuthFilter_SecretHash(t *testing.T) {
+	htpasswd := filepath.Join(t.TempDir(), ".htpasswd")
+	// foo:bar, generated with `openssl passwd -apr1 -salt r31..... bar`.
+	content := "# users\nfoo:$apr1$r31.....$bIPsnQhLqqwaf2dCQX3CS1\n"
+	if err := os.WriteFile(htpasswd, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewBasicAuthFilter(tree.Map{
+		"users": tree.Array{
+			tree.Map{
+				"name":       tree.V("fast"),
+				"secretHash": tree.V("$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"),
+			},
+			tree.Map{"name": tree.V("plain"), "secret": tree.V("text")},
+		},
+		"usersFile": tree.V(htpasswd),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		user     string
+		password string
+		want     bool
+	}{
+		{user: "fast", password: "Hello world!", want: true},
+		{user: "fast", password: "Hello world"},
+		{user: "foo", password: "bar", want: true},
+		{user: "foo", password: "baz"},
+		{user: "plain", password: "text", want: true},
+		{user: "fast", password: "text"},
+	}
+	for i, test := range tests {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(test.user+":"+test.password)))
+		if got := f.Request(ctx); got != test.want {
+			t.Fatalf("tests[%d] got %v; want %v", i, got, test.want)
+		}
+		wantUser := ""
+		if test.want {
+			wantUser = test.user
+		}
+		if got := string(ctx.URI().Username()); got != wantUser {
+			t.Errorf("tests[%d] username %q; want %q", i, got, wantUser)
+		}
+	}
+}
+
+func TestBasicAuthFilter_SecretHashCache(t *testing.T) {
+	f := &BasicAuthFilter{
+		Users: []*BasicAuthUser{
+			{Name: "foo", SecretHash: "$1$abcdefgh$cHJi5PXp/ki/ktXzqlk6I1"},
+		},
+	}
+	if err := f.init(); err != nil {
+		t.Fatal(err)
+	}
+	verify := f.Users[0].verify
+	calls := 0
+	f.Users[0].verify = func(password []byte) bool {
+		calls++
+		return verify(password)
+	}
+	for _, password := range []string{"secret", "secret", "wrong", "secret"} {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("foo:"+password)))
+		if got, want := f.Request(ctx), password == "secret"; got != want {
+			t.Fatalf("%s got %v; want %v", password, got, want)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("verify is called %d times; want 2", calls)
+	}
+}
+
+func TestNewBasicAuthFilter_SecretHashError(t *testing.T) {
+	tests := []struct {
+		user   tree.Map
+		errstr string
+	}{
+		{
+			user:   tree.Map{"name": tree.V("foo"), "secret": tree.V("bar"), "secretHash": tree.V("$1$abcdefgh$cHJi5PXp/ki/ktXzqlk6I1")},
+			errstr: `basicAuth: user "foo": both secret and secretHash are set`,
+		}, {
+			user:   tree.Map{"name": tree.V("foo"), "secretHash": tree.V("bar")},
+			errstr: `basicAuth: user "foo": unsupported secret hash: "bar"`,
+		},
+	}
+	for i, test := range tests {
+		_, err := NewBasicAuthFilter(tree.Map{"users": tree.Array{test.user}})
+		if err == nil || err.Error() != test.errstr {
+			t.Errorf("tests[%d] error %v; want %q", i, err, test.errstr)
+		}
+	}
+}
+
 // newBenchBasicAuthFilter returns a BasicAuthFilter with a single user,
 // initialised and ready to authenticate against.
 func newBenchBasicAuthFilter(b *testing.B) *BasicAuthFilter {
@@ -235,6 +335,28 @@ func BenchmarkBasicAuthFilter_Request_Unauthorized(b *testing.B) {
 	}
 }
 
+func BenchmarkBasicAuthFilter_Request_SecretHash(b *testing.B) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("bar"), bcrypt.DefaultCost)
+	if err != nil {
+		b.Fatal(err)
+	}
+	f := &BasicAuthFilter{
+		Users: []*BasicAuthUser{{Name: "foo", SecretHash: string(hash)}},
+	}
+	if err := f.init(); err != nil {
+		b.Fatalf("init: %v", err)
+	}
+	ctx := &fasthttp.RequestCtx{}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for b.Loop() {
+		ctx.Request.Header.Reset()
+		ctx.Request.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+		f.Request(ctx)
+	}
+}
+
 func TestBasicAuth_SchemaRegistered(t *testing.T) {
 	testCases := []struct {
 		caseName string
@@ -0,0 +1,923 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/fasthttpd/fasthttpd/pkg/logger"
+	"github.com/fasthttpd/fasthttpd/pkg/util"
+	"github.com/mojatter/tree"
+	"github.com/mojatter/tree/schema"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// DefaultCacheMaxEntries is the default number of URIs cached in
+	// memory by a CacheFilter.
+	DefaultCacheMaxEntries = 10000
+	// DefaultCacheMaxEntrySize is the default maximum size of a cached
+	// response body.
+	DefaultCacheMaxEntrySize = 1 << 20
+	// DefaultCacheInactive is the default time after which an unused
+	// entry is removed.
+	DefaultCacheInactive = 10 * time.Minute
+	// DefaultCacheLockTimeout is the default time concurrent requests for
+	// a missing entry wait for the first one.
+	DefaultCacheLockTimeout = 5 * time.Second
+
+	// cacheMaxVariants is the number of Vary variants kept per URI.
+	cacheMaxVariants = 16
+
+	cacheMethodPurge = "PURGE"
+	headerXCache     = "X-Cache"
+
+	cacheStatusHit         = "HIT"
+	cacheStatusMiss        = "MISS"
+	cacheStatusBypass      = "BYPASS"
+	cacheStatusStale       = "STALE"
+	cacheStatusRevalidated = "REVALIDATED"
+)
+
+// cacheFilterNow returns the current time. Tests swap it to inject a
+// deterministic clock.
+var cacheFilterNow = time.Now
+
+// cacheSkipHeaders are the response headers that are not stored.
+var cacheSkipHeaders = [][]byte{
+	[]byte(fasthttp.HeaderContentLength),
+	[]byte(fasthttp.HeaderConnection),
+	[]byte(fasthttp.HeaderTransferEncoding),
+	[]byte("Keep-Alive"),
+	[]byte(fasthttp.HeaderDate),
+	[]byte(fasthttp.HeaderAge),
+	[]byte(headerXCache),
+}
+
+// cacheRefreshHeaders are the headers a 304 Not Modified response
+// updates in a stored response.
+var cacheRefreshHeaders = []string{
+	fasthttp.HeaderCacheControl,
+	fasthttp.HeaderExpires,
+	fasthttp.HeaderETag,
+	fasthttp.HeaderLastModified,
+}
+
+// CacheFilter implements the Filter that caches responses in memory, and
+// optionally on disk, as a shared cache following RFC 9111. Stored
+// responses are served in Request without calling the handler, and
+// responses are stored in Response, so the filter should be listed last.
+type CacheFilter struct {
+	MaxEntries   int             `yaml:"maxEntries"`
+	MaxEntrySize config.Size     `yaml:"maxEntrySize"`
+	Inactive     config.Duration `yaml:"inactive"`
+	// DefaultTTL is the freshness lifetime of responses without
+	// Cache-Control max-age or Expires. Such responses are not stored if
+	// it is zero.
+	DefaultTTL  config.Duration `yaml:"defaultTTL"`
+	LockTimeout config.Duration `yaml:"lockTimeout"`
+	// Dir enables the on-disk tier that keeps entries evicted from
+	// memory.
+	Dir string `yaml:"dir"`
+	// PurgeAllow lists the client addresses allowed to remove an entry
+	// with the PURGE method.
+	PurgeAllow []string `yaml:"purgeAllow"`
+
+	objects    util.Cache
+	purgeAllow util.IPPrefixes
+
+	flightsMu sync.Mutex
+	flights   map[util.CacheKey]*cacheFlight
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+	l         logger.Logger
+}
+
+// cacheObject holds the variants of a URI.
+type cacheObject struct {
+	mu      sync.Mutex
+	tls     bool
+	host    []byte
+	uri     []byte
+	vary    []string
+	entries []*cacheEntry
+	// revalidating is the time until which a stale entry is being
+	// revalidated by a request while others are served the stale one.
+	revalidating time.Time
+}
+
+// cacheEntry is a stored response. It is immutable once stored. Fields are
+// exported for encoding/gob.
+type cacheEntry struct {
+	Status     int
+	Headers    []cacheHeader
+	Body       []byte
+	VaryValues [][]byte
+	// Date is the time the response was generated, corrected by Age.
+	Date                 time.Time
+	Expires              time.Time
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+	MustRevalidate       bool
+	ETag                 []byte
+	LastModified         []byte
+}
+
+type cacheHeader struct {
+	Key   []byte
+	Value []byte
+}
+
+// cacheDiskObject is the on-disk form of a cacheObject.
+type cacheDiskObject struct {
+	TLS     bool
+	Host    []byte
+	URI     []byte
+	Vary    []string
+	Entries []*cacheEntry
+}
+
+// cacheFlight is the request fetching a missing or expired entry that
+// the other requests for the same entry wait for.
+type cacheFlight struct {
+	done     chan struct{}
+	deadline time.Time
+}
+
+// cacheState carries a request from Request to Response.
+type cacheState struct {
+	filter *CacheFilter
+	key    util.CacheKey
+	// tls, host and uri are of the request URI as the client sent it,
+	// since the handler may rewrite it.
+	tls  bool
+	host []byte
+	uri  []byte
+	// invalidate reports whether the request is unsafe and removes the
+	// stored responses of key if it succeeds.
+	invalidate bool
+	obj        *cacheObject
+	entry      *cacheEntry
+	flight     *cacheFlight
+	status     string
+	// revalidator reports whether the request revalidates entry while
+	// stale responses are served.
+	revalidator bool
+	// conditional reports whether the validators of entry were sent. The
+	// conditionals of the client are kept to answer it.
+	conditional     bool
+	ifNoneMatch     []byte
+	ifModifiedSince []byte
+}
+
+type cacheStateKey struct{}
+
+// Close releases the flight and the revalidation lock of the request. It
+// is called by Response, or by fasthttp when the request finishes if the
+// Response hooks are skipped, e.g. because a later filter rejected it.
+func (s *cacheState) Close() error {
+	if s.flight != nil {
+		s.filter.releaseFlight(s.key, s.flight)
+		s.flight = nil
+	}
+	if s.revalidator {
+		s.obj.endRevalidate()
+		s.revalidator = false
+	}
+	return nil
+}
+
+// NewCacheFilter returns a new CacheFilter.
+func NewCacheFilter(cfg tree.Map, l logger.Logger) (Filter, error) {
+	f := &CacheFilter{l: l}
+	if err := tree.UnmarshalViaYAML(cfg, f); err != nil {
+		return nil, err
+	}
+	if err := f.init(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *CacheFilter) init() error {
+	if f.MaxEntries <= 0 {
+		f.MaxEntries = DefaultCacheMaxEntries
+	}
+	if f.MaxEntrySize <= 0 {
+		f.MaxEntrySize = DefaultCacheMaxEntrySize
+	}
+	if f.Inactive <= 0 {
+		f.Inactive = config.Duration(DefaultCacheInactive)
+	}
+	if f.LockTimeout <= 0 {
+		f.LockTimeout = config.Duration(DefaultCacheLockTimeout)
+	}
+	if len(f.PurgeAllow) > 0 {
+		ps, err := util.ParseIPPrefixes(f.PurgeAllow...)
+		if err != nil {
+			return fmt.Errorf("cache: purgeAllow: %w", err)
+		}
+		f.purgeAllow = ps
+	}
+	f.objects = util.NewCache(util.CacheConfig{
+		Expire:     time.Duration(f.Inactive).Milliseconds(),
+		Interval:   min(time.Duration(f.Inactive), time.Minute).Milliseconds(),
+		MaxEntries: f.MaxEntries,
+	})
+	f.flights = map[util.CacheKey]*cacheFlight{}
+	if f.Dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(f.Dir, 0o755); err != nil {
+		return fmt.Errorf("cache: %w", err)
+	}
+	f.done = make(chan struct{})
+	f.wg.Add(1)
+	go f.cleanDir()
+	return nil
+}
+
+// keyOf returns the key of the request URI.
+func (f *CacheFilter) keyOf(ctx *fasthttp.RequestCtx) util.CacheKey {
+	b := util.AcquireCacheKeyBuilder()
+	if ctx.IsTLS() {
+		b.WriteString("https")
+	} else {
+		b.WriteString("http")
+	}
+	b.Write(ctx.Host())
+	b.Write(ctx.Request.Header.RequestURI())
+	key := b.Sum()
+	util.ReleaseCacheKeyBuilder(b)
+	return key
+}
+
+// object returns the cacheObject of the request URI from memory, or from
+// disk if it is not in memory.
+func (f *CacheFilter) object(key util.CacheKey, ctx *fasthttp.RequestCtx) *cacheObject {
+	if obj, ok := f.objects.Get(key).(*cacheObject); ok {
+		if obj.matches(ctx) {
+			return obj
+		}
+		return nil
+	}
+	if f.Dir == "" {
+		return nil
+	}
+	obj := f.readDisk(key)
+	if obj == nil || !obj.matches(ctx) {
+		return nil
+	}
+	f.objects.Set(key, obj)
+	return obj
+}
+
+// matches reports whether o is for the request URI rather than another
+// URI with the same key.
+func (o *cacheObject) matches(ctx *fasthttp.RequestCtx) bool {
+	return o.tls == ctx.IsTLS() &&
+		bytes.Equal(o.host, ctx.Host()) &&
+		bytes.Equal(o.uri, ctx.Request.Header.RequestURI())
+}
+
+// find returns the entry whose Vary values match the request.
+func (o *cacheObject) find(h *fasthttp.RequestHeader) *cacheEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, e := range o.entries {
+		if e.matches(o.vary, h) {
+			return e
+		}
+	}
+	return nil
+}
+
+// put adds e, replacing the entry with the same Vary values.
+func (o *cacheObject) put(e *cacheEntry) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.entries = slices.DeleteFunc(o.entries, func(old *cacheEntry) bool {
+		return util.Bytes2dEqual(old.VaryValues, e.VaryValues)
+	})
+	if len(o.entries) >= cacheMaxVariants {
+		o.entries = o.entries[1:]
+	}
+	o.entries = append(o.entries, e)
+}
+
+// startRevalidate reports whether the caller should revalidate a stale
+// entry, which is true for a single caller per lockTimeout.
+func (o *cacheObject) startRevalidate(now time.Time, lockTimeout time.Duration) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if now.Before(o.revalidating) {
+		return false
+	}
+	o.revalidating = now.Add(lockTimeout)
+	return true
+}
+
+func (o *cacheObject) endRevalidate() {
+	o.mu.Lock()
+	o.revalidating = time.Time{}
+	o.mu.Unlock()
+}
+
+func (e *cacheEntry) matches(vary []string, h *fasthttp.RequestHeader) bool {
+	for i, name := range vary {
+		if !bytes.Equal(e.VaryValues[i], h.Peek(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *cacheEntry) canStaleWhileRevalidate(now time.Time) bool {
+	return !e.MustRevalidate && now.Before(e.Expires.Add(e.StaleWhileRevalidate))
+}
+
+func (e *cacheEntry) canStaleIfError(now time.Time) bool {
+	return !e.MustRevalidate && now.Before(e.Expires.Add(e.StaleIfError))
+}
+
+// acquireFlight returns the flight for key and whether the caller leads
+// it. A flight whose leader did not finish within lockTimeout is taken
+// over.
+func (f *CacheFilter) acquireFlight(key util.CacheKey) (*cacheFlight, bool) {
+	now := time.Now()
+	f.flightsMu.Lock()
+	defer f.flightsMu.Unlock()
+	if fl, ok := f.flights[key]; ok && now.Before(fl.deadline) {
+		return fl, false
+	}
+	fl := &cacheFlight{
+		done:     make(chan struct{}),
+		deadline: now.Add(time.Duration(f.LockTimeout)),
+	}
+	f.flights[key] = fl
+	return fl, true
+}
+
+func (f *CacheFilter) releaseFlight(key util.CacheKey, fl *cacheFlight) {
+	f.flightsMu.Lock()
+	if f.flights[key] == fl {
+		delete(f.flights, key)
+	}
+	f.flightsMu.Unlock()
+	close(fl.done)
+}
+
+// wait waits for the leader to finish and reports whether it did.
+func (fl *cacheFlight) wait() bool {
+	t := time.NewTimer(time.Until(fl.deadline))
+	defer t.Stop()
+	select {
+	case <-fl.done:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// Request serves a stored response and returns false if there is a fresh
+// one, or a stale one that may be served while another request
+// revalidates it. Otherwise it returns true to fetch the response from
+// the handler. Concurrent requests for the same missing entry wait for
+// the first one.
+func (f *CacheFilter) Request(ctx *fasthttp.RequestCtx) bool {
+	if f.purgeAllow != nil && string(ctx.Method()) == cacheMethodPurge {
+		return f.purge(ctx)
+	}
+	if !ctx.IsGet() && !ctx.IsHead() {
+		if !ctx.IsOptions() && !ctx.IsTrace() {
+			ctx.SetUserValue(cacheStateKey{}, &cacheState{filter: f, key: f.keyOf(ctx), invalidate: true})
+		}
+		return true
+	}
+	h := &ctx.Request.Header
+	reqCC := parseCacheControl(h.PeekAll(fasthttp.HeaderCacheControl))
+	if reqCC.noStore {
+		return true
+	}
+	bypass := reqCC.noCache || reqCC.maxAge == 0 ||
+		bytes.Equal(h.Peek(fasthttp.HeaderPragma), []byte("no-cache"))
+
+	key := f.keyOf(ctx)
+	obj := f.object(key, ctx)
+	var e *cacheEntry
+	if obj != nil {
+		e = obj.find(h)
+	}
+	now := cacheFilterNow()
+	state := &cacheState{
+		filter: f,
+		key:    key,
+		tls:    ctx.IsTLS(),
+		host:   bytes.Clone(ctx.Host()),
+		uri:    bytes.Clone(h.RequestURI()),
+		obj:    obj,
+		entry:  e,
+		status: cacheStatusMiss,
+	}
+	switch {
+	case bypass:
+		state.status = cacheStatusBypass
+	case e == nil:
+	case now.Before(e.Expires):
+		f.serve(ctx, e, cacheStatusHit, now, h.Peek(fasthttp.HeaderIfNoneMatch), h.Peek(fasthttp.HeaderIfModifiedSince))
+		return false
+	case e.canStaleWhileRevalidate(now):
+		if !obj.startRevalidate(now, time.Duration(f.LockTimeout)) {
+			f.serve(ctx, e, cacheStatusStale, now, h.Peek(fasthttp.HeaderIfNoneMatch), h.Peek(fasthttp.HeaderIfModifiedSince))
+			return false
+		}
+		state.revalidator = true
+	}
+	if ctx.IsHead() && e == nil {
+		// A response to HEAD has no body to store.
+		return true
+	}
+
+	if !bypass && !state.revalidator {
+		fl, leader := f.acquireFlight(key)
+		if leader {
+			state.flight = fl
+		} else if fl.wait() {
+			if obj = f.object(key, ctx); obj != nil {
+				if e := obj.find(h); e != nil && cacheFilterNow().Before(e.Expires) {
+					f.serve(ctx, e, cacheStatusHit, cacheFilterNow(), h.Peek(fasthttp.HeaderIfNoneMatch), h.Peek(fasthttp.HeaderIfModifiedSince))
+					return false
+				}
+			}
+		}
+	}
+	if e != nil && (len(e.ETag) > 0 || len(e.LastModified) > 0) {
+		state.conditional = true
+		state.ifNoneMatch = bytes.Clone(h.Peek(fasthttp.HeaderIfNoneMatch))
+		state.ifModifiedSince = bytes.Clone(h.Peek(fasthttp.HeaderIfModifiedSince))
+		h.Del(fasthttp.HeaderIfNoneMatch)
+		h.Del(fasthttp.HeaderIfModifiedSince)
+		if len(e.ETag) > 0 {
+			h.SetBytesV(fasthttp.HeaderIfNoneMatch, e.ETag)
+		}
+		if len(e.LastModified) > 0 {
+			h.SetBytesV(fasthttp.HeaderIfModifiedSince, e.LastModified)
+		}
+	}
+	ctx.SetUserValue(cacheStateKey{}, state)
+	return true
+}
+
+// Response stores the response if it is cacheable. If the request
+// revalidated a stored response, the stored one is refreshed and served
+// on 304 Not Modified, and served stale on a server error if
+// stale-if-error allows it. Successful unsafe requests remove the stored
+// response of the URI.
+func (f *CacheFilter) Response(ctx *fasthttp.RequestCtx) bool {
+	state, ok := ctx.UserValue(cacheStateKey{}).(*cacheState)
+	if !ok {
+		return true
+	}
+	ctx.RemoveUserValue(cacheStateKey{})
+	defer state.Close()
+	if state.invalidate {
+		if ctx.Response.StatusCode() < http.StatusBadRequest {
+			f.remove(state.key)
+		}
+		return true
+	}
+
+	now := cacheFilterNow()
+	resp := &ctx.Response
+	e := state.entry
+	switch status := resp.StatusCode(); {
+	case e != nil && state.conditional && status == http.StatusNotModified:
+		e = f.refresh(e, resp, now)
+		state.obj.put(e)
+		f.save(state.key, state.obj)
+		f.serve(ctx, e, cacheStatusRevalidated, now, state.ifNoneMatch, state.ifModifiedSince)
+	case e != nil && status >= http.StatusInternalServerError && e.canStaleIfError(now):
+		f.serve(ctx, e, cacheStatusStale, now, state.ifNoneMatch, state.ifModifiedSince)
+	default:
+		if ctx.IsGet() {
+			if e, vary := f.newEntry(ctx, now); e != nil {
+				f.store(state, e, vary)
+			}
+		}
+		resp.Header.Set(headerXCache, state.status)
+	}
+	return true
+}
+
+// serve writes e to the response, or 304 Not Modified if the conditionals
+// of the client match it.
+func (f *CacheFilter) serve(ctx *fasthttp.RequestCtx, e *cacheEntry, status string, now time.Time, ifNoneMatch, ifModifiedSince []byte) {
+	notModified := e.Status == http.StatusOK && cacheNotModified(e, ifNoneMatch, ifModifiedSince)
+	resp := &ctx.Response
+	resp.Reset()
+	resp.SetStatusCode(e.Status)
+	for _, h := range e.Headers {
+		resp.Header.AddBytesKV(h.Key, h.Value)
+	}
+	var buf [20]byte
+	resp.Header.SetBytesV(fasthttp.HeaderAge, strconv.AppendInt(buf[:0], int64(max(now.Sub(e.Date), 0)/time.Second), 10))
+	resp.Header.Set(headerXCache, status)
+	if notModified {
+		resp.SetStatusCode(http.StatusNotModified)
+		return
+	}
+	resp.SetBodyRaw(e.Body)
+}
+
+// cacheNotModified evaluates If-None-Match, or If-Modified-Since if it is
+// absent, against e.
+func cacheNotModified(e *cacheEntry, ifNoneMatch, ifModifiedSince []byte) bool {
+	if len(ifNoneMatch) > 0 {
+		return etagMatch(ifNoneMatch, e.ETag)
+	}
+	if len(ifModifiedSince) == 0 || len(e.LastModified) == 0 {
+		return false
+	}
+	since, err := fasthttp.ParseHTTPDate(ifModifiedSince)
+	if err != nil {
+		return false
+	}
+	lastModified, err := fasthttp.ParseHTTPDate(e.LastModified)
+	return err == nil && !lastModified.After(since)
+}
+
+// cacheableStatus reports whether responses with status may be stored,
+// which are the ones heuristically cacheable by RFC 9110.
+func cacheableStatus(status int) bool {
+	switch status {
+	case http.StatusOK,
+		http.StatusNonAuthoritativeInfo,
+		http.StatusNoContent,
+		http.StatusMultipleChoices,
+		http.StatusMovedPermanently,
+		http.StatusPermanentRedirect,
+		http.StatusNotFound,
+		http.StatusMethodNotAllowed,
+		http.StatusGone,
+		http.StatusRequestURITooLong,
+		http.StatusNotImplemented:
+		return true
+	}
+	return false
+}
+
+// lifetime returns the freshness lifetime of resp and whether it is
+// given by the response or DefaultTTL.
+func (f *CacheFilter) lifetime(resp *fasthttp.Response, cc cacheControl, now time.Time) (time.Duration, bool) {
+	switch {
+	case cc.sMaxAge >= 0:
+		return time.Duration(cc.sMaxAge) * time.Second, true
+	case cc.maxAge >= 0:
+		return time.Duration(cc.maxAge) * time.Second, true
+	}
+	if v := resp.Header.Peek(fasthttp.HeaderExpires); len(v) > 0 {
+		expires, err := fasthttp.ParseHTTPDate(v)
+		if err != nil {
+			// An invalid Expires means already expired.
+			return 0, true
+		}
+		date, err := fasthttp.ParseHTTPDate(resp.Header.Peek(fasthttp.HeaderDate))
+		if err != nil {
+			date = now
+		}
+		return expires.Sub(date), true
+	}
+	if f.DefaultTTL > 0 {
+		return time.Duration(f.DefaultTTL), true
+	}
+	return 0, false
+}
+
+// responseDate returns the time resp was generated, corrected by its Age.
+func responseDate(resp *fasthttp.Response, now time.Time) time.Time {
+	age := parseDeltaSeconds(resp.Header.Peek(fasthttp.HeaderAge), 0)
+	return now.Add(-time.Duration(age) * time.Second)
+}
+
+// newEntry returns the entry for the response and the names of its Vary
+// headers, or nil if the response cannot be stored.
+func (f *CacheFilter) newEntry(ctx *fasthttp.RequestCtx, now time.Time) (*cacheEntry, []string) {
+	resp := &ctx.Response
+	if !cacheableStatus(resp.StatusCode()) {
+		return nil, nil
+	}
+	cc := parseCacheControl(resp.Header.PeekAll(fasthttp.HeaderCacheControl))
+	if cc.noStore || cc.private {
+		return nil, nil
+	}
+	if len(ctx.Request.Header.Peek(fasthttp.HeaderAuthorization)) > 0 &&
+		!cc.public && cc.sMaxAge < 0 && !cc.mustRevalidate {
+		return nil, nil
+	}
+	for range resp.Header.Cookies() {
+		return nil, nil
+	}
+	vary, ok := parseVary(resp.Header.PeekAll(fasthttp.HeaderVary))
+	if !ok {
+		return nil, nil
+	}
+	etag := resp.Header.Peek(fasthttp.HeaderETag)
+	lastModified := resp.Header.Peek(fasthttp.HeaderLastModified)
+	validators := len(etag) > 0 || len(lastModified) > 0
+	lifetime, ok := f.lifetime(resp, cc, now)
+	if cc.noCache {
+		lifetime = 0
+	}
+	if (!ok || lifetime <= 0) && !validators {
+		return nil, nil
+	}
+	if resp.IsBodyStream() {
+		// A streamed body is only read if its size is known.
+		if n := resp.Header.ContentLength(); n < 0 || n > int(f.MaxEntrySize) {
+			return nil, nil
+		}
+	}
+	body := resp.Body()
+	if len(body) > int(f.MaxEntrySize) {
+		return nil, nil
+	}
+
+	e := &cacheEntry{
+		Status:         resp.StatusCode(),
+		Body:           bytes.Clone(body),
+		Date:           responseDate(resp, now),
+		MustRevalidate: cc.mustRevalidate || cc.noCache,
+		ETag:           bytes.Clone(etag),
+		LastModified:   bytes.Clone(lastModified),
+	}
+	e.Expires = e.Date.Add(lifetime)
+	if cc.staleWhileRevalidate > 0 {
+		e.StaleWhileRevalidate = time.Duration(cc.staleWhileRevalidate) * time.Second
+	}
+	if cc.staleIfError > 0 {
+		e.StaleIfError = time.Duration(cc.staleIfError) * time.Second
+	}
+	for k, v := range resp.Header.All() {
+		if !slices.ContainsFunc(cacheSkipHeaders, func(s []byte) bool { return bytes.EqualFold(s, k) }) {
+			e.Headers = append(e.Headers, cacheHeader{Key: bytes.Clone(k), Value: bytes.Clone(v)})
+		}
+	}
+	for _, name := range vary {
+		e.VaryValues = append(e.VaryValues, bytes.Clone(ctx.Request.Header.Peek(name)))
+	}
+	return e, vary
+}
+
+// parseVary returns the header names listed in the Vary header values in
+// canonical form. It returns false for "*", which never matches.
+func parseVary(values [][]byte) ([]string, bool) {
+	var names []string
+	for _, v := range values {
+		for _, name := range bytes.Split(v, []byte(",")) {
+			name = bytes.TrimSpace(name)
+			if len(name) == 0 {
+				continue
+			}
+			if len(name) == 1 && name[0] == '*' {
+				return nil, false
+			}
+			s := http.CanonicalHeaderKey(string(name))
+			if !slices.Contains(names, s) {
+				names = append(names, s)
+			}
+		}
+	}
+	slices.Sort(names)
+	return names, true
+}
+
+// refresh returns a copy of e updated by the 304 Not Modified response.
+func (f *CacheFilter) refresh(e *cacheEntry, resp *fasthttp.Response, now time.Time) *cacheEntry {
+	ne := *e
+	ccValues := resp.Header.PeekAll(fasthttp.HeaderCacheControl)
+	cc := parseCacheControl(ccValues)
+	lifetime, ok := f.lifetime(resp, cc, now)
+	if !ok {
+		lifetime = e.Expires.Sub(e.Date)
+	}
+	if len(ccValues) > 0 {
+		ne.StaleWhileRevalidate = time.Duration(max(cc.staleWhileRevalidate, 0)) * time.Second
+		ne.StaleIfError = time.Duration(max(cc.staleIfError, 0)) * time.Second
+		ne.MustRevalidate = cc.mustRevalidate || cc.noCache
+		if cc.noCache {
+			lifetime = 0
+		}
+	}
+	ne.Date = responseDate(resp, now)
+	ne.Expires = ne.Date.Add(lifetime)
+	if v := resp.Header.Peek(fasthttp.HeaderETag); len(v) > 0 {
+		ne.ETag = bytes.Clone(v)
+	}
+	if v := resp.Header.Peek(fasthttp.HeaderLastModified); len(v) > 0 {
+		ne.LastModified = bytes.Clone(v)
+	}
+	ne.Headers = slices.Clone(e.Headers)
+	for _, name := range cacheRefreshHeaders {
+		v := resp.Header.Peek(name)
+		if len(v) == 0 {
+			continue
+		}
+		h := cacheHeader{Key: []byte(name), Value: bytes.Clone(v)}
+		if i := slices.IndexFunc(ne.Headers, func(h cacheHeader) bool {
+			return bytes.EqualFold(h.Key, []byte(name))
+		}); i != -1 {
+			ne.Headers[i] = h
+		} else {
+			ne.Headers = append(ne.Headers, h)
+		}
+	}
+	return &ne
+}
+
+// store stores e of the request URI of state.
+func (f *CacheFilter) store(state *cacheState, e *cacheEntry, vary []string) {
+	obj := state.obj
+	if obj == nil || !slices.Equal(obj.vary, vary) {
+		obj = &cacheObject{
+			tls:  state.tls,
+			host: state.host,
+			uri:  state.uri,
+			vary: vary,
+		}
+	}
+	obj.put(e)
+	f.objects.Set(state.key, obj)
+	f.save(state.key, obj)
+}
+
+// remove removes the stored responses of key and reports whether there
+// were any.
+func (f *CacheFilter) remove(key util.CacheKey) bool {
+	found := f.objects.Get(key) != nil
+	f.objects.Del(key)
+	if f.Dir != "" {
+		err := os.Remove(f.diskPath(key))
+		found = found || err == nil
+	}
+	return found
+}
+
+// purge removes the stored responses of the request URI if the client is
+// allowed to. It returns false with 200 OK if they are removed, 404 Not
+// Found if there are none, or 403 Forbidden.
+func (f *CacheFilter) purge(ctx *fasthttp.RequestCtx) bool {
+	if !f.purgeAllow.Contains(util.AddrFromIP(ctx.RemoteIP())) {
+		ctx.Response.SetStatusCode(http.StatusForbidden)
+		return false
+	}
+	if f.remove(f.keyOf(ctx)) {
+		ctx.Response.SetStatusCode(http.StatusOK)
+	} else {
+		ctx.Response.SetStatusCode(http.StatusNotFound)
+	}
+	return false
+}
+
+func (f *CacheFilter) diskPath(key util.CacheKey) string {
+	return filepath.Join(f.Dir, fmt.Sprintf("%016x", uint64(key)))
+}
+
+// save writes obj to Dir if the on-disk tier is enabled.
+func (f *CacheFilter) save(key util.CacheKey, obj *cacheObject) {
+	if f.Dir == "" {
+		return
+	}
+	obj.mu.Lock()
+	d := &cacheDiskObject{
+		TLS:     obj.tls,
+		Host:    obj.host,
+		URI:     obj.uri,
+		Vary:    obj.vary,
+		Entries: slices.Clone(obj.entries),
+	}
+	obj.mu.Unlock()
+	if err := writeCacheDiskObject(f.diskPath(key), d); err != nil {
+		f.l.Printf("cache: %v", err)
+	}
+}
+
+// writeCacheDiskObject writes d to name through a temporary file, so that
+// readers never see a partial file.
+func writeCacheDiskObject(name string, d *cacheDiskObject) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(tmp).Encode(d); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// readDisk reads the cacheObject of key from Dir.
+func (f *CacheFilter) readDisk(key util.CacheKey) *cacheObject {
+	name := f.diskPath(key)
+	file, err := os.Open(name)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			f.l.Printf("cache: %v", err)
+		}
+		return nil
+	}
+	defer file.Close()
+	d := &cacheDiskObject{}
+	if err := gob.NewDecoder(file).Decode(d); err != nil {
+		f.l.Printf("cache: %s: %v", name, err)
+		return nil
+	}
+	now := time.Now()
+	_ = os.Chtimes(name, now, now)
+	return &cacheObject{
+		tls:     d.TLS,
+		host:    d.Host,
+		uri:     d.URI,
+		vary:    d.Vary,
+		entries: d.Entries,
+	}
+}
+
+// cleanDir removes the files in Dir that have not been used for Inactive
+// until Close is called.
+func (f *CacheFilter) cleanDir() {
+	defer f.wg.Done()
+	t := time.NewTicker(min(time.Duration(f.Inactive), time.Minute))
+	defer t.Stop()
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-t.C:
+			f.removeInactiveFiles(time.Now().Add(-time.Duration(f.Inactive)))
+		}
+	}
+}
+
+// removeInactiveFiles removes the files in Dir modified before t.
+func (f *CacheFilter) removeInactiveFiles(t time.Time) {
+	entries, err := os.ReadDir(f.Dir)
+	if err != nil {
+		f.l.Printf("cache: %v", err)
+		return
+	}
+	for _, de := range entries {
+		if de.IsDir() {
+			continue
+		}
+		if fi, err := de.Info(); err == nil && fi.ModTime().Before(t) {
+			_ = os.Remove(filepath.Join(f.Dir, de.Name()))
+		}
+	}
+}
+
+// Close stops cleaning Dir.
+func (f *CacheFilter) Close() error {
+	if f.done != nil {
+		f.closeOnce.Do(func() { close(f.done) })
+		f.wg.Wait()
+	}
+	return nil
+}
+
+func init() {
+	RegisterNewFilterWithLoggerFunc("cache", NewCacheFilter)
+	config.RegisterFilterSchema("cache", cacheSchemas)
+}
+
+// cacheSchemas mirrors CacheFilter's YAML-tagged fields. Prefixes are
+// parsed by NewCacheFilter.
+var cacheSchemas = schema.QueryRules{
+	".": schema.Map{KeyedRules: map[string]schema.Rule{
+		"type":         schema.String{Enum: []string{"cache"}},
+		"maxEntries":   schema.Int{Min: tree.Int64Ptr(1)},
+		"maxEntrySize": config.SizeRule{},
+		"inactive":     config.DurationRule{},
+		"defaultTTL":   config.DurationRule{},
+		"lockTimeout":  config.DurationRule{},
+		"dir":          schema.String{},
+		"purgeAllow":   schema.Array{},
+	}},
+	".purgeAllow[]": schema.String{},
+}
@@ -0,0 +1,613 @@
+package filter
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/fasthttpd/fasthttpd/pkg/logger"
+	"github.com/mojatter/tree"
+	"github.com/valyala/fasthttp"
+)
+
+// setCacheNow sets the clock of CacheFilter to the returned time and
+// restores it on cleanup.
+func setCacheNow(t *testing.T) *time.Time {
+	t.Helper()
+	now := time.Unix(1700000000, 0)
+	cacheFilterNow = func() time.Time { return now }
+	t.Cleanup(func() { cacheFilterNow = time.Now })
+	return &now
+}
+
+func newTestCacheFilter(t *testing.T, cfg tree.Map) *CacheFilter {
+	t.Helper()
+	f, err := NewCacheFilter(cfg, logger.NilLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.(*CacheFilter).Close() })
+	return f.(*CacheFilter)
+}
+
+// testOrigin is a handler that counts its calls.
+type testOrigin struct {
+	calls   atomic.Int32
+	handler fasthttp.RequestHandler
+}
+
+func (o *testOrigin) Handle(ctx *fasthttp.RequestCtx) {
+	o.calls.Add(1)
+	o.handler(ctx)
+}
+
+// cacheDo runs a request through f and origin as a route does. The
+// headers are name-value pairs; ":method" sets the method.
+func cacheDo(f *CacheFilter, origin *testOrigin, uri string, headers ...string) *fasthttp.RequestCtx {
+	req := &fasthttp.Request{}
+	req.SetRequestURI(uri)
+	for i := 0; i+1 < len(headers); i += 2 {
+		if headers[i] == ":method" {
+			req.Header.SetMethod(headers[i+1])
+			continue
+		}
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(req, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}, nil)
+	if f.Request(ctx) {
+		origin.Handle(ctx)
+		f.Response(ctx)
+	}
+	return ctx
+}
+
+func staticOrigin(status int, body string, headers ...string) *testOrigin {
+	return &testOrigin{handler: func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(status)
+		for i := 0; i+1 < len(headers); i += 2 {
+			ctx.Response.Header.Set(headers[i], headers[i+1])
+		}
+		ctx.SetBodyString(body)
+	}}
+}
+
+func assertCacheResponse(t *testing.T, name string, ctx *fasthttp.RequestCtx, status int, xcache, body string) {
+	t.Helper()
+	if got := ctx.Response.StatusCode(); got != status {
+		t.Errorf("%s: status %d; want %d", name, got, status)
+	}
+	if got := string(ctx.Response.Header.Peek(headerXCache)); got != xcache {
+		t.Errorf("%s: X-Cache %q; want %q", name, got, xcache)
+	}
+	if got := string(ctx.Response.Body()); got != body {
+		t.Errorf("%s: body %q; want %q", name, got, body)
+	}
+}
+
+func TestNewCacheFilter(t *testing.T) {
+	tests := []struct {
+		cfg    tree.Map
+		errstr string
+	}{
+		{
+			cfg: tree.Map{},
+		}, {
+			cfg: tree.Map{
+				"maxEntries":   tree.V(100),
+				"maxEntrySize": tree.V("64K"),
+				"inactive":     tree.V("1h"),
+				"defaultTTL":   tree.V("1m"),
+				"lockTimeout":  tree.V("1s"),
+				"dir":          tree.V(t.TempDir()),
+				"purgeAllow":   tree.Array{tree.V("127.0.0.1"), tree.V("10.0.0.0/8")},
+			},
+		}, {
+			cfg:    tree.Map{"purgeAllow": tree.Array{tree.V("localhost")}},
+			errstr: `cache: purgeAllow: invalid ip prefix "localhost"`,
+		},
+	}
+	for i, test := range tests {
+		f, err := NewCacheFilter(test.cfg, logger.NilLogger)
+		if test.errstr != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.errstr) {
+				t.Errorf("tests[%d] error %v; want %q", i, err, test.errstr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("tests[%d] unexpected error %v", i, err)
+		}
+		f.(*CacheFilter).Close()
+	}
+}
+
+func TestCacheFilter_Fresh(t *testing.T) {
+	now := setCacheNow(t)
+	f := newTestCacheFilter(t, tree.Map{})
+	origin := staticOrigin(http.StatusOK, "hello", "Cache-Control", "max-age=60", "Content-Type", "text/plain")
+
+	ctx := cacheDo(f, origin, "http://example.com/a")
+	assertCacheResponse(t, "first", ctx, http.StatusOK, cacheStatusMiss, "hello")
+
+	*now = now.Add(30 * time.Second)
+	ctx = cacheDo(f, origin, "http://example.com/a")
+	assertCacheResponse(t, "second", ctx, http.StatusOK, cacheStatusHit, "hello")
+	if got := string(ctx.Response.Header.Peek(fasthttp.HeaderAge)); got != "30" {
+		t.Errorf("age %q; want 30", got)
+	}
+	if got := string(ctx.Response.Header.ContentType()); got != "text/plain" {
+		t.Errorf("content-type %q; want text/plain", got)
+	}
+
+	ctx = cacheDo(f, origin, "http://example.com/a", ":method", fasthttp.MethodHead)
+	if got := string(ctx.Response.Header.Peek(headerXCache)); got != cacheStatusHit {
+		t.Errorf("head: X-Cache %q; want %q", got, cacheStatusHit)
+	}
+
+	ctx = cacheDo(f, origin, "http://example.com/a?q=1")
+	assertCacheResponse(t, "query", ctx, http.StatusOK, cacheStatusMiss, "hello")
+	ctx = cacheDo(f, origin, "http://other.example.com/a")
+	assertCacheResponse(t, "host", ctx, http.StatusOK, cacheStatusMiss, "hello")
+
+	ctx = cacheDo(f, origin, "http://example.com/a", "Cache-Control", "no-cache")
+	assertCacheResponse(t, "no-cache request", ctx, http.StatusOK, cacheStatusBypass, "hello")
+
+	*now = now.Add(61 * time.Second)
+	ctx = cacheDo(f, origin, "http://example.com/a")
+	assertCacheResponse(t, "expired", ctx, http.StatusOK, cacheStatusMiss, "hello")
+	if got := origin.calls.Load(); got != 5 {
+		t.Errorf("origin calls %d; want 5", got)
+	}
+}
+
+func TestCacheFilter_NotStored(t *testing.T) {
+	setCacheNow(t)
+	testCases := []struct {
+		caseName string
+		cfg      tree.Map
+		origin   *testOrigin
+		headers  []string
+	}{
+		{
+			caseName: "no freshness",
+			origin:   staticOrigin(http.StatusOK, "x"),
+		}, {
+			caseName: "no-store",
+			origin:   staticOrigin(http.StatusOK, "x", "Cache-Control", "no-store, max-age=60"),
+		}, {
+			caseName: "private",
+			origin:   staticOrigin(http.StatusOK, "x", "Cache-Control", "private, max-age=60"),
+		}, {
+			caseName: "set-cookie",
+			origin:   staticOrigin(http.StatusOK, "x", "Cache-Control", "max-age=60", "Set-Cookie", "a=b"),
+		}, {
+			caseName: "vary *",
+			origin:   staticOrigin(http.StatusOK, "x", "Cache-Control", "max-age=60", "Vary", "*"),
+		}, {
+			caseName: "authorization",
+			origin:   staticOrigin(http.StatusOK, "x", "Cache-Control", "max-age=60"),
+			headers:  []string{"Authorization", "Bearer x"},
+		}, {
+			caseName: "status",
+			origin:   staticOrigin(http.StatusInternalServerError, "x", "Cache-Control", "max-age=60"),
+		}, {
+			caseName: "too large",
+			cfg:      tree.Map{"maxEntrySize": tree.V(4)},
+			origin:   staticOrigin(http.StatusOK, "12345", "Cache-Control", "max-age=60"),
+		}, {
+			caseName: "expired",
+			origin:   staticOrigin(http.StatusOK, "x", "Expires", "Thu, 01 Jan 1970 00:00:00 GMT"),
+		}, {
+			caseName: "post",
+			origin:   staticOrigin(http.StatusOK, "x", "Cache-Control", "max-age=60"),
+			headers:  []string{":method", fasthttp.MethodPost},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.caseName, func(t *testing.T) {
+			cfg := tc.cfg
+			if cfg == nil {
+				cfg = tree.Map{}
+			}
+			f := newTestCacheFilter(t, cfg)
+			cacheDo(f, tc.origin, "http://example.com/a", tc.headers...)
+			cacheDo(f, tc.origin, "http://example.com/a", tc.headers...)
+			if got := tc.origin.calls.Load(); got != 2 {
+				t.Errorf("origin calls %d; want 2", got)
+			}
+		})
+	}
+}
+
+func TestCacheFilter_Stored(t *testing.T) {
+	setCacheNow(t)
+	testCases := []struct {
+		caseName string
+		cfg      tree.Map
+		origin   *testOrigin
+		headers  []string
+	}{
+		{
+			caseName: "default ttl",
+			cfg:      tree.Map{"defaultTTL": tree.V("1m")},
+			origin:   staticOrigin(http.StatusOK, "x"),
+		}, {
+			caseName: "expires",
+			origin: staticOrigin(http.StatusOK, "x",
+				"Date", "Tue, 14 Nov 2023 22:13:20 GMT",
+				"Expires", "Tue, 14 Nov 2023 22:14:20 GMT"),
+		}, {
+			caseName: "s-maxage with authorization",
+			origin:   staticOrigin(http.StatusOK, "x", "Cache-Control", "s-maxage=60"),
+			headers:  []string{"Authorization", "Bearer x"},
+		}, {
+			caseName: "not found",
+			origin:   staticOrigin(http.StatusNotFound, "x", "Cache-Control", "max-age=60"),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.caseName, func(t *testing.T) {
+			cfg := tc.cfg
+			if cfg == nil {
+				cfg = tree.Map{}
+			}
+			f := newTestCacheFilter(t, cfg)
+			cacheDo(f, tc.origin, "http://example.com/a", tc.headers...)
+			ctx := cacheDo(f, tc.origin, "http://example.com/a", tc.headers...)
+			if got := string(ctx.Response.Header.Peek(headerXCache)); got != cacheStatusHit {
+				t.Errorf("X-Cache %q; want %q", got, cacheStatusHit)
+			}
+			if got := tc.origin.calls.Load(); got != 1 {
+				t.Errorf("origin calls %d; want 1", got)
+			}
+		})
+	}
+}
+
+func TestCacheFilter_Vary(t *testing.T) {
+	setCacheNow(t)
+	f := newTestCacheFilter(t, tree.Map{})
+	origin := &testOrigin{handler: func(ctx *fasthttp.RequestCtx) {
+		ctx.Response.Header.Set("Cache-Control", "max-age=60")
+		ctx.Response.Header.Set("Vary", "accept-language")
+		ctx.SetBodyString("lang=" + string(ctx.Request.Header.Peek("Accept-Language")))
+	}}
+	for i, test := range []struct {
+		lang   string
+		xcache string
+	}{
+		{lang: "en", xcache: cacheStatusMiss},
+		{lang: "ja", xcache: cacheStatusMiss},
+		{lang: "en", xcache: cacheStatusHit},
+		{lang: "ja", xcache: cacheStatusHit},
+		{lang: "", xcache: cacheStatusMiss},
+	} {
+		ctx := cacheDo(f, origin, "http://example.com/a", "Accept-Language", test.lang)
+		assertCacheResponse(t, fmt.Sprintf("tests[%d]", i), ctx, http.StatusOK, test.xcache, "lang="+test.lang)
+	}
+}
+
+func TestCacheFilter_Revalidate(t *testing.T) {
+	now := setCacheNow(t)
+	f := newTestCacheFilter(t, tree.Map{})
+	var gotIfNoneMatch string
+	origin := &testOrigin{handler: func(ctx *fasthttp.RequestCtx) {
+		gotIfNoneMatch = string(ctx.Request.Header.Peek(fasthttp.HeaderIfNoneMatch))
+		ctx.Response.Header.Set("Cache-Control", "max-age=10")
+		ctx.Response.Header.Set("ETag", `"v1"`)
+		if gotIfNoneMatch == `"v1"` {
+			ctx.SetStatusCode(http.StatusNotModified)
+			return
+		}
+		ctx.SetBodyString("v1")
+	}}
+
+	cacheDo(f, origin, "http://example.com/a")
+	ctx := cacheDo(f, origin, "http://example.com/a", "If-None-Match", `"v1"`)
+	assertCacheResponse(t, "conditional hit", ctx, http.StatusNotModified, cacheStatusHit, "")
+
+	*now = now.Add(20 * time.Second)
+	ctx = cacheDo(f, origin, "http://example.com/a")
+	assertCacheResponse(t, "revalidated", ctx, http.StatusOK, cacheStatusRevalidated, "v1")
+	if gotIfNoneMatch != `"v1"` {
+		t.Errorf("If-None-Match %q; want %q", gotIfNoneMatch, `"v1"`)
+	}
+
+	*now = now.Add(5 * time.Second)
+	ctx = cacheDo(f, origin, "http://example.com/a")
+	assertCacheResponse(t, "refreshed", ctx, http.StatusOK, cacheStatusHit, "v1")
+
+	*now = now.Add(20 * time.Second)
+	ctx = cacheDo(f, origin, "http://example.com/a", "If-None-Match", `"v0"`)
+	assertCacheResponse(t, "client conditional", ctx, http.StatusOK, cacheStatusRevalidated, "v1")
+	if got := origin.calls.Load(); got != 3 {
+		t.Errorf("origin calls %d; want 3", got)
+	}
+}
+
+func TestCacheFilter_Stale(t *testing.T) {
+	now := setCacheNow(t)
+	f := newTestCacheFilter(t, tree.Map{})
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	origin := &testOrigin{handler: func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(int(status.Load()))
+		ctx.Response.Header.Set("Cache-Control", "max-age=10, stale-while-revalidate=10, stale-if-error=60")
+		ctx.SetBodyString("body")
+	}}
+	cacheDo(f, origin, "http://example.com/a")
+
+	// Within stale-while-revalidate, a request revalidates while the
+	// others are served the stale response.
+	*now = now.Add(15 * time.Second)
+	obj := f.object(f.keyOf(newCacheKeyCtx("http://example.com/a")), newCacheKeyCtx("http://example.com/a"))
+	if !obj.startRevalidate(*now, time.Second) {
+		t.Fatal("startRevalidate returned false")
+	}
+	ctx := cacheDo(f, origin, "http://example.com/a")
+	assertCacheResponse(t, "stale", ctx, http.StatusOK, cacheStatusStale, "body")
+	obj.endRevalidate()
+	ctx = cacheDo(f, origin, "http://example.com/a")
+	assertCacheResponse(t, "revalidator", ctx, http.StatusOK, cacheStatusMiss, "body")
+	if got := origin.calls.Load(); got != 2 {
+		t.Errorf("origin calls %d; want 2", got)
+	}
+
+	// Past stale-while-revalidate, an error is answered with the stale
+	// response within stale-if-error.
+	status.Store(http.StatusBadGateway)
+	*now = now.Add(30 * time.Second)
+	ctx = cacheDo(f, origin, "http://example.com/a")
+	assertCacheResponse(t, "stale-if-error", ctx, http.StatusOK, cacheStatusStale, "body")
+
+	*now = now.Add(time.Minute)
+	ctx = cacheDo(f, origin, "http://example.com/a")
+	assertCacheResponse(t, "error", ctx, http.StatusBadGateway, cacheStatusMiss, "body")
+}
+
+func newCacheKeyCtx(uri string) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI(uri)
+	return ctx
+}
+
+func TestCacheFilter_MustRevalidate(t *testing.T) {
+	now := setCacheNow(t)
+	f := newTestCacheFilter(t, tree.Map{})
+	origin := staticOrigin(http.StatusOK, "body", "Cache-Control", "max-age=10, must-revalidate, stale-if-error=60")
+	cacheDo(f, origin, "http://example.com/a")
+
+	*now = now.Add(15 * time.Second)
+	origin.handler = func(ctx *fasthttp.RequestCtx) { ctx.SetStatusCode(http.StatusServiceUnavailable) }
+	ctx := cacheDo(f, origin, "http://example.com/a")
+	assertCacheResponse(t, "must-revalidate", ctx, http.StatusServiceUnavailable, cacheStatusMiss, "")
+}
+
+func TestCacheFilter_Collapse(t *testing.T) {
+	f := newTestCacheFilter(t, tree.Map{})
+	release := make(chan struct{})
+	origin := &testOrigin{handler: func(ctx *fasthttp.RequestCtx) {
+		<-release
+		ctx.Response.Header.Set("Cache-Control", "max-age=60")
+		ctx.SetBodyString("slow")
+	}}
+
+	const n = 10
+	var wg sync.WaitGroup
+	statuses := make(chan string, n)
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := cacheDo(f, origin, "http://example.com/slow")
+			statuses <- string(ctx.Response.Header.Peek(headerXCache)) + ":" + string(ctx.Response.Body())
+		}()
+	}
+	// Let the requests reach the filter before the origin responds.
+	for origin.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(statuses)
+
+	if got := origin.calls.Load(); got != 1 {
+		t.Errorf("origin calls %d; want 1", got)
+	}
+	counts := map[string]int{}
+	for s := range statuses {
+		counts[s]++
+	}
+	if counts["MISS:slow"] != 1 || counts["HIT:slow"] != n-1 {
+		t.Errorf("unexpected responses %v", counts)
+	}
+}
+
+// TestCacheFilter_ResponseSkipped verifies that the flight and the
+// revalidation lock are released when the request finishes without the
+// Response hook, as when a later filter rejects the request.
+func TestCacheFilter_ResponseSkipped(t *testing.T) {
+	now := setCacheNow(t)
+	f := newTestCacheFilter(t, tree.Map{"lockTimeout": tree.V("10s")})
+	origin := staticOrigin(http.StatusOK, "body", "Cache-Control", "max-age=10, stale-while-revalidate=10")
+
+	ctx := newCacheKeyCtx("http://example.com/a")
+	if !f.Request(ctx) {
+		t.Fatal("Request returned false for a missing entry")
+	}
+	ctx.ResetUserValues()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ctx = cacheDo(f, origin, "http://example.com/a")
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("request waited for the released flight")
+	}
+	assertCacheResponse(t, "after flight", ctx, http.StatusOK, cacheStatusMiss, "body")
+
+	*now = now.Add(15 * time.Second)
+	ctx = newCacheKeyCtx("http://example.com/a")
+	if !f.Request(ctx) {
+		t.Fatal("Request returned false for the revalidator")
+	}
+	ctx.ResetUserValues()
+	obj := f.object(f.keyOf(ctx), ctx)
+	if !obj.startRevalidate(*now, time.Second) {
+		t.Error("revalidation is locked after the request finished")
+	}
+}
+
+func TestCacheFilter_Purge(t *testing.T) {
+	setCacheNow(t)
+	f := newTestCacheFilter(t, tree.Map{"purgeAllow": tree.Array{tree.V("127.0.0.1")}})
+	origin := staticOrigin(http.StatusOK, "x", "Cache-Control", "max-age=60")
+	cacheDo(f, origin, "http://example.com/a")
+
+	ctx := cacheDo(f, origin, "http://example.com/a", ":method", cacheMethodPurge)
+	if got := ctx.Response.StatusCode(); got != http.StatusOK {
+		t.Errorf("purge status %d; want %d", got, http.StatusOK)
+	}
+	ctx = cacheDo(f, origin, "http://example.com/a", ":method", cacheMethodPurge)
+	if got := ctx.Response.StatusCode(); got != http.StatusNotFound {
+		t.Errorf("purge again status %d; want %d", got, http.StatusNotFound)
+	}
+	ctx = cacheDo(f, origin, "http://example.com/a")
+	assertCacheResponse(t, "after purge", ctx, http.StatusOK, cacheStatusMiss, "x")
+
+	f2 := newTestCacheFilter(t, tree.Map{"purgeAllow": tree.Array{tree.V("10.0.0.0/8")}})
+	ctx = cacheDo(f2, origin, "http://example.com/a", ":method", cacheMethodPurge)
+	if got := ctx.Response.StatusCode(); got != http.StatusForbidden {
+		t.Errorf("forbidden purge status %d; want %d", got, http.StatusForbidden)
+	}
+	if got := origin.calls.Load(); got != 2 {
+		t.Errorf("origin calls %d; want 2", got)
+	}
+}
+
+func TestCacheFilter_Invalidate(t *testing.T) {
+	setCacheNow(t)
+	f := newTestCacheFilter(t, tree.Map{})
+	origin := staticOrigin(http.StatusOK, "x", "Cache-Control", "max-age=60")
+	cacheDo(f, origin, "http://example.com/a")
+	cacheDo(f, origin, "http://example.com/a", ":method", fasthttp.MethodPost)
+	ctx := cacheDo(f, origin, "http://example.com/a")
+	assertCacheResponse(t, "after post", ctx, http.StatusOK, cacheStatusMiss, "x")
+}
+
+func TestCacheFilter_Disk(t *testing.T) {
+	now := setCacheNow(t)
+	dir := t.TempDir()
+	origin := staticOrigin(http.StatusOK, "on disk", "Cache-Control", "max-age=60", "Content-Type", "text/plain")
+
+	f := newTestCacheFilter(t, tree.Map{"dir": tree.V(dir)})
+	cacheDo(f, origin, "http://example.com/a")
+	f.Close()
+
+	f = newTestCacheFilter(t, tree.Map{"dir": tree.V(dir)})
+	*now = now.Add(10 * time.Second)
+	ctx := cacheDo(f, origin, "http://example.com/a")
+	assertCacheResponse(t, "disk", ctx, http.StatusOK, cacheStatusHit, "on disk")
+	if got := string(ctx.Response.Header.Peek(fasthttp.HeaderAge)); got != "10" {
+		t.Errorf("age %q; want 10", got)
+	}
+	if got := origin.calls.Load(); got != 1 {
+		t.Errorf("origin calls %d; want 1", got)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("%d files; want 1", len(files))
+	}
+	f.removeInactiveFiles(time.Now().Add(time.Minute))
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("%d files after removeInactiveFiles; want 0", len(files))
+	}
+}
+
+func TestCacheSchema(t *testing.T) {
+	testCases := []struct {
+		caseName string
+		filter   tree.Map
+		wantErr  string
+	}{
+		{
+			caseName: "valid",
+			filter: tree.Map{
+				"type":         tree.V("cache"),
+				"maxEntries":   tree.V(1000),
+				"maxEntrySize": tree.V("1M"),
+				"inactive":     tree.V("10m"),
+				"defaultTTL":   tree.V("1m"),
+				"lockTimeout":  tree.V("5s"),
+				"dir":          tree.V("/var/cache/fasthttpd"),
+				"purgeAllow":   tree.Array{tree.V("127.0.0.1")},
+			},
+		},
+		{
+			caseName: "invalid inactive",
+			filter: tree.Map{
+				"type":     tree.V("cache"),
+				"inactive": tree.V("forever"),
+			},
+			wantErr: `.filters["cache"].inactive: invalid duration "forever"`,
+		},
+		{
+			caseName: "unknown top-level field",
+			filter: tree.Map{
+				"type":  tree.V("cache"),
+				"bogus": tree.V(1),
+			},
+			wantErr: `.filters["cache"]: unknown key "bogus"`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.caseName, func(t *testing.T) {
+			docs := []tree.Map{{"filters": tree.Map{"cache": tc.filter}}}
+			err := config.ValidateTreeMaps(docs)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("ValidateTreeMaps returned %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("ValidateTreeMaps returned nil, want error containing %q", tc.wantErr)
+			}
+			if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("error %q does not contain %q", err.Error(), tc.wantErr)
+			}
+		})
+	}
+}
+
+func BenchmarkCacheFilter_Request_Hit(b *testing.B) {
+	f, err := NewCacheFilter(tree.Map{}, logger.NilLogger)
+	if err != nil {
+		b.Fatal(err)
+	}
+	origin := staticOrigin(http.StatusOK, strings.Repeat("x", 1024), "Cache-Control", "max-age=3600", "Content-Type", "text/plain")
+	cacheDo(f.(*CacheFilter), origin, "http://example.com/a")
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("http://example.com/a")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for b.Loop() {
+		f.Request(ctx)
+	}
+}
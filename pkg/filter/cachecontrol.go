@@ -0,0 +1,101 @@
+package filter
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// cacheControl holds the Cache-Control directives used by CacheFilter.
+// Delta seconds are -1 when the directive is absent.
+type cacheControl struct {
+	noStore              bool
+	noCache              bool
+	private              bool
+	public               bool
+	mustRevalidate       bool
+	maxAge               int64
+	sMaxAge              int64
+	staleWhileRevalidate int64
+	staleIfError         int64
+}
+
+// parseCacheControl parses the Cache-Control header values. Unknown
+// directives are ignored, as are invalid delta seconds.
+func parseCacheControl(values [][]byte) cacheControl {
+	cc := cacheControl{
+		maxAge:               -1,
+		sMaxAge:              -1,
+		staleWhileRevalidate: -1,
+		staleIfError:         -1,
+	}
+	for _, v := range values {
+		for len(v) > 0 {
+			var d []byte
+			if i := bytes.IndexByte(v, ','); i != -1 {
+				d, v = v[:i], v[i+1:]
+			} else {
+				d, v = v, nil
+			}
+			name, value, _ := bytes.Cut(d, []byte("="))
+			name = bytes.TrimSpace(name)
+			value = bytes.Trim(bytes.TrimSpace(value), `"`)
+			switch {
+			case bytes.EqualFold(name, []byte("no-store")):
+				cc.noStore = true
+			case bytes.EqualFold(name, []byte("no-cache")):
+				cc.noCache = true
+			case bytes.EqualFold(name, []byte("private")):
+				cc.private = true
+			case bytes.EqualFold(name, []byte("public")):
+				cc.public = true
+			case bytes.EqualFold(name, []byte("must-revalidate")),
+				bytes.EqualFold(name, []byte("proxy-revalidate")):
+				cc.mustRevalidate = true
+			case bytes.EqualFold(name, []byte("max-age")):
+				cc.maxAge = parseDeltaSeconds(value, cc.maxAge)
+			case bytes.EqualFold(name, []byte("s-maxage")):
+				cc.sMaxAge = parseDeltaSeconds(value, cc.sMaxAge)
+			case bytes.EqualFold(name, []byte("stale-while-revalidate")):
+				cc.staleWhileRevalidate = parseDeltaSeconds(value, cc.staleWhileRevalidate)
+			case bytes.EqualFold(name, []byte("stale-if-error")):
+				cc.staleIfError = parseDeltaSeconds(value, cc.staleIfError)
+			}
+		}
+	}
+	return cc
+}
+
+// parseDeltaSeconds parses a non-negative number of seconds. It returns
+// def if b is invalid.
+func parseDeltaSeconds(b []byte, def int64) int64 {
+	n, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil || n < 0 {
+		return def
+	}
+	return n
+}
+
+// etagMatch reports whether the If-None-Match value ifNoneMatch matches
+// etag with the weak comparison of RFC 9110 section 13.1.2.
+func etagMatch(ifNoneMatch, etag []byte) bool {
+	if len(etag) == 0 {
+		return false
+	}
+	etag = bytes.TrimPrefix(etag, []byte("W/"))
+	for len(ifNoneMatch) > 0 {
+		var t []byte
+		if i := bytes.IndexByte(ifNoneMatch, ','); i != -1 {
+			t, ifNoneMatch = ifNoneMatch[:i], ifNoneMatch[i+1:]
+		} else {
+			t, ifNoneMatch = ifNoneMatch, nil
+		}
+		t = bytes.TrimSpace(t)
+		if len(t) == 1 && t[0] == '*' {
+			return true
+		}
+		if bytes.Equal(bytes.TrimPrefix(t, []byte("W/")), etag) {
+			return true
+		}
+	}
+	return false
+}
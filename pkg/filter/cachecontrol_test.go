@@ -0,0 +1,58 @@
+package filter
+
+import (
+	"testing"
+)
+
+func TestParseCacheControl(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   cacheControl
+	}{
+		{
+			want: cacheControl{maxAge: -1, sMaxAge: -1, staleWhileRevalidate: -1, staleIfError: -1},
+		}, {
+			values: []string{"public, max-age=60, s-maxage=120"},
+			want:   cacheControl{public: true, maxAge: 60, sMaxAge: 120, staleWhileRevalidate: -1, staleIfError: -1},
+		}, {
+			values: []string{"No-Store", "private"},
+			want:   cacheControl{noStore: true, private: true, maxAge: -1, sMaxAge: -1, staleWhileRevalidate: -1, staleIfError: -1},
+		}, {
+			values: []string{`max-age="30", stale-while-revalidate=10, stale-if-error=86400`},
+			want:   cacheControl{maxAge: 30, sMaxAge: -1, staleWhileRevalidate: 10, staleIfError: 86400},
+		}, {
+			values: []string{"no-cache, proxy-revalidate, max-age=-1, s-maxage=abc"},
+			want:   cacheControl{noCache: true, mustRevalidate: true, maxAge: -1, sMaxAge: -1, staleWhileRevalidate: -1, staleIfError: -1},
+		},
+	}
+	for i, test := range tests {
+		var values [][]byte
+		for _, v := range test.values {
+			values = append(values, []byte(v))
+		}
+		if got := parseCacheControl(values); got != test.want {
+			t.Errorf("tests[%d] got %+v; want %+v", i, got, test.want)
+		}
+	}
+}
+
+func TestEtagMatch(t *testing.T) {
+	tests := []struct {
+		ifNoneMatch string
+		etag        string
+		want        bool
+	}{
+		{ifNoneMatch: `"a"`, etag: `"a"`, want: true},
+		{ifNoneMatch: `"b", "a"`, etag: `"a"`, want: true},
+		{ifNoneMatch: `W/"a"`, etag: `"a"`, want: true},
+		{ifNoneMatch: `"a"`, etag: `W/"a"`, want: true},
+		{ifNoneMatch: `*`, etag: `"a"`, want: true},
+		{ifNoneMatch: `"b"`, etag: `"a"`},
+		{ifNoneMatch: `*`, etag: ``},
+	}
+	for i, test := range tests {
+		if got := etagMatch([]byte(test.ifNoneMatch), []byte(test.etag)); got != test.want {
+			t.Errorf("tests[%d] etagMatch(%q, %q) = %v; want %v", i, test.ifNoneMatch, test.etag, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package filter
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/mojatter/tree"
+	"github.com/mojatter/tree/schema"
+	"github.com/valyala/bytebufferpool"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// DefaultCompressMinSize is the default minimum size of a response
+	// body to be compressed.
+	DefaultCompressMinSize = 1024
+
+	compressBrotli = "br"
+	compressZstd   = "zstd"
+	compressGzip   = "gzip"
+)
+
+// DefaultCompressEncodings are the encodings in order of preference when
+// encodings is not set.
+var DefaultCompressEncodings = []string{compressBrotli, compressZstd, compressGzip}
+
+// DefaultCompressContentTypes are the media types compressed when
+// contentTypes is not set.
+var DefaultCompressContentTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+var (
+	compressAcceptEncoding = []byte(fasthttp.HeaderAcceptEncoding)
+	compressNoTransform    = []byte("no-transform")
+	compressWeakPrefix     = []byte("W/")
+)
+
+// compressStreamTypes are the prefixes of the media types that fasthttp
+// compresses in a body stream. It leaves the others uncompressed.
+var compressStreamTypes = [][]byte{
+	[]byte("text/"),
+	[]byte("application/"),
+	[]byte("image/svg"),
+	[]byte("image/x-icon"),
+	[]byte("font/"),
+	[]byte("multipart/"),
+}
+
+// CompressFilter implements the Filter that compresses response bodies
+// with an encoding negotiated by Accept-Encoding. Responses that are
+// already encoded, smaller than MinSize or not of ContentTypes are sent
+// as is.
+type CompressFilter struct {
+	// Encodings lists the encodings ("br", "zstd" and "gzip") in order of
+	// preference. It breaks ties between equal quality values of the
+	// Accept-Encoding header.
+	Encodings []string    `yaml:"encodings"`
+	MinSize   config.Size `yaml:"minSize"`
+	// ContentTypes lists the media types to compress. A type ending with
+	// "/*" matches any subtype.
+	ContentTypes []string `yaml:"contentTypes"`
+
+	types    map[string]struct{}
+	prefixes []string
+}
+
+// NewCompressFilter returns a new CompressFilter.
+func NewCompressFilter(cfg tree.Map) (Filter, error) {
+	f := &CompressFilter{}
+	if err := tree.UnmarshalViaYAML(cfg, f); err != nil {
+		return nil, err
+	}
+	if err := f.init(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *CompressFilter) init() error {
+	if len(f.Encodings) == 0 {
+		f.Encodings = DefaultCompressEncodings
+	}
+	for _, e := range f.Encodings {
+		switch e {
+		case compressBrotli, compressZstd, compressGzip:
+		default:
+			return fmt.Errorf("compress: unsupported encoding: %q", e)
+		}
+	}
+	if f.MinSize <= 0 {
+		f.MinSize = DefaultCompressMinSize
+	}
+	if len(f.ContentTypes) == 0 {
+		f.ContentTypes = DefaultCompressContentTypes
+	}
+	f.types = map[string]struct{}{}
+	for _, t := range f.ContentTypes {
+		t = strings.ToLower(t)
+		if prefix, ok := strings.CutSuffix(t, "*"); ok {
+			f.prefixes = append(f.prefixes, prefix)
+			continue
+		}
+		f.types[t] = struct{}{}
+	}
+	return nil
+}
+
+// compressible reports whether contentType is one of ContentTypes.
+func (f *CompressFilter) compressible(contentType []byte) bool {
+	if i := bytes.IndexByte(contentType, ';'); i != -1 {
+		contentType = contentType[:i]
+	}
+	contentType = bytes.TrimSpace(contentType)
+	var buf [64]byte
+	if len(contentType) > len(buf) {
+		return false
+	}
+	lower := buf[:len(contentType)]
+	for i, c := range contentType {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		lower[i] = c
+	}
+	if _, ok := f.types[string(lower)]; ok {
+		return true
+	}
+	for _, p := range f.prefixes {
+		if bytes.HasPrefix(lower, []byte(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiate returns the encoding with the highest quality value in
+// acceptEncoding, preferring the earlier one of Encodings on ties. It
+// returns "" if none of them is acceptable.
+func (f *CompressFilter) negotiate(acceptEncoding []byte) string {
+	best, bestQ := "", 0
+	for _, e := range f.Encodings {
+		if q := acceptEncodingQuality(acceptEncoding, e); q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+	return best
+}
+
+// acceptEncodingQuality returns the quality value of coding in
+// acceptEncoding in thousandths. The "*" coding applies if coding is not
+// listed.
+func acceptEncodingQuality(acceptEncoding []byte, coding string) int {
+	q, anyQ := -1, 0
+	for len(acceptEncoding) > 0 {
+		var item []byte
+		if i := bytes.IndexByte(acceptEncoding, ','); i != -1 {
+			item, acceptEncoding = acceptEncoding[:i], acceptEncoding[i+1:]
+		} else {
+			item, acceptEncoding = acceptEncoding, nil
+		}
+		name, params, _ := bytes.Cut(item, []byte(";"))
+		name = bytes.TrimSpace(name)
+		switch {
+		case bytes.EqualFold(name, []byte(coding)):
+			q = parseQuality(params)
+		case len(name) == 1 && name[0] == '*':
+			anyQ = parseQuality(params)
+		}
+	}
+	if q < 0 {
+		return anyQ
+	}
+	return q
+}
+
+// parseQuality parses the "q=0.5" parameter in thousandths. It returns
+// 1000 if the parameter is absent and 0 if it is invalid.
+func parseQuality(params []byte) int {
+	params = bytes.TrimSpace(params)
+	if len(params) < 2 || params[0]|0x20 != 'q' || params[1] != '=' {
+		return 1000
+	}
+	v := params[2:]
+	if len(v) == 0 || v[0] < '0' || v[0] > '1' {
+		return 0
+	}
+	q := int(v[0]-'0') * 1000
+	if len(v) > 1 {
+		if v[1] != '.' {
+			return 0
+		}
+		scale := 100
+		for _, c := range v[2:] {
+			if c < '0' || c > '9' || scale == 0 {
+				return 0
+			}
+			q += int(c-'0') * scale
+			scale /= 10
+		}
+	}
+	return min(q, 1000)
+}
+
+// addVary adds value to the Vary header unless it is already listed.
+func addVary(h *fasthttp.ResponseHeader, value []byte) {
+	v := h.Peek(fasthttp.HeaderVary)
+	if len(v) == 0 {
+		h.SetBytesV(fasthttp.HeaderVary, value)
+		return
+	}
+	for _, s := range bytes.Split(v, []byte(",")) {
+		if bytes.EqualFold(bytes.TrimSpace(s), value) {
+			return
+		}
+	}
+	h.AddBytesV(fasthttp.HeaderVary, value)
+}
+
+// streamCompressible reports whether fasthttp compresses a body stream of
+// contentType.
+func streamCompressible(contentType []byte) bool {
+	for _, prefix := range compressStreamTypes {
+		if bytes.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// weakenETag turns a strong ETag of h into a weak one, since the encoded
+// body is not byte-for-byte the one the ETag was given for.
+func weakenETag(h *fasthttp.ResponseHeader) {
+	etag := h.Peek(fasthttp.HeaderETag)
+	if len(etag) == 0 || bytes.HasPrefix(etag, compressWeakPrefix) {
+		return
+	}
+	h.SetBytesV(fasthttp.HeaderETag, append([]byte("W/"), etag...))
+}
+
+// Request does nothing and returns true.
+func (f *CompressFilter) Request(ctx *fasthttp.RequestCtx) bool {
+	return true
+}
+
+// Response compresses the response body with the negotiated encoding.
+func (f *CompressFilter) Response(ctx *fasthttp.RequestCtx) bool {
+	resp := &ctx.Response
+	switch status := resp.StatusCode(); {
+	case status < 200,
+		status == http.StatusNoContent,
+		status == http.StatusPartialContent,
+		status == http.StatusNotModified:
+		return true
+	}
+	if ctx.IsHead() ||
+		len(resp.Header.ContentEncoding()) > 0 ||
+		!f.compressible(resp.Header.ContentType()) ||
+		bytes.Contains(resp.Header.Peek(fasthttp.HeaderCacheControl), compressNoTransform) {
+		return true
+	}
+	if resp.IsBodyStream() {
+		if !streamCompressible(resp.Header.ContentType()) {
+			return true
+		}
+		if n := resp.Header.ContentLength(); n >= 0 && n < int(f.MinSize) {
+			return true
+		}
+	} else if len(resp.Body()) < int(f.MinSize) {
+		return true
+	}
+	// The response is eligible, so it varies by Accept-Encoding even if it
+	// is not compressed for this request.
+	addVary(&resp.Header, compressAcceptEncoding)
+
+	encoding := f.negotiate(ctx.Request.Header.Peek(fasthttp.HeaderAcceptEncoding))
+	if encoding == "" {
+		return true
+	}
+	if resp.IsBodyStream() {
+		compressBodyStream(ctx, encoding)
+		if len(resp.Header.ContentEncoding()) > 0 {
+			weakenETag(&resp.Header)
+		}
+		return true
+	}
+	w := bytebufferpool.Get()
+	switch encoding {
+	case compressBrotli:
+		w.B = fasthttp.AppendBrotliBytesLevel(w.B, resp.Body(), fasthttp.CompressBrotliDefaultCompression)
+	case compressZstd:
+		w.B = fasthttp.AppendZstdBytesLevel(w.B, resp.Body(), fasthttp.CompressZstdDefault)
+	default:
+		w.B = fasthttp.AppendGzipBytesLevel(w.B, resp.Body(), fasthttp.CompressDefaultCompression)
+	}
+	w.B = resp.SwapBody(w.B)
+	bytebufferpool.Put(w)
+	resp.Header.SetContentEncoding(encoding)
+	weakenETag(&resp.Header)
+	return true
+}
+
+// compressBodyStream compresses the body stream with encoding. fasthttp
+// keeps its pooled stream compressors unexported, so they are reached
+// through its compress handler with Accept-Encoding narrowed to encoding.
+func compressBodyStream(ctx *fasthttp.RequestCtx, encoding string) {
+	h := &ctx.Request.Header
+	acceptEncoding := bytes.Clone(h.Peek(fasthttp.HeaderAcceptEncoding))
+	h.Set(fasthttp.HeaderAcceptEncoding, encoding)
+	otherLevel := fasthttp.CompressDefaultCompression
+	if encoding == compressZstd {
+		otherLevel = fasthttp.CompressZstdDefault
+	}
+	fasthttp.CompressHandlerBrotliLevel(func(*fasthttp.RequestCtx) {},
+		fasthttp.CompressBrotliDefaultCompression, otherLevel)(ctx)
+	h.SetBytesV(fasthttp.HeaderAcceptEncoding, acceptEncoding)
+}
+
+func init() {
+	RegisterNewFilterFunc("compress", NewCompressFilter)
+	config.RegisterFilterSchema("compress", compressSchemas)
+}
+
+// compressSchemas mirrors CompressFilter's YAML-tagged fields.
+var compressSchemas = schema.QueryRules{
+	".": schema.Map{KeyedRules: map[string]schema.Rule{
+		"type":         schema.String{Enum: []string{"compress"}},
+		"encodings":    schema.Array{},
+		"minSize":      config.SizeRule{},
+		"contentTypes": schema.Array{},
+	}},
+	".encodings[]":    schema.String{Enum: []string{compressBrotli, compressZstd, compressGzip}},
+	".contentTypes[]": schema.String{},
+}
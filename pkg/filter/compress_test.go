@@ -0,0 +1,394 @@
+package filter
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/mojatter/tree"
+	"github.com/valyala/fasthttp"
+)
+
+func TestNewCompressFilter(t *testing.T) {
+	tests := []struct {
+		cfg           tree.Map
+		wantEncodings []string
+		wantMinSize   config.Size
+		errstr        string
+	}{
+		{
+			cfg:           tree.Map{},
+			wantEncodings: DefaultCompressEncodings,
+			wantMinSize:   DefaultCompressMinSize,
+		}, {
+			cfg: tree.Map{
+				"encodings":    tree.Array{tree.V("gzip")},
+				"minSize":      tree.V("4K"),
+				"contentTypes": tree.Array{tree.V("text/html")},
+			},
+			wantEncodings: []string{"gzip"},
+			wantMinSize:   4096,
+		}, {
+			cfg:    tree.Map{"encodings": tree.Array{tree.V("deflate")}},
+			errstr: `compress: unsupported encoding: "deflate"`,
+		},
+	}
+	for i, test := range tests {
+		f, err := NewCompressFilter(test.cfg)
+		if test.errstr != "" {
+			if err == nil || err.Error() != test.errstr {
+				t.Errorf("tests[%d] error %v; want %q", i, err, test.errstr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("tests[%d] unexpected error %v", i, err)
+		}
+		cf := f.(*CompressFilter)
+		if strings.Join(cf.Encodings, ",") != strings.Join(test.wantEncodings, ",") {
+			t.Errorf("tests[%d] encodings %v; want %v", i, cf.Encodings, test.wantEncodings)
+		}
+		if cf.MinSize != test.wantMinSize {
+			t.Errorf("tests[%d] minSize %d; want %d", i, cf.MinSize, test.wantMinSize)
+		}
+	}
+}
+
+func TestCompressFilter_negotiate(t *testing.T) {
+	f, err := NewCompressFilter(tree.Map{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{acceptEncoding: "", want: ""},
+		{acceptEncoding: "identity", want: ""},
+		{acceptEncoding: "gzip", want: "gzip"},
+		{acceptEncoding: "gzip, deflate, br", want: "br"},
+		{acceptEncoding: "gzip, deflate, br, zstd", want: "br"},
+		{acceptEncoding: "gzip;q=1.0, br;q=0.5", want: "gzip"},
+		{acceptEncoding: "zstd;q=0.8, gzip;q=0.8", want: "zstd"},
+		{acceptEncoding: "br;q=0, gzip", want: "gzip"},
+		{acceptEncoding: "*", want: "br"},
+		{acceptEncoding: "*;q=0.1, br;q=0", want: "zstd"},
+		{acceptEncoding: "GZIP; Q=0.5", want: "gzip"},
+		{acceptEncoding: "gzip;q=abc", want: ""},
+		{acceptEncoding: "gzip;q=0.001", want: "gzip"},
+	}
+	for i, test := range tests {
+		if got := f.(*CompressFilter).negotiate([]byte(test.acceptEncoding)); got != test.want {
+			t.Errorf("tests[%d] negotiate(%q) = %q; want %q", i, test.acceptEncoding, got, test.want)
+		}
+	}
+}
+
+func TestCompressFilter_compressible(t *testing.T) {
+	f, err := NewCompressFilter(tree.Map{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{contentType: "text/html; charset=utf-8", want: true},
+		{contentType: "Text/CSS", want: true},
+		{contentType: "application/json", want: true},
+		{contentType: "image/svg+xml", want: true},
+		{contentType: "image/png"},
+		{contentType: "application/octet-stream"},
+		{contentType: ""},
+	}
+	for i, test := range tests {
+		if got := f.(*CompressFilter).compressible([]byte(test.contentType)); got != test.want {
+			t.Errorf("tests[%d] compressible(%q) = %v; want %v", i, test.contentType, got, test.want)
+		}
+	}
+}
+
+func newCompressCtx(acceptEncoding, contentType, body string) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	if acceptEncoding != "" {
+		ctx.Request.Header.Set(fasthttp.HeaderAcceptEncoding, acceptEncoding)
+	}
+	ctx.Response.Header.SetContentType(contentType)
+	ctx.Response.SetBodyString(body)
+	return ctx
+}
+
+func decompress(t *testing.T, encoding string, body []byte) string {
+	t.Helper()
+	var got []byte
+	var err error
+	switch encoding {
+	case "br":
+		got, err = fasthttp.AppendUnbrotliBytes(nil, body)
+	case "zstd":
+		got, err = fasthttp.AppendUnzstdBytes(nil, body)
+	case "gzip":
+		got, err = fasthttp.AppendGunzipBytes(nil, body)
+	default:
+		return string(body)
+	}
+	if err != nil {
+		t.Fatalf("decompress %s: %v", encoding, err)
+	}
+	return string(got)
+}
+
+func TestCompressFilter_Response(t *testing.T) {
+	f, err := NewCompressFilter(tree.Map{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := strings.Repeat("fasthttpd ", 200)
+	testCases := []struct {
+		caseName     string
+		ctx          func() *fasthttp.RequestCtx
+		wantEncoding string
+		wantVary     string
+		wantETag     string
+	}{
+		{
+			caseName:     "br",
+			ctx:          func() *fasthttp.RequestCtx { return newCompressCtx("gzip, br", "text/html", large) },
+			wantEncoding: "br",
+			wantVary:     "Accept-Encoding",
+		}, {
+			caseName:     "zstd",
+			ctx:          func() *fasthttp.RequestCtx { return newCompressCtx("zstd", "application/json", large) },
+			wantEncoding: "zstd",
+			wantVary:     "Accept-Encoding",
+		}, {
+			caseName:     "gzip",
+			ctx:          func() *fasthttp.RequestCtx { return newCompressCtx("gzip", "text/plain", large) },
+			wantEncoding: "gzip",
+			wantVary:     "Accept-Encoding",
+		}, {
+			caseName: "strong etag is weakened",
+			ctx: func() *fasthttp.RequestCtx {
+				ctx := newCompressCtx("gzip", "text/plain", large)
+				ctx.Response.Header.Set(fasthttp.HeaderETag, `"v1"`)
+				return ctx
+			},
+			wantEncoding: "gzip",
+			wantVary:     "Accept-Encoding",
+			wantETag:     `W/"v1"`,
+		}, {
+			caseName: "weak etag is kept",
+			ctx: func() *fasthttp.RequestCtx {
+				ctx := newCompressCtx("gzip", "text/plain", large)
+				ctx.Response.Header.Set(fasthttp.HeaderETag, `W/"v1"`)
+				return ctx
+			},
+			wantEncoding: "gzip",
+			wantVary:     "Accept-Encoding",
+			wantETag:     `W/"v1"`,
+		}, {
+			caseName: "not accepted",
+			ctx: func() *fasthttp.RequestCtx {
+				ctx := newCompressCtx("", "text/plain", large)
+				ctx.Response.Header.Set(fasthttp.HeaderETag, `"v1"`)
+				return ctx
+			},
+			wantVary: "Accept-Encoding",
+			wantETag: `"v1"`,
+		}, {
+			caseName: "existing vary",
+			ctx: func() *fasthttp.RequestCtx {
+				ctx := newCompressCtx("gzip", "text/plain", large)
+				ctx.Response.Header.Set(fasthttp.HeaderVary, "Origin")
+				return ctx
+			},
+			wantEncoding: "gzip",
+			wantVary:     "Origin",
+		}, {
+			caseName: "too small",
+			ctx:      func() *fasthttp.RequestCtx { return newCompressCtx("gzip", "text/plain", "small") },
+		}, {
+			caseName: "not compressible",
+			ctx:      func() *fasthttp.RequestCtx { return newCompressCtx("gzip", "image/png", large) },
+		}, {
+			caseName: "already encoded",
+			ctx: func() *fasthttp.RequestCtx {
+				ctx := newCompressCtx("gzip", "text/plain", large)
+				ctx.Response.Header.SetContentEncoding("br")
+				return ctx
+			},
+			wantEncoding: "br",
+		}, {
+			caseName: "no-transform",
+			ctx: func() *fasthttp.RequestCtx {
+				ctx := newCompressCtx("gzip", "text/plain", large)
+				ctx.Response.Header.Set(fasthttp.HeaderCacheControl, "public, no-transform")
+				return ctx
+			},
+		}, {
+			caseName: "not modified",
+			ctx: func() *fasthttp.RequestCtx {
+				ctx := newCompressCtx("gzip", "text/plain", large)
+				ctx.Response.SetStatusCode(http.StatusNotModified)
+				return ctx
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.caseName, func(t *testing.T) {
+			ctx := tc.ctx()
+			preEncoding := string(ctx.Response.Header.ContentEncoding())
+			want := string(ctx.Response.Body())
+			if !f.Response(ctx) {
+				t.Fatal("Response returned false")
+			}
+			encoding := string(ctx.Response.Header.ContentEncoding())
+			if encoding != tc.wantEncoding {
+				t.Errorf("content-encoding %q; want %q", encoding, tc.wantEncoding)
+			}
+			if got := string(ctx.Response.Header.Peek(fasthttp.HeaderVary)); !strings.Contains(got, tc.wantVary) || (tc.wantVary == "" && got != "") {
+				t.Errorf("vary %q; want containing %q", got, tc.wantVary)
+			}
+			if got := string(ctx.Response.Header.Peek(fasthttp.HeaderETag)); got != tc.wantETag {
+				t.Errorf("etag %q; want %q", got, tc.wantETag)
+			}
+			body := ctx.Response.Body()
+			if preEncoding == "" {
+				body = []byte(decompress(t, encoding, body))
+			}
+			if string(body) != want {
+				t.Errorf("unexpected body %q", body)
+			}
+		})
+	}
+}
+
+func TestCompressFilter_Response_Stream(t *testing.T) {
+	f, err := NewCompressFilter(tree.Map{"encodings": tree.Array{tree.V("zstd"), tree.V("gzip")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := strings.Repeat("streamed ", 500)
+	for _, encoding := range []string{"gzip", "zstd"} {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.Set(fasthttp.HeaderAcceptEncoding, encoding+", br")
+		ctx.Response.Header.SetContentType("text/plain")
+		ctx.Response.Header.Set(fasthttp.HeaderETag, `"v1"`)
+		ctx.Response.SetBodyStream(bytes.NewReader([]byte(body)), -1)
+		if !f.Response(ctx) {
+			t.Fatal("Response returned false")
+		}
+		if got := string(ctx.Response.Header.ContentEncoding()); got != encoding {
+			t.Errorf("content-encoding %q; want %q", got, encoding)
+		}
+		if got := string(ctx.Response.Header.Peek(fasthttp.HeaderETag)); got != `W/"v1"` {
+			t.Errorf("etag %q; want %q", got, `W/"v1"`)
+		}
+		if got := string(ctx.Request.Header.Peek(fasthttp.HeaderAcceptEncoding)); got != encoding+", br" {
+			t.Errorf("accept-encoding is not restored: %q", got)
+		}
+		if got := decompress(t, encoding, ctx.Response.Body()); got != body {
+			t.Errorf("unexpected %s body %q", encoding, got)
+		}
+	}
+
+	// A stream of a type that fasthttp does not compress is left as is,
+	// without Vary.
+	bmp, err := NewCompressFilter(tree.Map{"contentTypes": tree.Array{tree.V("image/bmp")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.Set(fasthttp.HeaderAcceptEncoding, "gzip")
+	ctx.Response.Header.SetContentType("image/bmp")
+	ctx.Response.SetBodyStream(strings.NewReader(body), -1)
+	bmp.Response(ctx)
+	if got := ctx.Response.Header.ContentEncoding(); len(got) > 0 {
+		t.Errorf("bmp content-encoding %q; want none", got)
+	}
+	if got := ctx.Response.Header.Peek(fasthttp.HeaderVary); len(got) > 0 {
+		t.Errorf("bmp vary %q; want none", got)
+	}
+
+	// A stream shorter than minSize is not compressed.
+	ctx = &fasthttp.RequestCtx{}
+	ctx.Request.Header.Set(fasthttp.HeaderAcceptEncoding, "gzip")
+	ctx.Response.Header.SetContentType("text/plain")
+	ctx.Response.SetBodyStream(strings.NewReader("short"), 5)
+	f.Response(ctx)
+	if got := ctx.Response.Header.ContentEncoding(); len(got) > 0 {
+		t.Errorf("content-encoding %q; want none", got)
+	}
+}
+
+func TestCompressSchema(t *testing.T) {
+	testCases := []struct {
+		caseName string
+		filter   tree.Map
+		wantErr  string
+	}{
+		{
+			caseName: "valid",
+			filter: tree.Map{
+				"type":         tree.V("compress"),
+				"encodings":    tree.Array{tree.V("br"), tree.V("gzip")},
+				"minSize":      tree.V("2K"),
+				"contentTypes": tree.Array{tree.V("text/*")},
+			},
+		},
+		{
+			caseName: "unknown encoding",
+			filter: tree.Map{
+				"type":      tree.V("compress"),
+				"encodings": tree.Array{tree.V("deflate")},
+			},
+			wantErr: `.filters["compress"].encodings[0]`,
+		},
+		{
+			caseName: "invalid minSize",
+			filter: tree.Map{
+				"type":    tree.V("compress"),
+				"minSize": tree.V("big"),
+			},
+			wantErr: `.filters["compress"].minSize`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.caseName, func(t *testing.T) {
+			docs := []tree.Map{{"filters": tree.Map{"compress": tc.filter}}}
+			err := config.ValidateTreeMaps(docs)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("ValidateTreeMaps returned %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("ValidateTreeMaps returned nil, want error containing %q", tc.wantErr)
+			}
+			if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("error %q does not contain %q", err.Error(), tc.wantErr)
+			}
+		})
+	}
+}
+
+func BenchmarkCompressFilter_Response_Gzip(b *testing.B) {
+	f, err := NewCompressFilter(tree.Map{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	body := []byte(strings.Repeat("fasthttpd ", 200))
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.Set(fasthttp.HeaderAcceptEncoding, "gzip, deflate")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for b.Loop() {
+		ctx.Response.Reset()
+		ctx.Response.Header.SetContentType("text/html")
+		ctx.Response.SetBody(body)
+		f.Response(ctx)
+	}
+}
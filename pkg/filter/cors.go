@@ -0,0 +1,296 @@
+package filter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/mojatter/tree"
+	"github.com/mojatter/tree/schema"
+	"github.com/valyala/fasthttp"
+)
+
+// DefaultCORSAllowMethods are the methods allowed when allowMethods is
+// not set.
+var DefaultCORSAllowMethods = []string{
+	fasthttp.MethodGet,
+	fasthttp.MethodHead,
+	fasthttp.MethodPost,
+}
+
+const corsAny = "*"
+
+// CORSFilter implements the Filter that handles Cross-Origin Resource
+// Sharing. Preflight requests from allowed origins are answered with
+// 204 No Content in Request, and the Access-Control-* headers are added
+// to other responses in Response.
+type CORSFilter struct {
+	// AllowOrigins lists the allowed origins. Each origin is one of an
+	// exact origin ("https://example.com"), an origin with a leading
+	// wildcard host label ("https://*.example.com"), a regexp prefixed
+	// with "~" or "*" for any origin.
+	AllowOrigins     []string        `yaml:"allowOrigins"`
+	AllowMethods     []string        `yaml:"allowMethods"`
+	AllowHeaders     []string        `yaml:"allowHeaders"`
+	ExposeHeaders    []string        `yaml:"exposeHeaders"`
+	AllowCredentials bool            `yaml:"allowCredentials"`
+	MaxAge           config.Duration `yaml:"maxAge"`
+
+	anyOrigin bool
+	origins   map[string]struct{}
+	wildcards []corsWildcard
+	regexps   []*regexp.Regexp
+	anyHeader bool
+	headerSet map[string]struct{}
+	methods   []byte
+	headers   []byte
+	expose    []byte
+	maxAge    []byte
+}
+
+// corsWildcard matches origins such as "https://*.example.com".
+type corsWildcard struct {
+	prefix string // "https://"
+	suffix string // ".example.com"
+}
+
+var (
+	corsVaryOrigin    = []byte("Origin")
+	corsVaryPreflight = []byte("Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+	corsTrue          = []byte("true")
+	corsAnyBytes      = []byte(corsAny)
+)
+
+// NewCORSFilter returns a new CORSFilter.
+func NewCORSFilter(cfg tree.Map) (Filter, error) {
+	f := &CORSFilter{}
+	if err := tree.UnmarshalViaYAML(cfg, f); err != nil {
+		return nil, err
+	}
+	// An integer maxAge would be read in nanoseconds like the other
+	// durations, which is easily mistaken for the seconds of
+	// Access-Control-Max-Age.
+	if n := cfg.Get("maxAge"); n.Type().IsNumberValue() {
+		return nil, fmt.Errorf(`cors: maxAge must be a duration like "10m": %s`, n.Value().String())
+	}
+	if err := f.init(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *CORSFilter) init() error {
+	if len(f.AllowOrigins) == 0 {
+		return errors.New("cors: allowOrigins is required")
+	}
+	f.origins = map[string]struct{}{}
+	for _, o := range f.AllowOrigins {
+		switch {
+		case o == corsAny:
+			f.anyOrigin = true
+		case strings.HasPrefix(o, "~"):
+			re, err := regexp.Compile(o[1:])
+			if err != nil {
+				return fmt.Errorf("cors: invalid origin %q: %w", o, err)
+			}
+			f.regexps = append(f.regexps, re)
+		case strings.Contains(o, "*"):
+			prefix, suffix, _ := strings.Cut(strings.ToLower(o), "*")
+			if !strings.HasSuffix(prefix, "://") || !strings.HasPrefix(suffix, ".") || strings.Contains(suffix, "*") {
+				return fmt.Errorf("cors: invalid origin %q: only a leading wildcard host label is supported", o)
+			}
+			f.wildcards = append(f.wildcards, corsWildcard{prefix: prefix, suffix: suffix})
+		default:
+			f.origins[strings.ToLower(o)] = struct{}{}
+		}
+	}
+	if f.anyOrigin && f.AllowCredentials {
+		return errors.New(`cors: allowCredentials cannot be used with allowOrigins "*"`)
+	}
+
+	if len(f.AllowMethods) == 0 {
+		f.AllowMethods = DefaultCORSAllowMethods
+	}
+	f.methods = []byte(strings.Join(f.AllowMethods, ", "))
+	f.headerSet = map[string]struct{}{}
+	for _, h := range f.AllowHeaders {
+		if h == corsAny {
+			f.anyHeader = true
+			continue
+		}
+		f.headerSet[strings.ToLower(h)] = struct{}{}
+	}
+	if !f.anyHeader && len(f.AllowHeaders) > 0 {
+		f.headers = []byte(strings.Join(f.AllowHeaders, ", "))
+	}
+	if len(f.ExposeHeaders) > 0 {
+		f.expose = []byte(strings.Join(f.ExposeHeaders, ", "))
+	}
+	if f.MaxAge > 0 && time.Duration(f.MaxAge) < time.Second {
+		return fmt.Errorf("cors: maxAge must be at least 1s: %s", time.Duration(f.MaxAge))
+	}
+	if f.MaxAge > 0 {
+		f.maxAge = strconv.AppendInt(nil, int64(time.Duration(f.MaxAge)/time.Second), 10)
+	}
+	return nil
+}
+
+// allowOrigin reports whether origin is allowed.
+func (f *CORSFilter) allowOrigin(origin []byte) bool {
+	if f.anyOrigin {
+		return true
+	}
+	if _, ok := f.origins[string(origin)]; ok {
+		return true
+	}
+	for _, w := range f.wildcards {
+		if len(origin) > len(w.prefix)+len(w.suffix) &&
+			bytes.HasPrefix(origin, []byte(w.prefix)) &&
+			bytes.HasSuffix(origin, []byte(w.suffix)) &&
+			isCORSHostLabels(origin[len(w.prefix):len(origin)-len(w.suffix)]) {
+			return true
+		}
+	}
+	for _, re := range f.regexps {
+		if re.Match(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// isCORSHostLabels reports whether b consists of host name labels, so that
+// a wildcard cannot match a port or another host.
+func isCORSHostLabels(b []byte) bool {
+	for _, c := range b {
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// allowRequestHeaders reports whether every header in the comma-separated
+// Access-Control-Request-Headers value is allowed.
+func (f *CORSFilter) allowRequestHeaders(value []byte) bool {
+	if f.anyHeader {
+		return true
+	}
+	for len(value) > 0 {
+		var h []byte
+		if i := bytes.IndexByte(value, ','); i != -1 {
+			h, value = value[:i], value[i+1:]
+		} else {
+			h, value = value, nil
+		}
+		h = bytes.TrimSpace(h)
+		if len(h) == 0 {
+			continue
+		}
+		if _, ok := f.headerSet[strings.ToLower(string(h))]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *CORSFilter) setAllowOrigin(h *fasthttp.ResponseHeader, origin []byte) {
+	if f.anyOrigin {
+		h.SetBytesV(fasthttp.HeaderAccessControlAllowOrigin, corsAnyBytes)
+		return
+	}
+	h.SetBytesV(fasthttp.HeaderAccessControlAllowOrigin, origin)
+	if f.AllowCredentials {
+		h.SetBytesV(fasthttp.HeaderAccessControlAllowCredentials, corsTrue)
+	}
+}
+
+// Request answers preflight requests. A preflight request from an allowed
+// origin with an allowed method and headers gets 204 No Content, any other
+// preflight request gets 403 Forbidden. It returns false for every
+// preflight request and true for other requests.
+func (f *CORSFilter) Request(ctx *fasthttp.RequestCtx) bool {
+	origin := ctx.Request.Header.Peek(fasthttp.HeaderOrigin)
+	if len(origin) == 0 || !ctx.IsOptions() {
+		return true
+	}
+	method := ctx.Request.Header.Peek(fasthttp.HeaderAccessControlRequestMethod)
+	if len(method) == 0 {
+		return true
+	}
+	h := &ctx.Response.Header
+	if !f.anyOrigin {
+		h.AddBytesV(fasthttp.HeaderVary, corsVaryPreflight)
+	}
+	reqHeaders := ctx.Request.Header.Peek(fasthttp.HeaderAccessControlRequestHeaders)
+	if !f.allowOrigin(origin) ||
+		!slices.Contains(f.AllowMethods, string(method)) ||
+		!f.allowRequestHeaders(reqHeaders) {
+		ctx.Response.SetStatusCode(http.StatusForbidden)
+		return false
+	}
+	ctx.Response.SetStatusCode(http.StatusNoContent)
+	f.setAllowOrigin(h, origin)
+	h.SetBytesV(fasthttp.HeaderAccessControlAllowMethods, f.methods)
+	switch {
+	case f.anyHeader && len(reqHeaders) > 0:
+		h.SetBytesV(fasthttp.HeaderAccessControlAllowHeaders, reqHeaders)
+	case len(f.headers) > 0:
+		h.SetBytesV(fasthttp.HeaderAccessControlAllowHeaders, f.headers)
+	}
+	if len(f.maxAge) > 0 {
+		h.SetBytesV(fasthttp.HeaderAccessControlMaxAge, f.maxAge)
+	}
+	return false
+}
+
+// Response adds the Access-Control-* headers if the request origin is
+// allowed.
+func (f *CORSFilter) Response(ctx *fasthttp.RequestCtx) bool {
+	origin := ctx.Request.Header.Peek(fasthttp.HeaderOrigin)
+	if len(origin) == 0 {
+		return true
+	}
+	h := &ctx.Response.Header
+	if !f.anyOrigin {
+		h.AddBytesV(fasthttp.HeaderVary, corsVaryOrigin)
+	}
+	if !f.allowOrigin(origin) {
+		return true
+	}
+	f.setAllowOrigin(h, origin)
+	if len(f.expose) > 0 {
+		h.SetBytesV(fasthttp.HeaderAccessControlExposeHeaders, f.expose)
+	}
+	return true
+}
+
+func init() {
+	RegisterNewFilterFunc("cors", NewCORSFilter)
+	config.RegisterFilterSchema("cors", corsSchemas)
+}
+
+// corsSchemas mirrors CORSFilter's YAML-tagged fields. Origin patterns
+// are compiled by NewCORSFilter.
+var corsSchemas = schema.QueryRules{
+	".": schema.Map{KeyedRules: map[string]schema.Rule{
+		"type":             schema.String{Enum: []string{"cors"}},
+		"allowOrigins":     schema.Array{},
+		"allowMethods":     schema.Array{},
+		"allowHeaders":     schema.Array{},
+		"exposeHeaders":    schema.Array{},
+		"allowCredentials": schema.Bool{},
+		"maxAge":           config.DurationRule{},
+	}},
+	".allowOrigins[]":  schema.String{},
+	".allowMethods[]":  schema.String{},
+	".allowHeaders[]":  schema.String{},
+	".exposeHeaders[]": schema.String{},
+}
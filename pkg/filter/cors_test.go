@@ -0,0 +1,331 @@
+package filter
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/mojatter/tree"
+	"github.com/valyala/fasthttp"
+)
+
+func TestNewCORSFilter(t *testing.T) {
+	tests := []struct {
+		cfg    tree.Map
+		errstr string
+	}{
+		{
+			cfg: tree.Map{
+				"allowOrigins": tree.Array{tree.V("https://example.com"), tree.V("https://*.example.com"), tree.V(`~^https://app\d+\.example\.org$`)},
+			},
+		}, {
+			cfg:    tree.Map{},
+			errstr: "cors: allowOrigins is required",
+		}, {
+			cfg: tree.Map{
+				"allowOrigins": tree.Array{tree.V("https://app.*.example.com")},
+			},
+			errstr: `cors: invalid origin "https://app.*.example.com": only a leading wildcard host label is supported`,
+		}, {
+			cfg: tree.Map{
+				"allowOrigins": tree.Array{tree.V("~(")},
+			},
+			errstr: `cors: invalid origin "~(":`,
+		}, {
+			cfg: tree.Map{
+				"allowOrigins":     tree.Array{tree.V("*")},
+				"allowCredentials": tree.V(true),
+			},
+			errstr: `cors: allowCredentials cannot be used with allowOrigins "*"`,
+		}, {
+			cfg: tree.Map{
+				"allowOrigins": tree.Array{tree.V("*")},
+				"maxAge":       tree.V("500ms"),
+			},
+			errstr: `cors: maxAge must be at least 1s: 500ms`,
+		}, {
+			cfg: tree.Map{
+				"allowOrigins": tree.Array{tree.V("*")},
+				"maxAge":       tree.V(600),
+			},
+			errstr: `cors: maxAge must be a duration like "10m": 600`,
+		},
+	}
+	for i, test := range tests {
+		_, err := NewCORSFilter(test.cfg)
+		if test.errstr != "" {
+			if err == nil {
+				t.Fatalf("tests[%d] is no error; want %q", i, test.errstr)
+			}
+			if !strings.HasPrefix(err.Error(), test.errstr) {
+				t.Errorf("tests[%d] error %q; want %q", i, err.Error(), test.errstr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("tests[%d] error %v", i, err)
+		}
+	}
+}
+
+func TestCORSFilter_MaxAge(t *testing.T) {
+	tests := []struct {
+		maxAge tree.Node
+		want   string
+	}{
+		{maxAge: tree.V("10m"), want: "600"},
+		{maxAge: tree.V("1500ms"), want: "1"},
+	}
+	for i, test := range tests {
+		f, err := NewCORSFilter(tree.Map{
+			"allowOrigins": tree.Array{tree.V("*")},
+			"maxAge":       test.maxAge,
+		})
+		if err != nil {
+			t.Fatalf("tests[%d] error %v", i, err)
+		}
+		if got := string(f.(*CORSFilter).maxAge); got != test.want {
+			t.Errorf("tests[%d] got %q; want %q", i, got, test.want)
+		}
+	}
+}
+
+func TestCORSFilter_AllowOrigin(t *testing.T) {
+	f, err := NewCORSFilter(tree.Map{
+		"allowOrigins": tree.Array{
+			tree.V("https://Example.com"),
+			tree.V("https://*.example.com"),
+			tree.V(`~^https://app\d+\.example\.org$`),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{origin: "https://example.com", want: true},
+		{origin: "http://example.com"},
+		{origin: "https://www.example.com", want: true},
+		{origin: "https://a.b.example.com", want: true},
+		{origin: "https://.example.com"},
+		{origin: "https://evil.com:443.example.com"},
+		{origin: "https://evil-example.com"},
+		{origin: "https://app42.example.org", want: true},
+		{origin: "https://app.example.org"},
+	}
+	for _, test := range tests {
+		if got := f.(*CORSFilter).allowOrigin([]byte(test.origin)); got != test.want {
+			t.Errorf("allowOrigin(%q) = %v; want %v", test.origin, got, test.want)
+		}
+	}
+}
+
+func TestCORSFilter_Preflight(t *testing.T) {
+	f, err := NewCORSFilter(tree.Map{
+		"allowOrigins":     tree.Array{tree.V("https://example.com")},
+		"allowMethods":     tree.Array{tree.V("GET"), tree.V("PUT")},
+		"allowHeaders":     tree.Array{tree.V("Content-Type"), tree.V("Authorization")},
+		"allowCredentials": tree.V(true),
+		"maxAge":           tree.V("10m"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		method      string
+		origin      string
+		reqMethod   string
+		reqHeaders  string
+		want        bool
+		wantStatus  int
+		wantHeaders map[string]string
+	}{
+		{
+			method:     fasthttp.MethodOptions,
+			origin:     "https://example.com",
+			reqMethod:  "PUT",
+			reqHeaders: "content-type, authorization",
+			wantStatus: http.StatusNoContent,
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin":      "https://example.com",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Allow-Methods":     "GET, PUT",
+				"Access-Control-Allow-Headers":     "Content-Type, Authorization",
+				"Access-Control-Max-Age":           "600",
+				"Vary":                             "Origin, Access-Control-Request-Method, Access-Control-Request-Headers",
+			},
+		}, {
+			method:     fasthttp.MethodOptions,
+			origin:     "https://example.com",
+			reqMethod:  "DELETE",
+			wantStatus: http.StatusForbidden,
+		}, {
+			method:     fasthttp.MethodOptions,
+			origin:     "https://example.com",
+			reqMethod:  "GET",
+			reqHeaders: "X-Custom",
+			wantStatus: http.StatusForbidden,
+		}, {
+			method:     fasthttp.MethodOptions,
+			origin:     "https://evil.com",
+			reqMethod:  "GET",
+			wantStatus: http.StatusForbidden,
+		}, {
+			method:     fasthttp.MethodOptions,
+			origin:     "https://example.com",
+			want:       true,
+			wantStatus: http.StatusOK,
+		}, {
+			method:     fasthttp.MethodGet,
+			origin:     "https://example.com",
+			reqMethod:  "GET",
+			want:       true,
+			wantStatus: http.StatusOK,
+		},
+	}
+	for i, test := range tests {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod(test.method)
+		ctx.Request.Header.Set("Origin", test.origin)
+		if test.reqMethod != "" {
+			ctx.Request.Header.Set("Access-Control-Request-Method", test.reqMethod)
+		}
+		if test.reqHeaders != "" {
+			ctx.Request.Header.Set("Access-Control-Request-Headers", test.reqHeaders)
+		}
+		if got := f.Request(ctx); got != test.want {
+			t.Fatalf("tests[%d] got %v; want %v", i, got, test.want)
+		}
+		if got := ctx.Response.StatusCode(); got != test.wantStatus {
+			t.Errorf("tests[%d] status %d; want %d", i, got, test.wantStatus)
+		}
+		for k, v := range test.wantHeaders {
+			if got := string(ctx.Response.Header.Peek(k)); got != v {
+				t.Errorf("tests[%d] %s %q; want %q", i, k, got, v)
+			}
+		}
+	}
+}
+
+func TestCORSFilter_Response(t *testing.T) {
+	tests := []struct {
+		cfg         tree.Map
+		origin      string
+		wantHeaders map[string]string
+	}{
+		{
+			cfg: tree.Map{
+				"allowOrigins":  tree.Array{tree.V("https://*.example.com")},
+				"exposeHeaders": tree.Array{tree.V("X-Request-Id")},
+			},
+			origin: "https://www.example.com",
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin":      "https://www.example.com",
+				"Access-Control-Allow-Credentials": "",
+				"Access-Control-Expose-Headers":    "X-Request-Id",
+				"Vary":                             "Origin",
+			},
+		}, {
+			cfg: tree.Map{
+				"allowOrigins": tree.Array{tree.V("https://*.example.com")},
+			},
+			origin: "https://evil.com",
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin": "",
+				"Vary":                        "Origin",
+			},
+		}, {
+			cfg: tree.Map{
+				"allowOrigins": tree.Array{tree.V("*")},
+			},
+			origin: "https://evil.com",
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin": "*",
+				"Vary":                        "",
+			},
+		}, {
+			cfg: tree.Map{
+				"allowOrigins": tree.Array{tree.V("*")},
+			},
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin": "",
+			},
+		},
+	}
+	for i, test := range tests {
+		f, err := NewCORSFilter(test.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := &fasthttp.RequestCtx{}
+		if test.origin != "" {
+			ctx.Request.Header.Set("Origin", test.origin)
+		}
+		if !f.Response(ctx) {
+			t.Fatalf("tests[%d] response returns false", i)
+		}
+		for k, v := range test.wantHeaders {
+			if got := string(ctx.Response.Header.Peek(k)); got != v {
+				t.Errorf("tests[%d] %s %q; want %q", i, k, got, v)
+			}
+		}
+	}
+}
+
+func TestCORSSchema(t *testing.T) {
+	testCases := []struct {
+		caseName string
+		filter   tree.Map
+		wantErr  string
+	}{
+		{
+			caseName: "valid",
+			filter: tree.Map{
+				"type":             tree.V("cors"),
+				"allowOrigins":     tree.Array{tree.V("https://*.example.com")},
+				"allowMethods":     tree.Array{tree.V("GET")},
+				"allowHeaders":     tree.Array{tree.V("*")},
+				"exposeHeaders":    tree.Array{tree.V("X-Request-Id")},
+				"allowCredentials": tree.V(true),
+				"maxAge":           tree.V("1h"),
+			},
+		},
+		{
+			caseName: "invalid allowCredentials",
+			filter: tree.Map{
+				"type":             tree.V("cors"),
+				"allowCredentials": tree.V("yes"),
+			},
+			wantErr: `.filters["cors"].allowCredentials`,
+		},
+		{
+			caseName: "unknown top-level field",
+			filter: tree.Map{
+				"type":       tree.V("cors"),
+				"allowOrign": tree.Array{tree.V("*")},
+			},
+			wantErr: `.filters["cors"]: unknown key "allowOrign"`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.caseName, func(t *testing.T) {
+			docs := []tree.Map{{"filters": tree.Map{"cors": tc.filter}}}
+			err := config.ValidateTreeMaps(docs)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("ValidateTreeMaps returned %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("ValidateTreeMaps returned nil, want error containing %q", tc.wantErr)
+			}
+			if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("error %q does not contain %q", err.Error(), tc.wantErr)
+			}
+		})
+	}
+}
@@ -2,7 +2,9 @@ package filter
 
 import (
 	"fmt"
+	"log"
 
+	"github.com/fasthttpd/fasthttpd/pkg/logger"
 	"github.com/mojatter/tree"
 	"github.com/valyala/fasthttp"
 )
@@ -20,18 +22,39 @@ type Filter interface {
 // NewFilterFunc is a function that returns a new filter.
 type NewFilterFunc func(cfg tree.Map) (Filter, error)
 
-var typedNewFilterFunc = map[string]NewFilterFunc{}
+// NewFilterWithLoggerFunc is a function that returns a new filter which
+// logs with l.
+type NewFilterWithLoggerFunc func(cfg tree.Map, l logger.Logger) (Filter, error)
+
+var typedNewFilterFunc = map[string]NewFilterWithLoggerFunc{}
+
+// stdLogger is the logger of the filters created by NewFilter.
+var stdLogger logger.Logger = &logger.LoggerDelegator{PrintfFunc: log.Printf}
 
 // RegisterNewFilterFunc registers a NewFilterFunc with filterType.
 func RegisterNewFilterFunc(filterType string, fn NewFilterFunc) {
+	typedNewFilterFunc[filterType] = func(cfg tree.Map, _ logger.Logger) (Filter, error) {
+		return fn(cfg)
+	}
+}
+
+// RegisterNewFilterWithLoggerFunc registers a NewFilterWithLoggerFunc with
+// filterType.
+func RegisterNewFilterWithLoggerFunc(filterType string, fn NewFilterWithLoggerFunc) {
 	typedNewFilterFunc[filterType] = fn
 }
 
-// NewFilter returns a new filter.
+// NewFilter returns a new filter. Filters registered via
+// RegisterNewFilterWithLoggerFunc log with the standard logger.
 func NewFilter(cfg tree.Map) (Filter, error) {
+	return NewFilterWithLogger(cfg, stdLogger)
+}
+
+// NewFilterWithLogger returns a new filter which logs with l.
+func NewFilterWithLogger(cfg tree.Map, l logger.Logger) (Filter, error) {
 	t := cfg.Get("type").Value().String()
 	if fn, ok := typedNewFilterFunc[t]; ok {
-		return fn(cfg)
+		return fn(cfg, l)
 	}
 	return nil, fmt.Errorf("unknown filter type: %s", t)
 }
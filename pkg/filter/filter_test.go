@@ -1,9 +1,11 @@
 package filter
 
 import (
+	"reflect"
 	"strings"
 	"testing"
 
+	"github.com/fasthttpd/fasthttpd/pkg/logger"
 	"github.com/mojatter/tree"
 	"github.com/valyala/fasthttp"
 )
@@ -53,6 +55,34 @@ func TestNewFilter(t *testing.T) {
 	}
 }
 
+func TestNewFilterWithLogger(t *testing.T) {
+	var got []logger.Logger
+	RegisterNewFilterFunc("testFilter", func(cfg tree.Map) (Filter, error) {
+		got = append(got, nil)
+		return &FilterDelegator{}, nil
+	})
+	RegisterNewFilterWithLoggerFunc("testLoggerFilter", func(cfg tree.Map, l logger.Logger) (Filter, error) {
+		got = append(got, l)
+		return &FilterDelegator{}, nil
+	})
+	defer delete(typedNewFilterFunc, "testFilter")
+	defer delete(typedNewFilterFunc, "testLoggerFilter")
+
+	l := &logger.LoggerDelegator{}
+	for _, typ := range []string{"testFilter", "testLoggerFilter"} {
+		if _, err := NewFilterWithLogger(tree.Map{"type": tree.ToValue(typ)}, l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := NewFilter(tree.Map{"type": tree.ToValue("testLoggerFilter")}); err != nil {
+		t.Fatal(err)
+	}
+	want := []logger.Logger{nil, l, stdLogger}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loggers %v; want %v", got, want)
+	}
+}
+
 func TestFilterDelegator(t *testing.T) {
 	tests := []struct {
 		f        Filter
@@ -0,0 +1,282 @@
+package filter
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/fasthttpd/fasthttpd/pkg/logger"
+	"github.com/fasthttpd/fasthttpd/pkg/util"
+	"github.com/mojatter/tree"
+	"github.com/mojatter/tree/schema"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// DefaultForwardAuthTimeout is the default timeout of a subrequest to
+	// the auth service.
+	DefaultForwardAuthTimeout = 5 * time.Second
+	// DefaultForwardAuthCacheMaxKeys is the default number of results
+	// cached by a ForwardAuthFilter.
+	DefaultForwardAuthCacheMaxKeys = 10000
+
+	// forwardAuthMaxBodySize limits the body of an auth service response,
+	// which is only relayed to the client on denial.
+	forwardAuthMaxBodySize = 64 * 1024
+
+	headerXForwardedMethod = "X-Forwarded-Method"
+	headerXForwardedURI    = "X-Forwarded-Uri"
+)
+
+// DefaultForwardAuthRequestHeaders are the headers sent to the auth
+// service when requestHeaders is not set.
+var DefaultForwardAuthRequestHeaders = []string{
+	fasthttp.HeaderCookie,
+	fasthttp.HeaderAuthorization,
+}
+
+// forwardAuthNow returns the current time. Tests swap it to inject a
+// deterministic clock.
+var forwardAuthNow = time.Now
+
+// ForwardAuthFilter implements the Filter that delegates authentication to
+// an external service. Each request is sent to URL with the original
+// method and RequestHeaders, and the original URI in X-Forwarded-Uri. If
+// the service responds with 2xx, the request is passed through with
+// ResponseHeaders copied from the service response. Otherwise the status,
+// headers and body of the service response are returned to the client.
+type ForwardAuthFilter struct {
+	URL             string          `yaml:"url"`
+	RequestHeaders  []string        `yaml:"requestHeaders"`
+	ResponseHeaders []string        `yaml:"responseHeaders"`
+	Timeout         config.Duration `yaml:"timeout"`
+	// CacheTTL enables caching of successful results, keyed on the values
+	// of RequestHeaders, for the duration.
+	CacheTTL     config.Duration `yaml:"cacheTTL"`
+	CacheMaxKeys int             `yaml:"cacheMaxKeys"`
+
+	url     string
+	client  *fasthttp.HostClient
+	results util.Cache
+	l       logger.Logger
+}
+
+// forwardAuthResult is a cached successful result.
+type forwardAuthResult struct {
+	// creds are the values of RequestHeaders the result was given for.
+	creds   []byte
+	headers []forwardAuthHeader
+	expires int64
+}
+
+type forwardAuthHeader struct {
+	name  string
+	value []byte
+}
+
+// NewForwardAuthFilter returns a new ForwardAuthFilter.
+func NewForwardAuthFilter(cfg tree.Map, l logger.Logger) (Filter, error) {
+	f := &ForwardAuthFilter{l: l}
+	if err := tree.UnmarshalViaYAML(cfg, f); err != nil {
+		return nil, err
+	}
+	if err := f.init(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *ForwardAuthFilter) init() error {
+	if f.URL == "" {
+		return errors.New("forwardAuth: url is required")
+	}
+	u, err := url.Parse(f.URL)
+	if err != nil {
+		return fmt.Errorf("forwardAuth: %w", err)
+	}
+	isTLS := false
+	switch u.Scheme {
+	case "http":
+	case "https":
+		isTLS = true
+	default:
+		return fmt.Errorf("forwardAuth: unsupported url scheme: %s", f.URL)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("forwardAuth: missing host in url: %s", f.URL)
+	}
+	f.url = u.String()
+	if f.RequestHeaders == nil {
+		f.RequestHeaders = DefaultForwardAuthRequestHeaders
+	}
+	if f.Timeout <= 0 {
+		f.Timeout = config.Duration(DefaultForwardAuthTimeout)
+	}
+	f.client = &fasthttp.HostClient{
+		Addr:                     fasthttp.AddMissingPort(u.Host, isTLS),
+		IsTLS:                    isTLS,
+		NoDefaultUserAgentHeader: true,
+		MaxResponseBodySize:      forwardAuthMaxBodySize,
+	}
+	if f.CacheTTL > 0 {
+		if f.CacheMaxKeys <= 0 {
+			f.CacheMaxKeys = DefaultForwardAuthCacheMaxKeys
+		}
+		ttl := time.Duration(f.CacheTTL).Milliseconds()
+		f.results = util.NewCache(util.CacheConfig{
+			Expire:     ttl,
+			Interval:   ttl,
+			MaxEntries: f.CacheMaxKeys,
+		})
+	}
+	return nil
+}
+
+// appendCreds appends the values of RequestHeaders, each prefixed with its
+// length, and reports whether any of them is set.
+func (f *ForwardAuthFilter) appendCreds(dst []byte, ctx *fasthttp.RequestCtx) ([]byte, bool) {
+	found := false
+	for _, name := range f.RequestHeaders {
+		v := ctx.Request.Header.Peek(name)
+		found = found || len(v) > 0
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(len(v)))
+		dst = append(dst, v...)
+	}
+	return dst, found
+}
+
+// cached returns the cached result for creds if it has not expired.
+func (f *ForwardAuthFilter) cached(key util.CacheKey, creds []byte) *forwardAuthResult {
+	r, ok := f.results.Get(key).(*forwardAuthResult)
+	if !ok || r.expires <= forwardAuthNow().UnixNano() {
+		return nil
+	}
+	if subtle.ConstantTimeCompare(r.creds, creds) != 1 {
+		return nil
+	}
+	return r
+}
+
+// setHeaders replaces ResponseHeaders of the request with the ones in r,
+// so that a client cannot set them by itself.
+func (f *ForwardAuthFilter) setHeaders(ctx *fasthttp.RequestCtx, r *forwardAuthResult) {
+	for _, name := range f.ResponseHeaders {
+		ctx.Request.Header.Del(name)
+	}
+	for _, h := range r.headers {
+		ctx.Request.Header.SetBytesV(h.name, h.value)
+	}
+}
+
+// Request sends a subrequest to the auth service. It returns true if the
+// service responds with 2xx. Otherwise it relays the service response, or
+// sets 502 Bad Gateway (504 Gateway Timeout on timeout) if the service
+// cannot be reached, and returns false.
+func (f *ForwardAuthFilter) Request(ctx *fasthttp.RequestCtx) bool {
+	var key util.CacheKey
+	var creds []byte
+	cacheable := false
+	if f.results != nil {
+		var buf [256]byte
+		creds, cacheable = f.appendCreds(buf[:0], ctx)
+		if cacheable {
+			key = util.CacheKeyOf(creds)
+			if r := f.cached(key, creds); r != nil {
+				f.setHeaders(ctx, r)
+				return true
+			}
+		}
+	}
+
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer func() {
+		fasthttp.ReleaseRequest(req)
+		fasthttp.ReleaseResponse(resp)
+	}()
+	req.SetRequestURI(f.url)
+	req.Header.SetMethodBytes(ctx.Method())
+	for _, name := range f.RequestHeaders {
+		if v := ctx.Request.Header.Peek(name); len(v) > 0 {
+			req.Header.SetBytesV(name, v)
+		}
+	}
+	req.Header.SetBytesV(headerXForwardedMethod, ctx.Method())
+	req.Header.SetBytesV(headerXForwardedURI, ctx.URI().RequestURI())
+	req.Header.SetBytesV(fasthttp.HeaderXForwardedHost, ctx.Host())
+	if ctx.IsTLS() {
+		req.Header.Set(fasthttp.HeaderXForwardedProto, "https")
+	} else {
+		req.Header.Set(fasthttp.HeaderXForwardedProto, "http")
+	}
+	req.Header.Set(fasthttp.HeaderXForwardedFor, ctx.RemoteIP().String())
+
+	if err := f.client.DoTimeout(req, resp, time.Duration(f.Timeout)); err != nil {
+		f.l.Printf("forwardAuth: %s: %v", f.URL, err)
+		if errors.Is(err, fasthttp.ErrTimeout) {
+			ctx.Response.SetStatusCode(http.StatusGatewayTimeout)
+		} else {
+			ctx.Response.SetStatusCode(http.StatusBadGateway)
+		}
+		return false
+	}
+
+	if status := resp.StatusCode(); status < 200 || status >= 300 {
+		resp.Header.CopyTo(&ctx.Response.Header)
+		ctx.Response.Header.ResetConnectionClose()
+		ctx.Response.SetBody(resp.Body())
+		return false
+	}
+
+	r := &forwardAuthResult{}
+	for _, name := range f.ResponseHeaders {
+		if v := resp.Header.Peek(name); len(v) > 0 {
+			r.headers = append(r.headers, forwardAuthHeader{name: name, value: bytes.Clone(v)})
+		}
+	}
+	f.setHeaders(ctx, r)
+	if cacheable {
+		r.creds = bytes.Clone(creds)
+		r.expires = forwardAuthNow().Add(time.Duration(f.CacheTTL)).UnixNano()
+		f.results.Set(key, r)
+	}
+	return true
+}
+
+// Response does nothing and returns true.
+func (f *ForwardAuthFilter) Response(ctx *fasthttp.RequestCtx) bool {
+	return true
+}
+
+// Close closes the idle connections to the auth service.
+func (f *ForwardAuthFilter) Close() error {
+	f.client.CloseIdleConnections()
+	return nil
+}
+
+func init() {
+	RegisterNewFilterWithLoggerFunc("forwardAuth", NewForwardAuthFilter)
+	config.RegisterFilterSchema("forwardAuth", forwardAuthSchemas)
+}
+
+// forwardAuthSchemas mirrors ForwardAuthFilter's YAML-tagged fields. The
+// url is parsed by NewForwardAuthFilter.
+var forwardAuthSchemas = schema.QueryRules{
+	".": schema.Map{KeyedRules: map[string]schema.Rule{
+		"type":            schema.String{Enum: []string{"forwardAuth"}},
+		"url":             schema.String{},
+		"requestHeaders":  schema.Array{},
+		"responseHeaders": schema.Array{},
+		"timeout":         config.DurationRule{},
+		"cacheTTL":        config.DurationRule{},
+		"cacheMaxKeys":    schema.Int{Min: tree.Int64Ptr(1)},
+	}},
+	".requestHeaders[]":  schema.String{},
+	".responseHeaders[]": schema.String{},
+}
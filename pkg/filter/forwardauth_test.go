@@ -0,0 +1,307 @@
+package filter
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/fasthttpd/fasthttpd/pkg/logger"
+	"github.com/mojatter/tree"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+func TestNewForwardAuthFilter(t *testing.T) {
+	tests := []struct {
+		cfg    tree.Map
+		errstr string
+	}{
+		{
+			cfg: tree.Map{"url": tree.V("http://auth.internal/verify")},
+		}, {
+			cfg: tree.Map{
+				"url":             tree.V("https://auth.internal/verify"),
+				"requestHeaders":  tree.Array{tree.V("Cookie")},
+				"responseHeaders": tree.Array{tree.V("X-User")},
+				"timeout":         tree.V("1s"),
+				"cacheTTL":        tree.V("30s"),
+			},
+		}, {
+			cfg:    tree.Map{},
+			errstr: "forwardAuth: url is required",
+		}, {
+			cfg:    tree.Map{"url": tree.V("ftp://auth.internal/")},
+			errstr: "forwardAuth: unsupported url scheme: ftp://auth.internal/",
+		}, {
+			cfg:    tree.Map{"url": tree.V("http:///verify")},
+			errstr: "forwardAuth: missing host in url: http:///verify",
+		},
+	}
+	for i, test := range tests {
+		f, err := NewForwardAuthFilter(test.cfg, logger.NilLogger)
+		if test.errstr != "" {
+			if err == nil || err.Error() != test.errstr {
+				t.Errorf("tests[%d] error %v; want %q", i, err, test.errstr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("tests[%d] unexpected error %v", i, err)
+		}
+		f.(*ForwardAuthFilter).Close()
+	}
+}
+
+// newTestForwardAuthFilter returns a ForwardAuthFilter connected to an
+// in-memory auth service served by handler.
+func newTestForwardAuthFilter(t *testing.T, cfg tree.Map, handler fasthttp.RequestHandler) *ForwardAuthFilter {
+	t.Helper()
+	ln := fasthttputil.NewInmemoryListener()
+	go (&fasthttp.Server{Handler: handler}).Serve(ln) //nolint:errcheck
+	t.Cleanup(func() { ln.Close() })
+
+	cfg["url"] = tree.V("http://auth.internal/verify")
+	f, err := NewForwardAuthFilter(cfg, logger.NilLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ff := f.(*ForwardAuthFilter)
+	ff.client.Dial = func(string) (net.Conn, error) { return ln.Dial() }
+	t.Cleanup(func() { ff.Close() })
+	return ff
+}
+
+func newForwardAuthCtx(method, uri string, headers ...string) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	req := &fasthttp.Request{}
+	req.Header.SetMethod(method)
+	req.SetRequestURI(uri)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	ctx.Init(req, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 12345}, nil)
+	return ctx
+}
+
+func testForwardAuthHandler(ctx *fasthttp.RequestCtx) {
+	switch string(ctx.Request.Header.Cookie("session")) {
+	case "alice":
+		ctx.Response.Header.Set("X-User", "alice")
+		ctx.SetStatusCode(http.StatusOK)
+	case "":
+		ctx.Redirect("https://sso.example.com/login", http.StatusFound)
+	default:
+		ctx.Error("invalid session", http.StatusUnauthorized)
+		ctx.Response.Header.Set(fasthttp.HeaderWWWAuthenticate, `Bearer realm="sso"`)
+	}
+}
+
+func TestForwardAuthFilter_Request(t *testing.T) {
+	var got fasthttp.RequestHeader
+	f := newTestForwardAuthFilter(t, tree.Map{
+		"responseHeaders": tree.Array{tree.V("X-User")},
+	}, func(ctx *fasthttp.RequestCtx) {
+		ctx.Request.Header.CopyTo(&got)
+		testForwardAuthHandler(ctx)
+	})
+
+	ctx := newForwardAuthCtx(fasthttp.MethodPost, "http://example.com/api?q=1",
+		"Cookie", "session=alice", "X-User", "mallory", "X-Other", "secret")
+	if !f.Request(ctx) {
+		t.Fatalf("request is denied: %d", ctx.Response.StatusCode())
+	}
+	if v := string(ctx.Request.Header.Peek("X-User")); v != "alice" {
+		t.Errorf("X-User %q; want alice", v)
+	}
+	wants := map[string]string{
+		"Cookie":             "session=alice",
+		"X-Other":            "",
+		"X-Forwarded-Method": "POST",
+		"X-Forwarded-Uri":    "/api?q=1",
+		"X-Forwarded-Host":   "example.com",
+		"X-Forwarded-Proto":  "http",
+		"X-Forwarded-For":    "192.0.2.1",
+	}
+	if m := string(got.Method()); m != "POST" {
+		t.Errorf("method %q; want POST", m)
+	}
+	for name, want := range wants {
+		if v := string(got.Peek(name)); v != want {
+			t.Errorf("auth request %s %q; want %q", name, v, want)
+		}
+	}
+
+	// A header the client set must not survive if the auth service does
+	// not return it.
+	f.ResponseHeaders = append(f.ResponseHeaders, "X-Email")
+	ctx = newForwardAuthCtx(fasthttp.MethodGet, "http://example.com/", "Cookie", "session=alice", "X-Email", "mallory@example.com")
+	if !f.Request(ctx) {
+		t.Fatal("request is denied")
+	}
+	if v := ctx.Request.Header.Peek("X-Email"); v != nil {
+		t.Errorf("X-Email %q; want none", v)
+	}
+}
+
+func TestForwardAuthFilter_Request_Denied(t *testing.T) {
+	f := newTestForwardAuthFilter(t, tree.Map{}, testForwardAuthHandler)
+
+	ctx := newForwardAuthCtx(fasthttp.MethodGet, "http://example.com/")
+	if f.Request(ctx) {
+		t.Fatal("request is allowed")
+	}
+	if got := ctx.Response.StatusCode(); got != http.StatusFound {
+		t.Errorf("status %d; want %d", got, http.StatusFound)
+	}
+	if got := string(ctx.Response.Header.Peek(fasthttp.HeaderLocation)); got != "https://sso.example.com/login" {
+		t.Errorf("location %q", got)
+	}
+
+	ctx = newForwardAuthCtx(fasthttp.MethodGet, "http://example.com/", "Cookie", "session=bob")
+	if f.Request(ctx) {
+		t.Fatal("request is allowed")
+	}
+	if got := ctx.Response.StatusCode(); got != http.StatusUnauthorized {
+		t.Errorf("status %d; want %d", got, http.StatusUnauthorized)
+	}
+	if got := string(ctx.Response.Header.Peek(fasthttp.HeaderWWWAuthenticate)); got != `Bearer realm="sso"` {
+		t.Errorf("www-authenticate %q", got)
+	}
+	if got := string(ctx.Response.Body()); got != "invalid session" {
+		t.Errorf("body %q", got)
+	}
+}
+
+func TestForwardAuthFilter_Request_Unavailable(t *testing.T) {
+	f := newTestForwardAuthFilter(t, tree.Map{"timeout": tree.V("50ms")}, func(ctx *fasthttp.RequestCtx) {
+		time.Sleep(time.Second)
+	})
+	ctx := newForwardAuthCtx(fasthttp.MethodGet, "http://example.com/")
+	if f.Request(ctx) {
+		t.Fatal("request is allowed")
+	}
+	if got := ctx.Response.StatusCode(); got != http.StatusGatewayTimeout {
+		t.Errorf("status %d; want %d", got, http.StatusGatewayTimeout)
+	}
+
+	f.client.Dial = func(string) (net.Conn, error) { return nil, net.ErrClosed }
+	ctx = newForwardAuthCtx(fasthttp.MethodGet, "http://example.com/")
+	if f.Request(ctx) {
+		t.Fatal("request is allowed")
+	}
+	if got := ctx.Response.StatusCode(); got != http.StatusBadGateway {
+		t.Errorf("status %d; want %d", got, http.StatusBadGateway)
+	}
+}
+
+func TestForwardAuthFilter_Request_Cache(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	forwardAuthNow = func() time.Time { return now }
+	defer func() { forwardAuthNow = time.Now }()
+
+	var calls atomic.Int32
+	f := newTestForwardAuthFilter(t, tree.Map{
+		"responseHeaders": tree.Array{tree.V("X-User")},
+		"cacheTTL":        tree.V("10s"),
+	}, func(ctx *fasthttp.RequestCtx) {
+		calls.Add(1)
+		testForwardAuthHandler(ctx)
+	})
+
+	tests := []struct {
+		cookie    string
+		advance   time.Duration
+		want      bool
+		wantCalls int32
+	}{
+		{cookie: "session=alice", want: true, wantCalls: 1},
+		{cookie: "session=alice", want: true, wantCalls: 1},
+		{cookie: "session=alice", advance: 9 * time.Second, want: true, wantCalls: 1},
+		{cookie: "session=alice", advance: time.Second, want: true, wantCalls: 2},
+		// Denials and anonymous requests are not cached.
+		{cookie: "session=bob", wantCalls: 3},
+		{cookie: "session=bob", wantCalls: 4},
+		{wantCalls: 5},
+		{wantCalls: 6},
+	}
+	for i, test := range tests {
+		now = now.Add(test.advance)
+		var headers []string
+		if test.cookie != "" {
+			headers = []string{"Cookie", test.cookie}
+		}
+		ctx := newForwardAuthCtx(fasthttp.MethodGet, "http://example.com/", append(headers, "X-User", "mallory")...)
+		if got := f.Request(ctx); got != test.want {
+			t.Errorf("tests[%d] got %v; want %v", i, got, test.want)
+		}
+		if test.want {
+			if v := string(ctx.Request.Header.Peek("X-User")); v != "alice" {
+				t.Errorf("tests[%d] X-User %q; want alice", i, v)
+			}
+		}
+		if got := calls.Load(); got != test.wantCalls {
+			t.Errorf("tests[%d] calls %d; want %d", i, got, test.wantCalls)
+		}
+	}
+}
+
+func TestForwardAuthSchema(t *testing.T) {
+	testCases := []struct {
+		caseName string
+		filter   tree.Map
+		wantErr  string
+	}{
+		{
+			caseName: "valid",
+			filter: tree.Map{
+				"type":            tree.V("forwardAuth"),
+				"url":             tree.V("http://auth.internal/verify"),
+				"requestHeaders":  tree.Array{tree.V("Cookie"), tree.V("Authorization")},
+				"responseHeaders": tree.Array{tree.V("X-User")},
+				"timeout":         tree.V("2s"),
+				"cacheTTL":        tree.V("30s"),
+				"cacheMaxKeys":    tree.V(1000),
+			},
+		},
+		{
+			caseName: "invalid cacheTTL",
+			filter: tree.Map{
+				"type":     tree.V("forwardAuth"),
+				"url":      tree.V("http://auth.internal/verify"),
+				"cacheTTL": tree.V("later"),
+			},
+			wantErr: `.filters["sso"].cacheTTL: invalid duration "later"`,
+		},
+		{
+			caseName: "unknown top-level field",
+			filter: tree.Map{
+				"type":  tree.V("forwardAuth"),
+				"url":   tree.V("http://auth.internal/verify"),
+				"bogus": tree.V(1),
+			},
+			wantErr: `.filters["sso"]: unknown key "bogus"`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.caseName, func(t *testing.T) {
+			docs := []tree.Map{{"filters": tree.Map{"sso": tc.filter}}}
+			err := config.ValidateTreeMaps(docs)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("ValidateTreeMaps returned %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("ValidateTreeMaps returned nil, want error containing %q", tc.wantErr)
+			}
+			if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("error %q does not contain %q", err.Error(), tc.wantErr)
+			}
+		})
+	}
+}
@@ -2,8 +2,10 @@ package filter
 
 import (
 	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/fasthttpd/fasthttpd/pkg/vars"
 	"github.com/mojatter/tree"
 	"github.com/mojatter/tree/schema"
+	"github.com/valyala/bytebufferpool"
 	"github.com/valyala/fasthttp"
 )
 
@@ -16,6 +18,7 @@ func NewHeaderFilter(cfg tree.Map) (Filter, error) {
 }
 
 // HeaderFilter implements the Filter that filters headers of request and response.
+// The set and add values may contain variables such as ${request_id}.
 type HeaderFilter struct {
 	request  *headerFilter
 	response *headerFilter
@@ -23,13 +26,13 @@ type HeaderFilter struct {
 
 // Request filters ctx.Request.Header.
 func (f *HeaderFilter) Request(ctx *fasthttp.RequestCtx) bool {
-	f.request.filter(&ctx.Request.Header)
+	f.request.filter(ctx, &ctx.Request.Header)
 	return true
 }
 
 // Response filters ctx.Response.Header.
 func (f *HeaderFilter) Response(ctx *fasthttp.RequestCtx) bool {
-	f.response.filter(&ctx.Response.Header)
+	f.response.filter(ctx, &ctx.Response.Header)
 	return true
 }
 
@@ -47,11 +50,11 @@ func newHeaderHandler(cfg tree.Map) *headerFilter {
 	}
 	for k, v := range cfg.Get("set").Map() {
 		h.setKeys = append(h.setKeys, []byte(k))
-		h.setValues = append(h.setValues, []byte(v.Value().String()))
+		h.setValues = append(h.setValues, vars.Compile(v.Value().String()))
 	}
 	for k, v := range cfg.Get("add").Map() {
 		h.addKeys = append(h.addKeys, []byte(k))
-		h.addValues = append(h.addValues, []byte(v.Value().String()))
+		h.addValues = append(h.addValues, vars.Compile(v.Value().String()))
 	}
 	return h
 }
@@ -59,18 +62,32 @@ func newHeaderHandler(cfg tree.Map) *headerFilter {
 // headerFilter stores keys and values to customize the header.
 type headerFilter struct {
 	setKeys   [][]byte
-	setValues [][]byte
+	setValues []*vars.Template
 	addKeys   [][]byte
-	addValues [][]byte
+	addValues []*vars.Template
 	delKeys   [][]byte
 }
 
-func (h *headerFilter) filter(fh fasthttpHeader) {
+func (h *headerFilter) filter(ctx *fasthttp.RequestCtx, fh fasthttpHeader) {
 	for i, k := range h.setKeys {
-		fh.SetBytesKV(k, h.setValues[i])
+		if v := h.setValues[i]; v.IsStatic() {
+			fh.SetBytesKV(k, v.Static())
+		} else {
+			b := bytebufferpool.Get()
+			b.B = v.Append(b.B, ctx)
+			fh.SetBytesKV(k, b.B)
+			bytebufferpool.Put(b)
+		}
 	}
 	for i, k := range h.addKeys {
-		fh.AddBytesKV(k, h.addValues[i])
+		if v := h.addValues[i]; v.IsStatic() {
+			fh.AddBytesKV(k, v.Static())
+		} else {
+			b := bytebufferpool.Get()
+			b.B = v.Append(b.B, ctx)
+			fh.AddBytesKV(k, b.B)
+			bytebufferpool.Put(b)
+		}
 	}
 	for _, k := range h.delKeys {
 		fh.DelBytes(k)
@@ -81,6 +81,33 @@ func TestHeaderFilter(t *testing.T) {
 			want: func() *fasthttp.RequestCtx {
 				return &fasthttp.RequestCtx{}
 			},
+		}, {
+			cfg: tree.Map{
+				"request": tree.Map{
+					"set": tree.Map{
+						"X-Original-Path": tree.ToValue("${path}?${query.q}"),
+					},
+				},
+				"response": tree.Map{
+					"add": tree.Map{
+						"X-Session": tree.ToValue("sid=${cookie.sid}"),
+					},
+				},
+			},
+			got: func() *fasthttp.RequestCtx {
+				ctx := &fasthttp.RequestCtx{}
+				ctx.Request.SetRequestURI("/search?q=go")
+				ctx.Request.Header.SetCookie("sid", "abc")
+				return ctx
+			},
+			want: func() *fasthttp.RequestCtx {
+				ctx := &fasthttp.RequestCtx{}
+				ctx.Request.SetRequestURI("/search?q=go")
+				ctx.Request.Header.SetCookie("sid", "abc")
+				ctx.Request.Header.Set("X-Original-Path", "/search?go")
+				ctx.Response.Header.Add("X-Session", "sid=abc")
+				return ctx
+			},
 		},
 	}
 	for i, test := range tests {
@@ -0,0 +1,321 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"fmt"
+	"hash"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswdLine matches a "name:hash" line of an htpasswd file.
+var htpasswdLine = regexp.MustCompile(`^[^\s#:-][^\s:]*:\S+$`)
+
+// isHtpasswd reports whether bin looks like an htpasswd file rather than
+// YAML, i.e. every line other than blank lines and comments is
+// "name:hash".
+func isHtpasswd(bin []byte) bool {
+	found := false
+	s := bufio.NewScanner(bytes.NewReader(bin))
+	for s.Scan() {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		if !htpasswdLine.Match(line) {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// parseHtpasswd parses the "name:hash" lines of an htpasswd file.
+func parseHtpasswd(name string, bin []byte) ([]*BasicAuthUser, error) {
+	var users []*BasicAuthUser
+	s := bufio.NewScanner(bytes.NewReader(bin))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		user, secretHash, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: invalid htpasswd line", name, n)
+		}
+		users = append(users, &BasicAuthUser{Name: user, SecretHash: secretHash})
+	}
+	return users, s.Err()
+}
+
+// newSecretVerifier returns a function that reports whether a password
+// matches secretHash. bcrypt ($2a$, $2b$, $2y$), SHA-256-crypt ($5$),
+// SHA-512-crypt ($6$), MD5-crypt ($1$) and Apache APR1 ($apr1$) hashes
+// are supported.
+func newSecretVerifier(secretHash string) (func(password []byte) bool, error) {
+	switch {
+	case strings.HasPrefix(secretHash, "$2a$"),
+		strings.HasPrefix(secretHash, "$2b$"),
+		strings.HasPrefix(secretHash, "$2y$"):
+		h := []byte(secretHash)
+		if _, err := bcrypt.Cost(h); err != nil {
+			return nil, err
+		}
+		return func(password []byte) bool {
+			return bcrypt.CompareHashAndPassword(h, password) == nil
+		}, nil
+	case strings.HasPrefix(secretHash, "$5$"):
+		return newSHACryptVerifier(secretHash, "$5$", sha256.New, sha256CryptOrder)
+	case strings.HasPrefix(secretHash, "$6$"):
+		return newSHACryptVerifier(secretHash, "$6$", sha512.New, sha512CryptOrder)
+	case strings.HasPrefix(secretHash, "$1$"):
+		return newMD5CryptVerifier(secretHash, "$1$")
+	case strings.HasPrefix(secretHash, "$apr1$"):
+		return newMD5CryptVerifier(secretHash, "$apr1$")
+	}
+	return nil, fmt.Errorf("unsupported secret hash: %q", truncateSecretHash(secretHash))
+}
+
+// truncateSecretHash returns the prefix of secretHash that is safe to
+// show in an error.
+func truncateSecretHash(secretHash string) string {
+	if len(secretHash) > 6 {
+		return secretHash[:6] + "..."
+	}
+	return secretHash
+}
+
+// cryptConstantTimeEqual compares an encoded hash in constant time.
+func cryptConstantTimeEqual(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
+
+const cryptItoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// appendCrypt64 appends n characters encoding the 24-bit value b2 b1 b0
+// in the crypt(3) base64 variant.
+func appendCrypt64(dst []byte, b2, b1, b0 byte, n int) []byte {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for ; n > 0; n-- {
+		dst = append(dst, cryptItoa64[w&0x3f])
+		w >>= 6
+	}
+	return dst
+}
+
+// appendCryptDigest encodes digest in groups of three bytes given by
+// order. The last group may be shorter and is encoded with fewer
+// characters, so its unused indexes are -1.
+func appendCryptDigest(dst, digest []byte, order [][3]int) []byte {
+	at := func(i int) byte {
+		if i < 0 {
+			return 0
+		}
+		return digest[i]
+	}
+	for _, g := range order {
+		n := 4
+		switch {
+		case g[1] < 0:
+			n = 2
+		case g[0] < 0:
+			n = 3
+		}
+		dst = appendCrypt64(dst, at(g[0]), at(g[1]), at(g[2]), n)
+	}
+	return dst
+}
+
+var (
+	sha256CryptOrder = [][3]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+		{-1, 31, 30},
+	}
+	sha512CryptOrder = [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41}, {-1, -1, 63},
+	}
+	md5CryptOrder = [][3]int{
+		{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5},
+		{-1, -1, 11},
+	}
+)
+
+const (
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	shaCryptMaxRounds     = 999999999
+	shaCryptMaxSalt       = 16
+	md5CryptMaxSalt       = 8
+)
+
+// newSHACryptVerifier parses "$5$[rounds=N$]salt$hash" or the "$6$"
+// equivalent as specified by Ulrich Drepper's SHA-crypt.
+func newSHACryptVerifier(secretHash, magic string, newHash func() hash.Hash, order [][3]int) (func([]byte) bool, error) {
+	rest := secretHash[len(magic):]
+	rounds := shaCryptDefaultRounds
+	if v, ok := strings.CutPrefix(rest, "rounds="); ok {
+		n, r, ok := strings.Cut(v, "$")
+		if !ok {
+			return nil, fmt.Errorf("invalid %s hash", magic)
+		}
+		var err error
+		if rounds, err = strconv.Atoi(n); err != nil {
+			return nil, fmt.Errorf("invalid %s hash: %w", magic, err)
+		}
+		rounds = min(max(rounds, shaCryptMinRounds), shaCryptMaxRounds)
+		rest = r
+	}
+	salt, want, ok := strings.Cut(rest, "$")
+	if !ok || len(salt) > shaCryptMaxSalt {
+		return nil, fmt.Errorf("invalid %s hash", magic)
+	}
+	s, w := []byte(salt), []byte(want)
+	return func(password []byte) bool {
+		digest := shaCrypt(newHash, password, s, rounds)
+		return cryptConstantTimeEqual(appendCryptDigest(nil, digest, order), w)
+	}, nil
+}
+
+// shaCrypt returns the SHA-crypt digest of password.
+func shaCrypt(newHash func() hash.Hash, password, salt []byte, rounds int) []byte {
+	h := newHash()
+	size := h.Size()
+
+	h.Write(password)
+	h.Write(salt)
+	h.Write(password)
+	b := h.Sum(nil)
+
+	h.Reset()
+	h.Write(password)
+	h.Write(salt)
+	for i := len(password); i > 0; i -= size {
+		h.Write(b[:min(i, size)])
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(password)
+		}
+	}
+	a := h.Sum(nil)
+
+	h.Reset()
+	for range password {
+		h.Write(password)
+	}
+	p := repeatDigest(h.Sum(nil), len(password))
+
+	h.Reset()
+	for i := 0; i < 16+int(a[0]); i++ {
+		h.Write(salt)
+	}
+	s := repeatDigest(h.Sum(nil), len(salt))
+
+	c := a
+	for i := 0; i < rounds; i++ {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(c[:0])
+	}
+	return c
+}
+
+// repeatDigest returns n bytes of digest repeated.
+func repeatDigest(digest []byte, n int) []byte {
+	dst := make([]byte, 0, n)
+	for len(dst) < n {
+		dst = append(dst, digest[:min(len(digest), n-len(dst))]...)
+	}
+	return dst
+}
+
+// newMD5CryptVerifier parses "$1$salt$hash" or Apache's "$apr1$salt$hash",
+// which differ only in the magic.
+func newMD5CryptVerifier(secretHash, magic string) (func([]byte) bool, error) {
+	salt, want, ok := strings.Cut(secretHash[len(magic):], "$")
+	if !ok || len(salt) > md5CryptMaxSalt {
+		return nil, fmt.Errorf("invalid %s hash", magic)
+	}
+	m, s, w := []byte(magic), []byte(salt), []byte(want)
+	return func(password []byte) bool {
+		digest := md5Crypt(password, m, s)
+		return cryptConstantTimeEqual(appendCryptDigest(nil, digest, md5CryptOrder), w)
+	}, nil
+}
+
+// md5Crypt returns the MD5-crypt digest of password.
+func md5Crypt(password, magic, salt []byte) []byte {
+	h := md5.New()
+	h.Write(password)
+	h.Write(salt)
+	h.Write(password)
+	alt := h.Sum(nil)
+
+	h.Reset()
+	h.Write(password)
+	h.Write(magic)
+	h.Write(salt)
+	for i := len(password); i > 0; i -= md5.Size {
+		h.Write(alt[:min(i, md5.Size)])
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(password[:1])
+		}
+	}
+	final := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(password)
+		} else {
+			h.Write(final)
+		}
+		if i%3 != 0 {
+			h.Write(salt)
+		}
+		if i%7 != 0 {
+			h.Write(password)
+		}
+		if i&1 != 0 {
+			h.Write(final)
+		} else {
+			h.Write(password)
+		}
+		final = h.Sum(final[:0])
+	}
+	return final
+}
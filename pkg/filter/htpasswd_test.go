@@ -0,0 +1,79 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestNewSecretVerifier(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Generated with `openssl passwd`.
+	tests := []struct {
+		secretHash string
+		password   string
+	}{
+		{secretHash: string(bcryptHash), password: "secret"},
+		{secretHash: "$2y$" + string(bcryptHash[4:]), password: "secret"},
+		{secretHash: "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5", password: "Hello world!"},
+		{secretHash: "$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA", password: "Hello world!"},
+		{secretHash: "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", password: "Hello world!"},
+		{secretHash: "$6$rounds=1000$toolongsaltstrin$SDtZ.h1qRkJ/WoaBYK0veHS7pUmDpfan7wIAnvoE6x1ZDolhqQWun0M5i8JHDl5i6P/SVra9/GnmyXfWZ3wsK1", password: "secret"},
+		{secretHash: "$1$abcdefgh$cHJi5PXp/ki/ktXzqlk6I1", password: "secret"},
+		{secretHash: "$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/", password: "myPassword"},
+		{secretHash: "$apr1$x$tMwYqBfQwi3FYAr0aJc8M/", password: ""},
+	}
+	for _, test := range tests {
+		verify, err := newSecretVerifier(test.secretHash)
+		if err != nil {
+			t.Fatalf("%s: %v", test.secretHash, err)
+		}
+		if !verify([]byte(test.password)) {
+			t.Errorf("%s does not verify %q", test.secretHash, test.password)
+		}
+		if verify([]byte(test.password + "x")) {
+			t.Errorf("%s verifies a wrong password", test.secretHash)
+		}
+	}
+}
+
+func TestNewSecretVerifier_Error(t *testing.T) {
+	tests := []struct {
+		secretHash string
+		errstr     string
+	}{
+		{secretHash: "plain", errstr: `unsupported secret hash: "plain"`},
+		{secretHash: "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", errstr: `unsupported secret hash: "{SHA}W..."`},
+		{secretHash: "$2y$broken", errstr: "crypto/bcrypt:"},
+		{secretHash: "$5$nohash", errstr: "invalid $5$ hash"},
+		{secretHash: "$6$rounds=x$salt$hash", errstr: "invalid $6$ hash:"},
+		{secretHash: "$apr1$toolongsalt$hash", errstr: "invalid $apr1$ hash"},
+	}
+	for _, test := range tests {
+		_, err := newSecretVerifier(test.secretHash)
+		if err == nil || !strings.HasPrefix(err.Error(), test.errstr) {
+			t.Errorf("%s: error %v; want %q", test.secretHash, err, test.errstr)
+		}
+	}
+}
+
+func TestIsHtpasswd(t *testing.T) {
+	tests := []struct {
+		content string
+		want    bool
+	}{
+		{content: "# users\nuser01:$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/\n\nuser02:$2y$05$abc\n", want: true},
+		{content: "- name: user01\n  secret: secret01\n"},
+		{content: "name: user01\n"},
+		{content: "# empty\n"},
+	}
+	for i, test := range tests {
+		if got := isHtpasswd([]byte(test.content)); got != test.want {
+			t.Errorf("tests[%d] got %v; want %v", i, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/fasthttpd/fasthttpd/pkg/logger"
+	"github.com/fasthttpd/fasthttpd/pkg/util"
+	"github.com/mojatter/tree"
+	"github.com/mojatter/tree/schema"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// DefaultIPAccessReloadInterval is the default interval to check
+	// whether the rules file has changed.
+	DefaultIPAccessReloadInterval = 5 * time.Second
+	// DefaultRealIPHeader is the default header the client address is
+	// derived from when the peer is a trusted proxy.
+	DefaultRealIPHeader = fasthttp.HeaderXForwardedFor
+
+	ipAccessAllow = "allow"
+	ipAccessDeny  = "deny"
+)
+
+// IPAccessRule represents an allow or deny rule. Either Allow or Deny is
+// set to a CIDR, an IP address or "all".
+type IPAccessRule struct {
+	Allow string `yaml:"allow"`
+	Deny  string `yaml:"deny"`
+}
+
+// IPAccessFilter implements the Filter that allows or denies requests by
+// the client address. Rules are evaluated in order, the inline Rules
+// before the ones in RulesFile, and the first matching rule wins. A
+// request that matches no rule is allowed.
+type IPAccessFilter struct {
+	Rules []IPAccessRule `yaml:"rules"`
+	// RulesFile is a file with one "allow <prefix>" or "deny <prefix>"
+	// rule per line. It is reloaded when it changes.
+	RulesFile      string          `yaml:"rulesFile"`
+	ReloadInterval config.Duration `yaml:"reloadInterval"`
+	// TrustedProxies lists the peers whose RealIPHeader is used to derive
+	// the client address.
+	TrustedProxies []string `yaml:"trustedProxies"`
+	RealIPHeader   string   `yaml:"realIPHeader"`
+
+	inlineRules []ipAccessRule
+	rules       atomic.Pointer[[]ipAccessRule]
+	trusted     util.IPPrefixes
+	forwarded   bool
+
+	fileModTime time.Time
+	fileSize    int64
+	done        chan struct{}
+	closeOnce   sync.Once
+	wg          sync.WaitGroup
+	l           logger.Logger
+}
+
+type ipAccessRule struct {
+	allow    bool
+	prefixes util.IPPrefixes
+}
+
+// NewIPAccessFilter returns a new IPAccessFilter.
+func NewIPAccessFilter(cfg tree.Map, l logger.Logger) (Filter, error) {
+	f := &IPAccessFilter{l: l}
+	if err := tree.UnmarshalViaYAML(cfg, f); err != nil {
+		return nil, err
+	}
+	if err := f.init(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *IPAccessFilter) init() error {
+	for i, r := range f.Rules {
+		var rule ipAccessRule
+		var err error
+		switch {
+		case r.Allow != "" && r.Deny != "":
+			return fmt.Errorf("ipAccess: rules[%d]: both allow and deny are set", i)
+		case r.Allow != "":
+			rule, err = newIPAccessRule(ipAccessAllow, r.Allow)
+		case r.Deny != "":
+			rule, err = newIPAccessRule(ipAccessDeny, r.Deny)
+		default:
+			return fmt.Errorf("ipAccess: rules[%d]: allow or deny is required", i)
+		}
+		if err != nil {
+			return fmt.Errorf("ipAccess: rules[%d]: %w", i, err)
+		}
+		f.inlineRules = append(f.inlineRules, rule)
+	}
+	f.rules.Store(&f.inlineRules)
+
+	trusted, err := util.ParseIPPrefixes(f.TrustedProxies...)
+	if err != nil {
+		return fmt.Errorf("ipAccess: trustedProxies: %w", err)
+	}
+	f.trusted = trusted
+	if f.RealIPHeader == "" {
+		f.RealIPHeader = DefaultRealIPHeader
+	}
+	f.forwarded = strings.EqualFold(f.RealIPHeader, fasthttp.HeaderForwarded)
+
+	if f.RulesFile == "" {
+		return nil
+	}
+	if _, err := f.reload(); err != nil {
+		return err
+	}
+	if f.ReloadInterval <= 0 {
+		f.ReloadInterval = config.Duration(DefaultIPAccessReloadInterval)
+	}
+	f.done = make(chan struct{})
+	f.wg.Add(1)
+	go f.watch()
+	return nil
+}
+
+func newIPAccessRule(action, prefixes string) (ipAccessRule, error) {
+	ps, err := util.ParseIPPrefixes(prefixes)
+	if err != nil {
+		return ipAccessRule{}, err
+	}
+	return ipAccessRule{allow: action == ipAccessAllow, prefixes: ps}, nil
+}
+
+// watch reloads RulesFile every ReloadInterval until Close is called.
+func (f *IPAccessFilter) watch() {
+	defer f.wg.Done()
+	t := time.NewTicker(time.Duration(f.ReloadInterval))
+	defer t.Stop()
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-t.C:
+			if ok, err := f.reload(); err != nil {
+				f.l.Printf("ipAccess: keep the current rules: %v", err)
+			} else if ok {
+				f.l.Printf("ipAccess: reloaded %s", f.RulesFile)
+			}
+		}
+	}
+}
+
+// reload loads RulesFile if it has changed since the last load and
+// reports whether the rules were replaced.
+func (f *IPAccessFilter) reload() (bool, error) {
+	fi, err := os.Stat(f.RulesFile)
+	if err != nil {
+		return false, err
+	}
+	if fi.ModTime().Equal(f.fileModTime) && fi.Size() == f.fileSize {
+		return false, nil
+	}
+	// Remember the file even if it is invalid so that the error is
+	// reported once rather than on every check.
+	f.fileModTime, f.fileSize = fi.ModTime(), fi.Size()
+	fileRules, err := readIPAccessRules(f.RulesFile)
+	if err != nil {
+		return false, err
+	}
+	rules := append(append([]ipAccessRule{}, f.inlineRules...), fileRules...)
+	f.rules.Store(&rules)
+	return true, nil
+}
+
+// readIPAccessRules reads rules from name. Blank lines and lines starting
+// with '#' are ignored.
+func readIPAccessRules(name string) ([]ipAccessRule, error) {
+	bin, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var rules []ipAccessRule
+	s := bufio.NewScanner(bytes.NewReader(bin))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		action, prefixes, _ := strings.Cut(line, " ")
+		if action != ipAccessAllow && action != ipAccessDeny {
+			return nil, fmt.Errorf("ipAccess: %s:%d: unknown action %q", name, n, action)
+		}
+		rule, err := newIPAccessRule(action, prefixes)
+		if err != nil {
+			return nil, fmt.Errorf("ipAccess: %s:%d: %w", name, n, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, s.Err()
+}
+
+// clientAddr returns the client address of ctx, derived from
+// RealIPHeader if the peer is a trusted proxy.
+func (f *IPAccessFilter) clientAddr(ctx *fasthttp.RequestCtx) netip.Addr {
+	peer := util.AddrFromIP(ctx.RemoteIP())
+	if len(f.trusted) == 0 {
+		return peer
+	}
+	return util.ClientAddr(peer, ctx.Request.Header.PeekAll(f.RealIPHeader), f.forwarded, f.trusted)
+}
+
+// Request evaluates the rules against the client address. If the address
+// is denied, it sets 403 Forbidden and returns false.
+func (f *IPAccessFilter) Request(ctx *fasthttp.RequestCtx) bool {
+	addr := f.clientAddr(ctx)
+	for _, r := range *f.rules.Load() {
+		if r.prefixes.Contains(addr) {
+			if r.allow {
+				return true
+			}
+			ctx.Response.SetStatusCode(http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+// Response does nothing and returns true.
+func (f *IPAccessFilter) Response(ctx *fasthttp.RequestCtx) bool {
+	return true
+}
+
+// Close stops reloading RulesFile.
+func (f *IPAccessFilter) Close() error {
+	if f.done != nil {
+		f.closeOnce.Do(func() { close(f.done) })
+		f.wg.Wait()
+	}
+	return nil
+}
+
+func init() {
+	RegisterNewFilterWithLoggerFunc("ipAccess", NewIPAccessFilter)
+	config.RegisterFilterSchema("ipAccess", ipAccessSchemas)
+}
+
+// ipAccessSchemas mirrors IPAccessFilter's YAML-tagged fields. Prefixes
+// are parsed by NewIPAccessFilter.
+var ipAccessSchemas = schema.QueryRules{
+	".": schema.Map{KeyedRules: map[string]schema.Rule{
+		"type":      schema.String{Enum: []string{"ipAccess"}},
+		"rulesFile": schema.String{},
+		"rules": schema.Every{Rules: schema.QueryRules{
+			".": schema.Map{KeyedRules: map[string]schema.Rule{
+				"allow": schema.String{},
+				"deny":  schema.String{},
+			}},
+		}},
+		"reloadInterval": config.DurationRule{},
+		"trustedProxies": schema.Array{},
+		"realIPHeader":   schema.String{},
+	}},
+	".trustedProxies[]": schema.String{},
+}
@@ -0,0 +1,276 @@
+package filter
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/fasthttpd/fasthttpd/pkg/logger"
+	"github.com/mojatter/tree"
+	"github.com/valyala/fasthttp"
+)
+
+func newIPAccessCtx(peer string, headers ...string) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.ParseIP(peer), Port: 12345}, nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		ctx.Request.Header.Add(headers[i], headers[i+1])
+	}
+	return ctx
+}
+
+func TestNewIPAccessFilter(t *testing.T) {
+	tests := []struct {
+		cfg    tree.Map
+		errstr string
+	}{
+		{
+			cfg: tree.Map{
+				"rules": tree.Array{
+					tree.Map{"allow": tree.V("10.0.0.0/8")},
+					tree.Map{"deny": tree.V("all")},
+				},
+			},
+		}, {
+			cfg: tree.Map{
+				"rules": tree.Array{
+					tree.Map{"allow": tree.V("10.0.0.0/8"), "deny": tree.V("all")},
+				},
+			},
+			errstr: "ipAccess: rules[0]: both allow and deny are set",
+		}, {
+			cfg: tree.Map{
+				"rules": tree.Array{tree.Map{}},
+			},
+			errstr: "ipAccess: rules[0]: allow or deny is required",
+		}, {
+			cfg: tree.Map{
+				"rules": tree.Array{tree.Map{"deny": tree.V("10.0.0.0/33")}},
+			},
+			errstr: `ipAccess: rules[0]: invalid ip prefix "10.0.0.0/33"`,
+		}, {
+			cfg: tree.Map{
+				"trustedProxies": tree.Array{tree.V("lb.local")},
+			},
+			errstr: `ipAccess: trustedProxies: invalid ip prefix "lb.local"`,
+		}, {
+			cfg: tree.Map{
+				"rulesFile": tree.V("not-found.txt"),
+			},
+			errstr: "stat not-found.txt: no such file or directory",
+		},
+	}
+	for i, test := range tests {
+		f, err := NewIPAccessFilter(test.cfg, logger.NilLogger)
+		if test.errstr != "" {
+			if err == nil {
+				t.Fatalf("tests[%d] is no error; want %q", i, test.errstr)
+			}
+			if !strings.HasPrefix(err.Error(), test.errstr) {
+				t.Errorf("tests[%d] error %q; want %q", i, err.Error(), test.errstr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("tests[%d] error %v", i, err)
+		}
+		_ = f.(*IPAccessFilter).Close()
+	}
+}
+
+func TestIPAccessFilter_Request(t *testing.T) {
+	f, err := NewIPAccessFilter(tree.Map{
+		"rules": tree.Array{
+			tree.Map{"deny": tree.V("192.168.1.1")},
+			tree.Map{"allow": tree.V("192.168.0.0/16")},
+			tree.Map{"allow": tree.V("2001:db8::/32")},
+			tree.Map{"deny": tree.V("all")},
+		},
+		"trustedProxies": tree.Array{tree.V("10.0.0.0/8")},
+	}, logger.NilLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		peer    string
+		headers []string
+		want    bool
+	}{
+		{peer: "192.168.0.1", want: true},
+		{peer: "192.168.1.1", want: false},
+		{peer: "::ffff:192.168.0.1", want: true},
+		{peer: "2001:db8::1", want: true},
+		{peer: "203.0.113.1", want: false},
+		{peer: "10.0.0.1", want: false},
+		{peer: "10.0.0.1", headers: []string{"X-Forwarded-For", "192.168.0.1"}, want: true},
+		{peer: "10.0.0.1", headers: []string{"X-Forwarded-For", "192.168.0.1, 203.0.113.1"}, want: false},
+		{peer: "10.0.0.1", headers: []string{"X-Forwarded-For", "203.0.113.1, 192.168.0.1, 10.0.0.2"}, want: true},
+		{peer: "203.0.113.1", headers: []string{"X-Forwarded-For", "192.168.0.1"}, want: false},
+	}
+	for i, test := range tests {
+		ctx := newIPAccessCtx(test.peer, test.headers...)
+		if got := f.Request(ctx); got != test.want {
+			t.Errorf("tests[%d] got %v; want %v", i, got, test.want)
+			continue
+		}
+		if !test.want && ctx.Response.StatusCode() != http.StatusForbidden {
+			t.Errorf("tests[%d] status %d; want %d", i, ctx.Response.StatusCode(), http.StatusForbidden)
+		}
+	}
+}
+
+func TestIPAccessFilter_Forwarded(t *testing.T) {
+	f, err := NewIPAccessFilter(tree.Map{
+		"rules":          tree.Array{tree.Map{"deny": tree.V("203.0.113.0/24")}},
+		"trustedProxies": tree.Array{tree.V("10.0.0.1")},
+		"realIPHeader":   tree.V("Forwarded"),
+	}, logger.NilLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Request(newIPAccessCtx("10.0.0.1", "Forwarded", `for="203.0.113.7:4711";proto=https`)) {
+		t.Error("client in Forwarded is not denied")
+	}
+	if !f.Request(newIPAccessCtx("10.0.0.1", "X-Forwarded-For", "203.0.113.7")) {
+		t.Error("X-Forwarded-For is used instead of Forwarded")
+	}
+}
+
+// writeRulesFile replaces name atomically so that the filter never reads a
+// partially written file.
+func writeRulesFile(t *testing.T, name, content string) {
+	t.Helper()
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIPAccessFilter_RulesFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "rules.txt")
+	writeRulesFile(t, name, "# office\nallow 192.168.0.0/16\n\ndeny all\n")
+	f, err := NewIPAccessFilter(tree.Map{
+		"rules":          tree.Array{tree.Map{"deny": tree.V("192.168.1.1")}},
+		"rulesFile":      tree.V(name),
+		"reloadInterval": tree.V("10ms"),
+	}, logger.NilLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.(*IPAccessFilter).Close()
+
+	for peer, want := range map[string]bool{
+		"192.168.1.1": false,
+		"192.168.0.1": true,
+		"203.0.113.1": false,
+	} {
+		if got := f.Request(newIPAccessCtx(peer)); got != want {
+			t.Errorf("%s got %v; want %v", peer, got, want)
+		}
+	}
+
+	// An invalid file keeps the current rules.
+	writeRulesFile(t, name, "permit all\n")
+	time.Sleep(50 * time.Millisecond)
+	if f.Request(newIPAccessCtx("203.0.113.1")) {
+		t.Fatal("rules are replaced by an invalid file")
+	}
+
+	writeRulesFile(t, name, "allow 203.0.113.0/24\ndeny all\n")
+	deadline := time.Now().Add(5 * time.Second)
+	for !f.Request(newIPAccessCtx("203.0.113.1")) {
+		if time.Now().After(deadline) {
+			t.Fatal("rules file is not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if f.Request(newIPAccessCtx("192.168.0.1")) {
+		t.Error("old rules remain after reload")
+	}
+}
+
+func TestReadIPAccessRules_Error(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		content string
+		errstr  string
+	}{
+		{content: "allow 10.0.0.0/8\npermit all\n", errstr: `rules.txt:2: unknown action "permit"`},
+		{content: "deny 10.0.0.0/33\n", errstr: `rules.txt:1: invalid ip prefix "10.0.0.0/33"`},
+	}
+	for i, test := range tests {
+		name := filepath.Join(dir, "rules.txt")
+		if err := os.WriteFile(name, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := readIPAccessRules(name)
+		if err == nil || !strings.Contains(err.Error(), test.errstr) {
+			t.Errorf("tests[%d] error %v; want %q", i, err, test.errstr)
+		}
+	}
+}
+
+func TestIPAccessSchema(t *testing.T) {
+	testCases := []struct {
+		caseName string
+		filter   tree.Map
+		wantErr  string
+	}{
+		{
+			caseName: "valid",
+			filter: tree.Map{
+				"type": tree.V("ipAccess"),
+				"rules": tree.Array{
+					tree.Map{"allow": tree.V("10.0.0.0/8")},
+					tree.Map{"deny": tree.V("all")},
+				},
+				"rulesFile":      tree.V("./ip-rules.txt"),
+				"reloadInterval": tree.V("10s"),
+				"trustedProxies": tree.Array{tree.V("10.0.0.1")},
+				"realIPHeader":   tree.V("Forwarded"),
+			},
+		},
+		{
+			caseName: "unknown rule field",
+			filter: tree.Map{
+				"type":  tree.V("ipAccess"),
+				"rules": tree.Array{tree.Map{"permit": tree.V("all")}},
+			},
+			wantErr: `.filters["ip"].rules[0]: unknown key "permit"`,
+		},
+		{
+			caseName: "invalid reloadInterval",
+			filter: tree.Map{
+				"type":           tree.V("ipAccess"),
+				"reloadInterval": tree.V("often"),
+			},
+			wantErr: `.filters["ip"].reloadInterval: invalid duration "often"`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.caseName, func(t *testing.T) {
+			docs := []tree.Map{{"filters": tree.Map{"ip": tc.filter}}}
+			err := config.ValidateTreeMaps(docs)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("ValidateTreeMaps returned %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("ValidateTreeMaps returned nil, want error containing %q", tc.wantErr)
+			}
+			if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("error %q does not contain %q", err.Error(), tc.wantErr)
+			}
+		})
+	}
+}
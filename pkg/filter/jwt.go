@@ -0,0 +1,540 @@
+package filter
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/mojatter/tree"
+	"github.com/mojatter/tree/schema"
+	"github.com/valyala/fasthttp"
+)
+
+// JWT signing algorithms supported by JWTFilter.
+const (
+	JWTAlgHS256 = "HS256"
+	JWTAlgRS256 = "RS256"
+	JWTAlgES256 = "ES256"
+	JWTAlgEdDSA = "EdDSA"
+)
+
+// DefaultJWTUsernameClaim is the claim set as the URI username by default.
+const DefaultJWTUsernameClaim = "sub"
+
+// jwtNow returns the current time. Tests swap it to inject a
+// deterministic clock.
+var jwtNow = time.Now
+
+// JWTKey represents a verification key. Either Secret (HS256) or File (a
+// PEM encoded RSA, ECDSA P-256 or Ed25519 public key or certificate) is
+// set. Kid, if set, must match the "kid" header of tokens.
+type JWTKey struct {
+	Kid    string `yaml:"kid"`
+	Secret string `yaml:"secret"`
+	File   string `yaml:"file"`
+}
+
+// JWTFilter implements the Filter that authenticates requests with
+// "Authorization: Bearer" JSON Web Tokens. The algorithm of a key is
+// determined by its type, and tokens signed with any other algorithm are
+// rejected.
+type JWTFilter struct {
+	Realm    string   `yaml:"realm"`
+	Keys     []JWTKey `yaml:"keys"`
+	JWKSFile string   `yaml:"jwksFile"`
+	Issuer   string   `yaml:"issuer"`
+	// Audience lists the accepted "aud" values. A token is accepted if it
+	// has any of them.
+	Audience []string        `yaml:"audience"`
+	Leeway   config.Duration `yaml:"leeway"`
+	// UsernameClaim is the claim set as the URI username, like
+	// BasicAuthFilter does, so that the access log records it.
+	UsernameClaim string `yaml:"usernameClaim"`
+	// ClaimHeaders maps claims to request headers set for the handler.
+	// The headers are removed from incoming requests in any case.
+	ClaimHeaders map[string]string `yaml:"claimHeaders"`
+
+	keys         []jwtKey
+	challenge    []byte
+	claimHeaders []jwtClaimHeader
+}
+
+type jwtKey struct {
+	kid string
+	alg string
+	key any
+}
+
+type jwtClaimHeader struct {
+	claim  string
+	header string
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtClaims holds the registered claims checked by JWTFilter. Other
+// claims are read from the raw map.
+type jwtClaims struct {
+	Iss string          `json:"iss"`
+	Aud json.RawMessage `json:"aud"`
+	Exp *json.Number    `json:"exp"`
+	Nbf *json.Number    `json:"nbf"`
+}
+
+// NewJWTFilter returns a new JWTFilter.
+func NewJWTFilter(cfg tree.Map) (Filter, error) {
+	f := &JWTFilter{
+		Realm:         DefaultRealm,
+		UsernameClaim: DefaultJWTUsernameClaim,
+	}
+	if err := tree.UnmarshalViaYAML(cfg, f); err != nil {
+		return nil, err
+	}
+	if err := f.init(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *JWTFilter) init() error {
+	for i, k := range f.Keys {
+		var key jwtKey
+		var err error
+		switch {
+		case k.Secret != "" && k.File != "":
+			return fmt.Errorf("jwt: keys[%d]: both secret and file are set", i)
+		case k.Secret != "":
+			key = jwtKey{alg: JWTAlgHS256, key: []byte(k.Secret)}
+		case k.File != "":
+			key, err = readJWTKeyFile(k.File)
+		default:
+			return fmt.Errorf("jwt: keys[%d]: secret or file is required", i)
+		}
+		if err != nil {
+			return fmt.Errorf("jwt: keys[%d]: %w", i, err)
+		}
+		key.kid = k.Kid
+		f.keys = append(f.keys, key)
+	}
+	if f.JWKSFile != "" {
+		keys, err := readJWKSFile(f.JWKSFile)
+		if err != nil {
+			return fmt.Errorf("jwt: %w", err)
+		}
+		f.keys = append(f.keys, keys...)
+	}
+	if len(f.keys) == 0 {
+		return errors.New("jwt: keys or jwksFile is required")
+	}
+	f.challenge = []byte(`Bearer realm=` + strconv.Quote(f.Realm))
+	for claim, header := range f.ClaimHeaders {
+		f.claimHeaders = append(f.claimHeaders, jwtClaimHeader{claim: claim, header: header})
+	}
+	slices.SortFunc(f.claimHeaders, func(a, b jwtClaimHeader) int {
+		return strings.Compare(a.claim, b.claim)
+	})
+	return nil
+}
+
+// readJWTKeyFile reads the first public key or certificate in a PEM file.
+func readJWTKeyFile(name string) (jwtKey, error) {
+	bin, err := os.ReadFile(name)
+	if err != nil {
+		return jwtKey{}, err
+	}
+	for {
+		var block *pem.Block
+		block, bin = pem.Decode(bin)
+		if block == nil {
+			return jwtKey{}, fmt.Errorf("%s: no public key found", name)
+		}
+		var pub any
+		switch block.Type {
+		case "PUBLIC KEY":
+			pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				pub = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return jwtKey{}, fmt.Errorf("%s: %w", name, err)
+		}
+		key, err := newJWTPublicKey(pub)
+		if err != nil {
+			return jwtKey{}, fmt.Errorf("%s: %w", name, err)
+		}
+		return key, nil
+	}
+}
+
+func newJWTPublicKey(pub any) (jwtKey, error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return jwtKey{alg: JWTAlgRS256, key: pub}, nil
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return jwtKey{}, fmt.Errorf("unsupported curve: %s", pub.Curve.Params().Name)
+		}
+		return jwtKey{alg: JWTAlgES256, key: pub}, nil
+	case ed25519.PublicKey:
+		return jwtKey{alg: JWTAlgEdDSA, key: pub}, nil
+	}
+	return jwtKey{}, fmt.Errorf("unsupported public key: %T", pub)
+}
+
+// jwk is a JSON Web Key of RFC 7517.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// readJWKSFile reads the signature keys in a JSON Web Key Set file.
+func readJWKSFile(name string) ([]jwtKey, error) {
+	bin, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(bin, &set); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	var keys []jwtKey
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.jwtKey()
+		if err != nil {
+			return nil, fmt.Errorf("%s: keys[%d]: %w", name, i, err)
+		}
+		key.kid = k.Kid
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (k jwk) jwtKey() (jwtKey, error) {
+	b64 := base64.RawURLEncoding
+	switch k.Kty {
+	case "oct":
+		secret, err := b64.DecodeString(k.K)
+		if err != nil {
+			return jwtKey{}, err
+		}
+		return jwtKey{alg: JWTAlgHS256, key: secret}, nil
+	case "RSA":
+		n, err := b64.DecodeString(k.N)
+		if err != nil {
+			return jwtKey{}, err
+		}
+		e, err := b64.DecodeString(k.E)
+		if err != nil {
+			return jwtKey{}, err
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		return newJWTPublicKey(pub)
+	case "EC":
+		if k.Crv != "P-256" {
+			return jwtKey{}, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return jwtKey{}, err
+		}
+		y, err := b64.DecodeString(k.Y)
+		if err != nil {
+			return jwtKey{}, err
+		}
+		pub, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), append(append([]byte{4}, x...), y...))
+		if err != nil {
+			return jwtKey{}, err
+		}
+		return newJWTPublicKey(pub)
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return jwtKey{}, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return jwtKey{}, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return jwtKey{}, errors.New("invalid Ed25519 public key")
+		}
+		return newJWTPublicKey(ed25519.PublicKey(x))
+	}
+	return jwtKey{}, fmt.Errorf("unsupported key type: %q", k.Kty)
+}
+
+// verify reports whether sig is a valid signature of input by k.
+func (k jwtKey) verify(input, sig []byte) bool {
+	switch key := k.key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(input)
+		return hmac.Equal(mac.Sum(nil), sig)
+	case *rsa.PublicKey:
+		sum := sha256.Sum256(input)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) == nil
+	case *ecdsa.PublicKey:
+		if len(sig) != 64 {
+			return false
+		}
+		sum := sha256.Sum256(input)
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(key, sum[:], r, s)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, input, sig)
+	}
+	return false
+}
+
+var (
+	errJWTMalformed  = errors.New("malformed token")
+	errJWTSignature  = errors.New("invalid signature")
+	errJWTExpired    = errors.New("token is expired")
+	errJWTNotYet     = errors.New("token is not valid yet")
+	errJWTIssuer     = errors.New("invalid issuer")
+	errJWTAudience   = errors.New("invalid audience")
+	errJWTUnknownKey = errors.New("no key for the token")
+)
+
+// parse verifies token and returns its claims.
+func (f *JWTFilter) parse(token []byte) (map[string]json.RawMessage, error) {
+	parts := bytes.Split(token, []byte{'.'})
+	if len(parts) != 3 {
+		return nil, errJWTMalformed
+	}
+	b64 := base64.RawURLEncoding
+	var header jwtHeader
+	if err := jwtDecodeJSON(parts[0], &header); err != nil {
+		return nil, errJWTMalformed
+	}
+	sig := make([]byte, b64.DecodedLen(len(parts[2])))
+	n, err := b64.Decode(sig, parts[2])
+	if err != nil {
+		return nil, errJWTMalformed
+	}
+	sig = sig[:n]
+
+	input := token[:len(parts[0])+1+len(parts[1])]
+	found := false
+	verified := false
+	for _, k := range f.keys {
+		if k.alg != header.Alg || (header.Kid != "" && k.kid != "" && k.kid != header.Kid) {
+			continue
+		}
+		found = true
+		if k.verify(input, sig) {
+			verified = true
+			break
+		}
+	}
+	if !found {
+		return nil, errJWTUnknownKey
+	}
+	if !verified {
+		return nil, errJWTSignature
+	}
+
+	var claims jwtClaims
+	var raw map[string]json.RawMessage
+	if err := jwtDecodeJSON(parts[1], &claims); err != nil {
+		return nil, errJWTMalformed
+	}
+	if err := jwtDecodeJSON(parts[1], &raw); err != nil {
+		return nil, errJWTMalformed
+	}
+	if err := f.validate(&claims); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+func jwtDecodeJSON(src []byte, v any) error {
+	b64 := base64.RawURLEncoding
+	dst := make([]byte, b64.DecodedLen(len(src)))
+	n, err := b64.Decode(dst, src)
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(bytes.NewReader(dst[:n]))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+// validate checks the exp, nbf, iss and aud claims.
+func (f *JWTFilter) validate(c *jwtClaims) error {
+	now := jwtNow()
+	leeway := time.Duration(f.Leeway)
+	if c.Exp != nil {
+		exp, err := jwtNumericDate(*c.Exp)
+		if err != nil {
+			return errJWTMalformed
+		}
+		if !now.Before(exp.Add(leeway)) {
+			return errJWTExpired
+		}
+	}
+	if c.Nbf != nil {
+		nbf, err := jwtNumericDate(*c.Nbf)
+		if err != nil {
+			return errJWTMalformed
+		}
+		if now.Add(leeway).Before(nbf) {
+			return errJWTNotYet
+		}
+	}
+	if f.Issuer != "" && c.Iss != f.Issuer {
+		return errJWTIssuer
+	}
+	if len(f.Audience) > 0 {
+		var auds []string
+		if err := json.Unmarshal(c.Aud, &auds); err != nil {
+			var aud string
+			if err := json.Unmarshal(c.Aud, &aud); err != nil {
+				return errJWTAudience
+			}
+			auds = []string{aud}
+		}
+		if !slices.ContainsFunc(auds, func(aud string) bool {
+			return slices.Contains(f.Audience, aud)
+		}) {
+			return errJWTAudience
+		}
+	}
+	return nil
+}
+
+// jwtNumericDate converts a NumericDate, seconds since the epoch that may
+// have a fraction, to time.Time.
+func jwtNumericDate(n json.Number) (time.Time, error) {
+	v, err := n.Float64()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, int64(v*float64(time.Second))), nil
+}
+
+// claimString returns a string claim as is and any other claim as JSON.
+func claimString(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	return string(raw)
+}
+
+func (f *JWTFilter) unauthorized(ctx *fasthttp.RequestCtx, err error) {
+	ctx.Response.SetStatusCode(http.StatusUnauthorized)
+	v := f.challenge
+	if err != nil {
+		v = append(append([]byte{}, v...), `, error="invalid_token", error_description=`...)
+		v = strconv.AppendQuote(v, err.Error())
+	}
+	ctx.Response.Header.SetBytesV(fasthttp.HeaderWWWAuthenticate, v)
+}
+
+var bearerPrefix = []byte("Bearer ")
+
+// Request verifies the bearer token in the Authorization header. If the
+// token is valid, it sets the claim headers and the URI username and
+// returns true. Otherwise it sets 401 Unauthorized and returns false.
+func (f *JWTFilter) Request(ctx *fasthttp.RequestCtx) bool {
+	for _, ch := range f.claimHeaders {
+		ctx.Request.Header.Del(ch.header)
+	}
+	header := ctx.Request.Header.Peek(fasthttp.HeaderAuthorization)
+	if len(header) == 0 {
+		f.unauthorized(ctx, nil)
+		return false
+	}
+	if len(header) < len(bearerPrefix) || !bytes.EqualFold(header[:len(bearerPrefix)], bearerPrefix) {
+		ctx.Error("Unknown authorization", http.StatusBadRequest)
+		return false
+	}
+	claims, err := f.parse(bytes.TrimSpace(header[len(bearerPrefix):]))
+	if err != nil {
+		f.unauthorized(ctx, err)
+		return false
+	}
+	for _, ch := range f.claimHeaders {
+		if raw, ok := claims[ch.claim]; ok {
+			ctx.Request.Header.Set(ch.header, claimString(raw))
+		}
+	}
+	if raw, ok := claims[f.UsernameClaim]; ok {
+		ctx.URI().SetUsername(claimString(raw))
+	}
+	return true
+}
+
+// Response does nothing and returns true.
+func (f *JWTFilter) Response(ctx *fasthttp.RequestCtx) bool {
+	return true
+}
+
+func init() {
+	RegisterNewFilterFunc("jwt", NewJWTFilter)
+	config.RegisterFilterSchema("jwt", jwtSchemas)
+}
+
+// jwtSchemas mirrors JWTFilter's YAML-tagged fields. Key files are
+// parsed by NewJWTFilter.
+var jwtSchemas = schema.QueryRules{
+	".": schema.Map{KeyedRules: map[string]schema.Rule{
+		"type":     schema.String{Enum: []string{"jwt"}},
+		"realm":    schema.String{},
+		"jwksFile": schema.String{},
+		"keys": schema.Every{Rules: schema.QueryRules{
+			".": schema.Map{KeyedRules: map[string]schema.Rule{
+				"kid":    schema.String{},
+				"secret": schema.String{},
+				"file":   schema.String{},
+			}},
+		}},
+		"issuer":        schema.String{},
+		"audience":      schema.Array{},
+		"leeway":        config.DurationRule{},
+		"usernameClaim": schema.String{},
+		"claimHeaders":  schema.Every{Rules: schema.QueryRules{".": schema.String{}}},
+	}},
+	".audience[]": schema.String{},
+}
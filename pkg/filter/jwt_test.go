@@ -0,0 +1,455 @@
+package filter
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/mojatter/tree"
+	"github.com/valyala/fasthttp"
+)
+
+// signJWT returns a token of header and claims signed with key, which is a
+// secret or a private key.
+func signJWT(t *testing.T, header, claims map[string]any, key any) string {
+	t.Helper()
+	b64 := base64.RawURLEncoding
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := b64.EncodeToString(h) + "." + b64.EncodeToString(c)
+	sum := sha256.Sum256([]byte(input))
+	var sig []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(input))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, sum[:])
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(key, []byte(input))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + b64.EncodeToString(sig)
+}
+
+// writePublicKeyPEM writes pub to a PEM file in dir and returns its name.
+func writePublicKeyPEM(t *testing.T, dir, name string, pub any) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name = filepath.Join(dir, name)
+	if err := os.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+type jwtTestKeys struct {
+	secret []byte
+	rsa    *rsa.PrivateKey
+	ec     *ecdsa.PrivateKey
+	ed     ed25519.PrivateKey
+}
+
+func newJWTTestKeys(t *testing.T) *jwtTestKeys {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &jwtTestKeys{secret: []byte("0123456789abcdef0123456789abcdef"), rsa: rsaKey, ec: ecKey, ed: edKey}
+}
+
+func newJWTCtx(authorization string) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	if authorization != "" {
+		ctx.Request.Header.Set("Authorization", authorization)
+	}
+	return ctx
+}
+
+func TestNewJWTFilter(t *testing.T) {
+	dir := t.TempDir()
+	keys := newJWTTestKeys(t)
+	rsaFile := writePublicKeyPEM(t, dir, "rsa.pem", keys.rsa.Public())
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384File := writePublicKeyPEM(t, dir, "p384.pem", p384.Public())
+	badJWKS := filepath.Join(dir, "bad.json")
+	if err := os.WriteFile(badJWKS, []byte(`{"keys":[{"kty":"EC","crv":"P-521"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		cfg    tree.Map
+		errstr string
+	}{
+		{
+			cfg: tree.Map{
+				"keys": tree.Array{
+					tree.Map{"secret": tree.V("secret")},
+					tree.Map{"file": tree.V(rsaFile), "kid": tree.V("rsa")},
+				},
+			},
+		}, {
+			cfg:    tree.Map{},
+			errstr: "jwt: keys or jwksFile is required",
+		}, {
+			cfg: tree.Map{
+				"keys": tree.Array{tree.Map{"secret": tree.V("secret"), "file": tree.V(rsaFile)}},
+			},
+			errstr: "jwt: keys[0]: both secret and file are set",
+		}, {
+			cfg: tree.Map{
+				"keys": tree.Array{tree.Map{"kid": tree.V("k1")}},
+			},
+			errstr: "jwt: keys[0]: secret or file is required",
+		}, {
+			cfg: tree.Map{
+				"keys": tree.Array{tree.Map{"file": tree.V(p384File)}},
+			},
+			errstr: "jwt: keys[0]: " + p384File + ": unsupported curve: P-384",
+		}, {
+			cfg: tree.Map{
+				"keys": tree.Array{tree.Map{"file": tree.V("jwt_test.go")}},
+			},
+			errstr: "jwt: keys[0]: jwt_test.go: no public key found",
+		}, {
+			cfg: tree.Map{
+				"jwksFile": tree.V(badJWKS),
+			},
+			errstr: "jwt: " + badJWKS + ": keys[0]: unsupported curve: P-521",
+		},
+	}
+	for i, test := range tests {
+		_, err := NewJWTFilter(test.cfg)
+		if test.errstr != "" {
+			if err == nil {
+				t.Fatalf("tests[%d] is no error; want %q", i, test.errstr)
+			}
+			if err.Error() != test.errstr {
+				t.Errorf("tests[%d] error %q; want %q", i, err.Error(), test.errstr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("tests[%d] error %v", i, err)
+		}
+	}
+}
+
+func TestJWTFilter_Algorithms(t *testing.T) {
+	dir := t.TempDir()
+	keys := newJWTTestKeys(t)
+	b64 := base64.RawURLEncoding
+	ecPub := keys.ec.Public().(*ecdsa.PublicKey)
+	ecBytes, err := ecPub.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, err := json.Marshal(map[string]any{"keys": []map[string]string{
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64.EncodeToString(ecBytes[1:33]), "y": b64.EncodeToString(ecBytes[33:])},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64.EncodeToString(keys.ed.Public().(ed25519.PublicKey))},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwksFile := filepath.Join(dir, "jwks.json")
+	if err := os.WriteFile(jwksFile, jwks, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewJWTFilter(tree.Map{
+		"keys": tree.Array{
+			tree.Map{"secret": tree.V(string(keys.secret))},
+			tree.Map{"file": tree.V(writePublicKeyPEM(t, dir, "rsa.pem", keys.rsa.Public())), "kid": tree.V("rsa")},
+		},
+		"jwksFile": tree.V(jwksFile),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := map[string]any{"sub": "fast"}
+	otherRSA, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		caseName string
+		token    string
+		want     bool
+	}{
+		{
+			caseName: "HS256",
+			token:    signJWT(t, map[string]any{"alg": "HS256"}, claims, keys.secret),
+			want:     true,
+		}, {
+			caseName: "RS256",
+			token:    signJWT(t, map[string]any{"alg": "RS256", "kid": "rsa"}, claims, keys.rsa),
+			want:     true,
+		}, {
+			caseName: "ES256",
+			token:    signJWT(t, map[string]any{"alg": "ES256", "kid": "ec"}, claims, keys.ec),
+			want:     true,
+		}, {
+			caseName: "EdDSA",
+			token:    signJWT(t, map[string]any{"alg": "EdDSA"}, claims, keys.ed),
+			want:     true,
+		}, {
+			caseName: "wrong kid",
+			token:    signJWT(t, map[string]any{"alg": "RS256", "kid": "other"}, claims, keys.rsa),
+		}, {
+			caseName: "wrong key",
+			token:    signJWT(t, map[string]any{"alg": "RS256"}, claims, otherRSA),
+		}, {
+			caseName: "HS256 with the RSA public key as secret",
+			token:    signJWT(t, map[string]any{"alg": "HS256"}, claims, x509.MarshalPKCS1PublicKey(&keys.rsa.PublicKey)),
+		}, {
+			caseName: "alg none",
+			token:    strings.TrimSuffix(signJWT(t, map[string]any{"alg": "none"}, claims, nil), "."),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.caseName, func(t *testing.T) {
+			ctx := newJWTCtx("Bearer " + tc.token)
+			if got := f.Request(ctx); got != tc.want {
+				t.Fatalf("got %v; want %v (WWW-Authenticate: %s)", got, tc.want, ctx.Response.Header.Peek("WWW-Authenticate"))
+			}
+			if !tc.want && ctx.Response.StatusCode() != http.StatusUnauthorized {
+				t.Errorf("status %d; want %d", ctx.Response.StatusCode(), http.StatusUnauthorized)
+			}
+		})
+	}
+}
+
+func TestJWTFilter_Request(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	orig := jwtNow
+	jwtNow = func() time.Time { return now }
+	defer func() { jwtNow = orig }()
+
+	secret := []byte("secret")
+	f, err := NewJWTFilter(tree.Map{
+		"realm":    tree.V("api"),
+		"keys":     tree.Array{tree.Map{"secret": tree.V(string(secret))}},
+		"issuer":   tree.V("https://issuer.example.com"),
+		"audience": tree.Array{tree.V("api"), tree.V("web")},
+		"leeway":   tree.V("30s"),
+		"claimHeaders": tree.Map{
+			"sub":   tree.V("X-User"),
+			"roles": tree.V("X-User-Roles"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs256 := map[string]any{"alg": "HS256", "typ": "JWT"}
+	valid := func(overrides map[string]any) map[string]any {
+		c := map[string]any{
+			"iss":   "https://issuer.example.com",
+			"aud":   "api",
+			"sub":   "fast",
+			"roles": []string{"admin"},
+			"exp":   now.Unix() + 60,
+			"nbf":   now.Unix(),
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+	tests := []struct {
+		caseName      string
+		authorization string
+		want          bool
+		wantStatus    int
+		wantChallenge string
+	}{
+		{
+			caseName:      "valid",
+			authorization: "Bearer " + signJWT(t, hs256, valid(nil), secret),
+			want:          true,
+			wantStatus:    http.StatusOK,
+		}, {
+			caseName:      "lowercase scheme and aud array",
+			authorization: "bearer " + signJWT(t, hs256, valid(map[string]any{"aud": []string{"other", "web"}}), secret),
+			want:          true,
+			wantStatus:    http.StatusOK,
+		}, {
+			caseName:      "expired within leeway",
+			authorization: "Bearer " + signJWT(t, hs256, valid(map[string]any{"exp": now.Unix() - 10}), secret),
+			want:          true,
+			wantStatus:    http.StatusOK,
+		}, {
+			caseName:      "missing",
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: `Bearer realm="api"`,
+		}, {
+			caseName:      "basic",
+			authorization: "Basic Zm9vOmJhcg==",
+			wantStatus:    http.StatusBadRequest,
+		}, {
+			caseName:      "malformed",
+			authorization: "Bearer abc",
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: `Bearer realm="api", error="invalid_token", error_description="malformed token"`,
+		}, {
+			caseName:      "expired",
+			authorization: "Bearer " + signJWT(t, hs256, valid(map[string]any{"exp": now.Unix() - 30}), secret),
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: `Bearer realm="api", error="invalid_token", error_description="token is expired"`,
+		}, {
+			caseName:      "not valid yet",
+			authorization: "Bearer " + signJWT(t, hs256, valid(map[string]any{"nbf": now.Unix() + 60}), secret),
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: `Bearer realm="api", error="invalid_token", error_description="token is not valid yet"`,
+		}, {
+			caseName:      "wrong issuer",
+			authorization: "Bearer " + signJWT(t, hs256, valid(map[string]any{"iss": "https://evil.example.com"}), secret),
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: `Bearer realm="api", error="invalid_token", error_description="invalid issuer"`,
+		}, {
+			caseName:      "missing audience",
+			authorization: "Bearer " + signJWT(t, hs256, valid(map[string]any{"aud": nil}), secret),
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: `Bearer realm="api", error="invalid_token", error_description="invalid audience"`,
+		}, {
+			caseName:      "invalid signature",
+			authorization: "Bearer " + signJWT(t, hs256, valid(nil), []byte("other")),
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: `Bearer realm="api", error="invalid_token", error_description="invalid signature"`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.caseName, func(t *testing.T) {
+			ctx := newJWTCtx(tc.authorization)
+			ctx.Request.Header.Set("X-User", "spoofed")
+			if got := f.Request(ctx); got != tc.want {
+				t.Fatalf("got %v; want %v", got, tc.want)
+			}
+			if got := ctx.Response.StatusCode(); got != tc.wantStatus {
+				t.Errorf("status %d; want %d", got, tc.wantStatus)
+			}
+			if got := string(ctx.Response.Header.Peek("WWW-Authenticate")); got != tc.wantChallenge {
+				t.Errorf("WWW-Authenticate %q; want %q", got, tc.wantChallenge)
+			}
+			wantUser, wantRoles := "", ""
+			if tc.want {
+				wantUser, wantRoles = "fast", `["admin"]`
+			}
+			if got := string(ctx.Request.Header.Peek("X-User")); got != wantUser {
+				t.Errorf("X-User %q; want %q", got, wantUser)
+			}
+			if got := string(ctx.Request.Header.Peek("X-User-Roles")); got != wantRoles {
+				t.Errorf("X-User-Roles %q; want %q", got, wantRoles)
+			}
+			if got := string(ctx.URI().Username()); got != wantUser {
+				t.Errorf("username %q; want %q", got, wantUser)
+			}
+		})
+	}
+}
+
+func TestJWTSchema(t *testing.T) {
+	testCases := []struct {
+		caseName string
+		filter   tree.Map
+		wantErr  string
+	}{
+		{
+			caseName: "valid",
+			filter: tree.Map{
+				"type":          tree.V("jwt"),
+				"realm":         tree.V("api"),
+				"keys":          tree.Array{tree.Map{"kid": tree.V("k1"), "file": tree.V("./public.pem")}},
+				"jwksFile":      tree.V("./jwks.json"),
+				"issuer":        tree.V("https://issuer.example.com"),
+				"audience":      tree.Array{tree.V("api")},
+				"leeway":        tree.V("30s"),
+				"usernameClaim": tree.V("email"),
+				"claimHeaders":  tree.Map{"sub": tree.V("X-User")},
+			},
+		},
+		{
+			caseName: "unknown key field",
+			filter: tree.Map{
+				"type": tree.V("jwt"),
+				"keys": tree.Array{tree.Map{"alg": tree.V("HS256")}},
+			},
+			wantErr: `.filters["jwt"].keys[0]: unknown key "alg"`,
+		},
+		{
+			caseName: "invalid claim header",
+			filter: tree.Map{
+				"type":         tree.V("jwt"),
+				"claimHeaders": tree.Map{"sub": tree.V(1)},
+			},
+			wantErr: `.filters["jwt"].claimHeaders`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.caseName, func(t *testing.T) {
+			docs := []tree.Map{{"filters": tree.Map{"jwt": tc.filter}}}
+			err := config.ValidateTreeMaps(docs)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("ValidateTreeMaps returned %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("ValidateTreeMaps returned nil, want error containing %q", tc.wantErr)
+			}
+			if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("error %q does not contain %q", err.Error(), tc.wantErr)
+			}
+		})
+	}
+}
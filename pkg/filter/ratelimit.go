@@ -0,0 +1,236 @@
+package filter
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/fasthttpd/fasthttpd/pkg/util"
+	"github.com/mojatter/tree"
+	"github.com/mojatter/tree/schema"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// DefaultRateLimitMaxKeys is the default number of keys tracked by a
+	// RateLimitFilter.
+	DefaultRateLimitMaxKeys = 10000
+
+	rateLimitKeyIP           = "ip"
+	rateLimitKeyUser         = "user"
+	rateLimitKeyHeaderPrefix = "header:"
+)
+
+// rateLimitNow returns the current time. Tests swap it to inject a
+// deterministic clock.
+var rateLimitNow = time.Now
+
+// RateLimitFilter implements the Filter that limits the request rate per
+// key with a token bucket. Each key may send Burst requests at once and
+// gains Rate requests every Per. Requests over the limit are answered with
+// 429 Too Many Requests.
+type RateLimitFilter struct {
+	Rate  int             `yaml:"rate"`
+	Per   config.Duration `yaml:"per"`
+	Burst int             `yaml:"burst"`
+	// Keys lists the parts of the key a bucket is selected by: "ip",
+	// "user" (the basic auth username) or "header:<name>".
+	Keys    []string        `yaml:"keys"`
+	MaxKeys int             `yaml:"maxKeys"`
+	Expire  config.Duration `yaml:"expire"`
+
+	keys []rateLimitKey
+	// interval is the time to gain a single token.
+	interval int64
+	// tolerance is the time to gain Burst tokens.
+	tolerance int64
+	buckets   util.Cache
+	// overflow is shared by the keys that cannot be tracked because
+	// MaxKeys buckets are already tracked.
+	overflow rateLimitBucket
+}
+
+type rateLimitKey struct {
+	name   string
+	header []byte
+}
+
+// rateLimitBucket holds the theoretical arrival time of the next request
+// in Unix nanoseconds, as in the generic cell rate algorithm. The bucket
+// is full when tat is not after now.
+type rateLimitBucket struct {
+	tat atomic.Int64
+}
+
+// NewRateLimitFilter returns a new RateLimitFilter.
+func NewRateLimitFilter(cfg tree.Map) (Filter, error) {
+	f := &RateLimitFilter{}
+	if err := tree.UnmarshalViaYAML(cfg, f); err != nil {
+		return nil, err
+	}
+	if err := f.init(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RateLimitFilter) init() error {
+	if f.Rate <= 0 {
+		return fmt.Errorf("rateLimit: rate must be positive: %d", f.Rate)
+	}
+	if f.Per <= 0 {
+		f.Per = config.Duration(time.Second)
+	}
+	if f.Burst <= 0 {
+		f.Burst = f.Rate
+	}
+	if len(f.Keys) == 0 {
+		f.Keys = []string{rateLimitKeyIP}
+	}
+	if f.MaxKeys <= 0 {
+		f.MaxKeys = DefaultRateLimitMaxKeys
+	}
+	f.keys = make([]rateLimitKey, len(f.Keys))
+	for i, k := range f.Keys {
+		switch {
+		case k == rateLimitKeyIP, k == rateLimitKeyUser:
+			f.keys[i] = rateLimitKey{name: k}
+		case strings.HasPrefix(k, rateLimitKeyHeaderPrefix) && len(k) > len(rateLimitKeyHeaderPrefix):
+			f.keys[i] = rateLimitKey{name: k, header: []byte(k[len(rateLimitKeyHeaderPrefix):])}
+		default:
+			return fmt.Errorf("rateLimit: unknown key: %q", k)
+		}
+	}
+
+	f.interval = int64(f.Per) / int64(f.Rate)
+	if f.interval <= 0 {
+		return fmt.Errorf("rateLimit: rate %d per %s is too high", f.Rate, time.Duration(f.Per))
+	}
+	f.tolerance = f.interval * int64(f.Burst)
+	// An idle bucket is full after tolerance, so forgetting it earlier
+	// would hand out extra tokens.
+	if f.Expire <= 0 {
+		f.Expire = config.Duration(max(f.tolerance, int64(time.Second)))
+	} else if int64(f.Expire) < f.tolerance {
+		return fmt.Errorf("rateLimit: expire %s is shorter than the time to refill burst %s",
+			time.Duration(f.Expire), time.Duration(f.tolerance))
+	}
+	f.buckets = util.NewCache(util.CacheConfig{
+		Expire:     time.Duration(f.Expire).Milliseconds(),
+		MaxEntries: f.MaxKeys,
+	})
+	return nil
+}
+
+// cacheKey returns the key of ctx. It returns false if every part of the
+// key is empty, e.g. no basic auth user; such requests are not limited.
+func (f *RateLimitFilter) cacheKey(ctx *fasthttp.RequestCtx) (util.CacheKey, bool) {
+	b := util.AcquireCacheKeyBuilder()
+	defer util.ReleaseCacheKeyBuilder(b)
+
+	found := false
+	for _, k := range f.keys {
+		var v []byte
+		switch {
+		case k.header != nil:
+			v = ctx.Request.Header.PeekBytes(k.header)
+		case k.name == rateLimitKeyUser:
+			v = ctx.URI().Username()
+		default:
+			v = ctx.RemoteIP()
+		}
+		found = found || len(v) > 0
+		b.Write(v)
+	}
+	return b.Sum(), found
+}
+
+func newRateLimitBucket() any {
+	return &rateLimitBucket{}
+}
+
+// bucket returns the bucket of key. It returns the overflow bucket if the
+// key is new and MaxKeys buckets are already tracked.
+func (f *RateLimitFilter) bucket(key util.CacheKey) *rateLimitBucket {
+	if v := f.buckets.GetOrSet(key, newRateLimitBucket); v != nil {
+		return v.(*rateLimitBucket)
+	}
+	return &f.overflow
+}
+
+// take takes a token at now. It returns the time to wait for the next
+// token if the bucket is empty, and the time until the bucket is full.
+func (f *RateLimitFilter) take(b *rateLimitBucket, now int64) (wait, reset int64) {
+	for {
+		tat := b.tat.Load()
+		next := max(tat, now) + f.interval
+		if allowAt := next - f.tolerance; now < allowAt {
+			return allowAt - now, tat - now
+		}
+		if b.tat.CompareAndSwap(tat, next) {
+			return 0, next - now
+		}
+	}
+}
+
+// Request takes a token from the bucket of the request key. If the bucket
+// is empty, it sets 429 Too Many Requests and returns false. The keys that
+// cannot be tracked because MaxKeys is reached share a single bucket, so
+// that a flood of new keys neither locks out the tracked clients nor goes
+// unlimited.
+func (f *RateLimitFilter) Request(ctx *fasthttp.RequestCtx) bool {
+	key, ok := f.cacheKey(ctx)
+	if !ok {
+		return true
+	}
+	wait, reset := f.take(f.bucket(key), rateLimitNow().UnixNano())
+	if wait == 0 {
+		return true
+	}
+	f.tooManyRequests(ctx, wait, reset)
+	return false
+}
+
+func (f *RateLimitFilter) tooManyRequests(ctx *fasthttp.RequestCtx, wait, reset int64) {
+	ctx.Response.SetStatusCode(http.StatusTooManyRequests)
+	h := &ctx.Response.Header
+	h.Set("Retry-After", strconv.FormatInt(ceilSeconds(wait), 10))
+	h.Set("RateLimit-Limit", strconv.Itoa(f.Burst))
+	h.Set("RateLimit-Remaining", "0")
+	h.Set("RateLimit-Reset", strconv.FormatInt(ceilSeconds(reset), 10))
+}
+
+// ceilSeconds returns nanos in seconds, rounded up.
+func ceilSeconds(nanos int64) int64 {
+	return (nanos + int64(time.Second) - 1) / int64(time.Second)
+}
+
+// Response does nothing and returns true.
+func (f *RateLimitFilter) Response(ctx *fasthttp.RequestCtx) bool {
+	return true
+}
+
+func init() {
+	RegisterNewFilterFunc("rateLimit", NewRateLimitFilter)
+	config.RegisterFilterSchema("rateLimit", rateLimitSchemas)
+}
+
+// rateLimitSchemas mirrors RateLimitFilter's YAML-tagged fields. The
+// format of each key ("ip", "user" or "header:<name>") is checked by
+// NewRateLimitFilter.
+var rateLimitSchemas = schema.QueryRules{
+	".": schema.Map{KeyedRules: map[string]schema.Rule{
+		"type":    schema.String{Enum: []string{"rateLimit"}},
+		"rate":    schema.Int{Min: tree.Int64Ptr(1)},
+		"per":     config.DurationRule{},
+		"burst":   schema.Int{Min: tree.Int64Ptr(1)},
+		"keys":    schema.Array{},
+		"maxKeys": schema.Int{Min: tree.Int64Ptr(1)},
+		"expire":  config.DurationRule{},
+	}},
+	".keys[]": schema.String{},
+}
@@ -0,0 +1,296 @@
+package filter
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/mojatter/tree"
+	"github.com/valyala/fasthttp"
+)
+
+func TestNewRateLimitFilter(t *testing.T) {
+	tests := []struct {
+		cfg         tree.Map
+		wantBurst   int
+		wantKeys    []string
+		wantExpire  time.Duration
+		wantMaxKeys int
+		errstr      string
+	}{
+		{
+			cfg:         tree.Map{"rate": tree.V(10)},
+			wantBurst:   10,
+			wantKeys:    []string{"ip"},
+			wantExpire:  time.Second,
+			wantMaxKeys: DefaultRateLimitMaxKeys,
+		}, {
+			cfg: tree.Map{
+				"rate":    tree.V(60),
+				"per":     tree.V("1m"),
+				"burst":   tree.V(120),
+				"keys":    tree.Array{tree.V("header:X-Api-Key"), tree.V("user")},
+				"maxKeys": tree.V(100),
+			},
+			wantBurst:   120,
+			wantKeys:    []string{"header:X-Api-Key", "user"},
+			wantExpire:  2 * time.Minute,
+			wantMaxKeys: 100,
+		}, {
+			cfg:    tree.Map{},
+			errstr: "rateLimit: rate must be positive: 0",
+		}, {
+			cfg: tree.Map{
+				"rate": tree.V(1),
+				"keys": tree.Array{tree.V("header:")},
+			},
+			errstr: `rateLimit: unknown key: "header:"`,
+		}, {
+			cfg: tree.Map{
+				"rate":   tree.V(1),
+				"burst":  tree.V(10),
+				"expire": tree.V("5s"),
+			},
+			errstr: "rateLimit: expire 5s is shorter than the time to refill burst 10s",
+		}, {
+			cfg: tree.Map{
+				"rate": tree.V(10),
+				"per":  tree.V(1),
+			},
+			errstr: "rateLimit: rate 10 per 1ns is too high",
+		},
+	}
+	for i, test := range tests {
+		got, err := NewRateLimitFilter(test.cfg)
+		if test.errstr != "" {
+			if err == nil {
+				t.Fatalf("tests[%d] is no error; want %q", i, test.errstr)
+			}
+			if err.Error() != test.errstr {
+				t.Errorf("tests[%d] error %q; want %q", i, err.Error(), test.errstr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("tests[%d] error %v", i, err)
+		}
+		f := got.(*RateLimitFilter)
+		if f.Burst != test.wantBurst {
+			t.Errorf("tests[%d] burst %d; want %d", i, f.Burst, test.wantBurst)
+		}
+		if strings.Join(f.Keys, ",") != strings.Join(test.wantKeys, ",") {
+			t.Errorf("tests[%d] keys %v; want %v", i, f.Keys, test.wantKeys)
+		}
+		if time.Duration(f.Expire) != test.wantExpire {
+			t.Errorf("tests[%d] expire %v; want %v", i, time.Duration(f.Expire), test.wantExpire)
+		}
+		if f.MaxKeys != test.wantMaxKeys {
+			t.Errorf("tests[%d] maxKeys %d; want %d", i, f.MaxKeys, test.wantMaxKeys)
+		}
+	}
+}
+
+// setRateLimitNow replaces rateLimitNow with a clock that returns *now.
+func setRateLimitNow(t *testing.T, now *time.Time) {
+	t.Helper()
+	orig := rateLimitNow
+	rateLimitNow = func() time.Time { return *now }
+	t.Cleanup(func() { rateLimitNow = orig })
+}
+
+func newRateLimitCtx(ip string) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.ParseIP(ip), Port: 12345}, nil)
+	return ctx
+}
+
+func TestRateLimitFilter_Request(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	setRateLimitNow(t, &now)
+
+	f, err := NewRateLimitFilter(tree.Map{"rate": tree.V(1), "burst": tree.V(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		advance        time.Duration
+		ip             string
+		want           bool
+		wantRetryAfter string
+		wantReset      string
+	}{
+		{ip: "10.0.0.1", want: true},
+		{ip: "10.0.0.1", want: true},
+		{ip: "10.0.0.1", want: false, wantRetryAfter: "1", wantReset: "2"},
+		{ip: "10.0.0.2", want: true},
+		{advance: 500 * time.Millisecond, ip: "10.0.0.1", want: false, wantRetryAfter: "1", wantReset: "2"},
+		{advance: 500 * time.Millisecond, ip: "10.0.0.1", want: true},
+		{ip: "10.0.0.1", want: false, wantRetryAfter: "1", wantReset: "2"},
+		{advance: 2 * time.Second, ip: "10.0.0.1", want: true},
+		{ip: "10.0.0.1", want: true},
+		{ip: "10.0.0.1", want: false, wantRetryAfter: "1", wantReset: "2"},
+	}
+	for i, test := range tests {
+		now = now.Add(test.advance)
+		ctx := newRateLimitCtx(test.ip)
+		if got := f.Request(ctx); got != test.want {
+			t.Fatalf("tests[%d] got %v; want %v", i, got, test.want)
+		}
+		if test.want {
+			continue
+		}
+		h := &ctx.Response.Header
+		if got := ctx.Response.StatusCode(); got != http.StatusTooManyRequests {
+			t.Errorf("tests[%d] status %d; want %d", i, got, http.StatusTooManyRequests)
+		}
+		if got := string(h.Peek("Retry-After")); got != test.wantRetryAfter {
+			t.Errorf("tests[%d] Retry-After %q; want %q", i, got, test.wantRetryAfter)
+		}
+		if got := string(h.Peek("RateLimit-Limit")); got != "2" {
+			t.Errorf("tests[%d] RateLimit-Limit %q; want %q", i, got, "2")
+		}
+		if got := string(h.Peek("RateLimit-Remaining")); got != "0" {
+			t.Errorf("tests[%d] RateLimit-Remaining %q; want %q", i, got, "0")
+		}
+		if got := string(h.Peek("RateLimit-Reset")); got != test.wantReset {
+			t.Errorf("tests[%d] RateLimit-Reset %q; want %q", i, got, test.wantReset)
+		}
+	}
+}
+
+func TestRateLimitFilter_Keys(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	setRateLimitNow(t, &now)
+
+	f, err := NewRateLimitFilter(tree.Map{
+		"rate": tree.V(1),
+		"keys": tree.Array{tree.V("header:X-Api-Key"), tree.V("user")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		apiKey string
+		user   string
+		want   bool
+	}{
+		{want: true},
+		{want: true},
+		{apiKey: "k1", want: true},
+		{apiKey: "k1", want: false},
+		{apiKey: "k1", user: "foo", want: true},
+		{apiKey: "k1", user: "foo", want: false},
+		{user: "foo", want: true},
+		{user: "bar", want: true},
+	}
+	for i, test := range tests {
+		ctx := newRateLimitCtx("10.0.0.1")
+		if test.apiKey != "" {
+			ctx.Request.Header.Set("X-Api-Key", test.apiKey)
+		}
+		if test.user != "" {
+			ctx.URI().SetUsername(test.user)
+		}
+		if got := f.Request(ctx); got != test.want {
+			t.Errorf("tests[%d] got %v; want %v", i, got, test.want)
+		}
+	}
+}
+
+func TestRateLimitFilter_MaxKeys(t *testing.T) {
+	f, err := NewRateLimitFilter(tree.Map{"rate": tree.V(10), "maxKeys": tree.V(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 10 {
+		if !f.Request(newRateLimitCtx("10.0.0.1")) {
+			t.Fatal("first key is limited within burst")
+		}
+	}
+	if f.Request(newRateLimitCtx("10.0.0.1")) {
+		t.Fatal("tracked key is not limited over burst")
+	}
+	// Keys over maxKeys share a single bucket limited at the same rate.
+	for i := range 10 {
+		ctx := newRateLimitCtx(fmt.Sprintf("10.0.1.%d", i))
+		if !f.Request(ctx) {
+			t.Fatalf("key over maxKeys is limited within burst: status %d", ctx.Response.StatusCode())
+		}
+	}
+	ctx := newRateLimitCtx("10.0.0.2")
+	if f.Request(ctx) {
+		t.Fatal("new key is not limited while maxKeys are tracked")
+	}
+	if got := ctx.Response.StatusCode(); got != http.StatusTooManyRequests {
+		t.Errorf("status = %d; want %d", got, http.StatusTooManyRequests)
+	}
+}
+
+func TestRateLimitSchema(t *testing.T) {
+	testCases := []struct {
+		caseName string
+		filter   tree.Map
+		wantErr  string
+	}{
+		{
+			caseName: "valid",
+			filter: tree.Map{
+				"type":    tree.V("rateLimit"),
+				"rate":    tree.V(10),
+				"per":     tree.V("1m"),
+				"burst":   tree.V(20),
+				"keys":    tree.Array{tree.V("ip"), tree.V("header:X-Api-Key")},
+				"maxKeys": tree.V(1000),
+				"expire":  tree.V("10m"),
+			},
+		},
+		{
+			caseName: "invalid per",
+			filter: tree.Map{
+				"type": tree.V("rateLimit"),
+				"rate": tree.V(10),
+				"per":  tree.V("soon"),
+			},
+			wantErr: `.filters["limit"].per: invalid duration "soon"`,
+		},
+		{
+			caseName: "zero rate",
+			filter: tree.Map{
+				"type": tree.V("rateLimit"),
+				"rate": tree.V(0),
+			},
+			wantErr: `.filters["limit"].rate`,
+		},
+		{
+			caseName: "unknown top-level field",
+			filter: tree.Map{
+				"type":  tree.V("rateLimit"),
+				"rate":  tree.V(10),
+				"bogus": tree.V(1),
+			},
+			wantErr: `.filters["limit"]: unknown key "bogus"`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.caseName, func(t *testing.T) {
+			docs := []tree.Map{{"filters": tree.Map{"limit": tc.filter}}}
+			err := config.ValidateTreeMaps(docs)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("ValidateTreeMaps returned %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("ValidateTreeMaps returned nil, want error containing %q", tc.wantErr)
+			}
+			if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("error %q does not contain %q", err.Error(), tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"slices"
+	"strconv"
+
+	"github.com/fasthttpd/fasthttpd/pkg/util"
+	"github.com/valyala/fasthttp"
+)
+
+// hashRingReplicas is the number of points of a backend of weight 1 on the
+// consistent hash ring.
+const hashRingReplicas = 160
+
+// available reports whether be may serve a request, i.e. it is not marked
+// down by the health checker, not ejected by the passive health and not
+// tried yet.
+func (be *proxyBackend) available(tried []*proxyBackend) bool {
+	return be.alive.Load() && !be.ejected() && !slices.Contains(tried, be)
+}
+
+// weightedSchedule returns the indexes of the backends in the order of the
+// smooth weighted round-robin of nginx, which interleaves the backends
+// instead of sending runs of requests to the heavier ones. The schedule of
+// equal weights is 0, 1, ..., n-1.
+func weightedSchedule(weights []int) []uint64 {
+	d := 0
+	for _, w := range weights {
+		d = gcd(d, w)
+	}
+	total := 0
+	for _, w := range weights {
+		total += w / d
+	}
+	current := make([]int, len(weights))
+	sched := make([]uint64, 0, total)
+	for range total {
+		best := 0
+		for i, w := range weights {
+			current[i] += w / d
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		sched = append(sched, uint64(best))
+	}
+	return sched
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// pickLeastConn returns the available backend with the fewest in-flight
+// requests relative to its weight. Ties are broken in round-robin order.
+func (b *proxyBalancer) pickLeastConn(tried []*proxyBackend) *proxyBackend {
+	n := uint64(len(b.backends))
+	start := b.counter.Add(1) - 1
+	var best *proxyBackend
+	var bestLoad int64
+	for i := range n {
+		be := b.backends[(start+i)%n]
+		if !be.available(tried) {
+			continue
+		}
+		// load/weight < bestLoad/best.weight without division.
+		load := be.inflight.Load()
+		if best == nil || load*int64(best.weight) < bestLoad*int64(be.weight) {
+			best, bestLoad = be, load
+		}
+	}
+	return best
+}
+
+type ringPoint struct {
+	hash uint64
+	be   *proxyBackend
+}
+
+// newHashRing places hashRingReplicas times the weight points of each
+// backend on a consistent hash ring. Removing a backend only moves the keys
+// of its own points, so the other backends keep their keys.
+func newHashRing(backends []*proxyBackend) []ringPoint {
+	var ring []ringPoint
+	var buf []byte
+	for _, be := range backends {
+		for i := range hashRingReplicas * be.weight {
+			buf = append(buf[:0], be.url.String()...)
+			buf = append(buf, '#')
+			buf = strconv.AppendInt(buf, int64(i), 10)
+			ring = append(ring, ringPoint{hash: hashBytes(buf), be: be})
+		}
+	}
+	slices.SortStableFunc(ring, func(a, b ringPoint) int {
+		switch {
+		case a.hash < b.hash:
+			return -1
+		case a.hash > b.hash:
+			return 1
+		}
+		return 0
+	})
+	return ring
+}
+
+// pickHash returns the first available backend clockwise from the hash key
+// of the request on the ring.
+func (b *proxyBalancer) pickHash(ctx *fasthttp.RequestCtx, tried []*proxyBackend) *proxyBackend {
+	var h uint64
+	if b.hashKey == nil {
+		h = hashBytes(ctx.RemoteIP())
+	} else {
+		bp := proxyBufPool.Get().(*[]byte)
+		*bp = b.hashKey.Append((*bp)[:0], ctx)
+		h = hashBytes(*bp)
+		proxyBufPool.Put(bp)
+	}
+	ring := b.ring
+	i, _ := slices.BinarySearchFunc(ring, h, func(p ringPoint, h uint64) int {
+		switch {
+		case p.hash < h:
+			return -1
+		case p.hash > h:
+			return 1
+		}
+		return 0
+	})
+	for j := range len(ring) {
+		if be := ring[(i+j)%len(ring)].be; be.available(tried) {
+			return be
+		}
+	}
+	return nil
+}
+
+// hashBytes returns the FNV-1a hash of b followed by the finalizer of
+// SplitMix64, which spreads similar keys such as the ring points of a
+// backend over the ring.
+func hashBytes(b []byte) uint64 {
+	h := util.HashFNV1a(b)
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
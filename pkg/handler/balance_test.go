@@ -0,0 +1,176 @@
+package handler
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/fasthttpd/fasthttpd/pkg/logger"
+	"github.com/fasthttpd/fasthttpd/pkg/vars"
+	"github.com/valyala/fasthttp"
+)
+
+func TestWeightedSchedule(t *testing.T) {
+	tests := []struct {
+		weights []int
+		want    []uint64
+	}{
+		{weights: []int{1, 1, 1}, want: []uint64{0, 1, 2}},
+		{weights: []int{5, 1, 1}, want: []uint64{0, 0, 1, 0, 2, 0, 0}},
+		{weights: []int{4, 2}, want: []uint64{0, 1, 0}},
+	}
+	for i, test := range tests {
+		if got := weightedSchedule(test.weights); !slices.Equal(got, test.want) {
+			t.Errorf("tests[%d] got %v; want %v", i, got, test.want)
+		}
+	}
+}
+
+func TestProxyBalancer_WeightedRoundRobin(t *testing.T) {
+	b, err := newProxyBalancer(
+		[]string{"http://a", "http://b", "http://c"},
+		[]int{3, 0, 2},
+		algoRoundRobin,
+		logger.NilLogger,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]int{}
+	ctx := &fasthttp.RequestCtx{}
+	for range 12 {
+		seen[b.pick(ctx, nil).url.String()]++
+	}
+	want := map[string]int{"http://a": 6, "http://b": 2, "http://c": 4}
+	for u, n := range want {
+		if seen[u] != n {
+			t.Errorf("backend %s picked %d times; want %d", u, seen[u], n)
+		}
+	}
+}
+
+func TestProxyBalancer_LeastConn(t *testing.T) {
+	b, err := newProxyBalancer(
+		[]string{"http://a", "http://b", "http://c"},
+		[]int{1, 1, 2},
+		algoLeastConn,
+		logger.NilLogger,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &fasthttp.RequestCtx{}
+	a, bb, c := b.backends[0], b.backends[1], b.backends[2]
+
+	testCases := []struct {
+		caseName string
+		inflight [3]int64
+		tried    []*proxyBackend
+		down     *proxyBackend
+		want     *proxyBackend
+	}{
+		{
+			caseName: "fewest in-flight",
+			inflight: [3]int64{2, 1, 3},
+			want:     bb,
+		}, {
+			caseName: "relative to weight",
+			inflight: [3]int64{2, 2, 3},
+			want:     c,
+		}, {
+			caseName: "skips tried",
+			inflight: [3]int64{2, 1, 3},
+			tried:    []*proxyBackend{bb},
+			want:     c,
+		}, {
+			caseName: "skips down",
+			inflight: [3]int64{0, 1, 3},
+			down:     a,
+			want:     bb,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.caseName, func(t *testing.T) {
+			for i, be := range b.backends {
+				be.inflight.Store(tc.inflight[i])
+				be.alive.Store(be != tc.down)
+			}
+			if got := b.pick(ctx, tc.tried); got != tc.want {
+				t.Errorf("picked %v; want %s", got, tc.want.url)
+			}
+		})
+	}
+}
+
+func TestProxyBalancer_ConsistentHash(t *testing.T) {
+	urls := []string{"http://a", "http://b", "http://c", "http://d"}
+	newBalancer := func(urls []string) *proxyBalancer {
+		b, err := newProxyBalancer(urls, nil, algoConsistentHash, logger.NilLogger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.hashKey = vars.Compile("${header.X-User}")
+		return b
+	}
+	pickUsers := func(b *proxyBalancer) map[string]string {
+		picked := map[string]string{}
+		for i := range 1000 {
+			user := fmt.Sprintf("user-%d", i)
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Request.Header.Set("X-User", user)
+			picked[user] = b.pick(ctx, nil).url.String()
+		}
+		return picked
+	}
+
+	b := newBalancer(urls)
+	before := pickUsers(b)
+	counts := map[string]int{}
+	for _, u := range before {
+		counts[u]++
+	}
+	for _, u := range urls {
+		if n := counts[u]; n < 150 || n > 350 {
+			t.Errorf("backend %s got %d of 1000 keys; want about 250", u, n)
+		}
+	}
+	if again := pickUsers(b); !maps.Equal(before, again) {
+		t.Errorf("same keys were picked differently")
+	}
+
+	// Removing a backend only moves its own keys.
+	after := pickUsers(newBalancer(slices.Delete(slices.Clone(urls), 1, 2)))
+	for user, u := range before {
+		if u != "http://b" && after[user] != u {
+			t.Errorf("key %s moved from %s to %s", user, u, after[user])
+		}
+	}
+
+	// A down backend is skipped in the same way.
+	b.backends[1].alive.Store(false)
+	if down := pickUsers(b); !maps.Equal(down, after) {
+		t.Errorf("keys of a down backend moved differently than of a removed one")
+	}
+}
+
+func TestProxyBalancer_ConsistentHashClientIP(t *testing.T) {
+	b, err := newProxyBalancer([]string{"http://a", "http://b", "http://c"}, nil, algoConsistentHash, logger.NilLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[*proxyBackend]bool{}
+	for i := range 30 {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 12345}, nil)
+		first := b.pick(ctx, nil)
+		if be := b.pick(ctx, nil); be != first {
+			t.Fatalf("picked %s and %s for the same client", first.url, be.url)
+		}
+		seen[first] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("picked %d backends for 30 clients; want 3", len(seen))
+	}
+}
@@ -1,6 +1,8 @@
 package handler
 
 import (
+	"io"
+
 	"github.com/fasthttpd/fasthttpd/pkg/config"
 	"github.com/fasthttpd/fasthttpd/pkg/logger"
 	"github.com/mojatter/tree"
@@ -16,7 +18,15 @@ func NewBalancerHandler(cfg tree.Map, l logger.Logger) (fasthttp.RequestHandler,
 	return NewProxyHandler(cfg, l)
 }
 
+// NewBalancerHandlerCloser is the NewHandlerCloserFunc variant of
+// NewBalancerHandler.
+//
+// Deprecated: prefer handler type 'proxy' in new configs.
+func NewBalancerHandlerCloser(cfg tree.Map, l logger.Logger) (fasthttp.RequestHandler, io.Closer, error) {
+	return NewProxyHandlerCloser(cfg, l)
+}
+
 func init() {
-	RegisterNewHandlerFunc("balancer", NewBalancerHandler)
+	RegisterNewHandlerCloserFunc("balancer", NewBalancerHandlerCloser)
 	config.RegisterHandlerSchema("balancer", proxySchemas("balancer"))
 }
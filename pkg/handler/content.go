@@ -7,6 +7,7 @@ import (
 
 	"github.com/fasthttpd/fasthttpd/pkg/config"
 	"github.com/fasthttpd/fasthttpd/pkg/logger"
+	"github.com/fasthttpd/fasthttpd/pkg/vars"
 	"github.com/mojatter/tree"
 	"github.com/mojatter/tree/schema"
 	"github.com/valyala/fasthttp"
@@ -28,10 +29,12 @@ type contentHeader struct {
 }
 
 type contentResponse struct {
-	headers    []contentHeader
-	body       []byte
-	statusCode int
-	hasStatus  bool
+	headers []contentHeader
+	body    []byte
+	// bodyTemplate is set if body has variables.
+	bodyTemplate *vars.Template
+	statusCode   int
+	hasStatus    bool
 }
 
 type contentConditionKind uint8
@@ -78,7 +81,12 @@ func NewContent(handlerCfg tree.Map) (*Content, error) {
 func buildContentResponse(cfg, fallback tree.Map) contentResponse {
 	r := contentResponse{}
 	if cfg.Has("body") {
-		r.body = []byte(cfg.Get("body").Value().String())
+		t := vars.Compile(cfg.Get("body").Value().String())
+		if t.IsStatic() {
+			r.body = t.Static()
+		} else {
+			r.bodyTemplate = t
+		}
 	}
 	if cfg.Has("status") {
 		r.hasStatus = true
@@ -193,7 +201,9 @@ func (r *contentResponse) writeTo(ctx *fasthttp.RequestCtx) {
 		hdr := &r.headers[i]
 		ctx.Response.Header.AddBytesKV(hdr.key, hdr.value)
 	}
-	if r.body != nil {
+	if r.bodyTemplate != nil {
+		ctx.Response.SwapBody(r.bodyTemplate.Append(ctx.Response.SwapBody(nil)[:0], ctx))
+	} else if r.body != nil {
 		ctx.Response.SetBodyRaw(r.body)
 	}
 	if r.hasStatus {
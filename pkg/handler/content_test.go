@@ -168,6 +168,19 @@ func TestContent_Handle(t *testing.T) {
 				ctx.Response.SetBodyString("no hit")
 				return ctx
 			},
+		}, {
+			setup: func() func() {
+				return func() {}
+			},
+			cfg: tree.Map{
+				"body": tree.ToValue("hello ${query.name} at ${path}, ${unknown}"),
+			},
+			requestURI: "/hello?name=gopher",
+			want: func() *fasthttp.RequestCtx {
+				ctx := &fasthttp.RequestCtx{}
+				ctx.Response.SetBodyString("hello gopher at /hello, ${unknown}")
+				return ctx
+			},
 		},
 	}
 	for i, test := range tests {
@@ -2,6 +2,7 @@ package handler
 
 import (
 	"fmt"
+	"io"
 
 	"github.com/fasthttpd/fasthttpd/pkg/logger"
 	"github.com/mojatter/tree"
@@ -11,18 +12,45 @@ import (
 // NewHandlerFunc is a function that creates a new fasthttp.RequestHandler.
 type NewHandlerFunc func(cfg tree.Map, l logger.Logger) (fasthttp.RequestHandler, error)
 
-var typedNewHandlerFunc = map[string]NewHandlerFunc{}
+// NewHandlerCloserFunc is a function that creates a new fasthttp.RequestHandler
+// together with an io.Closer that releases its background resources (such as
+// health-check goroutines). The closer is called when the owning server
+// handler is closed, e.g. after a configuration reload.
+type NewHandlerCloserFunc func(cfg tree.Map, l logger.Logger) (fasthttp.RequestHandler, io.Closer, error)
+
+var typedNewHandlerFunc = map[string]NewHandlerCloserFunc{}
 
 // RegisterNewHandlerFunc registers a NewHandlerFunc with the specified type name.
 func RegisterNewHandlerFunc(typeName string, fn NewHandlerFunc) {
+	typedNewHandlerFunc[typeName] = func(cfg tree.Map, l logger.Logger) (fasthttp.RequestHandler, io.Closer, error) {
+		h, err := fn(cfg, l)
+		return h, nopCloser{}, err
+	}
+}
+
+// RegisterNewHandlerCloserFunc registers a NewHandlerCloserFunc with the
+// specified type name.
+func RegisterNewHandlerCloserFunc(typeName string, fn NewHandlerCloserFunc) {
 	typedNewHandlerFunc[typeName] = fn
 }
 
 // NewHandler creates a new fasthttp.RequestHandler.
 func NewHandler(cfg tree.Map, l logger.Logger) (fasthttp.RequestHandler, error) {
+	h, _, err := NewHandlerCloser(cfg, l)
+	return h, err
+}
+
+// NewHandlerCloser creates a new fasthttp.RequestHandler and the io.Closer
+// that releases it. Handlers registered via RegisterNewHandlerFunc get a
+// no-op closer.
+func NewHandlerCloser(cfg tree.Map, l logger.Logger) (fasthttp.RequestHandler, io.Closer, error) {
 	typeName := cfg.Get("type").Value().String()
 	if fn, ok := typedNewHandlerFunc[typeName]; ok {
 		return fn(cfg, l)
 	}
-	return nil, fmt.Errorf("unknown handler type: %s", typeName)
+	return nil, nil, fmt.Errorf("unknown handler type: %s", typeName)
 }
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,286 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/fasthttpd/fasthttpd/pkg/metrics"
+	"github.com/mojatter/tree"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	defaultHealthCheckInterval = 5 * time.Second
+	maxHealthCheckTimeout      = 5 * time.Second
+)
+
+// proxyHealthCheckConfig is the 'healthCheck' entry of the proxy handler
+// config.
+type proxyHealthCheckConfig struct {
+	Interval config.Duration `yaml:"interval"`
+	Timeout  config.Duration `yaml:"timeout"`
+	Path     string          `yaml:"path"`
+	Method   string          `yaml:"method"`
+	// Statuses are the healthy statuses such as "200", "2xx" or
+	// "200-399". Any status below 500 is healthy if empty.
+	Statuses   []string          `yaml:"statuses"`
+	Body       string            `yaml:"body"`
+	BodyRegexp string            `yaml:"bodyRegexp"`
+	Headers    map[string]string `yaml:"headers"`
+	// Rise and Fall are the consecutive successes and failures that
+	// mark a backend up and down.
+	Rise int `yaml:"rise"`
+	Fall int `yaml:"fall"`
+}
+
+type statusRange struct {
+	min, max int
+}
+
+// parseStatusRange parses "200", "2xx" or "200-399".
+func parseStatusRange(s string) (statusRange, error) {
+	if lo, hi, ok := strings.Cut(s, "-"); ok {
+		min, err1 := strconv.Atoi(strings.TrimSpace(lo))
+		max, err2 := strconv.Atoi(strings.TrimSpace(hi))
+		if err1 != nil || err2 != nil || min > max {
+			return statusRange{}, fmt.Errorf("invalid status range: %s", s)
+		}
+		return statusRange{min: min, max: max}, nil
+	}
+	if len(s) == 3 && strings.HasSuffix(strings.ToLower(s), "xx") && '1' <= s[0] && s[0] <= '5' {
+		c := int(s[0]-'0') * 100
+		return statusRange{min: c, max: c + 99}, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return statusRange{}, fmt.Errorf("invalid status range: %s", s)
+	}
+	return statusRange{min: n, max: n}, nil
+}
+
+// healthCheck probes the backends periodically and marks them up or down.
+type healthCheck struct {
+	interval   time.Duration
+	timeout    time.Duration
+	path       string
+	method     string
+	statuses   []statusRange
+	body       []byte
+	bodyRegexp *regexp.Regexp
+	headers    map[string]string
+	rise       int
+	fall       int
+}
+
+// newHealthCheck creates a new healthCheck by the proxy handler cfg. The
+// legacy healthCheckInterval is used unless healthCheck.interval is set.
+// It returns nil if the checks are disabled.
+func newHealthCheck(cfg tree.Map) (*healthCheck, error) {
+	hc := &proxyHealthCheckConfig{}
+	if cfg.Has("healthCheck") {
+		if err := tree.UnmarshalViaYAML(cfg.Get("healthCheck"), hc); err != nil {
+			return nil, fmt.Errorf("healthCheck: %w", err)
+		}
+		if hc.Interval <= 0 {
+			hc.Interval = config.Duration(defaultHealthCheckInterval)
+		}
+	}
+	if sec := cfg.Get("healthCheckInterval").Value().Int(); hc.Interval <= 0 && sec > 0 {
+		hc.Interval = config.Duration(time.Duration(sec) * time.Second)
+	}
+	if hc.Interval <= 0 {
+		return nil, nil
+	}
+	return hc.build()
+}
+
+func (hc *proxyHealthCheckConfig) build() (*healthCheck, error) {
+	c := &healthCheck{
+		interval: time.Duration(hc.Interval),
+		timeout:  time.Duration(hc.Timeout),
+		path:     hc.Path,
+		method:   strings.ToUpper(hc.Method),
+		headers:  hc.Headers,
+		rise:     max(hc.Rise, 1),
+		fall:     max(hc.Fall, 1),
+	}
+	if c.timeout <= 0 {
+		// Capping at the interval guarantees in-flight checks cannot pile
+		// up across ticks.
+		c.timeout = min(c.interval, maxHealthCheckTimeout)
+	}
+	if c.path != "" && !strings.HasPrefix(c.path, "/") {
+		return nil, fmt.Errorf("healthCheck: path must start with '/': %s", c.path)
+	}
+	for _, s := range hc.Statuses {
+		r, err := parseStatusRange(s)
+		if err != nil {
+			return nil, fmt.Errorf("healthCheck: %w", err)
+		}
+		c.statuses = append(c.statuses, r)
+	}
+	if hc.Body != "" {
+		c.body = []byte(hc.Body)
+	}
+	if hc.BodyRegexp != "" {
+		re, err := regexp.Compile(hc.BodyRegexp)
+		if err != nil {
+			return nil, fmt.Errorf("healthCheck: %w", err)
+		}
+		c.bodyRegexp = re
+	}
+	if c.method == "" {
+		c.method = fasthttp.MethodHead
+		if c.body != nil || c.bodyRegexp != nil {
+			c.method = fasthttp.MethodGet
+		}
+	}
+	return c, nil
+}
+
+// healthy reports whether status is one of the healthy statuses.
+func (c *healthCheck) healthy(status int) bool {
+	if len(c.statuses) == 0 {
+		return status < 500
+	}
+	for _, r := range c.statuses {
+		if r.min <= status && status <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+// probe sends the check request to be through client and returns nil iff
+// the backend is reachable and its response is healthy. Request/response
+// objects are acquired from fasthttp pools to keep the checker
+// allocation-free.
+func (c *healthCheck) probe(client *fasthttp.Client, be *proxyBackend) error {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	if c.path != "" {
+		req.URI().SetScheme(be.url.Scheme)
+		req.URI().SetHost(be.url.Host)
+		req.URI().SetPath(c.path)
+	} else {
+		req.SetRequestURI(be.url.String())
+	}
+	req.Header.SetMethod(c.method)
+	for k, v := range c.headers {
+		if strings.EqualFold(k, fasthttp.HeaderHost) {
+			req.Header.SetHost(v)
+			req.UseHostHeader = true
+			continue
+		}
+		req.Header.Set(k, v)
+	}
+	if err := client.DoTimeout(req, resp, c.timeout); err != nil {
+		return err
+	}
+	if code := resp.StatusCode(); !c.healthy(code) {
+		return fmt.Errorf("status %d", code)
+	}
+	if c.body != nil && !bytes.Contains(resp.Body(), c.body) {
+		return errors.New("body does not contain the expected string")
+	}
+	if c.bodyRegexp != nil && !c.bodyRegexp.Match(resp.Body()) {
+		return errors.New("body does not match the expected pattern")
+	}
+	return nil
+}
+
+// backendChecks is the state of the active health check of a backend. The
+// counts are only accessed by the checker goroutine.
+type backendChecks struct {
+	successes int
+	failures  int
+	// up and down count the transitions of the alive state.
+	up   *metrics.Counter
+	down *metrics.Counter
+}
+
+// startHealthCheck launches a background goroutine that probes each backend
+// at the interval of the check. A nil check disables the checker entirely.
+func (b *proxyBalancer) startHealthCheck() {
+	if b.check == nil {
+		return
+	}
+	ticker := time.NewTicker(b.check.interval)
+	client := &fasthttp.Client{
+		ReadTimeout:  b.check.timeout,
+		WriteTimeout: b.check.timeout,
+	}
+	if b.tls != nil {
+		client.ConfigureClient = b.tls.configureClient
+	}
+	go func() {
+		defer ticker.Stop()
+
+		b.runHealthCheck(ticker.C, client)
+	}()
+}
+
+// runHealthCheck iterates over tick events, probes every backend through
+// client and updates their alive state. Exits when tick is closed or the
+// balancer is closed. Extracted from startHealthCheck so tests can drive the
+// loop with a synthetic channel.
+func (b *proxyBalancer) runHealthCheck(tick <-chan time.Time, client *fasthttp.Client) {
+	c := b.check
+	for _, be := range b.backends {
+		// Counters live across reloads, so they are only created for the
+		// backends that are checked.
+		label := metrics.L("backend", be.url.String())
+		be.checks.up = metrics.Default.Counter(metricBackendTransitions,
+			"Total number of transitions of the proxy backend by the health checker by state.",
+			label, metrics.L("state", "up"))
+		be.checks.down = metrics.Default.Counter(metricBackendTransitions,
+			"Total number of transitions of the proxy backend by the health checker by state.",
+			label, metrics.L("state", "down"))
+	}
+	for {
+		select {
+		case <-b.done:
+			return
+		case _, ok := <-tick:
+			if !ok {
+				return
+			}
+		}
+		for _, be := range b.backends {
+			b.observeCheck(be, c.probe(client, be), c)
+		}
+	}
+}
+
+// observeCheck records the result of a check of be, and flips its alive
+// state after rise successes or fall failures in a row.
+func (b *proxyBalancer) observeCheck(be *proxyBackend, err error, c *healthCheck) {
+	checks := &be.checks
+	if err == nil {
+		checks.successes++
+		checks.failures = 0
+		if !be.alive.Load() && checks.successes >= c.rise {
+			be.alive.Store(true)
+			checks.up.Inc()
+			b.l.Printf("backend %s back online", be.url.String())
+		}
+		return
+	}
+	checks.failures++
+	checks.successes = 0
+	if be.alive.Load() && checks.failures >= c.fall {
+		be.alive.Store(false)
+		checks.down.Inc()
+		b.l.Printf("backend %s marked down: err=%v", be.url.String(), err)
+	}
+}
@@ -0,0 +1,243 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fasthttpd/fasthttpd/pkg/logger"
+	"github.com/mojatter/tree"
+	"github.com/valyala/fasthttp"
+)
+
+func TestParseStatusRange(t *testing.T) {
+	tests := []struct {
+		s      string
+		want   statusRange
+		errstr string
+	}{
+		{s: "200", want: statusRange{min: 200, max: 200}},
+		{s: "2xx", want: statusRange{min: 200, max: 299}},
+		{s: "3XX", want: statusRange{min: 300, max: 399}},
+		{s: "200-399", want: statusRange{min: 200, max: 399}},
+		{s: "399-200", errstr: "invalid status range: 399-200"},
+		{s: "6xx", errstr: "invalid status range: 6xx"},
+		{s: "ok", errstr: "invalid status range: ok"},
+	}
+	for i, test := range tests {
+		got, err := parseStatusRange(test.s)
+		if test.errstr != "" {
+			if err == nil || err.Error() != test.errstr {
+				t.Errorf("tests[%d] error %v; want %q", i, err, test.errstr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("tests[%d] unexpected error: %v", i, err)
+		}
+		if got != test.want {
+			t.Errorf("tests[%d] got %+v; want %+v", i, got, test.want)
+		}
+	}
+}
+
+func TestHealthCheck_Probe(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			if r.Host != "health.local" || r.Header.Get("X-Check") != "1" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Write([]byte(`{"status": "ok"}`)) //nolint:errcheck
+		case "/degraded":
+			w.Write([]byte(`{"status": "degraded"}`)) //nolint:errcheck
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer backend.Close()
+
+	be, err := newProxyBackend(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &fasthttp.Client{}
+	headers := tree.Map{"Host": tree.V("health.local"), "X-Check": tree.V("1")}
+
+	testCases := []struct {
+		caseName string
+		check    tree.Map
+		errstr   string
+	}{
+		{
+			caseName: "healthy",
+			check:    tree.Map{"path": tree.V("/healthz"), "headers": headers},
+		}, {
+			caseName: "headers are required",
+			check:    tree.Map{"path": tree.V("/healthz"), "statuses": tree.A(200)},
+			errstr:   "status 403",
+		}, {
+			caseName: "404 is healthy by default",
+			check:    tree.Map{"path": tree.V("/missing")},
+		}, {
+			caseName: "404 is not in statuses",
+			check:    tree.Map{"path": tree.V("/missing"), "statuses": tree.A("2xx", "300-399")},
+			errstr:   "status 404",
+		}, {
+			caseName: "body",
+			check:    tree.Map{"path": tree.V("/degraded"), "body": tree.V(`"ok"`)},
+			errstr:   "body does not contain the expected string",
+		}, {
+			caseName: "body regexp",
+			check:    tree.Map{"path": tree.V("/healthz"), "headers": headers, "bodyRegexp": tree.V(`"status":\s*"ok"`)},
+		}, {
+			caseName: "body regexp mismatch",
+			check:    tree.Map{"path": tree.V("/degraded"), "bodyRegexp": tree.V(`"status":\s*"ok"`)},
+			errstr:   "body does not match the expected pattern",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.caseName, func(t *testing.T) {
+			c, err := newHealthCheck(tree.Map{"healthCheck": tc.check})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = c.probe(client, be)
+			if tc.errstr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tc.errstr {
+				t.Errorf("error %v; want %q", err, tc.errstr)
+			}
+		})
+	}
+}
+
+func TestProxyBalancer_ObserveCheck(t *testing.T) {
+	b, err := newProxyBalancer([]string{"http://localhost"}, nil, algoRoundRobin, logger.NilLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.check, err = newHealthCheck(tree.Map{
+		"healthCheck": tree.Map{"rise": tree.V(2), "fall": tree.V(3)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Create the transition counters without probing.
+	tick := make(chan time.Time)
+	close(tick)
+	b.runHealthCheck(tick, nil)
+
+	be := b.backends[0]
+	up, down := be.checks.up.Value(), be.checks.down.Value()
+	fail := errors.New("status 500")
+	steps := []struct {
+		err   error
+		alive bool
+	}{
+		{err: fail, alive: true},
+		{err: fail, alive: true},
+		{err: nil, alive: true},
+		{err: fail, alive: true},
+		{err: fail, alive: true},
+		{err: fail, alive: false},
+		{err: nil, alive: false},
+		{err: fail, alive: false},
+		{err: nil, alive: false},
+		{err: nil, alive: true},
+	}
+	for i, step := range steps {
+		b.observeCheck(be, step.err, b.check)
+		if got := be.alive.Load(); got != step.alive {
+			t.Errorf("steps[%d] alive %v; want %v", i, got, step.alive)
+		}
+	}
+	if n := be.checks.down.Value() - down; n != 1 {
+		t.Errorf("down transitions %d; want 1", n)
+	}
+	if n := be.checks.up.Value() - up; n != 1 {
+		t.Errorf("up transitions %d; want 1", n)
+	}
+}
+
+func TestNewHealthCheck(t *testing.T) {
+	testCases := []struct {
+		caseName     string
+		cfg          tree.Map
+		wantNil      bool
+		wantInterval time.Duration
+		wantTimeout  time.Duration
+		wantMethod   string
+		errstr       string
+	}{
+		{
+			caseName: "disabled",
+			cfg:      tree.Map{},
+			wantNil:  true,
+		}, {
+			caseName:     "legacy interval",
+			cfg:          tree.Map{"healthCheckInterval": tree.V(2)},
+			wantInterval: 2 * time.Second,
+			wantTimeout:  2 * time.Second,
+			wantMethod:   fasthttp.MethodHead,
+		}, {
+			caseName:     "default interval",
+			cfg:          tree.Map{"healthCheck": tree.Map{"body": tree.V("ok")}},
+			wantInterval: defaultHealthCheckInterval,
+			wantTimeout:  maxHealthCheckTimeout,
+			wantMethod:   fasthttp.MethodGet,
+		}, {
+			caseName: "interval overrides legacy interval",
+			cfg: tree.Map{
+				"healthCheckInterval": tree.V(2),
+				"healthCheck":         tree.Map{"interval": tree.V("30s"), "timeout": tree.V("1s"), "method": tree.V("get")},
+			},
+			wantInterval: 30 * time.Second,
+			wantTimeout:  time.Second,
+			wantMethod:   fasthttp.MethodGet,
+		}, {
+			caseName: "relative path",
+			cfg:      tree.Map{"healthCheck": tree.Map{"path": tree.V("healthz")}},
+			errstr:   "healthCheck: path must start with '/': healthz",
+		}, {
+			caseName: "invalid status",
+			cfg:      tree.Map{"healthCheck": tree.Map{"statuses": tree.A("ok")}},
+			errstr:   "healthCheck: invalid status range: ok",
+		}, {
+			caseName: "invalid body regexp",
+			cfg:      tree.Map{"healthCheck": tree.Map{"bodyRegexp": tree.V("(")}},
+			errstr:   "healthCheck: error parsing regexp: missing closing ): `(`",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.caseName, func(t *testing.T) {
+			c, err := newHealthCheck(tc.cfg)
+			if tc.errstr != "" {
+				if err == nil || err.Error() != tc.errstr {
+					t.Fatalf("error %v; want %q", err, tc.errstr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.wantNil {
+				if c != nil {
+					t.Errorf("got %+v; want nil", c)
+				}
+				return
+			}
+			if c.interval != tc.wantInterval || c.timeout != tc.wantTimeout || c.method != tc.wantMethod {
+				t.Errorf("got interval %s, timeout %s, method %s; want %s, %s, %s",
+					c.interval, c.timeout, c.method, tc.wantInterval, tc.wantTimeout, tc.wantMethod)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/fasthttpd/fasthttpd/pkg/logger"
+	"github.com/fasthttpd/fasthttpd/pkg/metrics"
+	"github.com/mojatter/tree"
+	"github.com/mojatter/tree/schema"
+	"github.com/valyala/fasthttp"
+)
+
+// NewMetricsHandler returns a handler that exposes metrics.Default in the
+// Prometheus text format.
+func NewMetricsHandler(cfg tree.Map, l logger.Logger) (fasthttp.RequestHandler, error) {
+	return func(ctx *fasthttp.RequestCtx) {
+		ctx.SetContentType(metrics.ContentType)
+		ctx.SetBody(metrics.Default.AppendText(nil))
+	}, nil
+}
+
+func init() {
+	RegisterNewHandlerFunc("metrics", NewMetricsHandler)
+	config.RegisterHandlerSchema("metrics", schema.QueryRules{
+		".": schema.Map{KeyedRules: map[string]schema.Rule{
+			"type": schema.String{Enum: []string{"metrics"}},
+		}},
+	})
+}
+
+const (
+	metricRequestsTotal      = "fasthttpd_http_requests_total"
+	metricRequestDuration    = "fasthttpd_http_request_duration_seconds"
+	metricBackendUp          = "fasthttpd_proxy_backend_up"
+	metricBackendTransitions = "fasthttpd_proxy_backend_transitions_total"
+	metricMirrorRequests     = "fasthttpd_proxy_mirror_requests_total"
+)
+
+// statusClasses is the number of HTTP status classes, 1xx to 5xx.
+const statusClasses = 5
+
+var statusClassLabels = [statusClasses]string{"1xx", "2xx", "3xx", "4xx", "5xx"}
+
+type requestMetrics struct {
+	requests  *metrics.Counter
+	durations *metrics.Histogram
+}
+
+// hostMetrics records requests per route and status class of a hostHandler.
+// Series are created on first use so that only observed combinations are
+// exposed; afterwards observe only performs atomic operations.
+type hostMetrics struct {
+	host     string
+	handlers []string
+	slots    []atomic.Pointer[requestMetrics]
+}
+
+func newHostMetrics(cfg config.Config) *hostMetrics {
+	m := &hostMetrics{
+		host:     cfg.Host,
+		handlers: make([]string, len(cfg.Routes)),
+		slots:    make([]atomic.Pointer[requestMetrics], (len(cfg.Routes)+1)*statusClasses),
+	}
+	for i, r := range cfg.Routes {
+		m.handlers[i] = r.Handler
+	}
+	return m
+}
+
+// observe records a request served by the route at routeIndex (-1 when no
+// route matched) with status, which took d.
+func (m *hostMetrics) observe(routeIndex, status int, d time.Duration) {
+	class := min(max(status/100, 1), statusClasses) - 1
+	slot := &m.slots[(routeIndex+1)*statusClasses+class]
+	rm := slot.Load()
+	if rm == nil {
+		rm = m.newRequestMetrics(routeIndex, class)
+		slot.Store(rm)
+	}
+	rm.requests.Inc()
+	rm.durations.Observe(d)
+}
+
+func (m *hostMetrics) newRequestMetrics(routeIndex, class int) *requestMetrics {
+	route, handler := "none", ""
+	if routeIndex >= 0 {
+		route, handler = strconv.Itoa(routeIndex), m.handlers[routeIndex]
+	}
+	labels := []metrics.Label{
+		metrics.L("host", m.host),
+		metrics.L("route", route),
+		metrics.L("handler", handler),
+		metrics.L("code", statusClassLabels[class]),
+	}
+	return &requestMetrics{
+		requests: metrics.Default.Counter(metricRequestsTotal,
+			"Total number of HTTP requests.", labels...),
+		durations: metrics.Default.Histogram(metricRequestDuration,
+			"HTTP request latency in seconds.", metrics.DefBuckets, labels...),
+	}
+}
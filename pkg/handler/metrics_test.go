@@ -0,0 +1,141 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/fasthttpd/fasthttpd/pkg/logger"
+	"github.com/fasthttpd/fasthttpd/pkg/metrics"
+	"github.com/fasthttpd/fasthttpd/pkg/route"
+	"github.com/mojatter/tree"
+	"github.com/valyala/fasthttp"
+)
+
+func Test_hostHandler_Metrics(t *testing.T) {
+	h := newHostHandlerTest(t, "metrics.test")
+	defer h.Close()
+
+	requests := []struct {
+		path     string
+		notFound bool
+	}{
+		{path: "/img/a.png"},
+		{path: "/img/a.png", notFound: true}, // falls through to backend
+		{path: "/admin"},
+		{path: "/admin"},
+	}
+	for _, r := range requests {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.SetRequestURI(r.path)
+		if r.notFound {
+			ctx.Request.Header.Set("X-NotFound-Static", "true")
+		}
+		h.Handle(ctx)
+	}
+
+	testCases := []struct {
+		route   string
+		handler string
+		code    string
+		want    uint64
+	}{
+		{route: "0", handler: "static", code: "2xx", want: 1},
+		{route: "3", handler: "backend", code: "2xx", want: 1},
+		{route: "2", handler: "", code: "4xx", want: 2},
+	}
+	for _, tc := range testCases {
+		c := metrics.Default.Counter(metricRequestsTotal, "",
+			metrics.L("host", "metrics.test"),
+			metrics.L("route", tc.route),
+			metrics.L("handler", tc.handler),
+			metrics.L("code", tc.code))
+		if got := c.Value(); got != tc.want {
+			t.Errorf("requests{route=%q,code=%q} = %d; want %d", tc.route, tc.code, got, tc.want)
+		}
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		h.metrics.observe(0, http.StatusOK, time.Millisecond)
+	})
+	if allocs != 0 {
+		t.Errorf("observe allocs = %v; want 0", allocs)
+	}
+}
+
+func Test_hostHandler_MetricsFallThrough(t *testing.T) {
+	h := newHostHandlerTest(t, "fallthrough.test")
+	defer h.Close()
+	cfg := config.Config{
+		Host:     "fallthrough.test",
+		Handlers: map[string]tree.Map{"static": {}, "backend": {}},
+		Routes: []config.Route{
+			{Path: "/img/", Match: config.MatchPrefix, Handler: "static", NextIfNotFound: true},
+			{Path: "/view", Match: config.MatchPrefix, Handler: "backend"},
+		},
+	}
+	rs, err := route.NewRoutes(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.routes = rs
+	h.metrics = newHostMetrics(cfg)
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/img/a.png")
+	ctx.Request.Header.Set("X-NotFound-Static", "true")
+	h.Handle(ctx)
+	if got := ctx.Response.StatusCode(); got != http.StatusNotFound {
+		t.Fatalf("status = %d; want %d", got, http.StatusNotFound)
+	}
+
+	testCases := []struct {
+		route   string
+		handler string
+		want    uint64
+	}{
+		{route: "0", handler: "static", want: 1},
+		{route: "none", handler: "", want: 0},
+	}
+	for _, tc := range testCases {
+		c := metrics.Default.Counter(metricRequestsTotal, "",
+			metrics.L("host", "fallthrough.test"),
+			metrics.L("route", tc.route),
+			metrics.L("handler", tc.handler),
+			metrics.L("code", "4xx"))
+		if got := c.Value(); got != tc.want {
+			t.Errorf("requests{route=%q,code=\"4xx\"} = %d; want %d", tc.route, got, tc.want)
+		}
+	}
+}
+
+func TestNewMetricsHandler(t *testing.T) {
+	_, closer, err := NewProxyHandlerCloser(tree.Map{"url": tree.V("http://metrics-backend.test")}, logger.NilLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := NewMetricsHandler(tree.Map{"type": tree.V("metrics")}, logger.NilLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scrape := func() string {
+		ctx := &fasthttp.RequestCtx{}
+		h(ctx)
+		if got := string(ctx.Response.Header.ContentType()); got != metrics.ContentType {
+			t.Errorf("content type = %q; want %q", got, metrics.ContentType)
+		}
+		return string(ctx.Response.Body())
+	}
+
+	up := `fasthttpd_proxy_backend_up{backend="http://metrics-backend.test"} 1`
+	if body := scrape(); !strings.Contains(body, up) {
+		t.Errorf("body does not contain %q:\n%s", up, body)
+	}
+	closer.Close()
+	if body := scrape(); strings.Contains(body, "metrics-backend.test") {
+		t.Errorf("closed proxy still exposes its backend:\n%s", body)
+	}
+}
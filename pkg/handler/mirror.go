@@ -0,0 +1,181 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/fasthttpd/fasthttpd/pkg/logger"
+	"github.com/fasthttpd/fasthttpd/pkg/metrics"
+	"github.com/mojatter/tree"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	defaultMirrorMaxBodySize    = 1 << 20
+	defaultMirrorMaxConcurrency = 64
+	defaultMirrorTimeout        = 5 * time.Second
+)
+
+// mirrorRandomPercentage returns a random number in [0, 100). It is a
+// variable so that tests can replace it.
+var mirrorRandomPercentage = func() int {
+	return rand.IntN(100)
+}
+
+// proxyMirrorConfig is the 'mirror' entry of the proxy handler config.
+type proxyMirrorConfig struct {
+	URLs []string `yaml:"urls"`
+	// Percentage is the percentage of the requests to mirror, 100 when
+	// zero.
+	Percentage int `yaml:"percentage"`
+	// MaxBodySize is the largest request body to mirror. Requests with a
+	// larger body are not mirrored.
+	MaxBodySize config.Size `yaml:"maxBodySize"`
+	// MaxConcurrency caps the mirrored requests in flight. A request is
+	// not mirrored while the cap is reached.
+	MaxConcurrency int             `yaml:"maxConcurrency"`
+	Timeout        config.Duration `yaml:"timeout"`
+}
+
+type mirrorTarget struct {
+	be      *proxyBackend
+	sent    *metrics.Counter
+	failed  *metrics.Counter
+	dropped *metrics.Counter
+	// failing is set from a failed request until a successful one, so
+	// that only the changes are logged rather than every failure.
+	failing atomic.Bool
+}
+
+// proxyMirror sends copies of the proxied requests to shadow backends in
+// the background and ignores their responses.
+type proxyMirror struct {
+	targets     []*mirrorTarget
+	percentage  int
+	maxBodySize int
+	timeout     time.Duration
+	sem         chan struct{}
+	wg          sync.WaitGroup
+	l           logger.Logger
+}
+
+func newProxyMirror(cfg tree.Node, l logger.Logger) (*proxyMirror, error) {
+	mc := &proxyMirrorConfig{}
+	if err := tree.UnmarshalViaYAML(cfg, mc); err != nil {
+		return nil, fmt.Errorf("mirror: %w", err)
+	}
+	if len(mc.URLs) == 0 {
+		return nil, errors.New("mirror: require 'urls' entry")
+	}
+	m := &proxyMirror{
+		percentage:  mc.Percentage,
+		maxBodySize: int(mc.MaxBodySize),
+		timeout:     time.Duration(mc.Timeout),
+		l:           l,
+	}
+	if m.percentage <= 0 {
+		m.percentage = 100
+	}
+	if m.maxBodySize <= 0 {
+		m.maxBodySize = defaultMirrorMaxBodySize
+	}
+	if m.timeout <= 0 {
+		m.timeout = defaultMirrorTimeout
+	}
+	maxConcurrency := mc.MaxConcurrency
+	if maxConcurrency <= 0 {
+		maxConcurrency = defaultMirrorMaxConcurrency
+	}
+	m.sem = make(chan struct{}, maxConcurrency)
+	for _, u := range mc.URLs {
+		be, err := newProxyBackend(u)
+		if err != nil {
+			return nil, fmt.Errorf("mirror: %w", err)
+		}
+		// The responses are discarded, so they need not be streamed.
+		be.client.StreamResponseBody = false
+		be.client.ReadTimeout = m.timeout
+		be.client.WriteTimeout = m.timeout
+		label := metrics.L("backend", be.url.String())
+		m.targets = append(m.targets, &mirrorTarget{
+			be: be,
+			sent: metrics.Default.Counter(metricMirrorRequests,
+				"Total number of requests mirrored to the shadow backend by result.",
+				label, metrics.L("result", "sent")),
+			failed: metrics.Default.Counter(metricMirrorRequests,
+				"Total number of requests mirrored to the shadow backend by result.",
+				label, metrics.L("result", "failed")),
+			dropped: metrics.Default.Counter(metricMirrorRequests,
+				"Total number of requests mirrored to the shadow backend by result.",
+				label, metrics.L("result", "dropped")),
+		})
+	}
+	return m, nil
+}
+
+// Mirror sends copies of the request of ctx to the shadow backends in the
+// background. It must be called before the request is forwarded, since
+// forwarding consumes a streamed body.
+func (m *proxyMirror) Mirror(ctx *fasthttp.RequestCtx, rw *proxyRewrite) {
+	if m.percentage < 100 && mirrorRandomPercentage() >= m.percentage {
+		return
+	}
+	req := &ctx.Request
+	// Do not read a streamed body of unknown or excessive length.
+	if n := req.Header.ContentLength(); n > m.maxBodySize || (n < 0 && req.IsBodyStream()) {
+		return
+	}
+	if len(req.Body()) > m.maxBodySize {
+		return
+	}
+	for _, t := range m.targets {
+		select {
+		case m.sem <- struct{}{}:
+		default:
+			t.dropped.Inc()
+			continue
+		}
+		mreq := fasthttp.AcquireRequest()
+		req.CopyTo(mreq)
+		t.be.rewriteRequest(mreq, ctx, rw)
+		m.wg.Add(1)
+		go m.send(t, mreq)
+	}
+}
+
+func (m *proxyMirror) send(t *mirrorTarget, req *fasthttp.Request) {
+	defer func() {
+		fasthttp.ReleaseRequest(req)
+		<-m.sem
+		m.wg.Done()
+	}()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	if err := t.be.client.DoTimeout(req, resp, m.timeout); err != nil {
+		t.failed.Inc()
+		if !t.failing.Swap(true) {
+			m.l.Printf("mirror %s failing: err=%v", t.be.url.String(), err)
+		}
+		return
+	}
+	t.sent.Inc()
+	if t.failing.Swap(false) {
+		m.l.Printf("mirror %s back online", t.be.url.String())
+	}
+}
+
+// Close waits for the mirrored requests in flight and closes idle
+// connections to the shadow backends.
+func (m *proxyMirror) Close() error {
+	m.wg.Wait()
+	for _, t := range m.targets {
+		t.be.client.CloseIdleConnections()
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fasthttpd/fasthttpd/pkg/logger"
+	"github.com/mojatter/tree"
+	"github.com/valyala/fasthttp"
+)
+
+type mirroredRequest struct {
+	method        string
+	uri           string
+	host          string
+	forwardedFor  string
+	authorization string
+	body          string
+}
+
+// newMirrorTestServers starts a backend and a shadow server. The shadow
+// sends every request it receives to the returned channel, and blocks
+// until release is closed if release is not nil.
+func newMirrorTestServers(t *testing.T, release chan struct{}) (backend, shadow *httptest.Server, got chan mirroredRequest) {
+	backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("backend")) //nolint:errcheck
+	}))
+	t.Cleanup(backend.Close)
+	got = make(chan mirroredRequest, 16)
+	shadow = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- mirroredRequest{
+			method:        r.Method,
+			uri:           r.URL.RequestURI(),
+			host:          r.Host,
+			forwardedFor:  r.Header.Get("X-Forwarded-For"),
+			authorization: r.Header.Get("Authorization"),
+			body:          string(body),
+		}
+		if release != nil {
+			<-release
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(shadow.Close)
+	return backend, shadow, got
+}
+
+func newMirrorTestCtx(method, uri, body string) *fasthttp.RequestCtx {
+	req := &fasthttp.Request{}
+	req.Header.SetMethod(method)
+	req.Header.SetHost("example.com")
+	req.SetRequestURI(uri)
+	req.SetBodyString(body)
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(req, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 12345}, nil)
+	return ctx
+}
+
+func TestProxyHandler_Mirror(t *testing.T) {
+	backend, shadow, got := newMirrorTestServers(t, nil)
+
+	h, closer, err := NewProxyHandlerCloser(tree.Map{
+		"url": tree.V(backend.URL),
+		"mirror": tree.Map{
+			"urls":        tree.A(shadow.URL + "/shadow/"),
+			"maxBodySize": tree.V("8"),
+		},
+	}, logger.NilLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := newMirrorTestCtx(http.MethodPost, "/a?x=1", "hello")
+	ctx.Request.Header.Set("Authorization", "Bearer token")
+	// The auth filters set the authenticated user as the URI username.
+	ctx.URI().SetUsername("fast")
+	h(ctx)
+	if code, body := ctx.Response.StatusCode(), string(ctx.Response.Body()); code != http.StatusOK || body != "backend" {
+		t.Errorf("response = %d %q; want %d %q", code, body, http.StatusOK, "backend")
+	}
+	select {
+	case r := <-got:
+		want := mirroredRequest{
+			method:        http.MethodPost,
+			uri:           "/shadow/a?x=1",
+			host:          "example.com",
+			forwardedFor:  "10.0.0.1",
+			authorization: "Bearer token",
+			body:          "hello",
+		}
+		if r != want {
+			t.Errorf("mirrored %+v; want %+v", r, want)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("request was not mirrored")
+	}
+
+	// A body over maxBodySize is forwarded but not mirrored.
+	ctx = newMirrorTestCtx(http.MethodPost, "/large", "too large body")
+	h(ctx)
+	if code := ctx.Response.StatusCode(); code != http.StatusOK {
+		t.Errorf("status = %d; want %d", code, http.StatusOK)
+	}
+	closer.Close()
+	select {
+	case r := <-got:
+		t.Errorf("unexpected mirrored request %+v", r)
+	default:
+	}
+}
+
+func TestProxyMirror_Percentage(t *testing.T) {
+	saved := mirrorRandomPercentage
+	defer func() { mirrorRandomPercentage = saved }()
+
+	backend, shadow, got := newMirrorTestServers(t, nil)
+	h, closer, err := NewProxyHandlerCloser(tree.Map{
+		"url": tree.V(backend.URL),
+		"mirror": tree.Map{
+			"urls":       tree.A(shadow.URL),
+			"percentage": tree.V(10),
+		},
+	}, logger.NilLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{9, 10, 99, 0} {
+		mirrorRandomPercentage = func() int { return n }
+		h(newMirrorTestCtx(http.MethodGet, "/", ""))
+	}
+	closer.Close()
+	if n := len(got); n != 2 {
+		t.Errorf("mirrored %d requests; want 2", n)
+	}
+}
+
+func TestProxyMirror_MaxConcurrency(t *testing.T) {
+	release := make(chan struct{})
+	backend, shadow, got := newMirrorTestServers(t, release)
+	h, closer, err := NewProxyHandlerCloser(tree.Map{
+		"url": tree.V(backend.URL),
+		"mirror": tree.Map{
+			"urls":           tree.A(shadow.URL),
+			"maxConcurrency": tree.V(1),
+		},
+	}, logger.NilLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := closer.(*proxyBalancer).mirror
+	dropped := m.targets[0].dropped.Value()
+
+	h(newMirrorTestCtx(http.MethodGet, "/1", ""))
+	select {
+	case <-got:
+	case <-time.After(3 * time.Second):
+		t.Fatal("request was not mirrored")
+	}
+	// The shadow blocks the first request, so the second is dropped.
+	ctx := newMirrorTestCtx(http.MethodGet, "/2", "")
+	h(ctx)
+	if code := ctx.Response.StatusCode(); code != http.StatusOK {
+		t.Errorf("status = %d; want %d", code, http.StatusOK)
+	}
+	if n := m.targets[0].dropped.Value() - dropped; n != 1 {
+		t.Errorf("dropped %d requests; want 1", n)
+	}
+	close(release)
+	closer.Close()
+	if n := len(got); n != 0 {
+		t.Errorf("mirrored %d more requests; want 0", n)
+	}
+}
+
+func TestProxyMirror_LogTransitions(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	var mu sync.Mutex
+	var logs []string
+	l := &logger.LoggerDelegator{PrintfFunc: func(format string, args ...any) {
+		mu.Lock()
+		defer mu.Unlock()
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}}
+	backend, _, _ := newMirrorTestServers(t, nil)
+	h, closer, err := NewProxyHandlerCloser(tree.Map{
+		"url":    tree.V(backend.URL),
+		"mirror": tree.Map{"urls": tree.A("http://" + addr)},
+	}, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := closer.(*proxyBalancer).mirror
+	defer closer.Close()
+
+	for range 3 {
+		h(newMirrorTestCtx(http.MethodGet, "/", ""))
+		m.wg.Wait()
+	}
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("cannot listen on %s again: %v", addr, err)
+	}
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	s.Listener.Close()
+	s.Listener = ln
+	s.Start()
+	defer s.Close()
+	for range 3 {
+		h(newMirrorTestCtx(http.MethodGet, "/", ""))
+		m.wg.Wait()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(logs) != 2 || !strings.Contains(logs[0], "failing") || !strings.Contains(logs[1], "back online") {
+		t.Errorf("unexpected logs %q; want a failing and a back online", logs)
+	}
+}
+
+func TestNewProxyMirror_Errors(t *testing.T) {
+	testCases := []struct {
+		caseName string
+		mirror   tree.Map
+		errstr   string
+	}{
+		{
+			caseName: "missing urls",
+			mirror:   tree.Map{"percentage": tree.V(10)},
+			errstr:   `failed to create proxy: mirror: require 'urls' entry`,
+		}, {
+			caseName: "unsupported scheme",
+			mirror:   tree.Map{"urls": tree.A("ftp://localhost")},
+			errstr:   `failed to create proxy: mirror: unsupported url scheme: ftp://localhost`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.caseName, func(t *testing.T) {
+			_, err := NewProxyHandler(tree.Map{
+				"url":    tree.V("http://localhost:9000"),
+				"mirror": tc.mirror,
+			}, logger.NilLogger)
+			if err == nil {
+				t.Fatalf("unexpected no error")
+			}
+			if err.Error() != tc.errstr {
+				t.Errorf("unexpected error: %q; want %q", err.Error(), tc.errstr)
+			}
+		})
+	}
+}
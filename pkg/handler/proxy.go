@@ -1,52 +1,120 @@
 package handler
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
-	"hash/fnv"
+	"io"
 	"math/rand/v2"
-	"net"
-	"net/http"
-	"net/http/httputil"
 	"net/url"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/fasthttpd/fasthttpd/pkg/config"
 	"github.com/fasthttpd/fasthttpd/pkg/logger"
+	"github.com/fasthttpd/fasthttpd/pkg/metrics"
+	"github.com/fasthttpd/fasthttpd/pkg/util"
+	"github.com/fasthttpd/fasthttpd/pkg/vars"
 	"github.com/mojatter/tree"
 	"github.com/mojatter/tree/schema"
 	"github.com/valyala/fasthttp"
-	"github.com/valyala/fasthttp/fasthttpadaptor"
 )
 
 // Supported algorithms for NewProxyHandler.
 const (
-	algoRoundRobin = "round-robin"
-	algoRandom     = "random"
-	algoIPHash     = "ip-hash"
+	algoRoundRobin     = "round-robin"
+	algoRandom         = "random"
+	algoIPHash         = "ip-hash"
+	algoLeastConn      = "least-conn"
+	algoConsistentHash = "consistent-hash"
 )
 
 var supportedAlgorithms = map[string]struct{}{
-	algoRoundRobin: {},
-	algoRandom:     {},
-	algoIPHash:     {},
+	algoRoundRobin:     {},
+	algoRandom:         {},
+	algoIPHash:         {},
+	algoLeastConn:      {},
+	algoConsistentHash: {},
 }
 
 type proxyBackend struct {
-	url     *url.URL
-	handler http.Handler
-	alive   atomic.Bool
+	url      *url.URL
+	client   *fasthttp.HostClient
+	weight   int
+	alive    atomic.Bool
+	inflight atomic.Int64
+	checks   backendChecks
+	failures backendFailures
+	// timeout limits each try of a request, zero for no limit.
+	timeout time.Duration
+}
+
+func newProxyBackend(rawURL string) (*proxyBackend, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	isTLS := false
+	switch u.Scheme {
+	case "http":
+	case "https":
+		isTLS = true
+	default:
+		return nil, fmt.Errorf("unsupported url scheme: %s", rawURL)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host in url: %s", rawURL)
+	}
+	be := &proxyBackend{
+		url:    u,
+		weight: 1,
+		client: &fasthttp.HostClient{
+			Addr:                     fasthttp.AddMissingPort(u.Host, isTLS),
+			IsTLS:                    isTLS,
+			NoDefaultUserAgentHeader: true,
+			StreamResponseBody:       true,
+		},
+	}
+	be.alive.Store(true)
+	return be, nil
 }
 
 type proxyBalancer struct {
 	backends  []*proxyBackend
 	algorithm string
+	// sched is the weighted order of the backend indexes for round-robin,
+	// random and ip-hash.
+	sched []uint64
+	// ring is the consistent hash ring, and hashKey is the template of the
+	// key hashed onto it, or nil for the client IP.
+	ring    []ringPoint
+	hashKey *vars.Template
+	// rewrite rewrites the requests to the backends and their responses.
+	rewrite *proxyRewrite
+	// mirror sends copies of the requests to shadow backends, or nil.
+	mirror *proxyMirror
+	// sticky routes the requests of a client to the same backend, or nil.
+	sticky *proxySticky
+	// tls is the TLS config of the https backends, or nil for the
+	// defaults.
+	tls *upstreamTLS
+	// check, retry and health are nil unless configured.
+	check     *healthCheck
+	retry     *proxyRetry
+	health    *passiveHealth
 	counter   atomic.Uint64
 	l         logger.Logger
+	done      chan struct{}
+	closeOnce sync.Once
+	// unregisters remove the backend metrics on Close.
+	unregisters []func()
 }
 
-func newProxyBalancer(urls []string, algorithm string, l logger.Logger) (*proxyBalancer, error) {
+// newProxyBalancer creates a proxyBalancer of the backends at urls. The
+// backend at urls[i] has the weight weights[i], or 1 if weights is shorter.
+func newProxyBalancer(urls []string, weights []int, algorithm string, l logger.Logger) (*proxyBalancer, error) {
 	if len(urls) == 0 {
 		return nil, errors.New("require 'url' or 'urls' entry")
 	}
@@ -54,175 +122,468 @@ func newProxyBalancer(urls []string, algorithm string, l logger.Logger) (*proxyB
 		return nil, fmt.Errorf("algorithm not supported: %s", algorithm)
 	}
 	backends := make([]*proxyBackend, 0, len(urls))
-	for _, s := range urls {
-		u, err := url.Parse(s)
+	ws := make([]int, len(urls))
+	for i, s := range urls {
+		be, err := newProxyBackend(s)
 		if err != nil {
 			return nil, err
 		}
-		rp := httputil.NewSingleHostReverseProxy(u)
-		rp.ErrorLog = l.LogLogger()
-		be := &proxyBackend{url: u, handler: rp}
-		be.alive.Store(true)
+		if i < len(weights) {
+			if weights[i] < 0 {
+				return nil, fmt.Errorf("negative weight: %d: %s", weights[i], s)
+			}
+			be.weight = max(weights[i], 1)
+		}
+		ws[i] = be.weight
 		backends = append(backends, be)
 	}
-	return &proxyBalancer{
+	b := &proxyBalancer{
 		backends:  backends,
 		algorithm: algorithm,
+		sched:     weightedSchedule(ws),
+		rewrite:   defaultProxyRewrite,
 		l:         l,
-	}, nil
+		done:      make(chan struct{}),
+	}
+	if algorithm == algoConsistentHash {
+		b.ring = newHashRing(backends)
+	}
+	return b, nil
+}
+
+// Close stops the health checker and the reloading of the certificates,
+// removes the backend metrics and closes idle upstream connections. It is
+// safe to call more than once.
+func (b *proxyBalancer) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.done)
+		if b.mirror != nil {
+			b.mirror.Close()
+		}
+		for _, unregister := range b.unregisters {
+			unregister()
+		}
+		for _, be := range b.backends {
+			be.client.CloseIdleConnections()
+		}
+	})
+	return nil
+}
+
+// registerMetrics exposes the alive state of every backend as
+// fasthttpd_proxy_backend_up.
+func (b *proxyBalancer) registerMetrics() {
+	for _, be := range b.backends {
+		unregister := metrics.Default.GaugeFunc(metricBackendUp,
+			"Whether the proxy backend is up (1) or marked down by the health checker (0).",
+			func() float64 {
+				if be.alive.Load() {
+					return 1
+				}
+				return 0
+			},
+			metrics.L("backend", be.url.String()))
+		b.unregisters = append(b.unregisters, unregister)
+	}
 }
 
 // pick returns the next alive backend according to the configured algorithm,
-// skipping backends that are currently marked down by the health checker.
-func (b *proxyBalancer) pick(r *http.Request) *proxyBackend {
+// skipping backends that are currently marked down by the health checker or
+// ejected by the passive health, and the backends already tried.
+func (b *proxyBalancer) pick(ctx *fasthttp.RequestCtx, tried []*proxyBackend) *proxyBackend {
 	n := uint64(len(b.backends))
 	if n == 0 {
 		return nil
 	}
 	var start uint64
 	switch b.algorithm {
+	case algoLeastConn:
+		return b.pickLeastConn(tried)
+	case algoConsistentHash:
+		return b.pickHash(ctx, tried)
 	case algoRandom:
-		start = rand.Uint64N(n)
+		start = b.sched[rand.Uint64N(uint64(len(b.sched)))]
 	case algoIPHash:
-		start = hashClientIP(r) % n
+		start = b.sched[hashClientIP(ctx)%uint64(len(b.sched))]
 	default: // round-robin
-		start = b.counter.Add(1) - 1
+		start = b.sched[(b.counter.Add(1)-1)%uint64(len(b.sched))]
 	}
 	for i := range n {
-		be := b.backends[(start+i)%n]
-		if be.alive.Load() {
+		if be := b.backends[(start+i)%n]; be.available(tried) {
 			return be
 		}
 	}
 	return nil
 }
 
-func (b *proxyBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	be := b.pick(r)
-	if be == nil {
-		http.Error(w, "no healthy backend", http.StatusServiceUnavailable)
-		return
+// Handle proxies the request to the picked backend. A failed request is
+// tried again on another backend, or on the same one if there is no other,
+// as configured by retry. With sticky, the backend named by the affinity
+// cookie is used while it is available. The response is 504 if the
+// backend timed out, or 502 if it failed otherwise.
+func (b *proxyBalancer) Handle(ctx *fasthttp.RequestCtx) {
+	var sticky *proxyBackend
+	var renew bool
+	if b.sticky != nil {
+		sticky, renew = b.sticky.backend(ctx)
 	}
-	be.handler.ServeHTTP(w, r)
-}
-
-func hashClientIP(r *http.Request) uint64 {
-	host := r.RemoteAddr
-	if h, _, err := net.SplitHostPort(host); err == nil {
-		host = h
+	be := sticky
+	if be == nil || !be.available(nil) {
+		be = b.pick(ctx, nil)
 	}
-	hs := fnv.New64a()
-	hs.Write([]byte(host))
-	return hs.Sum64()
-}
-
-// startHealthCheck launches a background goroutine that HEADs each backend.
-// intervalSec <= 0 disables the checker entirely.
-//
-// The HEAD timeout is derived as min(interval, 5s): capping at the interval
-// guarantees in-flight checks cannot pile up across ticks, and 5s is a safe
-// upper bound for realistic backends.
-func (b *proxyBalancer) startHealthCheck(intervalSec int) {
-	if intervalSec <= 0 {
+	if be == nil {
+		ctx.Error("no healthy backend", fasthttp.StatusServiceUnavailable)
 		return
 	}
-	interval := time.Duration(intervalSec) * time.Second
-	timeout := min(interval, 5*time.Second)
-	ticker := time.NewTicker(interval)
-	client := &fasthttp.Client{
-		ReadTimeout:  timeout,
-		WriteTimeout: timeout,
+	if b.mirror != nil {
+		b.mirror.Mirror(ctx, b.rewrite)
 	}
-	go func() {
-		defer ticker.Stop()
-
-		b.runHealthCheck(ticker.C, client)
-	}()
-}
-
-// runHealthCheck iterates over tick events, HEADs every backend through client
-// and updates their alive state. Exits when tick is closed. Extracted from
-// startHealthCheck so tests can drive the loop with a synthetic channel.
-func (b *proxyBalancer) runHealthCheck(tick <-chan time.Time, client *fasthttp.Client) {
-	for range tick {
-		for _, be := range b.backends {
-			err := headBackend(client, be.url.String())
-			alive := err == nil
-			if was := be.alive.Swap(alive); was != alive {
-				if alive {
-					b.l.Printf("backend %s back online", be.url.String())
+	tries := b.retry.tries(&ctx.Request)
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	var deadline time.Time
+	if b.retry != nil && b.retry.timeout > 0 {
+		deadline = time.Now().Add(b.retry.timeout)
+	}
+	var triedBuf [4]*proxyBackend
+	tried := triedBuf[:0]
+	for i := 1; ; i++ {
+		be.inflight.Add(1)
+		err := be.do(req, ctx, b.rewrite, deadline)
+		be.inflight.Add(-1)
+		failed := err != nil || b.retry.failed(ctx.Response.StatusCode())
+		b.health.observe(be, failed)
+		if !failed || i >= tries || (!deadline.IsZero() && !time.Now().Before(deadline)) {
+			if err != nil {
+				b.l.Printf("proxy error: %v", err)
+				ctx.Response.Reset()
+				if isTimeout(err) {
+					ctx.Response.SetStatusCode(fasthttp.StatusGatewayTimeout)
 				} else {
-					b.l.Printf("backend %s marked down: err=%v", be.url.String(), err)
+					ctx.Response.SetStatusCode(fasthttp.StatusBadGateway)
 				}
+			} else if b.sticky != nil && (be != sticky || renew) {
+				b.sticky.setCookie(ctx, be)
 			}
+			return
 		}
+		tried = append(tried, be)
+		if next := b.pick(ctx, tried); next != nil {
+			be = next
+		}
+		ctx.Response.Reset()
 	}
 }
 
-// headBackend issues a HEAD request via fasthttp.Client and returns nil iff the
-// backend is reachable and responded with a non-5xx status. Request/response
-// objects are acquired from fasthttp pools to keep the checker allocation-free.
-func headBackend(client *fasthttp.Client, url string) error {
-	req := fasthttp.AcquireRequest()
-	defer fasthttp.ReleaseRequest(req)
+// hashClientIP returns the FNV-1a hash of the client IP in text form, so
+// that an IPv4 address maps the same whether it is held in 4 or 16 bytes.
+func hashClientIP(ctx *fasthttp.RequestCtx) uint64 {
+	var buf [64]byte
+	ip, _ := ctx.RemoteIP().AppendText(buf[:0])
+	return util.HashFNV1a(ip)
+}
 
-	resp := fasthttp.AcquireResponse()
-	defer fasthttp.ReleaseResponse(resp)
+// hopHeaders are the hop-by-hop headers that must not be forwarded, see
+// RFC 9110 section 7.6.1. Connection and Transfer-Encoding are managed by
+// fasthttp itself.
+var hopHeaders = []string{
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Upgrade",
+}
+
+var proxyBufPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, 256)
+		return &buf
+	},
+}
 
-	req.SetRequestURI(url)
-	req.Header.SetMethod(fasthttp.MethodHead)
-	if err := client.Do(req, resp); err != nil {
+// requestBodyStream hides the io.Closer of the body stream of ctx.Request
+// from the outgoing copy, so that the stream is released with ctx only.
+type requestBodyStream struct {
+	io.Reader
+}
+
+// do forwards a copy of ctx.Request in req to the backend and streams the
+// backend response into ctx.Response, both rewritten by rw. ctx.Request is
+// left as the client sent it. A non-zero deadline limits the time to get
+// the response, and so does the timeout of be.
+func (be *proxyBackend) do(req *fasthttp.Request, ctx *fasthttp.RequestCtx, rw *proxyRewrite, deadline time.Time) error {
+	if be.timeout > 0 {
+		if d := time.Now().Add(be.timeout); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+	ctx.Request.CopyTo(req)
+	if ctx.Request.IsBodyStream() {
+		req.SetBodyStream(requestBodyStream{ctx.RequestBodyStream()}, ctx.Request.Header.ContentLength())
+	}
+	be.rewriteRequest(req, ctx, rw)
+	var err error
+	if deadline.IsZero() {
+		err = be.client.Do(req, &ctx.Response)
+	} else {
+		err = be.client.DoDeadline(req, &ctx.Response, deadline)
+	}
+	if err != nil {
 		return err
 	}
-	if code := resp.StatusCode(); code >= 500 {
-		return fmt.Errorf("status %d", code)
+	for _, h := range hopHeaders {
+		ctx.Response.Header.Del(h)
 	}
+	rw.rewriteResponse(ctx)
 	return nil
 }
 
-func proxyURLs(cfg tree.Map) ([]string, error) {
+// rewriteRequest rewrites req, a copy of ctx.Request, to be sent to the
+// backend as configured by rw. The Host header sent by the client is kept
+// unless rw says otherwise.
+func (be *proxyBackend) rewriteRequest(req *fasthttp.Request, ctx *fasthttp.RequestCtx, rw *proxyRewrite) {
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+
+	bp := proxyBufPool.Get().(*[]byte)
+	buf := (*bp)[:0]
+
+	// The forwarding headers refer to the Host header of the client, so
+	// they are set before the host is rewritten.
+	buf = rw.setForwardedHeaders(req, ctx, buf)
+	buf = rw.setHost(req, ctx, be, buf)
+
+	uri := req.URI()
+	// fasthttp replaces the Authorization header with the credentials of
+	// the URI, which the auth filters set to the user they authenticated.
+	uri.SetUsername("")
+	uri.SetPassword("")
+	uri.SetScheme(be.url.Scheme)
+	if p := be.url.Path; rw.rewritesPath() || (p != "" && p != "/") {
+		// Join with the escaped form of the normalized path so that
+		// SetPathBytes decodes it exactly once.
+		rp := uri.RequestURI()
+		if i := bytes.IndexByte(rp, '?'); i >= 0 {
+			rp = rp[:i]
+		}
+		buf, rp = rw.appendPath(buf[:0], ctx, rp)
+		if p != "" && p != "/" {
+			n := len(buf)
+			buf = joinURLPath(buf, p, rp)
+			rp = buf[n:]
+		}
+		uri.SetPathBytes(rp)
+	}
+	if q := be.url.RawQuery; q != "" {
+		buf = append(buf[:0], q...)
+		if rq := uri.QueryString(); len(rq) > 0 {
+			buf = append(buf, '&')
+			buf = append(buf, rq...)
+		}
+		uri.SetQueryStringBytes(buf)
+	}
+
+	*bp = buf
+	proxyBufPool.Put(bp)
+}
+
+// joinURLPath appends base and p joined with a single slash to dst.
+func joinURLPath(dst []byte, base string, p []byte) []byte {
+	dst = append(dst, base...)
+	switch {
+	case strings.HasSuffix(base, "/") && len(p) > 0 && p[0] == '/':
+		dst = append(dst, p[1:]...)
+	case !strings.HasSuffix(base, "/") && (len(p) == 0 || p[0] != '/'):
+		dst = append(dst, '/')
+		dst = append(dst, p...)
+	default:
+		dst = append(dst, p...)
+	}
+	return dst
+}
+
+// appendEscapedPath appends p to dst with the bytes that are not allowed in
+// a URL path percent-encoded, see RFC 3986 section 3.3.
+func appendEscapedPath(dst, p []byte) []byte {
+	const upperhex = "0123456789ABCDEF"
+	for _, c := range p {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			strings.IndexByte("-._~!$&'()*+,;=:@/", c) >= 0:
+			dst = append(dst, c)
+		default:
+			dst = append(dst, '%', upperhex[c>>4], upperhex[c&0x0f])
+		}
+	}
+	return dst
+}
+
+// proxyURLs returns the backend URLs and their weights. An entry of 'urls'
+// is either a URL or a map of 'url' and 'weight'.
+func proxyURLs(cfg tree.Map) ([]string, []int, error) {
 	urls := cfg.Get("urls").Array()
 	if len(urls) == 0 {
 		single := cfg.Get("url").Value().String()
 		if single == "" {
-			return nil, errors.New("require 'url' or 'urls' entry")
+			return nil, nil, errors.New("require 'url' or 'urls' entry")
 		}
-		return []string{single}, nil
+		return []string{single}, nil, nil
 	}
 	result := make([]string, len(urls))
+	weights := make([]int, len(urls))
 	for i, u := range urls {
-		result[i] = u.Value().String()
+		if u.Type() != tree.TypeMap {
+			result[i] = u.Value().String()
+			continue
+		}
+		result[i] = u.Get("url").Value().String()
+		if result[i] == "" {
+			return nil, nil, fmt.Errorf("require 'url' in urls[%d]", i)
+		}
+		weights[i] = u.Get("weight").Value().Int()
 	}
-	return result, nil
+	return result, weights, nil
 }
 
 // NewProxyHandler creates a new proxy handler that proxies to one or more
-// backend URLs.
+// backend URLs. Requests are forwarded with pooled fasthttp.HostClient
+// connections and response bodies are streamed to the client.
 //
 // The specified cfg supports the following keys:
 //   - url                 - single backend URL (used when 'urls' is empty)
-//   - urls                - backend URL list
-//   - algorithm           - one of round-robin (default), random, ip-hash
+//   - urls                - backend URL list, optionally with weights
+//   - algorithm           - one of round-robin (default), random, ip-hash,
+//     least-conn, consistent-hash
+//   - hashKey             - key template of consistent-hash (client IP by default)
 //   - healthCheckInterval - health-check interval in seconds (0 disables)
+//   - healthCheck         - health-check request and thresholds
+//   - path                - path template sent in place of the request path
+//   - stripPrefix         - prefix removed from the request path
+//   - addPrefix           - prefix added to the request path
+//   - preserveHost        - keeps the Host header of the client (default true)
+//   - hostHeader          - Host header template sent to the backends
+//   - trustedProxies      - peers whose forwarding headers are kept (default none)
+//   - rewriteLocation     - rewrites of the Location response header
+//   - rewriteCookieDomain - rewrites of the Domain of the Set-Cookie headers
+//   - rewriteCookiePath   - rewrites of the Path of the Set-Cookie headers
+//   - mirror              - shadow backends that receive copies of requests
+//   - sticky              - affinity cookie naming the backend of a client
+//   - transport           - timeouts and connection pool of the backends
+//   - tls                 - TLS and client certificate of the https backends
+//   - retry               - retries of failed requests on other backends
+//   - maxFails            - consecutive failures that eject a backend (0 disables)
+//   - failTimeout         - window of the failures and base ejection time
 func NewProxyHandler(cfg tree.Map, l logger.Logger) (fasthttp.RequestHandler, error) {
-	urls, err := proxyURLs(cfg)
+	h, _, err := NewProxyHandlerCloser(cfg, l)
+	return h, err
+}
+
+// NewProxyHandlerCloser is the NewHandlerCloserFunc variant of
+// NewProxyHandler. The returned io.Closer stops the health checker.
+func NewProxyHandlerCloser(cfg tree.Map, l logger.Logger) (fasthttp.RequestHandler, io.Closer, error) {
+	urls, weights, err := proxyURLs(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create proxy: %w", err)
+		return nil, nil, fmt.Errorf("failed to create proxy: %w", err)
 	}
 	algorithm := cfg.Get("algorithm").Value().String()
 	if algorithm == "" {
 		algorithm = algoRoundRobin
 	}
-	b, err := newProxyBalancer(urls, algorithm, l)
+	b, err := newProxyBalancer(urls, weights, algorithm, l)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create proxy: %w", err)
+		return nil, nil, fmt.Errorf("failed to create proxy: %w", err)
+	}
+	if err := b.configure(cfg, l); err != nil {
+		b.Close()
+		return nil, nil, fmt.Errorf("failed to create proxy: %w", err)
 	}
-	b.startHealthCheck(cfg.Get("healthCheckInterval").Value().Int())
-	return fasthttpadaptor.NewFastHTTPHandler(b), nil
+	b.registerMetrics()
+	b.startHealthCheck()
+	if b.tls != nil {
+		go b.tls.watch(b.done)
+	}
+	return b.Handle, b, nil
 }
 
+// configure sets the optional features of cfg to b. Nothing is registered
+// or started here, so that b is simply closed if cfg is invalid.
+func (b *proxyBalancer) configure(cfg tree.Map, l logger.Logger) error {
+	if key := cfg.Get("hashKey").Value().String(); key != "" {
+		b.hashKey = vars.Compile(key)
+	}
+	rw, err := newProxyRewrite(cfg)
+	if err != nil {
+		return err
+	}
+	b.rewrite = rw
+	if cfg.Has("tls") {
+		t, err := newUpstreamTLS(cfg.Get("tls"), l)
+		if err != nil {
+			return err
+		}
+		b.tls = t
+		for _, be := range b.backends {
+			be.client.TLSConfig = t.clientConfig(be.url.Hostname())
+		}
+	}
+	if cfg.Has("transport") {
+		t, err := newProxyTransport(cfg.Get("transport"))
+		if err != nil {
+			return err
+		}
+		for _, be := range b.backends {
+			t.apply(be)
+		}
+	}
+	if cfg.Has("retry") {
+		r, err := newProxyRetry(cfg.Get("retry"))
+		if err != nil {
+			return err
+		}
+		b.retry = r
+	}
+	if maxFails := cfg.Get("maxFails").Value().Int(); maxFails > 0 {
+		b.health = &passiveHealth{maxFails: maxFails, failTimeout: defaultFailTimeout, l: l}
+		if cfg.Has("failTimeout") {
+			var d config.Duration
+			if err := tree.UnmarshalViaYAML(cfg.Get("failTimeout"), &d); err != nil {
+				return fmt.Errorf("failTimeout: %w", err)
+			}
+			b.health.failTimeout = time.Duration(d)
+		}
+	}
+	if cfg.Has("sticky") {
+		s, err := newProxySticky(cfg.Get("sticky"), b.backends)
+		if err != nil {
+			return err
+		}
+		b.sticky = s
+	}
+	if cfg.Has("mirror") {
+		m, err := newProxyMirror(cfg.Get("mirror"), l)
+		if err != nil {
+			return err
+		}
+		b.mirror = m
+	}
+	check, err := newHealthCheck(cfg)
+	if err != nil {
+		return err
+	}
+	b.check = check
+	return nil
+}
+
+var proxyRewriteRuleSchema = schema.Map{KeyedRules: map[string]schema.Rule{
+	"from": schema.String{},
+	"to":   schema.String{},
+}}
+
 func init() {
-	RegisterNewHandlerFunc("proxy", NewProxyHandler)
+	RegisterNewHandlerCloserFunc("proxy", NewProxyHandlerCloser)
 	config.RegisterHandlerSchema("proxy", proxySchemas("proxy"))
 }
 
@@ -235,9 +596,97 @@ func proxySchemas(typeName string) schema.QueryRules {
 			"type":                schema.String{Enum: []string{typeName}},
 			"url":                 schema.String{},
 			"urls":                schema.Array{},
-			"algorithm":           schema.String{Enum: []string{algoRoundRobin, algoRandom, algoIPHash}},
+			"algorithm":           schema.String{Enum: []string{algoRoundRobin, algoRandom, algoIPHash, algoLeastConn, algoConsistentHash}},
+			"hashKey":             schema.String{},
 			"healthCheckInterval": schema.Int{Min: tree.Int64Ptr(0)},
+			"healthCheck":         schema.Map{},
+			"path":                schema.String{},
+			"stripPrefix":         schema.String{},
+			"addPrefix":           schema.String{},
+			"preserveHost":        schema.Bool{},
+			"hostHeader":          schema.String{},
+			"trustedProxies":      schema.Array{},
+			"rewriteLocation":     schema.Array{},
+			"rewriteCookieDomain": schema.Array{},
+			"rewriteCookiePath":   schema.Array{},
+			"mirror":              schema.Map{},
+			"sticky":              schema.Map{},
+			"transport":           schema.Map{},
+			"tls":                 schema.Map{},
+			"retry":               schema.Map{},
+			"maxFails":            schema.Int{Min: tree.Int64Ptr(0)},
+			"failTimeout":         config.DurationRule{},
+		}},
+		".urls[]": schema.Or{
+			schema.String{},
+			schema.Map{KeyedRules: map[string]schema.Rule{
+				"url":    schema.String{},
+				"weight": schema.Int{Min: tree.Int64Ptr(1)},
+			}},
+		},
+		".trustedProxies[]":      schema.String{},
+		".rewriteLocation[]":     proxyRewriteRuleSchema,
+		".rewriteCookieDomain[]": proxyRewriteRuleSchema,
+		".rewriteCookiePath[]":   proxyRewriteRuleSchema,
+		".mirror": schema.Map{KeyedRules: map[string]schema.Rule{
+			"urls":           schema.Array{},
+			"percentage":     schema.Int{Min: tree.Int64Ptr(1), Max: tree.Int64Ptr(100)},
+			"maxBodySize":    config.SizeRule{},
+			"maxConcurrency": schema.Int{Min: tree.Int64Ptr(1)},
+			"timeout":        config.DurationRule{},
+		}},
+		".mirror.urls[]": schema.String{},
+		".sticky": schema.Map{KeyedRules: map[string]schema.Rule{
+			"cookie":   schema.String{},
+			"secret":   schema.String{},
+			"ttl":      config.DurationRule{},
+			"path":     schema.String{},
+			"domain":   schema.String{},
+			"secure":   schema.Bool{},
+			"httpOnly": schema.Bool{},
+			"sameSite": schema.String{Enum: []string{"Lax", "Strict", "None"}},
+		}},
+		".transport": schema.Map{KeyedRules: map[string]schema.Rule{
+			"dialTimeout":           config.DurationRule{},
+			"tlsHandshakeTimeout":   config.DurationRule{},
+			"responseHeaderTimeout": config.DurationRule{},
+			"timeout":               config.DurationRule{},
+			"maxConns":              schema.Int{Min: tree.Int64Ptr(0)},
+			"maxConnWaitTimeout":    config.DurationRule{},
+			"idleConnTimeout":       config.DurationRule{},
+			"maxConnDuration":       config.DurationRule{},
+			"readBufferSize":        config.SizeRule{},
+			"writeBufferSize":       config.SizeRule{},
+		}},
+		".tls": schema.Map{KeyedRules: map[string]schema.Rule{
+			"caFile":             schema.String{},
+			"certFile":           schema.String{},
+			"keyFile":            schema.String{},
+			"serverName":         schema.String{},
+			"minVersion":         schema.String{Enum: []string{"1.0", "1.1", "1.2", "1.3"}},
+			"insecureSkipVerify": schema.Bool{},
+			"reloadInterval":     config.DurationRule{},
+		}},
+		".retry": schema.Map{KeyedRules: map[string]schema.Rule{
+			"attempts": schema.Int{Min: tree.Int64Ptr(0)},
+			"statuses": schema.Array{},
+			"methods":  schema.Array{},
+			"timeout":  config.DurationRule{},
+		}},
+		".retry.statuses[]": schema.Int{Min: tree.Int64Ptr(100), Max: tree.Int64Ptr(599)},
+		".retry.methods[]":  schema.String{},
+		".healthCheck": schema.Map{KeyedRules: map[string]schema.Rule{
+			"interval":   config.DurationRule{},
+			"timeout":    config.DurationRule{},
+			"path":       schema.String{},
+			"method":     schema.String{},
+			"statuses":   schema.Array{},
+			"body":       schema.String{},
+			"bodyRegexp": schema.String{},
+			"headers":    schema.Map{},
+			"rise":       schema.Int{Min: tree.Int64Ptr(1)},
+			"fall":       schema.Int{Min: tree.Int64Ptr(1)},
 		}},
-		".urls[]": schema.String{},
+		".healthCheck.statuses[]": schema.Or{schema.Int{}, schema.String{}},
 	}
 }
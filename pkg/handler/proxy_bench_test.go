@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+
+	"github.com/fasthttpd/fasthttpd/pkg/logger"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// startBenchmarkBackend serves a small fixed body on an in-memory listener
+// so that the benchmarks measure the proxy rather than the network.
+func startBenchmarkBackend(b *testing.B) *fasthttputil.InmemoryListener {
+	ln := fasthttputil.NewInmemoryListener()
+	s := &fasthttp.Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			ctx.SetContentType("text/plain")
+			ctx.SetBodyString("hello, world")
+		},
+	}
+	go s.Serve(ln) //nolint:errcheck
+	b.Cleanup(func() {
+		_ = s.Shutdown()
+	})
+	return ln
+}
+
+func benchmarkProxyHandler(b *testing.B, h fasthttp.RequestHandler) {
+	ctx := &fasthttp.RequestCtx{}
+	req := &fasthttp.Request{}
+	remoteAddr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 12345}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		req.Header.SetHost("localhost")
+		req.SetRequestURI("/index.html?q=1")
+		ctx.Init(req, remoteAddr, nil)
+		h(ctx)
+		if body := ctx.Response.Body(); len(body) != len("hello, world") {
+			b.Fatalf("unexpected body %q (status %d)", body, ctx.Response.StatusCode())
+		}
+		ctx.Response.Reset()
+	}
+}
+
+// BenchmarkProxy_Native measures the fasthttp.HostClient based proxy.
+func BenchmarkProxy_Native(b *testing.B) {
+	ln := startBenchmarkBackend(b)
+
+	p, err := newProxyBalancer([]string{"http://backend"}, nil, algoRoundRobin, logger.NilLogger)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer p.Close()
+	p.backends[0].client.Dial = func(string) (net.Conn, error) {
+		return ln.Dial()
+	}
+
+	benchmarkProxyHandler(b, p.Handle)
+}
+
+// BenchmarkProxy_Adaptor measures the previous implementation, which served
+// httputil.ReverseProxy through fasthttpadaptor, as a baseline.
+func BenchmarkProxy_Adaptor(b *testing.B) {
+	ln := startBenchmarkBackend(b)
+
+	u, _ := url.Parse("http://backend")
+	rp := httputil.NewSingleHostReverseProxy(u)
+	rp.Transport = &http.Transport{
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			return ln.Dial()
+		},
+	}
+
+	benchmarkProxyHandler(b, fasthttpadaptor.NewFastHTTPHandler(rp))
+}
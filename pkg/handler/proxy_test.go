@@ -1,14 +1,23 @@
 package handler
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"hash/fnv"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/fasthttpd/fasthttpd/pkg/filter"
 	"github.com/fasthttpd/fasthttpd/pkg/logger"
+	"github.com/fasthttpd/fasthttpd/pkg/metrics"
 	"github.com/mojatter/tree"
 	"github.com/valyala/fasthttp"
 )
@@ -39,6 +48,10 @@ func TestNewProxyHandler(t *testing.T) {
 			caseName: "invalid url returns parse error",
 			cfg:      tree.Map{"url": tree.ToValue(":invalid url")},
 			errstr:   `failed to create proxy: parse ":invalid url": missing protocol scheme`,
+		}, {
+			caseName: "unsupported scheme returns error",
+			cfg:      tree.Map{"url": tree.ToValue("ftp://localhost:9000")},
+			errstr:   `failed to create proxy: unsupported url scheme: ftp://localhost:9000`,
 		}, {
 			caseName: "algorithm round-robin",
 			cfg: tree.Map{
@@ -57,6 +70,34 @@ func TestNewProxyHandler(t *testing.T) {
 				"url":       tree.ToValue("http://localhost:9000"),
 				"algorithm": tree.ToValue("ip-hash"),
 			},
+		}, {
+			caseName: "algorithm least-conn",
+			cfg: tree.Map{
+				"url":       tree.ToValue("http://localhost:9000"),
+				"algorithm": tree.ToValue("least-conn"),
+			},
+		}, {
+			caseName: "algorithm consistent-hash",
+			cfg: tree.Map{
+				"urls": tree.A(
+					"http://localhost:9000",
+					tree.Map{"url": tree.V("http://localhost:9001"), "weight": tree.V(2)},
+				),
+				"algorithm": tree.ToValue("consistent-hash"),
+				"hashKey":   tree.ToValue("${header.X-User}"),
+			},
+		}, {
+			caseName: "urls entry without url returns error",
+			cfg: tree.Map{
+				"urls": tree.A(tree.Map{"weight": tree.V(2)}),
+			},
+			errstr: `failed to create proxy: require 'url' in urls[0]`,
+		}, {
+			caseName: "negative weight returns error",
+			cfg: tree.Map{
+				"urls": tree.A(tree.Map{"url": tree.V("http://localhost:9000"), "weight": tree.V(-1)}),
+			},
+			errstr: `failed to create proxy: negative weight: -1: http://localhost:9000`,
 		}, {
 			caseName: "unknown algorithm returns error",
 			cfg: tree.Map{
@@ -100,6 +141,7 @@ func TestNewProxyHandler(t *testing.T) {
 func TestProxyBalancer_RoundRobinRotation(t *testing.T) {
 	b, err := newProxyBalancer(
 		[]string{"http://a", "http://b", "http://c"},
+		nil,
 		algoRoundRobin,
 		logger.NilLogger,
 	)
@@ -107,9 +149,9 @@ func TestProxyBalancer_RoundRobinRotation(t *testing.T) {
 		t.Fatal(err)
 	}
 	seen := map[string]int{}
-	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	ctx := &fasthttp.RequestCtx{}
 	for range 6 {
-		be := b.pick(req)
+		be := b.pick(ctx, nil)
 		if be == nil {
 			t.Fatalf("unexpected nil backend")
 		}
@@ -127,21 +169,31 @@ func TestProxyBalancer_RoundRobinRotation(t *testing.T) {
 func TestProxyBalancer_IPHashDeterministic(t *testing.T) {
 	b, err := newProxyBalancer(
 		[]string{"http://a", "http://b", "http://c"},
+		nil,
 		algoIPHash,
 		logger.NilLogger,
 	)
 	if err != nil {
 		t.Fatal(err)
 	}
-	req := httptest.NewRequest(http.MethodGet, "/", nil)
-	req.RemoteAddr = "10.0.0.1:12345"
-	first := b.pick(req)
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 12345}, nil)
+	first := b.pick(ctx, nil)
 	for range 5 {
-		if be := b.pick(req); be != first {
+		if be := b.pick(ctx, nil); be != first {
 			t.Fatalf("ip-hash picked different backend on repeat: got %s want %s",
 				be.url, first.url)
 		}
 	}
+
+	hs := fnv.New64a()
+	hs.Write([]byte("10.0.0.1"))
+	for _, ip := range []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.1").To4()} {
+		ctx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: ip, Port: 12345}, nil)
+		if got, want := hashClientIP(ctx), hs.Sum64(); got != want {
+			t.Errorf("hashClientIP(%d bytes) = %d; want %d", len(ip), got, want)
+		}
+	}
 }
 
 // TestProxyBalancer_SkipDeadBackend verifies that pick skips backends that are
@@ -149,6 +201,7 @@ func TestProxyBalancer_IPHashDeterministic(t *testing.T) {
 func TestProxyBalancer_SkipDeadBackend(t *testing.T) {
 	b, err := newProxyBalancer(
 		[]string{"http://a", "http://b", "http://c"},
+		nil,
 		algoRoundRobin,
 		logger.NilLogger,
 	)
@@ -157,20 +210,21 @@ func TestProxyBalancer_SkipDeadBackend(t *testing.T) {
 	}
 	b.backends[0].alive.Store(false)
 	b.backends[2].alive.Store(false)
-	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	ctx := &fasthttp.RequestCtx{}
 	for range 3 {
-		be := b.pick(req)
+		be := b.pick(ctx, nil)
 		if be == nil || be.url.String() != "http://b" {
 			t.Fatalf("expected http://b; got %v", be)
 		}
 	}
 }
 
-// TestProxyBalancer_NoAliveBackendReturns503 verifies that ServeHTTP returns
+// TestProxyBalancer_NoAliveBackendReturns503 verifies that Handle returns
 // 503 when every backend is marked down.
 func TestProxyBalancer_NoAliveBackendReturns503(t *testing.T) {
 	b, err := newProxyBalancer(
 		[]string{"http://a", "http://b"},
+		nil,
 		algoRoundRobin,
 		logger.NilLogger,
 	)
@@ -180,11 +234,10 @@ func TestProxyBalancer_NoAliveBackendReturns503(t *testing.T) {
 	for _, be := range b.backends {
 		be.alive.Store(false)
 	}
-	rec := httptest.NewRecorder()
-	req := httptest.NewRequest(http.MethodGet, "/", nil)
-	b.ServeHTTP(rec, req)
-	if rec.Code != http.StatusServiceUnavailable {
-		t.Errorf("status = %d; want %d", rec.Code, http.StatusServiceUnavailable)
+	ctx := &fasthttp.RequestCtx{}
+	b.Handle(ctx)
+	if got := ctx.Response.StatusCode(); got != http.StatusServiceUnavailable {
+		t.Errorf("status = %d; want %d", got, http.StatusServiceUnavailable)
 	}
 }
 
@@ -212,12 +265,17 @@ func TestProxyBalancer_RunHealthCheck(t *testing.T) {
 
 	b, err := newProxyBalancer(
 		[]string{good.URL, bad.URL, recovering.URL},
+		nil,
 		algoRoundRobin,
 		logger.NilLogger,
 	)
 	if err != nil {
 		t.Fatal(err)
 	}
+	b.check, err = newHealthCheck(tree.Map{"healthCheckInterval": tree.V(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
 	// Simulate "recovering" having been marked down by a previous iteration.
 	b.backends[2].alive.Store(false)
 
@@ -253,6 +311,307 @@ func TestProxyBalancer_RunHealthCheck(t *testing.T) {
 	}
 }
 
+// TestProxyHandler_Forward runs requests through the proxy against a real
+// backend and verifies what the backend receives and what the client gets.
+func TestProxyHandler_Forward(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Got-Uri", r.URL.RequestURI())
+		w.Header().Set("X-Got-Host", r.Host)
+		w.Header().Set("X-Got-Forwarded-For", r.Header.Get("X-Forwarded-For"))
+		w.Header().Set("X-Got-Upgrade", r.Header.Get("Upgrade"))
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(append([]byte("echo:"), body...)) //nolint:errcheck
+	}))
+	defer backend.Close()
+
+	testCases := []struct {
+		caseName         string
+		url              string
+		path             string
+		userValues       map[string]string
+		method           string
+		uri              string
+		headers          map[string]string
+		body             string
+		wantURI          string
+		wantHost         string
+		wantForwardedFor string
+		wantBody         string
+	}{
+		{
+			caseName:         "path and query are kept",
+			url:              backend.URL,
+			method:           http.MethodGet,
+			uri:              "/a/b?x=1",
+			wantURI:          "/a/b?x=1",
+			wantHost:         "example.com",
+			wantForwardedFor: "10.0.0.1",
+			wantBody:         "echo:",
+		}, {
+			caseName:         "backend path and query are joined",
+			url:              backend.URL + "/base/?k=v",
+			method:           http.MethodGet,
+			uri:              "/a%20b?x=1",
+			wantURI:          "/base/a%20b?k=v&x=1",
+			wantHost:         "example.com",
+			wantForwardedFor: "10.0.0.1",
+			wantBody:         "echo:",
+		}, {
+			caseName:         "forwarded-for is overwritten and hop headers removed",
+			url:              backend.URL,
+			method:           http.MethodPost,
+			uri:              "/post",
+			headers:          map[string]string{"X-Forwarded-For": "192.0.2.1", "Upgrade": "h2c"},
+			body:             "hello",
+			wantURI:          "/post",
+			wantHost:         "example.com",
+			wantForwardedFor: "10.0.0.1",
+			wantBody:         "echo:hello",
+		}, {
+			caseName:         "path template replaces the request path",
+			url:              backend.URL + "/base/?k=v",
+			path:             "/v1/users/${route.capture.id}",
+			userValues:       map[string]string{"id": "4 2"},
+			method:           http.MethodGet,
+			uri:              "/users/4%202?x=1",
+			wantURI:          "/base/v1/users/4%202?k=v&x=1",
+			wantHost:         "example.com",
+			wantForwardedFor: "10.0.0.1",
+			wantBody:         "echo:",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.caseName, func(t *testing.T) {
+			cfg := tree.Map{"url": tree.V(tc.url)}
+			if tc.path != "" {
+				cfg["path"] = tree.V(tc.path)
+			}
+			h, closer, err := NewProxyHandlerCloser(cfg, logger.NilLogger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closer.Close()
+
+			req := &fasthttp.Request{}
+			req.Header.SetMethod(tc.method)
+			req.Header.SetHost("example.com")
+			req.SetRequestURI(tc.uri)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			req.SetBodyString(tc.body)
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Init(req, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 12345}, nil)
+			for k, v := range tc.userValues {
+				ctx.SetUserValue(k, v)
+			}
+
+			h(ctx)
+
+			resp := &ctx.Response
+			if got := resp.StatusCode(); got != http.StatusCreated {
+				t.Fatalf("status = %d; want %d", got, http.StatusCreated)
+			}
+			if got := string(resp.Header.Peek("X-Got-Uri")); got != tc.wantURI {
+				t.Errorf("backend uri = %q; want %q", got, tc.wantURI)
+			}
+			if got := string(resp.Header.Peek("X-Got-Host")); got != tc.wantHost {
+				t.Errorf("backend host = %q; want %q", got, tc.wantHost)
+			}
+			if got := string(resp.Header.Peek("X-Got-Forwarded-For")); got != tc.wantForwardedFor {
+				t.Errorf("backend X-Forwarded-For = %q; want %q", got, tc.wantForwardedFor)
+			}
+			if got := string(resp.Header.Peek("X-Got-Upgrade")); got != "" {
+				t.Errorf("backend Upgrade = %q; want empty", got)
+			}
+			if got := string(resp.Header.Peek("Keep-Alive")); got != "" {
+				t.Errorf("response Keep-Alive = %q; want empty", got)
+			}
+			if got := string(resp.Body()); got != tc.wantBody {
+				t.Errorf("body = %q; want %q", got, tc.wantBody)
+			}
+		})
+	}
+}
+
+// TestProxyHandler_ForwardAuthorization verifies that the Authorization
+// header reaches the backend as the client sent it after an auth filter
+// set the URI username, and that ctx.Request is left untouched.
+func TestProxyHandler_ForwardAuthorization(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Got-Uri", r.URL.RequestURI())
+		w.Header().Set("X-Got-Authorization", r.Header.Get("Authorization"))
+	}))
+	defer backend.Close()
+
+	b64 := base64.RawURLEncoding
+	input := b64.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." +
+		b64.EncodeToString([]byte(`{"sub":"fast"}`))
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(input))
+	token := input + "." + b64.EncodeToString(mac.Sum(nil))
+
+	jwt, err := filter.NewJWTFilter(tree.Map{
+		"keys": tree.Array{tree.Map{"secret": tree.V("secret")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	basicAuth, err := filter.NewBasicAuthFilter(tree.Map{
+		"users": tree.Array{tree.Map{"name": tree.V("fast"), "secret": tree.V("httpd")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, closer, err := NewProxyHandlerCloser(tree.Map{"url": tree.V(backend.URL + "/base/")}, logger.NilLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	testCases := []struct {
+		caseName      string
+		filter        filter.Filter
+		authorization string
+	}{
+		{
+			caseName:      "jwt",
+			filter:        jwt,
+			authorization: "Bearer " + token,
+		}, {
+			caseName:      "basicAuth",
+			filter:        basicAuth,
+			authorization: "Basic " + base64.StdEncoding.EncodeToString([]byte("fast:httpd")),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.caseName, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Request.Header.SetHost("example.com")
+			ctx.Request.SetRequestURI("/a?x=1")
+			ctx.Request.Header.Set("Authorization", tc.authorization)
+			if !tc.filter.Request(ctx) {
+				t.Fatalf("filter rejected the request: %d", ctx.Response.StatusCode())
+			}
+			if got := string(ctx.URI().Username()); got != "fast" {
+				t.Fatalf("username = %q; want %q", got, "fast")
+			}
+
+			h(ctx)
+
+			resp := &ctx.Response
+			if got := resp.StatusCode(); got != http.StatusOK {
+				t.Fatalf("status = %d; want %d", got, http.StatusOK)
+			}
+			if got := string(resp.Header.Peek("X-Got-Authorization")); got != tc.authorization {
+				t.Errorf("backend Authorization = %q; want %q", got, tc.authorization)
+			}
+			if got := string(resp.Header.Peek("X-Got-Uri")); got != "/base/a?x=1" {
+				t.Errorf("backend uri = %q; want %q", got, "/base/a?x=1")
+			}
+			if got := string(ctx.Request.Header.RequestURI()); got != "/a?x=1" {
+				t.Errorf("request uri = %q; want %q", got, "/a?x=1")
+			}
+			if got := string(ctx.URI().Username()); got != "fast" {
+				t.Errorf("username = %q; want %q", got, "fast")
+			}
+		})
+	}
+}
+
+// TestProxyHandler_Cache verifies that the cache filter stores and removes
+// the responses of a proxied request by the URI the client sent, not by the
+// URI sent to the backend.
+func TestProxyHandler_Cache(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, r.URL.RequestURI()) //nolint:errcheck
+	}))
+	defer backend.Close()
+
+	f, err := filter.NewCacheFilter(tree.Map{}, logger.NilLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.(io.Closer).Close()
+	h, closer, err := NewProxyHandlerCloser(tree.Map{"url": tree.V(backend.URL + "/base/")}, logger.NilLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	tests := []struct {
+		method   string
+		wantHits int32
+		wantBody string
+	}{
+		{method: http.MethodGet, wantHits: 1, wantBody: "/base/a?x=1"},
+		{method: http.MethodGet, wantHits: 1, wantBody: "/base/a?x=1"},
+		{method: http.MethodPost, wantHits: 2, wantBody: "/base/a?x=1"},
+		{method: http.MethodGet, wantHits: 3, wantBody: "/base/a?x=1"},
+		{method: http.MethodGet, wantHits: 3, wantBody: "/base/a?x=1"},
+	}
+	for i, test := range tests {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod(test.method)
+		ctx.Request.Header.SetHost("example.com")
+		ctx.Request.SetRequestURI("/a?x=1")
+		if f.Request(ctx) {
+			h(ctx)
+			f.Response(ctx)
+		}
+		if got := hits.Load(); got != test.wantHits {
+			t.Errorf("tests[%d] backend hits = %d; want %d", i, got, test.wantHits)
+		}
+		if got := string(ctx.Response.Body()); got != test.wantBody {
+			t.Errorf("tests[%d] body = %q; want %q", i, got, test.wantBody)
+		}
+	}
+}
+
+// TestProxyHandler_BadGateway verifies that an unreachable backend results
+// in 502.
+func TestProxyHandler_BadGateway(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	h, err := NewProxyHandler(tree.Map{"url": tree.V("http://" + addr)}, logger.NilLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("http://example.com/")
+	h(ctx)
+	if got := ctx.Response.StatusCode(); got != http.StatusBadGateway {
+		t.Errorf("status = %d; want %d", got, http.StatusBadGateway)
+	}
+}
+
+// TestNewProxyHandlerCloser_InvalidConfig verifies that nothing of a
+// rejected config is left registered.
+func TestNewProxyHandlerCloser_InvalidConfig(t *testing.T) {
+	url := "http://invalid-config.local:9000"
+	_, _, err := NewProxyHandlerCloser(tree.Map{
+		"url":         tree.V(url),
+		"mirror":      tree.Map{"urls": tree.A("http://mirror.local:9000")},
+		"healthCheck": tree.Map{"interval": tree.V("bad")},
+	}, logger.NilLogger)
+	if err == nil {
+		t.Fatal("no error")
+	}
+	if text := string(metrics.Default.AppendText(nil)); strings.Contains(text, url) {
+		t.Errorf("metrics of a rejected config are registered:\n%s", text)
+	}
+}
+
 func TestProxy_SchemaRegistered(t *testing.T) {
 	testCases := []struct {
 		caseName string
@@ -273,17 +632,192 @@ func TestProxy_SchemaRegistered(t *testing.T) {
 				"urls":                tree.A("http://a:8080", "http://b:8080"),
 				"algorithm":           tree.V("ip-hash"),
 				"healthCheckInterval": tree.V(5),
+				"path":                tree.V("/v1/${route.capture.id}"),
+			},
+		},
+		{
+			caseName: "valid mirror",
+			handler: tree.Map{
+				"type": tree.V("proxy"),
+				"url":  tree.V("http://localhost:8080"),
+				"mirror": tree.Map{
+					"urls":           tree.A("http://shadow:8080"),
+					"percentage":     tree.V(10),
+					"maxBodySize":    tree.V("1M"),
+					"maxConcurrency": tree.V(16),
+					"timeout":        tree.V("2s"),
+				},
+			},
+		},
+		{
+			caseName: "mirror percentage out of range",
+			handler: tree.Map{
+				"type":   tree.V("proxy"),
+				"url":    tree.V("http://localhost:8080"),
+				"mirror": tree.Map{"urls": tree.A("http://shadow:8080"), "percentage": tree.V(101)},
 			},
+			wantErr: "percentage",
+		},
+		{
+			caseName: "valid health check",
+			handler: tree.Map{
+				"type": tree.V("proxy"),
+				"urls": tree.A("http://a:8080", "http://b:8080"),
+				"healthCheck": tree.Map{
+					"interval":   tree.V("10s"),
+					"timeout":    tree.V("2s"),
+					"path":       tree.V("/healthz"),
+					"method":     tree.V("GET"),
+					"statuses":   tree.A(200, "3xx"),
+					"bodyRegexp": tree.V(`"status":\s*"ok"`),
+					"headers":    tree.Map{"Host": tree.V("health.local")},
+					"rise":       tree.V(2),
+					"fall":       tree.V(3),
+				},
+			},
+		},
+		{
+			caseName: "health check rise out of range",
+			handler: tree.Map{
+				"type":        tree.V("proxy"),
+				"url":         tree.V("http://localhost:8080"),
+				"healthCheck": tree.Map{"rise": tree.V(0)},
+			},
+			wantErr: "rise",
+		},
+		{
+			caseName: "valid sticky",
+			handler: tree.Map{
+				"type": tree.V("proxy"),
+				"urls": tree.A("http://a:8080", "http://b:8080"),
+				"sticky": tree.Map{
+					"cookie":   tree.V("backend"),
+					"secret":   tree.V("secret"),
+					"ttl":      tree.V("1h"),
+					"path":     tree.V("/"),
+					"secure":   tree.V(true),
+					"httpOnly": tree.V(true),
+					"sameSite": tree.V("Lax"),
+				},
+			},
+		},
+		{
+			caseName: "sticky sameSite rejected",
+			handler: tree.Map{
+				"type":   tree.V("proxy"),
+				"url":    tree.V("http://localhost:8080"),
+				"sticky": tree.Map{"sameSite": tree.V("Loose")},
+			},
+			wantErr: "sameSite",
+		},
+		{
+			caseName: "valid rewrites",
+			handler: tree.Map{
+				"type":           tree.V("proxy"),
+				"url":            tree.V("http://localhost:8080"),
+				"stripPrefix":    tree.V("/api"),
+				"addPrefix":      tree.V("/v1"),
+				"preserveHost":   tree.V(false),
+				"hostHeader":     tree.V("${host}"),
+				"trustedProxies": tree.A("10.0.0.0/8", "::1"),
+				"rewriteLocation": tree.A(
+					tree.Map{"from": tree.V("http://localhost:8080/"), "to": tree.V("/")},
+				),
+				"rewriteCookieDomain": tree.A(tree.Map{"from": tree.V("localhost"), "to": tree.V("example.com")}),
+				"rewriteCookiePath":   tree.A(tree.Map{"from": tree.V("/v1/"), "to": tree.V("/api/")}),
+			},
+		},
+		{
+			caseName: "unknown rewrite key rejected",
+			handler: tree.Map{
+				"type":            tree.V("proxy"),
+				"url":             tree.V("http://localhost:8080"),
+				"rewriteLocation": tree.A(tree.Map{"from": tree.V("/"), "replace": tree.V("/")}),
+			},
+			wantErr: `unknown key "replace"`,
 		},
 		{
 			caseName: "unknown algorithm rejected",
 			handler: tree.Map{
 				"type":      tree.V("proxy"),
 				"url":       tree.V("http://localhost"),
-				"algorithm": tree.V("least-conn"),
+				"algorithm": tree.V("p2c"),
 			},
 			wantErr: "algorithm",
 		},
+		{
+			caseName: "valid weighted consistent hash",
+			handler: tree.Map{
+				"type": tree.V("proxy"),
+				"urls": tree.A(
+					"http://a:8080",
+					tree.Map{"url": tree.V("http://b:8080"), "weight": tree.V(3)},
+				),
+				"algorithm": tree.V("consistent-hash"),
+				"hashKey":   tree.V("${cookie.session}"),
+			},
+		},
+		{
+			caseName: "zero weight rejected",
+			handler: tree.Map{
+				"type": tree.V("proxy"),
+				"urls": tree.A(tree.Map{"url": tree.V("http://a:8080"), "weight": tree.V(0)}),
+			},
+			wantErr: "weight",
+		},
+		{
+			caseName: "valid transport",
+			handler: tree.Map{
+				"type": tree.V("proxy"),
+				"url":  tree.V("https://localhost:8443"),
+				"transport": tree.Map{
+					"dialTimeout":           tree.V("1s"),
+					"tlsHandshakeTimeout":   tree.V("2s"),
+					"responseHeaderTimeout": tree.V("10s"),
+					"timeout":               tree.V("30s"),
+					"maxConns":              tree.V(64),
+					"maxConnWaitTimeout":    tree.V("100ms"),
+					"idleConnTimeout":       tree.V("90s"),
+					"maxConnDuration":       tree.V("10m"),
+					"readBufferSize":        tree.V("16KB"),
+					"writeBufferSize":       tree.V(8192),
+				},
+			},
+		},
+		{
+			caseName: "transport timeout rejected",
+			handler: tree.Map{
+				"type":      tree.V("proxy"),
+				"url":       tree.V("http://localhost:8080"),
+				"transport": tree.Map{"dialTimeout": tree.V("soon")},
+			},
+			wantErr: "dialTimeout",
+		},
+		{
+			caseName: "valid tls",
+			handler: tree.Map{
+				"type": tree.V("proxy"),
+				"url":  tree.V("https://localhost:8443"),
+				"tls": tree.Map{
+					"caFile":             tree.V("ca.pem"),
+					"certFile":           tree.V("client.pem"),
+					"keyFile":            tree.V("client-key.pem"),
+					"serverName":         tree.V("backend.internal"),
+					"minVersion":         tree.V("1.3"),
+					"insecureSkipVerify": tree.V(false),
+					"reloadInterval":     tree.V("1m"),
+				},
+			},
+		},
+		{
+			caseName: "tls minVersion rejected",
+			handler: tree.Map{
+				"type": tree.V("proxy"),
+				"url":  tree.V("https://localhost:8443"),
+				"tls":  tree.Map{"minVersion": tree.V("1.4")},
+			},
+			wantErr: "minVersion",
+		},
 		{
 			caseName: "unknown proxy field",
 			handler: tree.Map{
@@ -0,0 +1,159 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/fasthttpd/fasthttpd/pkg/logger"
+	"github.com/mojatter/tree"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	defaultFailTimeout = 10 * time.Second
+	// maxEjectionShift caps the exponential backoff of the ejections at
+	// 32 times failTimeout.
+	maxEjectionShift = 5
+)
+
+// defaultRetryMethods are the idempotent methods, see RFC 9110 section
+// 9.2.2.
+var defaultRetryMethods = []string{
+	fasthttp.MethodGet,
+	fasthttp.MethodHead,
+	fasthttp.MethodOptions,
+	fasthttp.MethodTrace,
+	fasthttp.MethodPut,
+	fasthttp.MethodDelete,
+}
+
+// proxyRetryConfig is the 'retry' entry of the proxy handler config.
+type proxyRetryConfig struct {
+	// Attempts is the number of retries after the first try.
+	Attempts int `yaml:"attempts"`
+	// Statuses are the backend response statuses that are retried in
+	// addition to connection errors and timeouts.
+	Statuses []int    `yaml:"statuses"`
+	Methods  []string `yaml:"methods"`
+	// Timeout is the deadline of the request across all the tries.
+	Timeout config.Duration `yaml:"timeout"`
+}
+
+// proxyRetry decides whether a failed request is tried again on another
+// backend.
+type proxyRetry struct {
+	attempts int
+	statuses []int
+	methods  [][]byte
+	timeout  time.Duration
+}
+
+func newProxyRetry(cfg tree.Node) (*proxyRetry, error) {
+	rc := &proxyRetryConfig{}
+	if err := tree.UnmarshalViaYAML(cfg, rc); err != nil {
+		return nil, fmt.Errorf("retry: %w", err)
+	}
+	r := &proxyRetry{
+		attempts: rc.Attempts,
+		statuses: rc.Statuses,
+		timeout:  time.Duration(rc.Timeout),
+	}
+	methods := rc.Methods
+	if len(methods) == 0 {
+		methods = defaultRetryMethods
+	}
+	for _, m := range methods {
+		r.methods = append(r.methods, []byte(strings.ToUpper(m)))
+	}
+	return r, nil
+}
+
+// tries returns the number of tries allowed for req. A request whose body
+// is streamed is tried once because the body cannot be sent again.
+func (r *proxyRetry) tries(req *fasthttp.Request) int {
+	if r == nil || r.attempts <= 0 || req.IsBodyStream() {
+		return 1
+	}
+	method := req.Header.Method()
+	for _, m := range r.methods {
+		if bytes.Equal(m, method) {
+			return 1 + r.attempts
+		}
+	}
+	return 1
+}
+
+// failed reports whether the backend response status counts as a failure.
+func (r *proxyRetry) failed(status int) bool {
+	return r != nil && slices.Contains(r.statuses, status)
+}
+
+// passiveHealth ejects a backend after maxFails consecutive failures
+// within failTimeout, like max_fails and fail_timeout of nginx. The
+// ejection lasts failTimeout, doubled for every ejection in a row until
+// a request succeeds.
+type passiveHealth struct {
+	maxFails    int
+	failTimeout time.Duration
+	l           logger.Logger
+}
+
+// backendFailures is the state of the passive health of a backend.
+type backendFailures struct {
+	mu        sync.Mutex
+	fails     int
+	firstFail time.Time
+	ejections int
+	// failing is set while fails or ejections is not zero, so that a
+	// success need not take the lock.
+	failing atomic.Bool
+	// ejectedUntil is the UnixNano time until which the backend is
+	// ejected.
+	ejectedUntil atomic.Int64
+}
+
+// ejected reports whether be is ejected by the passive health.
+func (be *proxyBackend) ejected() bool {
+	until := be.failures.ejectedUntil.Load()
+	return until != 0 && time.Now().UnixNano() < until
+}
+
+// observe records the result of a request to be.
+func (h *passiveHealth) observe(be *proxyBackend, failed bool) {
+	if h == nil {
+		return
+	}
+	f := &be.failures
+	if !failed {
+		if f.failing.Load() {
+			f.mu.Lock()
+			f.fails, f.ejections = 0, 0
+			f.failing.Store(false)
+			f.mu.Unlock()
+		}
+		return
+	}
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failing.Store(true)
+	if f.fails == 0 || now.Sub(f.firstFail) > h.failTimeout {
+		f.fails = 0
+		f.firstFail = now
+	}
+	f.fails++
+	if f.fails < h.maxFails {
+		return
+	}
+	f.fails = 0
+	f.ejections++
+	d := h.failTimeout << min(f.ejections-1, maxEjectionShift)
+	f.ejectedUntil.Store(now.Add(d).UnixNano())
+	h.l.Printf("backend %s ejected for %s after %d failures", be.url.String(), d, h.maxFails)
+}
@@ -0,0 +1,232 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fasthttpd/fasthttpd/pkg/logger"
+	"github.com/mojatter/tree"
+	"github.com/valyala/fasthttp"
+)
+
+// closedURL returns the URL of a port nobody listens on.
+func closedURL(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return "http://" + addr
+}
+
+// newStatusServer starts a backend that responds with status and counts
+// the requests.
+func newStatusServer(t *testing.T, status int, delay time.Duration, hits *atomic.Int32) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		time.Sleep(delay)
+		w.WriteHeader(status)
+		w.Write([]byte(http.StatusText(status))) //nolint:errcheck
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestProxyHandler_Retry(t *testing.T) {
+	var flakyHits, goodHits atomic.Int32
+	flaky := newStatusServer(t, http.StatusServiceUnavailable, 0, &flakyHits)
+	good := newStatusServer(t, http.StatusOK, 0, &goodHits)
+
+	testCases := []struct {
+		caseName   string
+		urls       []any
+		method     string
+		wantStatus int
+		wantGood   int32
+	}{
+		{
+			caseName:   "status is retried on the other backend",
+			urls:       []any{flaky.URL, good.URL},
+			method:     http.MethodGet,
+			wantStatus: http.StatusOK,
+			wantGood:   1,
+		}, {
+			caseName:   "connection error is retried on the other backend",
+			urls:       []any{closedURL(t), good.URL},
+			method:     http.MethodGet,
+			wantStatus: http.StatusOK,
+			wantGood:   1,
+		}, {
+			caseName:   "non-idempotent method is not retried",
+			urls:       []any{flaky.URL, good.URL},
+			method:     http.MethodPost,
+			wantStatus: http.StatusServiceUnavailable,
+		}, {
+			caseName:   "last response is returned",
+			urls:       []any{flaky.URL},
+			method:     http.MethodGet,
+			wantStatus: http.StatusServiceUnavailable,
+		}, {
+			caseName:   "last error results in bad gateway",
+			urls:       []any{closedURL(t)},
+			method:     http.MethodGet,
+			wantStatus: http.StatusBadGateway,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.caseName, func(t *testing.T) {
+			h, closer, err := NewProxyHandlerCloser(tree.Map{
+				"urls": tree.A(tc.urls...),
+				"retry": tree.Map{
+					"attempts": tree.V(2),
+					"statuses": tree.A(http.StatusServiceUnavailable),
+				},
+			}, logger.NilLogger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closer.Close()
+
+			goodHits.Store(0)
+			ctx := newMirrorTestCtx(tc.method, "/a?x=1", "body")
+			h(ctx)
+			if got := ctx.Response.StatusCode(); got != tc.wantStatus {
+				t.Errorf("status = %d; want %d", got, tc.wantStatus)
+			}
+			if got := goodHits.Load(); got != tc.wantGood {
+				t.Errorf("good backend hits = %d; want %d", got, tc.wantGood)
+			}
+		})
+	}
+}
+
+func TestProxyHandler_RetryDeadline(t *testing.T) {
+	var hits atomic.Int32
+	slow := newStatusServer(t, http.StatusOK, 300*time.Millisecond, &hits)
+	h, closer, err := NewProxyHandlerCloser(tree.Map{
+		"url": tree.V(slow.URL),
+		"retry": tree.Map{
+			"attempts": tree.V(5),
+			"timeout":  tree.V("100ms"),
+		},
+	}, logger.NilLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	start := time.Now()
+	ctx := newMirrorTestCtx(http.MethodGet, "/", "")
+	h(ctx)
+	if got := ctx.Response.StatusCode(); got != http.StatusGatewayTimeout {
+		t.Errorf("status = %d; want %d", got, http.StatusGatewayTimeout)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("took %s; want within the deadline", d)
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("backend hits = %d; want 1", n)
+	}
+}
+
+func TestProxyHandler_PassiveHealth(t *testing.T) {
+	var hits atomic.Int32
+	good := newStatusServer(t, http.StatusOK, 0, &hits)
+	h, closer, err := NewProxyHandlerCloser(tree.Map{
+		"urls":        tree.A(closedURL(t), good.URL),
+		"maxFails":    tree.V(2),
+		"failTimeout": tree.V("1m"),
+	}, logger.NilLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+	b := closer.(*proxyBalancer)
+	bad := b.backends[0]
+
+	// Round-robin sends every other request to the bad backend until it
+	// is ejected after two failures.
+	var badGateways int
+	for range 8 {
+		ctx := newMirrorTestCtx(http.MethodGet, "/", "")
+		h(ctx)
+		if ctx.Response.StatusCode() == http.StatusBadGateway {
+			badGateways++
+		}
+	}
+	if badGateways != 2 {
+		t.Errorf("bad gateways = %d; want 2", badGateways)
+	}
+	if !bad.ejected() {
+		t.Errorf("bad backend should be ejected")
+	}
+}
+
+func TestPassiveHealth_Backoff(t *testing.T) {
+	be, err := newProxyBackend("http://localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &passiveHealth{maxFails: 2, failTimeout: time.Second, l: logger.NilLogger}
+	ejectedFor := func() time.Duration {
+		return time.Until(time.Unix(0, be.failures.ejectedUntil.Load())).Round(time.Second)
+	}
+
+	h.observe(be, true)
+	if be.ejected() {
+		t.Fatalf("ejected after a failure")
+	}
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		h.observe(be, true)
+		h.observe(be, true)
+		if got := ejectedFor(); got != want {
+			t.Errorf("ejected for %s; want %s", got, want)
+		}
+	}
+	h.observe(be, false)
+	h.observe(be, true)
+	h.observe(be, true)
+	if got := ejectedFor(); got != time.Second {
+		t.Errorf("ejected for %s after a success; want %s", got, time.Second)
+	}
+}
+
+func TestProxyRetry_Tries(t *testing.T) {
+	r, err := newProxyRetry(tree.Map{
+		"attempts": tree.V(2),
+		"methods":  tree.A("get", "POST"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		method string
+		stream bool
+		want   int
+	}{
+		{method: http.MethodGet, want: 3},
+		{method: http.MethodPost, want: 3},
+		{method: http.MethodPut, want: 1},
+		{method: http.MethodPost, stream: true, want: 1},
+	}
+	for i, test := range tests {
+		req := &fasthttp.Request{}
+		req.Header.SetMethod(test.method)
+		if test.stream {
+			req.SetBodyStream(strings.NewReader("body"), -1)
+		}
+		if got := r.tries(req); got != test.want {
+			t.Errorf("tests[%d] tries %d; want %d", i, got, test.want)
+		}
+	}
+	var nilRetry *proxyRetry
+	if got := nilRetry.tries(&fasthttp.Request{}); got != 1 {
+		t.Errorf("tries without retry %d; want 1", got)
+	}
+}
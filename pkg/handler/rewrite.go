@@ -0,0 +1,326 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/fasthttpd/fasthttpd/pkg/util"
+	"github.com/fasthttpd/fasthttpd/pkg/vars"
+	"github.com/mojatter/tree"
+	"github.com/valyala/fasthttp"
+)
+
+const headerXRealIP = "X-Real-IP"
+
+// proxyRewriteRule is an entry of the 'rewriteLocation', 'rewriteCookieDomain'
+// and 'rewriteCookiePath' of the proxy handler config.
+type proxyRewriteRule struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+}
+
+// proxyRewriteConfig is the part of the proxy handler config about how the
+// requests and responses are rewritten.
+type proxyRewriteConfig struct {
+	Path        string `yaml:"path"`
+	StripPrefix string `yaml:"stripPrefix"`
+	AddPrefix   string `yaml:"addPrefix"`
+	// PreserveHost keeps the Host header of the client, true when nil.
+	PreserveHost *bool  `yaml:"preserveHost"`
+	HostHeader   string `yaml:"hostHeader"`
+	// TrustedProxies are the peers whose forwarding headers are kept and
+	// appended to. No peer is trusted when nil.
+	TrustedProxies      []string           `yaml:"trustedProxies"`
+	RewriteLocation     []proxyRewriteRule `yaml:"rewriteLocation"`
+	RewriteCookieDomain []proxyRewriteRule `yaml:"rewriteCookieDomain"`
+	RewriteCookiePath   []proxyRewriteRule `yaml:"rewriteCookiePath"`
+}
+
+type locationRewrite struct {
+	from []byte
+	to   *vars.Template
+}
+
+type cookieRewrite struct {
+	from []byte
+	to   []byte
+}
+
+// proxyRewrite rewrites the requests to the backends and their responses
+// to the clients.
+type proxyRewrite struct {
+	// path is the template of the path sent in place of the request path,
+	// or nil.
+	path         *vars.Template
+	stripPrefix  string
+	addPrefix    string
+	preserveHost bool
+	// hostHeader is the template of the Host header, or nil.
+	hostHeader    *vars.Template
+	trusted       util.IPPrefixes
+	locations     []locationRewrite
+	cookieDomains []cookieRewrite
+	cookiePaths   []cookieRewrite
+}
+
+// defaultProxyRewrite is the proxyRewrite of a proxy handler config without
+// any of the rewrite keys.
+var defaultProxyRewrite = &proxyRewrite{preserveHost: true}
+
+func newProxyRewrite(cfg tree.Map) (*proxyRewrite, error) {
+	rc := &proxyRewriteConfig{}
+	if err := tree.UnmarshalViaYAML(cfg, rc); err != nil {
+		return nil, err
+	}
+	rw := &proxyRewrite{
+		stripPrefix:  strings.TrimSuffix(rc.StripPrefix, "/"),
+		addPrefix:    rc.AddPrefix,
+		preserveHost: rc.PreserveHost == nil || *rc.PreserveHost,
+	}
+	if rc.Path != "" {
+		rw.path = vars.Compile(rc.Path)
+	}
+	if rc.StripPrefix != "" && !strings.HasPrefix(rc.StripPrefix, "/") {
+		return nil, fmt.Errorf("stripPrefix must start with '/': %s", rc.StripPrefix)
+	}
+	if rc.AddPrefix != "" && !strings.HasPrefix(rc.AddPrefix, "/") {
+		return nil, fmt.Errorf("addPrefix must start with '/': %s", rc.AddPrefix)
+	}
+	if rc.HostHeader != "" {
+		rw.hostHeader = vars.Compile(rc.HostHeader)
+	}
+	trusted, err := util.ParseIPPrefixes(rc.TrustedProxies...)
+	if err != nil {
+		return nil, fmt.Errorf("trustedProxies: %w", err)
+	}
+	rw.trusted = trusted
+	for i, r := range rc.RewriteLocation {
+		if r.From == "" {
+			return nil, fmt.Errorf("rewriteLocation[%d]: require 'from' entry", i)
+		}
+		rw.locations = append(rw.locations, locationRewrite{from: []byte(r.From), to: vars.Compile(r.To)})
+	}
+	if rw.cookieDomains, err = newCookieRewrites("rewriteCookieDomain", rc.RewriteCookieDomain); err != nil {
+		return nil, err
+	}
+	if rw.cookiePaths, err = newCookieRewrites("rewriteCookiePath", rc.RewriteCookiePath); err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+func newCookieRewrites(key string, rules []proxyRewriteRule) ([]cookieRewrite, error) {
+	var rewrites []cookieRewrite
+	for i, r := range rules {
+		if r.From == "" {
+			return nil, fmt.Errorf("%s[%d]: require 'from' entry", key, i)
+		}
+		rewrites = append(rewrites, cookieRewrite{from: []byte(r.From), to: []byte(r.To)})
+	}
+	return rewrites, nil
+}
+
+// appendPath appends the path sent to the backends in place of the request
+// path p to dst, and returns dst and the path, which is either p or in dst.
+func (rw *proxyRewrite) appendPath(dst []byte, ctx *fasthttp.RequestCtx, p []byte) ([]byte, []byte) {
+	if rw.path != nil {
+		// Escape the expansion so that SetPathBytes decodes it exactly
+		// once, like p.
+		m := len(dst)
+		dst = rw.path.Append(dst, ctx)
+		n := len(dst)
+		dst = appendEscapedPath(dst, dst[m:n])
+		p = dst[n:]
+	}
+	if rw.stripPrefix != "" {
+		p = stripPathPrefix(p, rw.stripPrefix)
+	}
+	if rw.addPrefix != "" {
+		n := len(dst)
+		dst = joinURLPath(dst, rw.addPrefix, p)
+		p = dst[n:]
+	}
+	return dst, p
+}
+
+// rewritesPath reports whether appendPath changes the request path.
+func (rw *proxyRewrite) rewritesPath() bool {
+	return rw.path != nil || rw.stripPrefix != "" || rw.addPrefix != ""
+}
+
+var slashPath = []byte("/")
+
+// stripPathPrefix removes prefix from p if p is prefix or starts with
+// prefix and a slash.
+func stripPathPrefix(p []byte, prefix string) []byte {
+	if !bytes.HasPrefix(p, []byte(prefix)) {
+		return p
+	}
+	switch rest := p[len(prefix):]; {
+	case len(rest) == 0:
+		return slashPath
+	case rest[0] == '/':
+		return rest
+	}
+	return p
+}
+
+// setForwardedHeaders sets X-Forwarded-For, X-Forwarded-Proto,
+// X-Forwarded-Host, X-Real-IP and Forwarded of req, which is sent for the
+// request of ctx. The values sent by a trusted peer are kept, and appended
+// to for X-Forwarded-For and Forwarded. buf is a scratch buffer.
+func (rw *proxyRewrite) setForwardedHeaders(req *fasthttp.Request, ctx *fasthttp.RequestCtx, buf []byte) []byte {
+	ip := ctx.RemoteIP()
+	trusted := rw.trusted.Contains(util.AddrFromIP(ip))
+	proto := "http"
+	if ctx.IsTLS() {
+		proto = "https"
+	}
+	host := req.Header.Host()
+	h := &req.Header
+
+	// Forwarded, see RFC 7239 section 4.
+	buf = buf[:0]
+	if trusted {
+		if prior := h.Peek(fasthttp.HeaderForwarded); len(prior) > 0 {
+			buf = append(buf, prior...)
+			buf = append(buf, ", "...)
+		}
+	}
+	if !ip.IsUnspecified() {
+		buf = append(buf, "for="...)
+		if ip.To4() == nil {
+			buf = append(buf, `"[`...)
+			buf, _ = ip.AppendText(buf)
+			buf = append(buf, `]"`...)
+		} else {
+			buf, _ = ip.AppendText(buf)
+		}
+		buf = append(buf, ';')
+	}
+	if len(host) > 0 && bytes.IndexAny(host, "\"\\") == -1 {
+		buf = append(buf, `host="`...)
+		buf = append(buf, host...)
+		buf = append(buf, `";`...)
+	}
+	buf = append(buf, "proto="...)
+	buf = append(buf, proto...)
+	h.SetBytesV(fasthttp.HeaderForwarded, buf)
+
+	if !trusted || len(h.Peek(fasthttp.HeaderXForwardedProto)) == 0 {
+		h.Set(fasthttp.HeaderXForwardedProto, proto)
+	}
+	if !trusted || len(h.Peek(fasthttp.HeaderXForwardedHost)) == 0 {
+		if len(host) > 0 {
+			h.SetBytesV(fasthttp.HeaderXForwardedHost, host)
+		} else {
+			h.Del(fasthttp.HeaderXForwardedHost)
+		}
+	}
+	if ip.IsUnspecified() {
+		if !trusted {
+			h.Del(fasthttp.HeaderXForwardedFor)
+			h.Del(headerXRealIP)
+		}
+		return buf
+	}
+	buf = buf[:0]
+	if trusted {
+		if prior := h.Peek(fasthttp.HeaderXForwardedFor); len(prior) > 0 {
+			buf = append(buf, prior...)
+			buf = append(buf, ", "...)
+		}
+	}
+	n := len(buf)
+	buf, _ = ip.AppendText(buf)
+	h.SetBytesV(fasthttp.HeaderXForwardedFor, buf)
+	if !trusted || len(h.Peek(headerXRealIP)) == 0 {
+		h.SetBytesV(headerXRealIP, buf[n:])
+	}
+	return buf
+}
+
+// setHost sets the Host header of req, which is sent to be for the request
+// of ctx. buf is a scratch buffer.
+func (rw *proxyRewrite) setHost(req *fasthttp.Request, ctx *fasthttp.RequestCtx, be *proxyBackend, buf []byte) []byte {
+	switch {
+	case rw.hostHeader != nil:
+		buf = rw.hostHeader.Append(buf[:0], ctx)
+		req.Header.SetHostBytes(buf)
+	case !rw.preserveHost:
+		req.Header.SetHost(be.url.Host)
+	case len(req.Header.Host()) == 0:
+		req.URI().SetHost(be.url.Host)
+	}
+	req.UseHostHeader = true
+	return buf
+}
+
+// rewriteResponse rewrites the Location header and the Domain and Path of
+// the Set-Cookie headers of the response of ctx.
+func (rw *proxyRewrite) rewriteResponse(ctx *fasthttp.RequestCtx) {
+	if len(rw.locations) == 0 && len(rw.cookieDomains) == 0 && len(rw.cookiePaths) == 0 {
+		return
+	}
+	bp := proxyBufPool.Get().(*[]byte)
+	buf := (*bp)[:0]
+	defer func() {
+		*bp = buf
+		proxyBufPool.Put(bp)
+	}()
+
+	resp := &ctx.Response
+	if loc := resp.Header.Peek(fasthttp.HeaderLocation); len(loc) > 0 {
+		for _, r := range rw.locations {
+			if bytes.HasPrefix(loc, r.from) {
+				buf = r.to.Append(buf[:0], ctx)
+				buf = append(buf, loc[len(r.from):]...)
+				resp.Header.SetBytesV(fasthttp.HeaderLocation, buf)
+				break
+			}
+		}
+	}
+	if len(rw.cookieDomains) == 0 && len(rw.cookiePaths) == 0 {
+		return
+	}
+	var cookies []*fasthttp.Cookie
+	resp.Header.VisitAllCookie(func(_, value []byte) {
+		c := fasthttp.AcquireCookie()
+		if err := c.ParseBytes(value); err != nil || !rw.rewriteCookie(c, buf[:0]) {
+			fasthttp.ReleaseCookie(c)
+			return
+		}
+		cookies = append(cookies, c)
+	})
+	for _, c := range cookies {
+		resp.Header.SetCookie(c)
+		fasthttp.ReleaseCookie(c)
+	}
+}
+
+// rewriteCookie rewrites the Domain and Path of c by the first matching
+// rules and reports whether c is changed. buf is a scratch buffer.
+func (rw *proxyRewrite) rewriteCookie(c *fasthttp.Cookie, buf []byte) bool {
+	changed := false
+	if d := bytes.TrimPrefix(c.Domain(), []byte{'.'}); len(d) > 0 {
+		for _, r := range rw.cookieDomains {
+			if bytes.EqualFold(d, bytes.TrimPrefix(r.from, []byte{'.'})) {
+				c.SetDomainBytes(r.to)
+				changed = true
+				break
+			}
+		}
+	}
+	if p := c.Path(); len(p) > 0 {
+		for _, r := range rw.cookiePaths {
+			if bytes.HasPrefix(p, r.from) {
+				buf = append(append(buf[:0], r.to...), p[len(r.from):]...)
+				c.SetPathBytes(buf)
+				changed = true
+				break
+			}
+		}
+	}
+	return changed
+}
@@ -0,0 +1,296 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fasthttpd/fasthttpd/pkg/logger"
+	"github.com/mojatter/tree"
+	"github.com/valyala/fasthttp"
+)
+
+func TestStripPathPrefix(t *testing.T) {
+	tests := []struct {
+		p      string
+		prefix string
+		want   string
+	}{
+		{p: "/api/users", prefix: "/api", want: "/users"},
+		{p: "/api", prefix: "/api", want: "/"},
+		{p: "/api/", prefix: "/api", want: "/"},
+		{p: "/apis/users", prefix: "/api", want: "/apis/users"},
+		{p: "/users", prefix: "/api", want: "/users"},
+	}
+	for i, test := range tests {
+		if got := string(stripPathPrefix([]byte(test.p), test.prefix)); got != test.want {
+			t.Errorf("tests[%d] got %q; want %q", i, got, test.want)
+		}
+	}
+}
+
+func TestProxyHandler_RewriteRequest(t *testing.T) {
+	echoed := []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "X-Real-IP", "Forwarded"}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Got-Uri", r.URL.RequestURI())
+		w.Header().Set("X-Got-Host", r.Host)
+		for _, k := range echoed {
+			w.Header().Set("X-Got-"+k, r.Header.Get(k))
+		}
+	}))
+	defer backend.Close()
+
+	testCases := []struct {
+		caseName string
+		cfg      tree.Map
+		remoteIP string
+		uri      string
+		headers  map[string]string
+		wantURI  string
+		want     map[string]string
+	}{
+		{
+			caseName: "forwarding headers are set",
+			cfg:      tree.Map{"url": tree.V(backend.URL)},
+			remoteIP: "10.0.0.1",
+			uri:      "/a?x=1",
+			wantURI:  "/a?x=1",
+			want: map[string]string{
+				"Host":              "example.com",
+				"X-Forwarded-For":   "10.0.0.1",
+				"X-Forwarded-Proto": "http",
+				"X-Forwarded-Host":  "example.com",
+				"X-Real-IP":         "10.0.0.1",
+				"Forwarded":         `for=10.0.0.1;host="example.com";proto=http`,
+			},
+		}, {
+			caseName: "values of a trusted peer are kept",
+			cfg: tree.Map{
+				"url":            tree.V(backend.URL),
+				"trustedProxies": tree.A("10.0.0.0/8"),
+			},
+			remoteIP: "10.0.0.1",
+			uri:      "/",
+			headers: map[string]string{
+				"X-Forwarded-For":   "192.0.2.1",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "public.example.com",
+				"X-Real-IP":         "192.0.2.1",
+				"Forwarded":         "for=192.0.2.1;proto=https",
+			},
+			wantURI: "/",
+			want: map[string]string{
+				"X-Forwarded-For":   "192.0.2.1, 10.0.0.1",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "public.example.com",
+				"X-Real-IP":         "192.0.2.1",
+				"Forwarded":         `for=192.0.2.1;proto=https, for=10.0.0.1;host="example.com";proto=http`,
+			},
+		}, {
+			caseName: "values of an untrusted peer are overwritten",
+			cfg: tree.Map{
+				"url":            tree.V(backend.URL),
+				"trustedProxies": tree.A("10.0.0.0/8"),
+			},
+			remoteIP: "2001:db8::1",
+			uri:      "/",
+			headers: map[string]string{
+				"X-Forwarded-For":   "192.0.2.1",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "public.example.com",
+				"X-Real-IP":         "192.0.2.1",
+				"Forwarded":         "for=192.0.2.1;proto=https",
+			},
+			wantURI: "/",
+			want: map[string]string{
+				"X-Forwarded-For":   "2001:db8::1",
+				"X-Forwarded-Proto": "http",
+				"X-Forwarded-Host":  "example.com",
+				"X-Real-IP":         "2001:db8::1",
+				"Forwarded":         `for="[2001:db8::1]";host="example.com";proto=http`,
+			},
+		}, {
+			caseName: "no peer is trusted by default",
+			cfg:      tree.Map{"url": tree.V(backend.URL)},
+			remoteIP: "10.0.0.1",
+			uri:      "/",
+			headers: map[string]string{
+				"X-Forwarded-For":   "192.0.2.1",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "public.example.com",
+				"X-Real-IP":         "192.0.2.1",
+				"Forwarded":         "for=192.0.2.1;proto=https",
+			},
+			wantURI: "/",
+			want: map[string]string{
+				"X-Forwarded-For":   "10.0.0.1",
+				"X-Forwarded-Proto": "http",
+				"X-Forwarded-Host":  "example.com",
+				"X-Real-IP":         "10.0.0.1",
+				"Forwarded":         `for=10.0.0.1;host="example.com";proto=http`,
+			},
+		}, {
+			caseName: "prefix is stripped and added",
+			cfg: tree.Map{
+				"url":         tree.V(backend.URL + "/base"),
+				"stripPrefix": tree.V("/api/"),
+				"addPrefix":   tree.V("/v1"),
+			},
+			remoteIP: "10.0.0.1",
+			uri:      "/api/users?x=1",
+			wantURI:  "/base/v1/users?x=1",
+		}, {
+			caseName: "path without the prefix is kept",
+			cfg: tree.Map{
+				"url":         tree.V(backend.URL),
+				"stripPrefix": tree.V("/api"),
+			},
+			remoteIP: "10.0.0.1",
+			uri:      "/apis/users",
+			wantURI:  "/apis/users",
+		}, {
+			caseName: "host of the backend",
+			cfg: tree.Map{
+				"url":          tree.V(backend.URL),
+				"preserveHost": tree.V(false),
+			},
+			remoteIP: "10.0.0.1",
+			uri:      "/",
+			wantURI:  "/",
+			want: map[string]string{
+				"Host":             strings.TrimPrefix(backend.URL, "http://"),
+				"X-Forwarded-Host": "example.com",
+			},
+		}, {
+			caseName: "host header template",
+			cfg: tree.Map{
+				"url":        tree.V(backend.URL),
+				"hostHeader": tree.V("internal.${host}"),
+			},
+			remoteIP: "10.0.0.1",
+			uri:      "/",
+			wantURI:  "/",
+			want: map[string]string{
+				"Host":             "internal.example.com",
+				"X-Forwarded-Host": "example.com",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.caseName, func(t *testing.T) {
+			h, closer, err := NewProxyHandlerCloser(tc.cfg, logger.NilLogger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closer.Close()
+
+			req := &fasthttp.Request{}
+			req.Header.SetHost("example.com")
+			req.SetRequestURI(tc.uri)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Init(req, &net.TCPAddr{IP: net.ParseIP(tc.remoteIP), Port: 12345}, nil)
+			h(ctx)
+
+			resp := &ctx.Response
+			if got := resp.StatusCode(); got != http.StatusOK {
+				t.Fatalf("status = %d; want %d", got, http.StatusOK)
+			}
+			if got := string(resp.Header.Peek("X-Got-Uri")); got != tc.wantURI {
+				t.Errorf("backend uri = %q; want %q", got, tc.wantURI)
+			}
+			for k, want := range tc.want {
+				if got := string(resp.Header.Peek("X-Got-" + k)); got != want {
+					t.Errorf("backend %s = %q; want %q", k, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyHandler_RewriteResponse(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "http://backend.local:9000/app/login?next=%2F")
+		http.SetCookie(w, &http.Cookie{Name: "sid", Value: "1", Domain: "backend.local", Path: "/app/"})
+		http.SetCookie(w, &http.Cookie{Name: "lang", Value: "ja", Domain: "other.local", Path: "/"})
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer backend.Close()
+
+	h, closer, err := NewProxyHandlerCloser(tree.Map{
+		"url": tree.V(backend.URL),
+		"rewriteLocation": tree.A(
+			tree.Map{"from": tree.V("http://other.local/"), "to": tree.V("/other/")},
+			tree.Map{"from": tree.V("http://backend.local:9000/app/"), "to": tree.V("https://${host}/")},
+		),
+		"rewriteCookieDomain": tree.A(tree.Map{"from": tree.V("Backend.Local"), "to": tree.V("example.com")}),
+		"rewriteCookiePath":   tree.A(tree.Map{"from": tree.V("/app/"), "to": tree.V("/")}),
+	}, logger.NilLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	ctx := newMirrorTestCtx(http.MethodGet, "/login", "")
+	h(ctx)
+
+	resp := &ctx.Response
+	if got, want := string(resp.Header.Peek("Location")), "https://example.com/login?next=%2F"; got != want {
+		t.Errorf("Location = %q; want %q", got, want)
+	}
+	wantCookies := map[string]string{
+		"sid":  "sid=1; domain=example.com; path=/",
+		"lang": "lang=ja; Path=/; Domain=other.local",
+	}
+	for name, want := range wantCookies {
+		if got := string(resp.Header.PeekCookie(name)); got != want {
+			t.Errorf("Set-Cookie %s = %q; want %q", name, got, want)
+		}
+	}
+}
+
+func TestNewProxyRewrite_Errors(t *testing.T) {
+	testCases := []struct {
+		caseName string
+		cfg      tree.Map
+		errstr   string
+	}{
+		{
+			caseName: "relative stripPrefix",
+			cfg:      tree.Map{"stripPrefix": tree.V("api")},
+			errstr:   `failed to create proxy: stripPrefix must start with '/': api`,
+		}, {
+			caseName: "relative addPrefix",
+			cfg:      tree.Map{"addPrefix": tree.V("v1")},
+			errstr:   `failed to create proxy: addPrefix must start with '/': v1`,
+		}, {
+			caseName: "invalid trusted proxy",
+			cfg:      tree.Map{"trustedProxies": tree.A("10.0.0.0/33")},
+			errstr:   `failed to create proxy: trustedProxies: invalid ip prefix "10.0.0.0/33": netip.ParsePrefix("10.0.0.0/33"): prefix length out of range`,
+		}, {
+			caseName: "location rewrite without from",
+			cfg:      tree.Map{"rewriteLocation": tree.A(tree.Map{"to": tree.V("/")})},
+			errstr:   `failed to create proxy: rewriteLocation[0]: require 'from' entry`,
+		}, {
+			caseName: "cookie path rewrite without from",
+			cfg:      tree.Map{"rewriteCookiePath": tree.A(tree.Map{"to": tree.V("/")})},
+			errstr:   `failed to create proxy: rewriteCookiePath[0]: require 'from' entry`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.caseName, func(t *testing.T) {
+			tc.cfg["url"] = tree.V("http://localhost:9000")
+			_, err := NewProxyHandler(tc.cfg, logger.NilLogger)
+			if err == nil {
+				t.Fatalf("unexpected no error")
+			}
+			if err.Error() != tc.errstr {
+				t.Errorf("unexpected error: %q; want %q", err.Error(), tc.errstr)
+			}
+		})
+	}
+}
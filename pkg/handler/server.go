@@ -1,17 +1,19 @@
 package handler
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"time"
 
 	"github.com/fasthttpd/fasthttpd/pkg/config"
 	"github.com/fasthttpd/fasthttpd/pkg/filter"
 	"github.com/fasthttpd/fasthttpd/pkg/logger"
 	"github.com/fasthttpd/fasthttpd/pkg/logger/accesslog"
 	"github.com/fasthttpd/fasthttpd/pkg/route"
+	"github.com/fasthttpd/fasthttpd/pkg/util"
 	"github.com/mojatter/tree"
 	"github.com/valyala/fasthttp"
 )
@@ -32,57 +34,88 @@ type ServerHandler interface {
 
 // NewServerHandler creates a new ServerHandler by the provided cfgs.
 func NewServerHandler(cfgs []config.Config) (ServerHandler, error) {
-	if len(cfgs) == 1 {
+	if len(cfgs) == 1 && cfgs[0].UnknownHostStatus == 0 {
 		return newHostHandler(cfgs[0])
 	}
 	return newVirtualHandler(cfgs)
 }
 
+// virtualHandler dispatches requests to the hostHandler whose host or
+// aliases match the request host. Requests for unknown hosts go to the
+// default server, which is the config marked defaultServer, or are answered
+// with unknownHostStatus, or otherwise go to the first config.
 type virtualHandler struct {
-	handlers []*hostHandler
-	logger   logger.Logger
+	handlers          []*hostHandler
+	hosts             *util.HostMatcher
+	defaultHandler    *hostHandler
+	unknownHostStatus int
+	logger            logger.Logger
 }
 
 func newVirtualHandler(cfgs []config.Config) (*virtualHandler, error) {
+	v := &virtualHandler{hosts: util.NewHostMatcher()}
+	defaultIndex := -1
+	for i, cfg := range cfgs {
+		if cfg.DefaultServer {
+			if defaultIndex != -1 {
+				return nil, fmt.Errorf("multiple default servers on %q: %q and %q",
+					cfg.Listen, cfgs[defaultIndex].Host, cfg.Host)
+			}
+			defaultIndex = i
+		}
+		if cfg.UnknownHostStatus != 0 {
+			if v.unknownHostStatus != 0 && v.unknownHostStatus != cfg.UnknownHostStatus {
+				return nil, fmt.Errorf("conflicting unknownHostStatus on %q: %d and %d",
+					cfg.Listen, v.unknownHostStatus, cfg.UnknownHostStatus)
+			}
+			v.unknownHostStatus = cfg.UnknownHostStatus
+		}
+		for _, host := range append([]string{cfg.Host}, cfg.Aliases...) {
+			if err := v.hosts.Add(host, i); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	outputs := map[string]bool{}
-	var handlers []*hostHandler
 	var loggers []logger.Logger
 	for _, cfg := range cfgs {
 		h, err := newHostHandler(cfg)
 		if err != nil {
+			for _, built := range v.handlers {
+				_ = built.Close()
+			}
 			return nil, err
 		}
-		handlers = append(handlers, h)
+		v.handlers = append(v.handlers, h)
 		if _, ok := outputs[cfg.Log.Output]; !ok {
 			outputs[cfg.Log.Output] = true
 			loggers = append(loggers, h.Logger())
 		}
 	}
-	return &virtualHandler{
-		handlers: handlers,
-		logger: &logger.LoggerDelegator{
-			PrintfFunc: func(format string, args ...any) {
-				for _, l := range loggers {
-					l.Printf(format, args...)
-				}
-			},
+	switch {
+	case defaultIndex != -1:
+		v.defaultHandler = v.handlers[defaultIndex]
+	case v.unknownHostStatus == 0:
+		v.defaultHandler = v.handlers[0]
+	}
+	v.logger = &logger.LoggerDelegator{
+		PrintfFunc: func(format string, args ...any) {
+			for _, l := range loggers {
+				l.Printf(format, args...)
+			}
 		},
-	}, nil
+	}
+	return v, nil
 }
 
-func (v *virtualHandler) handler(hostBytes []byte) *hostHandler {
-	host := hostBytes
-	if i := bytes.Index(hostBytes, []byte{':'}); i != -1 {
-		host = hostBytes[:i]
+// handler returns the hostHandler for the request host, or nil when the host
+// is unknown and no default server is configured.
+func (v *virtualHandler) handler(host []byte) *hostHandler {
+	if i, ok := v.hosts.Match(util.StripHostPort(host)); ok {
+		return v.handlers[i]
 	}
-	if len(v.handlers) > 1 {
-		for _, h := range v.handlers {
-			if bytes.Equal(host, h.hostBytes) {
-				return h
-			}
-		}
-	}
-	return v.handlers[0]
+	return v.defaultHandler
 }
 
 // Config returns the config.Config.Server.
@@ -97,12 +130,21 @@ func (v *virtualHandler) Logger() logger.Logger {
 
 // Handle handles the provided request.
 func (v *virtualHandler) Handle(ctx *fasthttp.RequestCtx) {
-	v.handler(ctx.Host()).Handle(ctx)
+	h := v.handler(ctx.Host())
+	if h == nil {
+		ctx.Error(fasthttp.StatusMessage(v.unknownHostStatus), v.unknownHostStatus)
+		return
+	}
+	h.Handle(ctx)
 }
 
 // HandleError implements fasthttp.Server.ErrorHandler.
 func (v *virtualHandler) HandleError(ctx *fasthttp.RequestCtx, err error) {
-	v.handler(ctx.Host()).HandleError(ctx, err)
+	h := v.handler(ctx.Host())
+	if h == nil {
+		h = v.handlers[0]
+	}
+	h.HandleError(ctx, err)
 }
 
 // Close calls Close each handlers.
@@ -121,22 +163,24 @@ func (v *virtualHandler) Close() error {
 
 type hostHandler struct {
 	cfg        config.Config
-	hostBytes  []byte
 	logger     logger.Logger
 	accessLog  accesslog.AccessLog
 	errorPages *ErrorPages
 	filters    map[string]filter.Filter
 	handlers   map[string]fasthttp.RequestHandler
+	closers    []io.Closer
 	routes     *route.Routes
+	metrics    *hostMetrics
 }
 
 func newHostHandler(cfg config.Config) (*hostHandler, error) {
 	h := &hostHandler{
 		cfg:        cfg,
-		hostBytes:  []byte(cfg.Host),
 		errorPages: NewErrorPages(cfg.Root, cfg.ErrorPages),
+		metrics:    newHostMetrics(cfg),
 	}
 	if err := h.init(); err != nil {
+		_ = h.Close()
 		return nil, err
 	}
 	return h, nil
@@ -147,16 +191,17 @@ func (h *hostHandler) init() error {
 	if err != nil {
 		return err
 	}
+	// Set before the next error return so that Close closes it.
+	h.logger = l
 	al, err := accesslog.NewAccessLog(h.cfg)
 	if err != nil {
 		return err
 	}
-	h.logger = l
 	h.accessLog = al
 
 	h.filters = map[string]filter.Filter{}
 	for name, filterCfg := range h.cfg.Filters {
-		f, err := filter.NewFilter(filterCfg)
+		f, err := filter.NewFilterWithLogger(filterCfg, l)
 		if err != nil {
 			return err
 		}
@@ -168,11 +213,12 @@ func (h *hostHandler) init() error {
 		if hcfg.Get("root").Value().String() == "" {
 			_ = hcfg.Set("root", tree.ToValue(h.cfg.Root))
 		}
-		hh, err := NewHandler(hcfg, l)
+		hh, closer, err := NewHandlerCloser(hcfg, l)
 		if err != nil {
 			return err
 		}
 		h.handlers[name] = hh
+		h.closers = append(h.closers, closer)
 	}
 
 	routes, err := route.NewRoutes(h.cfg)
@@ -197,27 +243,37 @@ func (h *hostHandler) Logger() logger.Logger {
 // Handle handles the provided request.
 func (h *hostHandler) Handle(ctx *fasthttp.RequestCtx) {
 	h.accessLog.Collect(ctx)
-	off := 0
+	// served is the index of the route that served the response. A route
+	// falling through on 404 still serves it if no later route matches.
+	off, served := 0, -1
 	for {
 		result := h.routes.CachedRouteCtx(ctx, off)
 		h.handleRouteResult(ctx, result)
-		off = result.RouteIndex
+		index := result.RouteIndex
 		resultStatusCode := result.StatusCode
 		result.Release()
+		if index >= 0 {
+			served = index
+		}
 
 		if resultStatusCode != http.StatusNotFound &&
 			ctx.Response.StatusCode() == http.StatusNotFound &&
-			h.routes.IsNextIfNotFound(off) {
+			h.routes.IsNextIfNotFound(index) {
 			ctx.Response.Reset()
-			off++
+			off = index + 1
 			continue
 		}
 		break
 	}
 	h.accessLog.Log(ctx)
+	h.metrics.observe(served, ctx.Response.StatusCode(), time.Since(ctx.Time()))
 }
 
 func (h *hostHandler) handleRouteResult(ctx *fasthttp.RequestCtx, result *route.Result) {
+	for _, c := range result.Captures {
+		// Copied since the result is released after handling.
+		ctx.SetUserValue(c.Name, string(c.Value))
+	}
 	if uri := result.RewriteURIWithQueryString(ctx); len(uri) > 0 {
 		ctx.Request.SetRequestURIBytes(uri)
 	}
@@ -260,14 +316,32 @@ func (h *hostHandler) HandleError(ctx *fasthttp.RequestCtx, err error) {
 	h.errorPages.Handle(ctx)
 }
 
-// Close closes the server.
+// Close closes the server. It releases the handlers and filters that hold
+// background resources, then the access log and the logger.
 func (h *hostHandler) Close() error {
 	var errs []error
+	for _, c := range h.closers {
+		if err := c.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, f := range h.filters {
+		if c, ok := f.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
 	if h.accessLog != nil {
 		if err := h.accessLog.Close(); err != nil {
 			errs = append(errs, err)
 		}
 	}
+	if h.logger != nil {
+		if err := h.logger.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
 	if len(errs) > 0 {
 		return fmt.Errorf("failed to close main handler: %v", errors.Join(errs...))
 	}
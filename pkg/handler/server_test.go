@@ -45,8 +45,9 @@ func TestNewServerHandler(t *testing.T) {
 	}
 }
 
-func newHostHandlerTest(t *testing.T) *hostHandler {
-	rs, err := route.NewRoutes(config.Config{
+func newHostHandlerTest(t *testing.T, host string) *hostHandler {
+	cfg := config.Config{
+		Host: host,
 		Filters: map[string]tree.Map{
 			"auth":  {},
 			"cache": {},
@@ -63,7 +64,7 @@ func newHostHandlerTest(t *testing.T) *hostHandler {
 				Filters:        []string{"cache"},
 				NextIfNotFound: true,
 			}, {
-				Path:    `/view/([0-9]+)$`,
+				Path:    `/view/(?P<id>[0-9]+)$`,
 				Match:   config.MatchRegexp,
 				Rewrite: "/view?id=$1",
 			}, {
@@ -77,7 +78,8 @@ func newHostHandlerTest(t *testing.T) *hostHandler {
 				Filters: []string{"auth"},
 			},
 		},
-	})
+	}
+	rs, err := route.NewRoutes(cfg)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -111,12 +113,16 @@ func newHostHandlerTest(t *testing.T) *hostHandler {
 				ctx.Response.SetBodyString("Body static")
 			},
 			"backend": func(ctx *fasthttp.RequestCtx) {
+				if id, ok := ctx.UserValue("id").(string); ok {
+					ctx.Response.Header.Set("X-View-Id", id)
+				}
 				ctx.Response.Header.Set("Content-Type", "text/html; charset=utf-8")
 				ctx.Response.SetBodyString("Body")
 			},
 		},
 		routes:     rs,
 		errorPages: &ErrorPages{},
+		metrics:    newHostMetrics(cfg),
 	}
 }
 
@@ -157,7 +163,7 @@ outer:
 }
 
 func Test_hostHandler_Handle(t *testing.T) {
-	h := newHostHandlerTest(t)
+	h := newHostHandlerTest(t, "handle.test")
 	defer h.Close()
 
 	tests := []struct {
@@ -192,6 +198,7 @@ func Test_hostHandler_Handle(t *testing.T) {
 			wantBody:   "Body",
 			wantHeaders: [][]string{
 				{"Content-Type", "text/html; charset=utf-8"},
+				{"X-View-Id", "1"},
 			},
 		}, {
 			note: "typical static",
@@ -320,3 +327,142 @@ func Test_virtualHandler(t *testing.T) {
 		}
 	}
 }
+
+func Test_virtualHandler_HostPatterns(t *testing.T) {
+	// statusRoutes answers every request with status so that the test can
+	// tell which virtual host served it.
+	statusRoutes := func(status int) []config.Route {
+		return []config.Route{{Status: status}}
+	}
+	testCases := []struct {
+		caseName string
+		cfgs     []config.Config
+		host     string
+		want     int
+	}{
+		{
+			caseName: "exact beats wildcard",
+			cfgs: []config.Config{
+				{Host: "*.example.com", Routes: statusRoutes(201)},
+				{Host: "www.example.com", Routes: statusRoutes(202)},
+			},
+			host: "www.example.com",
+			want: 202,
+		}, {
+			caseName: "wildcard matches subdomain",
+			cfgs: []config.Config{
+				{Host: "example.com", Routes: statusRoutes(201)},
+				{Host: "*.example.com", Routes: statusRoutes(202)},
+			},
+			host: "tenant.example.com:8080",
+			want: 202,
+		}, {
+			caseName: "longest wildcard wins",
+			cfgs: []config.Config{
+				{Host: "*.example.com", Routes: statusRoutes(201)},
+				{Host: "*.api.example.com", Routes: statusRoutes(202)},
+			},
+			host: "v1.api.example.com",
+			want: 202,
+		}, {
+			caseName: "regexp",
+			cfgs: []config.Config{
+				{Host: "example.com", Routes: statusRoutes(201)},
+				{Host: `~^app\d+\.example\.com$`, Routes: statusRoutes(202)},
+			},
+			host: "app42.example.com",
+			want: 202,
+		}, {
+			caseName: "alias is case-insensitive",
+			cfgs: []config.Config{
+				{Host: "example.com", Routes: statusRoutes(201)},
+				{Host: "example.org", Aliases: []string{"www.example.org"}, Routes: statusRoutes(202)},
+			},
+			host: "WWW.Example.ORG",
+			want: 202,
+		}, {
+			caseName: "unknown host falls back to first",
+			cfgs: []config.Config{
+				{Host: "example.com", Routes: statusRoutes(201)},
+				{Host: "example.org", Routes: statusRoutes(202)},
+			},
+			host: "unknown.test",
+			want: 201,
+		}, {
+			caseName: "unknown host goes to default server",
+			cfgs: []config.Config{
+				{Host: "example.com", Routes: statusRoutes(201)},
+				{Host: "example.org", DefaultServer: true, Routes: statusRoutes(202)},
+			},
+			host: "unknown.test",
+			want: 202,
+		}, {
+			caseName: "unknown host gets unknownHostStatus",
+			cfgs: []config.Config{
+				{Host: "example.com", UnknownHostStatus: http.StatusMisdirectedRequest, Routes: statusRoutes(201)},
+				{Host: "example.org", Routes: statusRoutes(202)},
+			},
+			host: "unknown.test",
+			want: http.StatusMisdirectedRequest,
+		}, {
+			caseName: "single config with unknownHostStatus",
+			cfgs: []config.Config{
+				{Host: "example.com", UnknownHostStatus: http.StatusNotFound, Routes: statusRoutes(201)},
+			},
+			host: "unknown.test",
+			want: http.StatusNotFound,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.caseName, func(t *testing.T) {
+			h, err := NewServerHandler(tc.cfgs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer h.Close()
+
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Request.Header.SetHost(tc.host)
+			ctx.Request.URI().SetPath("/")
+			h.Handle(ctx)
+			if got := ctx.Response.StatusCode(); got != tc.want {
+				t.Errorf("status = %d; want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func Test_newVirtualHandler_Errors(t *testing.T) {
+	testCases := []struct {
+		caseName string
+		cfgs     []config.Config
+		errstr   string
+	}{
+		{
+			caseName: "multiple default servers",
+			cfgs: []config.Config{
+				{Host: "a", Listen: ":8080", DefaultServer: true},
+				{Host: "b", Listen: ":8080", DefaultServer: true},
+			},
+			errstr: `multiple default servers on ":8080": "a" and "b"`,
+		}, {
+			caseName: "conflicting unknownHostStatus",
+			cfgs: []config.Config{
+				{Host: "a", Listen: ":8080", UnknownHostStatus: 404},
+				{Host: "b", Listen: ":8080", UnknownHostStatus: 421},
+			},
+			errstr: `conflicting unknownHostStatus on ":8080": 404 and 421`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.caseName, func(t *testing.T) {
+			_, err := newVirtualHandler(tc.cfgs)
+			if err == nil {
+				t.Fatal("unexpected no error")
+			}
+			if err.Error() != tc.errstr {
+				t.Errorf("unexpected error: %q; want %q", err.Error(), tc.errstr)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/mojatter/tree"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	defaultStickyCookie = "fasthttpd_backend"
+	// stickySigSize is the size of the truncated HMAC-SHA256 of the cookie
+	// value.
+	stickySigSize = 16
+)
+
+// stickyNow returns the current time. Tests swap it to inject a
+// deterministic clock.
+var stickyNow = time.Now
+
+// stickyDefaultSecret is the key of the cookie signature if no secret is
+// configured. It is random per process, so the cookies survive a reload of
+// the config but not a restart.
+var stickyDefaultSecret = sync.OnceValue(func() []byte {
+	secret := make([]byte, 32)
+	rand.Read(secret) //nolint:errcheck
+	return secret
+})
+
+// proxyStickyConfig is the 'sticky' entry of the proxy handler config.
+type proxyStickyConfig struct {
+	Cookie string `yaml:"cookie"`
+	// Secret is the key of the cookie signature. A random key per process
+	// is used if empty, so the cookies are invalidated on restart.
+	Secret string `yaml:"secret"`
+	// TTL is the Max-Age of the cookie. The cookie is a session cookie if
+	// zero.
+	TTL      config.Duration `yaml:"ttl"`
+	Path     string          `yaml:"path"`
+	Domain   string          `yaml:"domain"`
+	Secure   bool            `yaml:"secure"`
+	HTTPOnly *bool           `yaml:"httpOnly"`
+	SameSite string          `yaml:"sameSite"`
+}
+
+// stickyTarget is a backend that can be named by the affinity cookie.
+type stickyTarget struct {
+	be *proxyBackend
+	// sig is the signature of the ID of be, and value is the cookie value
+	// naming be, which is the ID and sig joined by a dot.
+	sig   []byte
+	value []byte
+}
+
+// proxySticky routes the requests of a client to the same backend by an
+// affinity cookie naming the backend. The cookie is signed so that clients
+// cannot pick a backend of their choice.
+type proxySticky struct {
+	cookie   string
+	ttl      time.Duration
+	path     string
+	domain   string
+	secure   bool
+	httpOnly bool
+	sameSite fasthttp.CookieSameSite
+	// targets are keyed by the ID of the backends.
+	targets map[string]*stickyTarget
+	values  map[*proxyBackend][]byte
+}
+
+func newProxySticky(cfg tree.Node, backends []*proxyBackend) (*proxySticky, error) {
+	sc := &proxyStickyConfig{}
+	if err := tree.UnmarshalViaYAML(cfg, sc); err != nil {
+		return nil, fmt.Errorf("sticky: %w", err)
+	}
+	s := &proxySticky{
+		cookie:   sc.Cookie,
+		ttl:      time.Duration(sc.TTL),
+		path:     sc.Path,
+		domain:   sc.Domain,
+		secure:   sc.Secure,
+		httpOnly: sc.HTTPOnly == nil || *sc.HTTPOnly,
+		targets:  map[string]*stickyTarget{},
+		values:   map[*proxyBackend][]byte{},
+	}
+	if s.cookie == "" {
+		s.cookie = defaultStickyCookie
+	}
+	if s.path == "" {
+		s.path = "/"
+	}
+	switch strings.ToLower(sc.SameSite) {
+	case "":
+	case "lax":
+		s.sameSite = fasthttp.CookieSameSiteLaxMode
+	case "strict":
+		s.sameSite = fasthttp.CookieSameSiteStrictMode
+	case "none":
+		s.sameSite = fasthttp.CookieSameSiteNoneMode
+	default:
+		return nil, fmt.Errorf("sticky: unknown sameSite: %s", sc.SameSite)
+	}
+	secret := []byte(sc.Secret)
+	if len(secret) == 0 {
+		secret = stickyDefaultSecret()
+	}
+	for _, be := range backends {
+		// The ID is derived from the URL rather than the position so that
+		// the cookies survive a reordering of the backends.
+		id := strconv.AppendUint(nil, hashBytes([]byte(be.url.String())), 36)
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(s.cookie)) //nolint:errcheck
+		mac.Write([]byte{'='})      //nolint:errcheck
+		mac.Write(id)               //nolint:errcheck
+		sig := base64.RawURLEncoding.AppendEncode(nil, mac.Sum(nil)[:stickySigSize])
+		value := append(append(append([]byte{}, id...), '.'), sig...)
+		s.targets[string(id)] = &stickyTarget{be: be, sig: sig, value: value}
+		s.values[be] = value
+	}
+	return s, nil
+}
+
+// backend returns the backend named by the affinity cookie of ctx, or nil
+// if the cookie is missing or its signature is invalid. It also reports
+// whether the cookie has a ttl of which half has passed, so that it is
+// re-issued to extend it.
+func (s *proxySticky) backend(ctx *fasthttp.RequestCtx) (*proxyBackend, bool) {
+	id, rest, ok := bytes.Cut(ctx.Request.Header.Cookie(s.cookie), []byte{'.'})
+	if !ok {
+		return nil, false
+	}
+	// The issue time is not signed, since it only decides when the cookie
+	// is re-issued.
+	sig, issued, _ := bytes.Cut(rest, []byte{'.'})
+	t := s.targets[string(id)]
+	if t == nil || !hmac.Equal(sig, t.sig) {
+		return nil, false
+	}
+	return t.be, s.ttl > 0 && s.due(issued)
+}
+
+// due reports whether half of the ttl has passed since issued, the Unix
+// time in seconds in base 36. A cookie without it is due.
+func (s *proxySticky) due(issued []byte) bool {
+	sec, err := strconv.ParseInt(string(issued), 36, 64)
+	return err != nil || stickyNow().Sub(time.Unix(sec, 0)) >= s.ttl/2
+}
+
+// setCookie sets the affinity cookie naming be to the response of ctx. A
+// cookie with a ttl carries its issue time.
+func (s *proxySticky) setCookie(ctx *fasthttp.RequestCtx, be *proxyBackend) {
+	c := fasthttp.AcquireCookie()
+	defer fasthttp.ReleaseCookie(c)
+
+	c.SetKey(s.cookie)
+	c.SetPath(s.path)
+	if s.domain != "" {
+		c.SetDomain(s.domain)
+	}
+	if s.ttl > 0 {
+		var buf [64]byte
+		value := append(append(buf[:0], s.values[be]...), '.')
+		c.SetValueBytes(strconv.AppendInt(value, stickyNow().Unix(), 36))
+		c.SetMaxAge(int(s.ttl / time.Second))
+	} else {
+		c.SetValueBytes(s.values[be])
+	}
+	c.SetSecure(s.secure)
+	c.SetHTTPOnly(s.httpOnly)
+	c.SetSameSite(s.sameSite)
+	ctx.Response.Header.SetCookie(c)
+}
@@ -0,0 +1,228 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasthttpd/fasthttpd/pkg/logger"
+	"github.com/mojatter/tree"
+	"github.com/valyala/fasthttp"
+)
+
+// newNamedServer starts a backend that responds with its name.
+func newNamedServer(t *testing.T, name string) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name)) //nolint:errcheck
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestProxyHandler_Sticky(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	orig := stickyNow
+	stickyNow = func() time.Time { return now }
+	defer func() { stickyNow = orig }()
+
+	a, b := newNamedServer(t, "a"), newNamedServer(t, "b")
+	h, closer, err := NewProxyHandlerCloser(tree.Map{
+		"urls": tree.A(a.URL, b.URL),
+		"sticky": tree.Map{
+			"cookie":   tree.V("be"),
+			"secret":   tree.V("secret"),
+			"ttl":      tree.V("1h"),
+			"path":     tree.V("/app"),
+			"secure":   tree.V(true),
+			"sameSite": tree.V("Lax"),
+		},
+	}, logger.NilLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+	balancer := closer.(*proxyBalancer)
+
+	// do sends a request with the cookie and returns the name of the
+	// backend and the cookie set by the response.
+	do := func(cookie string) (string, string) {
+		ctx := newMirrorTestCtx(http.MethodGet, "/app", "")
+		if cookie != "" {
+			ctx.Request.Header.SetCookie("be", cookie)
+		}
+		h(ctx)
+		if code := ctx.Response.StatusCode(); code != http.StatusOK {
+			t.Fatalf("status = %d; want %d", code, http.StatusOK)
+		}
+		c := fasthttp.AcquireCookie()
+		defer fasthttp.ReleaseCookie(c)
+		c.SetKey("be")
+		if !ctx.Response.Header.Cookie(c) {
+			return string(ctx.Response.Body()), ""
+		}
+		return string(ctx.Response.Body()), string(c.Value())
+	}
+
+	name, cookie := do("")
+	if cookie == "" {
+		t.Fatalf("cookie was not set")
+	}
+	for range 4 {
+		if got, set := do(cookie); got != name || set != "" {
+			t.Errorf("got %s and cookie %q; want %s and no cookie", got, set, name)
+		}
+	}
+	// The cookie with ttl is re-issued once half of it has passed.
+	now = now.Add(30 * time.Minute)
+	got, set := do(cookie)
+	if got != name || set == "" || set == cookie {
+		t.Fatalf("got %s and cookie %q; want %s and a new cookie", got, set, name)
+	}
+	cookie = set
+	if got, set := do(cookie); got != name || set != "" {
+		t.Errorf("got %s and cookie %q; want %s and no cookie", got, set, name)
+	}
+
+	// A forged cookie is ignored and replaced.
+	id, _, _ := strings.Cut(cookie, ".")
+	if _, set := do(id + ".forged"); set == "" {
+		t.Errorf("cookie was not replaced for a forged cookie")
+	}
+
+	// The algorithm is used while the backend is down.
+	for _, be := range balancer.backends {
+		if sticky, _ := balancer.sticky.backend(newStickyTestCtx("be", cookie)); be == sticky {
+			be.alive.Store(false)
+		}
+	}
+	other, set := do(cookie)
+	if other == name || set == "" || set == cookie {
+		t.Errorf("got %s and cookie %q; want the other backend and a new cookie", other, set)
+	}
+}
+
+func TestProxyHandler_StickySession(t *testing.T) {
+	cfg := tree.Map{
+		"url":    tree.V(newNamedServer(t, "a").URL),
+		"sticky": tree.Map{"cookie": tree.V("be")},
+	}
+	h, closer, err := NewProxyHandlerCloser(cfg, logger.NilLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	ctx := newMirrorTestCtx(http.MethodGet, "/", "")
+	h(ctx)
+	cookie := string(ctx.Response.Header.PeekCookie("be"))
+	if cookie == "" {
+		t.Fatal("cookie was not set")
+	}
+	c := fasthttp.AcquireCookie()
+	defer fasthttp.ReleaseCookie(c)
+	if err := c.Parse(cookie); err != nil {
+		t.Fatal(err)
+	}
+
+	// A session cookie is not re-issued.
+	ctx = newMirrorTestCtx(http.MethodGet, "/", "")
+	ctx.Request.Header.SetCookieBytesKV([]byte("be"), c.Value())
+	h(ctx)
+	if set := ctx.Response.Header.PeekCookie("be"); len(set) > 0 {
+		t.Errorf("session cookie was re-issued: %s", set)
+	}
+
+	// The default secret is kept by a reload.
+	reloaded, closer, err := NewProxyHandlerCloser(cfg, logger.NilLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+	ctx = newMirrorTestCtx(http.MethodGet, "/", "")
+	ctx.Request.Header.SetCookieBytesKV([]byte("be"), c.Value())
+	reloaded(ctx)
+	if set := ctx.Response.Header.PeekCookie("be"); len(set) > 0 {
+		t.Errorf("cookie was replaced after reload: %s", set)
+	}
+}
+
+func TestProxySticky_SetCookie(t *testing.T) {
+	backends := []*proxyBackend{}
+	for _, u := range []string{"http://a", "http://b"} {
+		be, err := newProxyBackend(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends = append(backends, be)
+	}
+	testCases := []struct {
+		caseName string
+		sticky   tree.Map
+		want     []string
+		wantNot  []string
+	}{
+		{
+			caseName: "defaults",
+			sticky:   tree.Map{},
+			want:     []string{"fasthttpd_backend=", "; path=/", "; HttpOnly"},
+			wantNot:  []string{"max-age", "secure", "SameSite"},
+		}, {
+			caseName: "attributes",
+			sticky: tree.Map{
+				"cookie":   tree.V("be"),
+				"ttl":      tree.V("90m"),
+				"path":     tree.V("/app"),
+				"domain":   tree.V("example.com"),
+				"secure":   tree.V(true),
+				"httpOnly": tree.V(false),
+				"sameSite": tree.V("Strict"),
+			},
+			want:    []string{"be=", "; max-age=5400", "; domain=example.com", "; path=/app", "; secure", "; SameSite=Strict"},
+			wantNot: []string{"HttpOnly"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.caseName, func(t *testing.T) {
+			s, err := newProxySticky(tc.sticky, backends)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := &fasthttp.RequestCtx{}
+			s.setCookie(ctx, backends[1])
+			got := string(ctx.Response.Header.PeekCookie(s.cookie))
+			for _, want := range tc.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("cookie %q does not contain %q", got, want)
+				}
+			}
+			for _, want := range tc.wantNot {
+				if strings.Contains(got, want) {
+					t.Errorf("cookie %q contains %q", got, want)
+				}
+			}
+			value, _, _ := strings.Cut(strings.TrimPrefix(got, s.cookie+"="), ";")
+			if be, _ := s.backend(newStickyTestCtx(s.cookie, value)); be != backends[1] {
+				t.Errorf("cookie %q names %v; want %s", value, be, backends[1].url)
+			}
+		})
+	}
+}
+
+func TestNewProxySticky_Errors(t *testing.T) {
+	_, err := NewProxyHandler(tree.Map{
+		"url":    tree.V("http://localhost:9000"),
+		"sticky": tree.Map{"sameSite": tree.V("Loose")},
+	}, logger.NilLogger)
+	want := "failed to create proxy: sticky: unknown sameSite: Loose"
+	if err == nil || err.Error() != want {
+		t.Errorf("error %v; want %q", err, want)
+	}
+}
+
+func newStickyTestCtx(name, value string) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetCookie(name, value)
+	return ctx
+}
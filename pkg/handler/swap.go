@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/fasthttpd/fasthttpd/pkg/logger"
+	"github.com/valyala/fasthttp"
+)
+
+// SwapHandler is a ServerHandler that delegates to another ServerHandler
+// which can be replaced while the server is running. Swap installs the new
+// handler atomically; the previous one keeps serving the requests it has
+// already accepted and is closed as soon as the last of them returns, so a
+// configuration reload never drops in-flight or keep-alive connections.
+type SwapHandler struct {
+	current atomic.Pointer[swapGeneration]
+	logger  logger.Logger
+}
+
+var _ ServerHandler = (*SwapHandler)(nil)
+
+// swapGeneration is one installed ServerHandler together with the number of
+// requests it is serving. Once retired it closes itself when inflight drops
+// to zero.
+type swapGeneration struct {
+	h         ServerHandler
+	inflight  atomic.Int64
+	retired   atomic.Bool
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewSwapHandler creates a new SwapHandler that initially delegates to h.
+func NewSwapHandler(h ServerHandler) *SwapHandler {
+	s := &SwapHandler{}
+	s.current.Store(&swapGeneration{h: h})
+	s.logger = &logger.LoggerDelegator{
+		PrintfFunc: func(format string, args ...any) {
+			s.current.Load().h.Logger().Printf(format, args...)
+		},
+	}
+	return s
+}
+
+// Swap installs h and retires the previously installed handler. The retired
+// handler is closed once every request it is serving has finished; close
+// errors are reported through the new handler's logger.
+func (s *SwapHandler) Swap(h ServerHandler) {
+	old := s.current.Swap(&swapGeneration{h: h})
+	old.retired.Store(true)
+	if old.inflight.Load() == 0 {
+		s.closeGeneration(old)
+	}
+}
+
+// acquire returns the current generation with its inflight counter
+// incremented. The re-check after the increment guarantees that a
+// generation retired concurrently is never used after it has been closed.
+func (s *SwapHandler) acquire() *swapGeneration {
+	for {
+		g := s.current.Load()
+		g.inflight.Add(1)
+		if s.current.Load() == g {
+			return g
+		}
+		s.release(g)
+	}
+}
+
+func (s *SwapHandler) release(g *swapGeneration) {
+	if g.inflight.Add(-1) == 0 && g.retired.Load() {
+		s.closeGeneration(g)
+	}
+}
+
+func (s *SwapHandler) closeGeneration(g *swapGeneration) {
+	if err := g.close(); err != nil {
+		s.logger.Printf("failed to close retired handler: %v", err)
+	}
+}
+
+// swapRelease releases a generation when fasthttp resets the request, that
+// is after the response is written.
+type swapRelease struct {
+	s *SwapHandler
+	g *swapGeneration
+}
+
+type swapReleaseKey struct{}
+
+func (r *swapRelease) Close() error {
+	r.s.release(r.g)
+	return nil
+}
+
+func (g *swapGeneration) close() error {
+	g.closeOnce.Do(func() {
+		g.closeErr = g.h.Close()
+	})
+	return g.closeErr
+}
+
+// Config returns the config.Config.Server of the current handler.
+func (s *SwapHandler) Config() config.Server {
+	return s.current.Load().h.Config()
+}
+
+// Logger returns a logger that always writes through the current handler.
+func (s *SwapHandler) Logger() logger.Logger {
+	return s.logger
+}
+
+// Handle handles the provided request with the current handler. A streamed
+// response body, e.g. that of a proxied response, is written by fasthttp
+// after Handle returns, so the handler is held until the request is reset.
+func (s *SwapHandler) Handle(ctx *fasthttp.RequestCtx) {
+	g := s.acquire()
+	held := false
+	defer func() {
+		if !held {
+			s.release(g)
+		}
+	}()
+	g.h.Handle(ctx)
+	if ctx.Response.IsBodyStream() {
+		ctx.SetUserValue(swapReleaseKey{}, &swapRelease{s: s, g: g})
+		held = true
+	}
+}
+
+// HandleError implements fasthttp.Server.ErrorHandler.
+func (s *SwapHandler) HandleError(ctx *fasthttp.RequestCtx, err error) {
+	g := s.acquire()
+	defer s.release(g)
+	g.h.HandleError(ctx, err)
+}
+
+// Close closes the current handler. Retired handlers that are still
+// draining are closed when their last request finishes.
+func (s *SwapHandler) Close() error {
+	return s.current.Load().close()
+}
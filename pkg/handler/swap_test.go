@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/fasthttpd/fasthttpd/pkg/logger"
+	"github.com/valyala/fasthttp"
+)
+
+// swapTestHandler is a ServerHandler stub that writes its name as the body,
+// optionally as a stream, optionally blocks in Handle until block is closed
+// or panics, and counts Close calls.
+type swapTestHandler struct {
+	name    string
+	stream  bool
+	panics  bool
+	block   chan struct{}
+	entered chan struct{}
+	closed  atomic.Int32
+}
+
+func (h *swapTestHandler) Config() config.Server { return config.Server{Name: h.name} }
+func (h *swapTestHandler) Logger() logger.Logger { return logger.NilLogger }
+func (h *swapTestHandler) Close() error          { h.closed.Add(1); return nil }
+
+func (h *swapTestHandler) Handle(ctx *fasthttp.RequestCtx) {
+	if h.entered != nil {
+		close(h.entered)
+	}
+	if h.block != nil {
+		<-h.block
+	}
+	if h.panics {
+		panic(h.name)
+	}
+	if h.stream {
+		ctx.SetBodyStream(strings.NewReader(h.name), -1)
+		return
+	}
+	ctx.SetBodyString(h.name)
+}
+
+func (h *swapTestHandler) HandleError(ctx *fasthttp.RequestCtx, err error) {}
+
+func TestSwapHandler_Swap(t *testing.T) {
+	old := &swapTestHandler{name: "old"}
+	s := NewSwapHandler(old)
+
+	ctx := &fasthttp.RequestCtx{}
+	s.Handle(ctx)
+	if got := string(ctx.Response.Body()); got != "old" {
+		t.Fatalf("body = %q; want %q", got, "old")
+	}
+
+	next := &swapTestHandler{name: "new"}
+	s.Swap(next)
+	if got := old.closed.Load(); got != 1 {
+		t.Errorf("idle old handler closed %d times; want 1", got)
+	}
+	if got := s.Config().Name; got != "new" {
+		t.Errorf("Config().Name = %q; want %q", got, "new")
+	}
+
+	ctx = &fasthttp.RequestCtx{}
+	s.Handle(ctx)
+	if got := string(ctx.Response.Body()); got != "new" {
+		t.Errorf("body = %q; want %q", got, "new")
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := next.closed.Load(); got != 1 {
+		t.Errorf("current handler closed %d times; want 1", got)
+	}
+}
+
+// TestSwapHandler_DrainBeforeClose verifies that a retired handler is not
+// closed while it is still serving a request, and is closed exactly once
+// when that request finishes.
+func TestSwapHandler_DrainBeforeClose(t *testing.T) {
+	old := &swapTestHandler{
+		name:    "old",
+		block:   make(chan struct{}),
+		entered: make(chan struct{}),
+	}
+	s := NewSwapHandler(old)
+
+	var wg sync.WaitGroup
+	ctx := &fasthttp.RequestCtx{}
+	wg.Go(func() {
+		s.Handle(ctx)
+	})
+	<-old.entered
+
+	s.Swap(&swapTestHandler{name: "new"})
+	if got := old.closed.Load(); got != 0 {
+		t.Fatalf("old handler closed %d times while in flight; want 0", got)
+	}
+
+	close(old.block)
+	wg.Wait()
+
+	if got := string(ctx.Response.Body()); got != "old" {
+		t.Errorf("in-flight body = %q; want %q", got, "old")
+	}
+	if got := old.closed.Load(); got != 1 {
+		t.Errorf("old handler closed %d times after drain; want 1", got)
+	}
+}
+
+// TestSwapHandler_HoldUntilReset verifies that a retired handler is not
+// closed before its streamed response is written, nor left open forever
+// by a panic.
+func TestSwapHandler_HoldUntilReset(t *testing.T) {
+	old := &swapTestHandler{name: "old", stream: true}
+	s := NewSwapHandler(old)
+
+	ctx := &fasthttp.RequestCtx{}
+	s.Handle(ctx)
+	panicky := &swapTestHandler{name: "panicky", panics: true}
+	s.Swap(panicky)
+	if got := old.closed.Load(); got != 0 {
+		t.Fatalf("old handler closed %d times while streaming; want 0", got)
+	}
+	if got := string(ctx.Response.Body()); got != "old" {
+		t.Errorf("streamed body = %q; want %q", got, "old")
+	}
+	// fasthttp resets the request after the response is written.
+	ctx.Request.Reset()
+	if got := old.closed.Load(); got != 1 {
+		t.Errorf("old handler closed %d times after reset; want 1", got)
+	}
+
+	func() {
+		defer func() { recover() }()
+		s.Handle(&fasthttp.RequestCtx{})
+	}()
+	s.Swap(&swapTestHandler{name: "new"})
+	if got := panicky.closed.Load(); got != 1 {
+		t.Errorf("panicked handler closed %d times; want 1", got)
+	}
+}
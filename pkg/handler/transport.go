@@ -0,0 +1,205 @@
+package handler
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/mojatter/tree"
+	"github.com/valyala/fasthttp"
+)
+
+// proxyTransportConfig is the 'transport' entry of the proxy handler config.
+// The zero values keep the fasthttp.HostClient defaults.
+type proxyTransportConfig struct {
+	DialTimeout         config.Duration `yaml:"dialTimeout"`
+	TLSHandshakeTimeout config.Duration `yaml:"tlsHandshakeTimeout"`
+	// ResponseHeaderTimeout is the time to wait for the response to start
+	// after the request is sent.
+	ResponseHeaderTimeout config.Duration `yaml:"responseHeaderTimeout"`
+	// Timeout is the time of a try of the request, from getting a
+	// connection to reading the response body.
+	Timeout config.Duration `yaml:"timeout"`
+	// MaxConns is the number of connections per backend. The connections
+	// are kept idle until idleConnTimeout, so it also caps the idle ones.
+	MaxConns           int             `yaml:"maxConns"`
+	MaxConnWaitTimeout config.Duration `yaml:"maxConnWaitTimeout"`
+	IdleConnTimeout    config.Duration `yaml:"idleConnTimeout"`
+	MaxConnDuration    config.Duration `yaml:"maxConnDuration"`
+	ReadBufferSize     config.Size     `yaml:"readBufferSize"`
+	WriteBufferSize    config.Size     `yaml:"writeBufferSize"`
+}
+
+// proxyTransport configures the connections to the backends.
+type proxyTransport struct {
+	dialTimeout           time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+	timeout               time.Duration
+	maxConns              int
+	maxConnWaitTimeout    time.Duration
+	idleConnTimeout       time.Duration
+	maxConnDuration       time.Duration
+	readBufferSize        int
+	writeBufferSize       int
+}
+
+func newProxyTransport(cfg tree.Node) (*proxyTransport, error) {
+	tc := &proxyTransportConfig{}
+	if err := tree.UnmarshalViaYAML(cfg, tc); err != nil {
+		return nil, fmt.Errorf("transport: %w", err)
+	}
+	return &proxyTransport{
+		dialTimeout:           time.Duration(tc.DialTimeout),
+		tlsHandshakeTimeout:   time.Duration(tc.TLSHandshakeTimeout),
+		responseHeaderTimeout: time.Duration(tc.ResponseHeaderTimeout),
+		timeout:               time.Duration(tc.Timeout),
+		maxConns:              tc.MaxConns,
+		maxConnWaitTimeout:    time.Duration(tc.MaxConnWaitTimeout),
+		idleConnTimeout:       time.Duration(tc.IdleConnTimeout),
+		maxConnDuration:       time.Duration(tc.MaxConnDuration),
+		readBufferSize:        int(tc.ReadBufferSize),
+		writeBufferSize:       int(tc.WriteBufferSize),
+	}, nil
+}
+
+// apply configures the client of be.
+func (t *proxyTransport) apply(be *proxyBackend) {
+	c := be.client
+	c.MaxConns = t.maxConns
+	c.MaxConnWaitTimeout = t.maxConnWaitTimeout
+	c.MaxIdleConnDuration = t.idleConnTimeout
+	c.MaxConnDuration = t.maxConnDuration
+	c.ReadBufferSize = t.readBufferSize
+	c.WriteBufferSize = t.writeBufferSize
+	c.RetryIfErr = retryIfNotTimeout
+	be.timeout = t.timeout
+	if t.dialTimeout > 0 || t.tlsHandshakeTimeout > 0 || t.responseHeaderTimeout > 0 {
+		c.Dial = t.dialer(be)
+	}
+}
+
+// retryIfNotTimeout is the fasthttp.RetryIfErrFunc of the clients. The
+// client retries idempotent requests on a fresh connection as by default,
+// but not after a timeout, which would only take the timeout again.
+func retryIfNotTimeout(req *fasthttp.Request, _ int, err error) (bool, bool) {
+	if isTimeout(err) {
+		return false, false
+	}
+	h := &req.Header
+	return false, h.IsGet() || h.IsHead() || h.IsPut()
+}
+
+// dialer returns the fasthttp.DialFunc of be. The TLS handshake is done
+// here rather than by fasthttp, which bounds it by the write timeout only.
+func (t *proxyTransport) dialer(be *proxyBackend) fasthttp.DialFunc {
+	return func(addr string) (net.Conn, error) {
+		dialTimeout := t.dialTimeout
+		if dialTimeout <= 0 {
+			dialTimeout = fasthttp.DefaultDialTimeout
+		}
+		conn, err := fasthttp.DialTimeout(addr, dialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if be.client.IsTLS {
+			if conn, err = t.handshake(conn, be.tlsConfig()); err != nil {
+				return nil, err
+			}
+		}
+		if t.responseHeaderTimeout > 0 {
+			conn = &headerTimeoutConn{Conn: conn, timeout: t.responseHeaderTimeout}
+		}
+		return conn, nil
+	}
+}
+
+// handshake returns the TLS client connection over conn. The handshake is
+// left to the first request unless tlsHandshakeTimeout is set.
+func (t *proxyTransport) handshake(conn net.Conn, cfg *tls.Config) (net.Conn, error) {
+	tc := tls.Client(conn, cfg)
+	if t.tlsHandshakeTimeout <= 0 {
+		return tc, nil
+	}
+	if err := tc.SetDeadline(time.Now().Add(t.tlsHandshakeTimeout)); err != nil {
+		tc.Close()
+		return nil, err
+	}
+	if err := tc.Handshake(); err != nil {
+		tc.Close()
+		if isTimeout(err) {
+			return nil, fasthttp.ErrTLSHandshakeTimeout
+		}
+		return nil, err
+	}
+	if err := tc.SetDeadline(time.Time{}); err != nil {
+		tc.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// tlsConfig returns the TLS config of the connections to be, whose server
+// name defaults to the host of the URL.
+func (be *proxyBackend) tlsConfig() *tls.Config {
+	cfg := &tls.Config{}
+	if be.client.TLSConfig != nil {
+		cfg = be.client.TLSConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = be.url.Hostname()
+	}
+	return cfg
+}
+
+// headerTimeoutConn limits the time to wait for the first byte of each
+// response. The read deadline set by fasthttp applies after it.
+type headerTimeoutConn struct {
+	net.Conn
+	timeout  time.Duration
+	deadline time.Time
+	waiting  bool
+}
+
+// SetReadDeadline is called by fasthttp before reading a response.
+func (c *headerTimeoutConn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	c.waiting = true
+	d := time.Now().Add(c.timeout)
+	if !t.IsZero() && t.Before(d) {
+		d = t
+	}
+	return c.Conn.SetReadDeadline(d)
+}
+
+func (c *headerTimeoutConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if c.waiting && n > 0 {
+		c.waiting = false
+		if derr := c.Conn.SetReadDeadline(c.deadline); derr != nil && err == nil {
+			err = derr
+		}
+	}
+	return n, err
+}
+
+// Handshake lets fasthttp know that the underlying connection is already
+// a TLS one.
+func (c *headerTimeoutConn) Handshake() error {
+	if h, ok := c.Conn.(interface{ Handshake() error }); ok {
+		return h.Handshake()
+	}
+	return nil
+}
+
+// isTimeout reports whether err is a timeout of a backend request.
+func isTimeout(err error) bool {
+	if errors.Is(err, fasthttp.ErrDialTimeout) || errors.Is(err, fasthttp.ErrTLSHandshakeTimeout) {
+		return true
+	}
+	var te interface{ Timeout() bool }
+	return errors.As(err, &te) && te.Timeout()
+}
@@ -0,0 +1,170 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fasthttpd/fasthttpd/pkg/logger"
+	"github.com/mojatter/tree"
+	"github.com/valyala/fasthttp"
+)
+
+// silentURL returns the https URL of a listener that accepts connections
+// and never writes to them.
+func silentURL(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	return "https://" + ln.Addr().String()
+}
+
+func TestProxyHandler_Transport(t *testing.T) {
+	slowHeader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("ok")) //nolint:errcheck
+	}))
+	defer slowHeader.Close()
+	slowBody := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(150 * time.Millisecond)
+		w.Write([]byte("ok")) //nolint:errcheck
+	}))
+	defer slowBody.Close()
+
+	testCases := []struct {
+		caseName   string
+		url        string
+		transport  tree.Map
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			caseName:   "response header timeout",
+			url:        slowHeader.URL,
+			transport:  tree.Map{"responseHeaderTimeout": tree.V("50ms")},
+			wantStatus: http.StatusGatewayTimeout,
+		}, {
+			caseName:   "total timeout",
+			url:        slowHeader.URL,
+			transport:  tree.Map{"timeout": tree.V("50ms")},
+			wantStatus: http.StatusGatewayTimeout,
+		}, {
+			caseName:   "tls handshake timeout",
+			url:        silentURL(t),
+			transport:  tree.Map{"tlsHandshakeTimeout": tree.V("50ms")},
+			wantStatus: http.StatusGatewayTimeout,
+		}, {
+			caseName:   "slow body after the headers",
+			url:        slowBody.URL,
+			transport:  tree.Map{"responseHeaderTimeout": tree.V("50ms")},
+			wantStatus: http.StatusOK,
+			wantBody:   "ok",
+		}, {
+			caseName:   "within the timeouts",
+			url:        slowHeader.URL,
+			transport:  tree.Map{"responseHeaderTimeout": tree.V("1s"), "timeout": tree.V("2s")},
+			wantStatus: http.StatusOK,
+			wantBody:   "ok",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.caseName, func(t *testing.T) {
+			h, closer, err := NewProxyHandlerCloser(tree.Map{
+				"url":       tree.V(tc.url),
+				"transport": tc.transport,
+			}, logger.NilLogger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closer.Close()
+
+			start := time.Now()
+			ctx := newMirrorTestCtx(http.MethodGet, "/", "")
+			h(ctx)
+			if got := ctx.Response.StatusCode(); got != tc.wantStatus {
+				t.Fatalf("status = %d; want %d", got, tc.wantStatus)
+			}
+			if got := string(ctx.Response.Body()); got != tc.wantBody {
+				t.Errorf("body = %q; want %q", got, tc.wantBody)
+			}
+			if tc.wantStatus == http.StatusGatewayTimeout {
+				if d := time.Since(start); d > 250*time.Millisecond {
+					t.Errorf("took %s; want within the timeout", d)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyTransport_Apply(t *testing.T) {
+	tr, err := newProxyTransport(tree.Map{
+		"dialTimeout":        tree.V("1s"),
+		"timeout":            tree.V("30s"),
+		"maxConns":           tree.V(64),
+		"maxConnWaitTimeout": tree.V("100ms"),
+		"idleConnTimeout":    tree.V("90s"),
+		"maxConnDuration":    tree.V("10m"),
+		"readBufferSize":     tree.V("16KB"),
+		"writeBufferSize":    tree.V(8192),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	be, err := newProxyBackend("http://localhost:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.apply(be)
+
+	c := be.client
+	got := fmt.Sprint(c.MaxConns, c.MaxConnWaitTimeout, c.MaxIdleConnDuration, c.MaxConnDuration,
+		c.ReadBufferSize, c.WriteBufferSize, be.timeout, c.Dial != nil)
+	want := "64 100ms 1m30s 10m0s 16384 8192 30s true"
+	if got != want {
+		t.Errorf("client %s; want %s", got, want)
+	}
+}
+
+func TestIsTimeout(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: fasthttp.ErrTimeout, want: true},
+		{err: fasthttp.ErrDialTimeout, want: true},
+		{err: fmt.Errorf("dial: %w", fasthttp.ErrTLSHandshakeTimeout), want: true},
+		{err: &net.OpError{Op: "read", Err: timeoutErr{}}, want: true},
+		{err: fasthttp.ErrConnectionClosed, want: false},
+		{err: io.ErrUnexpectedEOF, want: false},
+		{err: errors.New("timeout"), want: false},
+	}
+	for i, test := range tests {
+		if got := isTimeout(test.err); got != test.want {
+			t.Errorf("tests[%d] got %v; want %v", i, got, test.want)
+		}
+	}
+}
+
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string   { return "i/o timeout" }
+func (timeoutErr) Timeout() bool   { return true }
+func (timeoutErr) Temporary() bool { return true }
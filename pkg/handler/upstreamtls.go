@@ -0,0 +1,242 @@
+package handler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/fasthttpd/fasthttpd/pkg/logger"
+	"github.com/mojatter/tree"
+	"github.com/valyala/fasthttp"
+)
+
+// defaultUpstreamTLSReloadInterval is the default interval to check whether
+// the certificate files have changed.
+const defaultUpstreamTLSReloadInterval = 5 * time.Second
+
+var upstreamTLSVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// upstreamTLSConfig is the 'tls' entry of the proxy handler config.
+type upstreamTLSConfig struct {
+	// CAFile is a PEM bundle of the CAs that verify the backends in place
+	// of the system roots.
+	CAFile string `yaml:"caFile"`
+	// CertFile and KeyFile are the client certificate for mutual TLS.
+	CertFile   string `yaml:"certFile"`
+	KeyFile    string `yaml:"keyFile"`
+	ServerName string `yaml:"serverName"`
+	MinVersion string `yaml:"minVersion"`
+	// InsecureSkipVerify disables the verification of the backends. It is
+	// meant for development only.
+	InsecureSkipVerify bool            `yaml:"insecureSkipVerify"`
+	ReloadInterval     config.Duration `yaml:"reloadInterval"`
+}
+
+// upstreamCerts are the certificates loaded from the files.
+type upstreamCerts struct {
+	roots *x509.CertPool
+	cert  *tls.Certificate
+}
+
+// fileStamp identifies a version of a file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// upstreamTLS is the TLS client config of the connections to the backends.
+// The certificates are reloaded when their files change, and the callbacks
+// of the configs pick up the current ones, so that the configs are never
+// replaced.
+type upstreamTLS struct {
+	caFile   string
+	certFile string
+	keyFile  string
+	// config is the base of the configs returned by clientConfig.
+	config *tls.Config
+	// verify is set when the backends are verified against the roots of
+	// caFile.
+	verify   bool
+	interval time.Duration
+	certs    atomic.Pointer[upstreamCerts]
+	// stamps are only accessed by the loading goroutine.
+	stamps map[string]fileStamp
+	l      logger.Logger
+}
+
+func newUpstreamTLS(cfg tree.Node, l logger.Logger) (*upstreamTLS, error) {
+	tc := &upstreamTLSConfig{}
+	if err := tree.UnmarshalViaYAML(cfg, tc); err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	if (tc.CertFile == "") != (tc.KeyFile == "") {
+		return nil, errors.New("tls: require both 'certFile' and 'keyFile' entries")
+	}
+	t := &upstreamTLS{
+		caFile:   tc.CAFile,
+		certFile: tc.CertFile,
+		keyFile:  tc.KeyFile,
+		interval: time.Duration(tc.ReloadInterval),
+		stamps:   map[string]fileStamp{},
+		l:        l,
+	}
+	if t.interval <= 0 {
+		t.interval = defaultUpstreamTLSReloadInterval
+	}
+	t.config = &tls.Config{
+		ServerName:           tc.ServerName,
+		InsecureSkipVerify:   tc.InsecureSkipVerify, // #nosec G402
+		GetClientCertificate: t.getClientCertificate,
+	}
+	if tc.MinVersion != "" {
+		v, ok := upstreamTLSVersions[tc.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("tls: unknown minVersion: %s", tc.MinVersion)
+		}
+		t.config.MinVersion = v
+	}
+	if t.caFile != "" && !tc.InsecureSkipVerify {
+		// The roots are reloadable, so the backends are verified by
+		// verifyConnection instead of by crypto/tls with config.RootCAs.
+		t.config.InsecureSkipVerify = true // #nosec G402
+		t.verify = true
+	}
+	if _, err := t.reload(); err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	return t, nil
+}
+
+// watch reloads the certificates every interval until done is closed.
+func (t *upstreamTLS) watch(done <-chan struct{}) {
+	if t.caFile == "" && t.certFile == "" {
+		return
+	}
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if ok, err := t.reload(); err != nil {
+				t.l.Printf("tls: keep the current certificates: %v", err)
+			} else if ok {
+				t.l.Printf("tls: reloaded the upstream certificates")
+			}
+		}
+	}
+}
+
+// reload loads the certificate files if any of them has changed since the
+// last load and reports whether the certificates were replaced.
+func (t *upstreamTLS) reload() (bool, error) {
+	changed := false
+	for _, name := range []string{t.caFile, t.certFile, t.keyFile} {
+		if name == "" {
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			return false, err
+		}
+		stamp := fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+		if t.stamps[name] != stamp {
+			// Remember the file even if it is invalid so that the error is
+			// reported once rather than on every check.
+			t.stamps[name] = stamp
+			changed = true
+		}
+	}
+	if !changed && t.certs.Load() != nil {
+		return false, nil
+	}
+	certs := &upstreamCerts{}
+	if t.caFile != "" {
+		pem, err := os.ReadFile(t.caFile)
+		if err != nil {
+			return false, err
+		}
+		certs.roots = x509.NewCertPool()
+		if !certs.roots.AppendCertsFromPEM(pem) {
+			return false, fmt.Errorf("no certificates in %s", t.caFile)
+		}
+	}
+	if t.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+		if err != nil {
+			return false, err
+		}
+		certs.cert = &cert
+	}
+	t.certs.Store(certs)
+	return changed, nil
+}
+
+// clientConfig returns the TLS config of the connections to host, which
+// verifies the backend for serverName if configured, or for host.
+func (t *upstreamTLS) clientConfig(host string) *tls.Config {
+	cfg := t.config.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	if t.verify {
+		// ConnectionState.ServerName is empty for an IP address, so the
+		// name is bound here.
+		name := cfg.ServerName
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return t.verifyConnection(cs, name)
+		}
+	}
+	return cfg
+}
+
+// configureClient is the fasthttp.Client.ConfigureClient of the health
+// checker, which sets the TLS config of the host of hc.
+func (t *upstreamTLS) configureClient(hc *fasthttp.HostClient) error {
+	host, _, err := net.SplitHostPort(hc.Addr)
+	if err != nil {
+		return err
+	}
+	hc.TLSConfig = t.clientConfig(host)
+	return nil
+}
+
+// getClientCertificate implements tls.Config.GetClientCertificate. No
+// certificate is sent if certFile is not configured.
+func (t *upstreamTLS) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if cert := t.certs.Load().cert; cert != nil {
+		return cert, nil
+	}
+	return &tls.Certificate{}, nil
+}
+
+// verifyConnection verifies the certificate chain of the backend for
+// serverName against the current roots as crypto/tls does with
+// tls.Config.RootCAs.
+func (t *upstreamTLS) verifyConnection(cs tls.ConnectionState, serverName string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("tls: backend sent no certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         t.certs.Load().roots,
+		DNSName:       serverName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
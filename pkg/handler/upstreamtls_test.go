@@ -0,0 +1,352 @@
+package handler
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasthttpd/fasthttpd/pkg/logger"
+	"github.com/mojatter/tree"
+)
+
+// testCA issues the certificates of the upstream TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the PEM certificate and key of a server certificate for
+// dnsName, or of a client certificate if dnsName is empty.
+func (ca *testCA) issue(t *testing.T, cn, dnsName string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if dnsName != "" {
+		tmpl.DNSNames = []string{dnsName}
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeFile writes data to name in dir and returns the path. The mtime is
+// moved forward on every write so that a rewrite is always noticed.
+func writeFile(t *testing.T, dir, name string, data []byte) string {
+	path := filepath.Join(dir, name)
+	mtime := time.Now()
+	if fi, err := os.Stat(path); err == nil {
+		mtime = fi.ModTime().Add(time.Second)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newMTLSServer starts a backend for backend.internal that requires a
+// client certificate issued by ca and responds with its common name.
+func newMTLSServer(t *testing.T, ca *testCA) *httptest.Server {
+	certPEM, keyPEM := ca.issue(t, "backend", "backend.internal")
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName)) //nolint:errcheck
+	}))
+	s.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	s.StartTLS()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestProxyHandler_UpstreamTLS(t *testing.T) {
+	ca, otherCA := newTestCA(t), newTestCA(t)
+	backend := newMTLSServer(t, ca)
+
+	dir := t.TempDir()
+	caFile := writeFile(t, dir, "ca.pem", ca.pem)
+	otherCAFile := writeFile(t, dir, "other-ca.pem", otherCA.pem)
+	certPEM, keyPEM := ca.issue(t, "client", "")
+	certFile := writeFile(t, dir, "client.pem", certPEM)
+	keyFile := writeFile(t, dir, "client-key.pem", keyPEM)
+
+	testCases := []struct {
+		caseName   string
+		tls        tree.Map
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			caseName: "mutual TLS",
+			tls: tree.Map{
+				"caFile":     tree.V(caFile),
+				"certFile":   tree.V(certFile),
+				"keyFile":    tree.V(keyFile),
+				"serverName": tree.V("backend.internal"),
+				"minVersion": tree.V("1.2"),
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   "client",
+		}, {
+			caseName: "without client certificate",
+			tls: tree.Map{
+				"caFile":     tree.V(caFile),
+				"serverName": tree.V("backend.internal"),
+			},
+			wantStatus: http.StatusBadGateway,
+		}, {
+			caseName: "unknown authority",
+			tls: tree.Map{
+				"caFile":     tree.V(otherCAFile),
+				"certFile":   tree.V(certFile),
+				"keyFile":    tree.V(keyFile),
+				"serverName": tree.V("backend.internal"),
+			},
+			wantStatus: http.StatusBadGateway,
+		}, {
+			caseName: "server name of the url",
+			tls: tree.Map{
+				"caFile":   tree.V(caFile),
+				"certFile": tree.V(certFile),
+				"keyFile":  tree.V(keyFile),
+			},
+			wantStatus: http.StatusBadGateway,
+		}, {
+			caseName: "insecure skip verify",
+			tls: tree.Map{
+				"certFile":           tree.V(certFile),
+				"keyFile":            tree.V(keyFile),
+				"insecureSkipVerify": tree.V(true),
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   "client",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.caseName, func(t *testing.T) {
+			h, closer, err := NewProxyHandlerCloser(tree.Map{
+				"url": tree.V(backend.URL),
+				"tls": tc.tls,
+			}, logger.NilLogger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closer.Close()
+
+			ctx := newMirrorTestCtx(http.MethodGet, "/", "")
+			h(ctx)
+			if got := ctx.Response.StatusCode(); got != tc.wantStatus {
+				t.Fatalf("status = %d; want %d", got, tc.wantStatus)
+			}
+			if got := string(ctx.Response.Body()); got != tc.wantBody {
+				t.Errorf("body = %q; want %q", got, tc.wantBody)
+			}
+		})
+	}
+}
+
+func TestProxyHandler_UpstreamTLSReload(t *testing.T) {
+	ca := newTestCA(t)
+	backend := newMTLSServer(t, ca)
+
+	dir := t.TempDir()
+	caFile := writeFile(t, dir, "ca.pem", ca.pem)
+	certPEM, keyPEM := ca.issue(t, "client-1", "")
+	certFile := writeFile(t, dir, "client.pem", certPEM)
+	keyFile := writeFile(t, dir, "client-key.pem", keyPEM)
+
+	h, closer, err := NewProxyHandlerCloser(tree.Map{
+		"url": tree.V(backend.URL),
+		"tls": tree.Map{
+			"caFile":         tree.V(caFile),
+			"certFile":       tree.V(certFile),
+			"keyFile":        tree.V(keyFile),
+			"serverName":     tree.V("backend.internal"),
+			"reloadInterval": tree.V("10ms"),
+		},
+		"healthCheck": tree.Map{"interval": tree.V("10ms"), "timeout": tree.V("1s")},
+	}, logger.NilLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+	be := closer.(*proxyBalancer).backends[0]
+
+	// do sends a request on a new connection and returns the response body.
+	do := func() string {
+		be.client.CloseIdleConnections()
+		ctx := newMirrorTestCtx(http.MethodGet, "/", "")
+		h(ctx)
+		if code := ctx.Response.StatusCode(); code != http.StatusOK {
+			t.Fatalf("status = %d; want %d", code, http.StatusOK)
+		}
+		return string(ctx.Response.Body())
+	}
+	if got := do(); got != "client-1" {
+		t.Fatalf("body = %q; want %q", got, "client-1")
+	}
+
+	// A broken pair keeps the current certificate.
+	writeFile(t, dir, "client.pem", []byte("broken"))
+	time.Sleep(50 * time.Millisecond)
+	if got := do(); got != "client-1" {
+		t.Errorf("body = %q; want %q", got, "client-1")
+	}
+
+	certPEM, keyPEM = ca.issue(t, "client-2", "")
+	writeFile(t, dir, "client.pem", certPEM)
+	writeFile(t, dir, "client-key.pem", keyPEM)
+	for deadline := time.Now().Add(2 * time.Second); do() != "client-2"; {
+		if time.Now().After(deadline) {
+			t.Fatal("certificate is not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The health checker connects with the same certificates.
+	if !be.alive.Load() {
+		t.Errorf("backend should be alive")
+	}
+}
+
+func TestNewUpstreamTLS_Errors(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := writeFile(t, dir, "not.pem", []byte("not a certificate"))
+	testCases := []struct {
+		caseName string
+		tls      tree.Map
+		errstr   string
+	}{
+		{
+			caseName: "certFile without keyFile",
+			tls:      tree.Map{"certFile": tree.V(notPEM)},
+			errstr:   "failed to create proxy: tls: require both 'certFile' and 'keyFile' entries",
+		}, {
+			caseName: "unknown minVersion",
+			tls:      tree.Map{"minVersion": tree.V("1.4")},
+			errstr:   "failed to create proxy: tls: unknown minVersion: 1.4",
+		}, {
+			caseName: "caFile without certificates",
+			tls:      tree.Map{"caFile": tree.V(notPEM)},
+			errstr:   "failed to create proxy: tls: no certificates in " + notPEM,
+		}, {
+			caseName: "missing caFile",
+			tls:      tree.Map{"caFile": tree.V(filepath.Join(dir, "missing.pem"))},
+			errstr:   "failed to create proxy: tls: stat " + filepath.Join(dir, "missing.pem") + ": no such file or directory",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.caseName, func(t *testing.T) {
+			_, err := NewProxyHandler(tree.Map{
+				"url": tree.V("https://localhost:8443"),
+				"tls": tc.tls,
+			}, logger.NilLogger)
+			if err == nil {
+				t.Fatalf("unexpected no error")
+			}
+			if err.Error() != tc.errstr {
+				t.Errorf("unexpected error: %q; want %q", err.Error(), tc.errstr)
+			}
+		})
+	}
+}
+
+func TestUpstreamTLS_VerifyConnection(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	u, err := newUpstreamTLS(tree.Map{"caFile": tree.V(writeFile(t, dir, "ca.pem", ca.pem))}, logger.NilLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, _ := ca.issue(t, "backend", "backend.internal")
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		serverName string
+		certs      []*x509.Certificate
+		errstr     string
+	}{
+		{serverName: "backend.internal", certs: []*x509.Certificate{cert}},
+		{serverName: "other.internal", certs: []*x509.Certificate{cert}, errstr: "not other.internal"},
+		{serverName: net.IPv4(127, 0, 0, 1).String(), certs: []*x509.Certificate{cert}, errstr: "doesn't contain any IP SANs"},
+		{serverName: "backend.internal", errstr: "no certificate"},
+	}
+	for i, test := range tests {
+		err := u.verifyConnection(tls.ConnectionState{PeerCertificates: test.certs}, test.serverName)
+		switch {
+		case test.errstr == "" && err != nil:
+			t.Errorf("tests[%d] unexpected error: %v", i, err)
+		case test.errstr != "" && (err == nil || !strings.Contains(err.Error(), test.errstr)):
+			t.Errorf("tests[%d] error %v; want %q", i, err, test.errstr)
+		}
+	}
+}
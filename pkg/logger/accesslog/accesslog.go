@@ -8,6 +8,7 @@ import (
 
 	"github.com/fasthttpd/fasthttpd/pkg/config"
 	"github.com/fasthttpd/fasthttpd/pkg/logger"
+	"github.com/fasthttpd/fasthttpd/pkg/metrics"
 	"github.com/valyala/fasthttp"
 )
 
@@ -63,6 +64,9 @@ type accessLog struct {
 	bw                *bufio.Writer
 	done              chan struct{}
 	closed            bool
+	flushes           *metrics.Counter
+	flushedBytes      *metrics.Counter
+	flushErrors       *metrics.Counter
 }
 
 // newSkeleton allocates an *accessLog with the shared pipeline state
@@ -73,10 +77,17 @@ func newSkeleton(out logger.Rotator, cfg config.Config) *accessLog {
 	if bufSize <= 0 {
 		bufSize = 4096
 	}
+	output := metrics.L("output", cfg.AccessLog.Output)
 	return &accessLog{
 		out:  out,
 		bw:   bufio.NewWriterSize(out, bufSize),
 		done: make(chan struct{}),
+		flushes: metrics.Default.Counter("fasthttpd_accesslog_flushes_total",
+			"Total number of access log buffer flushes.", output),
+		flushedBytes: metrics.Default.Counter("fasthttpd_accesslog_flushed_bytes_total",
+			"Total number of access log bytes flushed.", output),
+		flushErrors: metrics.Default.Counter("fasthttpd_accesslog_flush_errors_total",
+			"Total number of failed access log buffer flushes.", output),
 		bufPool: sync.Pool{
 			New: func() any {
 				b := make([]byte, 0, 256)
@@ -103,7 +114,7 @@ func (l *accessLog) Rotate() error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	if err := l.bw.Flush(); err != nil {
+	if err := l.flush(); err != nil {
 		return err
 	}
 
@@ -125,7 +136,7 @@ func (l *accessLog) Close() error {
 	close(l.done)
 
 	l.mu.Lock()
-	_ = l.bw.Flush() // best-effort flush on close
+	_ = l.flush() // best-effort flush on close
 	l.mu.Unlock()
 
 	l.appendLine = nil
@@ -156,12 +167,28 @@ func (l *accessLog) flushLoop(interval time.Duration) {
 			return
 		case <-ticker.C:
 			l.mu.Lock()
-			_ = l.bw.Flush() // periodic best-effort flush
+			_ = l.flush() // periodic best-effort flush
 			l.mu.Unlock()
 		}
 	}
 }
 
+// flush writes the buffered lines to out and updates the flush metrics. The
+// caller must hold l.mu.
+func (l *accessLog) flush() error {
+	n := l.bw.Buffered()
+	if n == 0 {
+		return nil
+	}
+	if err := l.bw.Flush(); err != nil {
+		l.flushErrors.Inc()
+		return err
+	}
+	l.flushes.Inc()
+	l.flushedBytes.Add(uint64(n))
+	return nil
+}
+
 func (l *accessLog) Log(ctx *fasthttp.RequestCtx) {
 	if l.closed {
 		return
@@ -2,9 +2,12 @@ package accesslog
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/fasthttpd/fasthttpd/pkg/metrics"
+	"github.com/valyala/fasthttp"
 )
 
 func TestNewAccessLog(t *testing.T) {
@@ -47,3 +50,35 @@ func TestNewAccessLog(t *testing.T) {
 		l.Close()
 	}
 }
+
+func TestAccessLog_FlushMetrics(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "access.log")
+	l, err := NewAccessLog(config.Config{
+		AccessLog: config.AccessLog{
+			Output:        output,
+			Format:        "%s",
+			FlushInterval: 60000,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Response.SetStatusCode(fasthttp.StatusOK)
+	l.Log(ctx)
+	if err := l.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	label := metrics.L("output", output)
+	if got := metrics.Default.Counter("fasthttpd_accesslog_flushes_total", "", label).Value(); got != 1 {
+		t.Errorf("flushes = %d; want 1", got)
+	}
+	if got := metrics.Default.Counter("fasthttpd_accesslog_flushed_bytes_total", "", label).Value(); got != uint64(len("200\n")) {
+		t.Errorf("flushed bytes = %d; want %d", got, len("200\n"))
+	}
+}
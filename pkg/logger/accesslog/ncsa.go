@@ -57,6 +57,8 @@ func (l *accessLog) parseNCSAFormat(format string, cfg config.Config) ([]appendF
 			fns = append(fns, newAppendEnv(ms[3]))
 		case "i":
 			fns = append(fns, newAppendRequestHeader(ms[3]))
+		case "n":
+			fns = append(fns, newAppendUserValue(ms[3]))
 		case "o":
 			fns = append(fns, newAppendResponseHeader(ms[3]))
 		case "p":
@@ -241,6 +243,25 @@ func newAppendResponseHeader(key string) appendFunc {
 	}
 }
 
+// newAppendUserValue returns the appendFunc of %{key}n, which logs the user
+// value key such as a named capture of the matched route, as Apache logs
+// notes.
+func newAppendUserValue(key string) appendFunc {
+	return func(dst []byte, ctx *fasthttp.RequestCtx) []byte {
+		switch v := ctx.UserValue(key).(type) {
+		case string:
+			if len(v) > 0 {
+				return append(dst, v...)
+			}
+		case []byte:
+			if len(v) > 0 {
+				return append(dst, v...)
+			}
+		}
+		return appendNil(dst, nil)
+	}
+}
+
 func newAppendStrftime(format string) appendFunc {
 	s := util.NewStrftime(format)
 	return func(dst []byte, ctx *fasthttp.RequestCtx) []byte {
@@ -140,11 +140,12 @@ func TestAccessLog_NCSA(t *testing.T) {
 		}, {
 			cfg: config.Config{
 				AccessLog: config.AccessLog{
-					Format: "%% %Y %{cookie}C %{ACCESSLOG_TEST}e %{Request-Header}i %{Response-Header}o",
+					Format: "%% %Y %{cookie}C %{ACCESSLOG_TEST}e %{Request-Header}i %{Response-Header}o %{id}n %{none}n",
 				},
 			},
 			ctx: func() *fasthttp.RequestCtx {
 				ctx := &fasthttp.RequestCtx{}
+				ctx.SetUserValue("id", "42")
 				ctx.SetRemoteAddr(remoteAddr)
 				ctx.Request.SetRequestURI("/path")
 				ctx.URI().SetUsername("foo")
@@ -155,7 +156,7 @@ func TestAccessLog_NCSA(t *testing.T) {
 				ctx.Response.Header.Set("Response-Header", "response-header-value")
 				return ctx
 			},
-			want: "% %Y cookie-value " + envValue + " request-header-value response-header-value",
+			want: "% %Y cookie-value " + envValue + " request-header-value response-header-value 42 -",
 		}, {
 			cfg: config.Config{
 				Host: "example.com",
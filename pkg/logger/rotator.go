@@ -56,11 +56,14 @@ func (r *sharedRotator) share() *sharedRotator {
 }
 
 func (r *sharedRotator) Close() error {
+	sharedMutex.Lock()
 	r.shared--
 	if r.shared > 0 {
+		sharedMutex.Unlock()
 		return nil
 	}
-	removeSharedRotator(r)
+	removeSharedRotatorLocked(r)
+	sharedMutex.Unlock()
 	return r.Rotator.Close()
 }
 
@@ -85,11 +88,9 @@ func SharedRotator(output string, cfg config.Rotation) (Rotator, error) {
 	return shared.share(), nil
 }
 
-// removeSharedRotator removes a shared rotator.
-func removeSharedRotator(o Rotator) {
-	sharedMutex.Lock()
-	defer sharedMutex.Unlock()
-
+// removeSharedRotatorLocked removes a shared rotator. The caller must hold
+// sharedMutex.
+func removeSharedRotatorLocked(o Rotator) {
 	for k, v := range sharedRotators {
 		if o == v {
 			delete(sharedRotators, k)
@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/fasthttpd/fasthttpd/pkg/config"
@@ -44,6 +45,28 @@ func TestSharedRotator(t *testing.T) {
 	}
 }
 
+func TestSharedRotator_Concurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				r, err := SharedRotator("stdout", config.Rotation{})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				r.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(sharedRotators) != 0 {
+		t.Errorf("unexpected sharedRotators length: %d; want 0", len(sharedRotators))
+	}
+}
+
 func TestRotateShared(t *testing.T) {
 	tmpDir, err := os.MkdirTemp("", "*.logger_test")
 	if err != nil {
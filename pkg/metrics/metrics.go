@@ -0,0 +1,302 @@
+package metrics
+
+import (
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metric types.
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// DefBuckets are the default histogram buckets in seconds, the same as the
+// Prometheus client libraries.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the registry exposed by the metrics handler.
+var Default = NewRegistry()
+
+// Label is a metric label.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// L is shorthand for Label{Name: name, Value: value}.
+func L(name, value string) Label {
+	return Label{Name: name, Value: value}
+}
+
+// Registry holds metric families and renders them in the Prometheus text
+// format. Series are created once, typically when a handler is constructed,
+// and updated on the hot path with atomic operations only. Series are keyed
+// by name and labels, so a handler rebuilt by a configuration reload keeps
+// counting into the same series.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+type family struct {
+	name   string
+	help   string
+	typ    string
+	series map[string]*series
+}
+
+type series struct {
+	labels    string // formatted as `a="b",c="d"`
+	counter   *Counter
+	histogram *Histogram
+	// gauges is a stack of gauge functions; the most recently registered
+	// one is exposed. See GaugeFunc.
+	gauges []*gaugeFunc
+}
+
+type gaugeFunc struct {
+	fn func() float64
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]*family{}}
+}
+
+func (r *Registry) series(name, help, typ string, labels []Label) *series {
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{name: name, help: help, typ: typ, series: map[string]*series{}}
+		r.families[name] = f
+	} else if f.typ != typ {
+		panic("metrics: " + name + " registered as " + f.typ + " and " + typ)
+	}
+	key := formatLabels(labels)
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: key}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Counter returns the counter identified by name and labels, creating it if
+// necessary.
+func (r *Registry) Counter(name, help string, labels ...Label) *Counter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.series(name, help, typeCounter, labels)
+	if s.counter == nil {
+		s.counter = &Counter{}
+	}
+	return s.counter
+}
+
+// Histogram returns the histogram identified by name and labels, creating it
+// with buckets (in seconds) if necessary.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...Label) *Histogram {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.series(name, help, typeHistogram, labels)
+	if s.histogram == nil {
+		s.histogram = newHistogram(buckets)
+	}
+	return s.histogram
+}
+
+// GaugeFunc registers fn as the gauge identified by name and labels and
+// returns a function that unregisters it. When several functions are
+// registered for the same series, e.g. while an old and a new handler
+// overlap during a reload, the most recent one is exposed.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64, labels ...Label) (unregister func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.series(name, help, typeGauge, labels)
+	g := &gaugeFunc{fn: fn}
+	s.gauges = append(s.gauges, g)
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		if i := slices.Index(s.gauges, g); i != -1 {
+			s.gauges = slices.Delete(s.gauges, i, i+1)
+		}
+	}
+}
+
+// ContentType is the content type of AppendText output.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// AppendText appends every metric in the Prometheus text exposition format
+// to dst, sorted by name and labels.
+func (r *Registry) AppendText(dst []byte) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		f := r.families[name]
+		keys := make([]string, 0, len(f.series))
+		for k, s := range f.series {
+			if f.typ == typeGauge && len(s.gauges) == 0 {
+				continue
+			}
+			keys = append(keys, k)
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		slices.Sort(keys)
+
+		dst = append(dst, "# HELP "...)
+		dst = append(dst, f.name...)
+		dst = append(dst, ' ')
+		dst = append(dst, escapeHelp(f.help)...)
+		dst = append(dst, "\n# TYPE "...)
+		dst = append(dst, f.name...)
+		dst = append(dst, ' ')
+		dst = append(dst, f.typ...)
+		dst = append(dst, '\n')
+		for _, k := range keys {
+			s := f.series[k]
+			switch f.typ {
+			case typeCounter:
+				dst = appendSample(dst, f.name, s.labels, "", float64(s.counter.Value()))
+			case typeGauge:
+				dst = appendSample(dst, f.name, s.labels, "", s.gauges[len(s.gauges)-1].fn())
+			case typeHistogram:
+				dst = s.histogram.appendText(dst, f.name, s.labels)
+			}
+		}
+	}
+	return dst
+}
+
+func appendSample(dst []byte, name, labels, extra string, v float64) []byte {
+	dst = append(dst, name...)
+	if labels != "" || extra != "" {
+		dst = append(dst, '{')
+		dst = append(dst, labels...)
+		if labels != "" && extra != "" {
+			dst = append(dst, ',')
+		}
+		dst = append(dst, extra...)
+		dst = append(dst, '}')
+	}
+	dst = append(dst, ' ')
+	dst = appendFloat(dst, v)
+	return append(dst, '\n')
+}
+
+func appendFloat(dst []byte, v float64) []byte {
+	switch {
+	case math.IsInf(v, 1):
+		return append(dst, "+Inf"...)
+	case math.IsInf(v, -1):
+		return append(dst, "-Inf"...)
+	case math.IsNaN(v):
+		return append(dst, "NaN"...)
+	}
+	return strconv.AppendFloat(dst, v, 'g', -1, 64)
+}
+
+func formatLabels(labels []Label) string {
+	var b strings.Builder
+	for i, l := range labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l.Name)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(l.Value))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+var (
+	labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpReplacer       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabelValue(s string) string { return labelValueReplacer.Replace(s) }
+func escapeHelp(s string) string       { return helpReplacer.Replace(s) }
+
+// Counter is a monotonically increasing counter.
+type Counter struct {
+	v atomic.Uint64
+}
+
+// Inc increments the counter by 1.
+func (c *Counter) Inc() { c.v.Add(1) }
+
+// Add increments the counter by n.
+func (c *Counter) Add(n uint64) { c.v.Add(n) }
+
+// Value returns the current value.
+func (c *Counter) Value() uint64 { return c.v.Load() }
+
+// Histogram counts observed durations in buckets.
+type Histogram struct {
+	upperBounds []time.Duration
+	les         []string
+	counts      []atomic.Uint64 // non-cumulative; the last one is +Inf
+	count       atomic.Uint64
+	sumNanos    atomic.Int64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	h := &Histogram{
+		upperBounds: make([]time.Duration, len(buckets)),
+		les:         make([]string, len(buckets)),
+		counts:      make([]atomic.Uint64, len(buckets)+1),
+	}
+	for i, b := range buckets {
+		h.upperBounds[i] = time.Duration(b * float64(time.Second))
+		h.les[i] = string(appendFloat(nil, b))
+	}
+	return h
+}
+
+// Observe records d.
+func (h *Histogram) Observe(d time.Duration) {
+	i := 0
+	for ; i < len(h.upperBounds); i++ {
+		if d <= h.upperBounds[i] {
+			break
+		}
+	}
+	h.counts[i].Add(1)
+	h.sumNanos.Add(int64(d))
+	h.count.Add(1)
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 { return h.count.Load() }
+
+func (h *Histogram) appendText(dst []byte, name, labels string) []byte {
+	bucketName := name + "_bucket"
+	var cumulative uint64
+	for i, le := range h.les {
+		cumulative += h.counts[i].Load()
+		dst = appendSample(dst, bucketName, labels, `le="`+le+`"`, float64(cumulative))
+	}
+	cumulative += h.counts[len(h.les)].Load()
+	dst = appendSample(dst, bucketName, labels, `le="+Inf"`, float64(cumulative))
+	dst = appendSample(dst, name+"_sum", labels, "", time.Duration(h.sumNanos.Load()).Seconds())
+	return appendSample(dst, name+"_count", labels, "", float64(cumulative))
+}
@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistry_AppendText(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("test_requests_total", "Requests.", L("code", "2xx"), L("path", `a"b\`)).Add(3)
+	r.Counter("test_requests_total", "Requests.", L("code", "2xx"), L("path", `a"b\`)).Inc()
+	r.Counter("test_requests_total", "Requests.", L("code", "5xx"), L("path", "/")).Inc()
+
+	h := r.Histogram("test_duration_seconds", "Duration.", []float64{0.1, 1})
+	h.Observe(50 * time.Millisecond)
+	h.Observe(500 * time.Millisecond)
+	h.Observe(2 * time.Second)
+
+	unregister := r.GaugeFunc("test_up", "Up.", func() float64 { return 0 }, L("backend", "a"))
+	r.GaugeFunc("test_up", "Up.", func() float64 { return 1 }, L("backend", "a"))
+	unregisterGone := r.GaugeFunc("test_gone", "Gone.", func() float64 { return 1 })
+	unregisterGone()
+
+	got := string(r.AppendText(nil))
+	want := `# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.1"} 1
+test_duration_seconds_bucket{le="1"} 2
+test_duration_seconds_bucket{le="+Inf"} 3
+test_duration_seconds_sum 2.55
+test_duration_seconds_count 3
+# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{code="2xx",path="a\"b\\"} 4
+test_requests_total{code="5xx",path="/"} 1
+# HELP test_up Up.
+# TYPE test_up gauge
+test_up{backend="a"} 1
+`
+	if got != want {
+		t.Errorf("AppendText() =\n%s\nwant\n%s", got, want)
+	}
+
+	// Unregistering the older function keeps the newer one exposed.
+	unregister()
+	if got := string(r.AppendText(nil)); !strings.HasSuffix(got, "test_up{backend=\"a\"} 1\n") {
+		t.Errorf("unexpected gauge after unregister:\n%s", got)
+	}
+}
+
+func TestRegistry_TypeConflict(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("test_metric", "")
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a counter name as histogram did not panic")
+		}
+	}()
+	r.Histogram("test_metric", "", DefBuckets)
+}
+
+func TestHotPathAllocs(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("test_total", "")
+	h := r.Histogram("test_seconds", "", DefBuckets)
+	allocs := testing.AllocsPerRun(100, func() {
+		c.Inc()
+		h.Observe(30 * time.Millisecond)
+	})
+	if allocs != 0 {
+		t.Errorf("allocs = %v; want 0", allocs)
+	}
+}
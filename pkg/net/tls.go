@@ -19,20 +19,29 @@ var (
 )
 
 // MultiTLSConfig generates multiple TLS config from fasthttpd configrations.
+// Certificates are selected by matching the SNI server name against each
+// config's host and aliases with the same rules as virtual hosts (see
+// util.HostMatcher); the default server's certificate is the fallback.
 func MultiTLSConfig(cfgs []config.Config) (*tls.Config, error) {
 	var certs []tls.Certificate
 	var nextProtos util.StringSet
 	var fns []func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	certHosts := util.NewHostMatcher()
+	defaultCert := -1
 
 	autoCertCacheDirToHosts := map[string][]string{}
 	for _, cfg := range cfgs {
+		names := append([]string{cfg.Host}, cfg.Aliases...)
 		if cfg.SSL.AutoCert {
-			if strings.Contains(cfg.Host, "*") {
-				return nil, errNotSupportedWildcard
+			dir := cfg.SSL.AutoCertCacheDir
+			for _, name := range names {
+				if util.IsHostPattern(name) || strings.Contains(name, "*") {
+					return nil, errNotSupportedWildcard
+				}
+				if name != "" {
+					autoCertCacheDirToHosts[dir] = append(autoCertCacheDirToHosts[dir], name)
+				}
 			}
-			hosts := autoCertCacheDirToHosts[cfg.SSL.AutoCertCacheDir]
-			hosts = append(hosts, cfg.Host)
-			autoCertCacheDirToHosts[cfg.SSL.AutoCertCacheDir] = hosts
 			continue
 		}
 		if cfg.SSL.CertFile != "" && cfg.SSL.KeyFile != "" {
@@ -40,6 +49,14 @@ func MultiTLSConfig(cfgs []config.Config) (*tls.Config, error) {
 			if err != nil {
 				return nil, err
 			}
+			for _, name := range names {
+				if err := certHosts.Add(name, len(certs)); err != nil {
+					return nil, err
+				}
+			}
+			if cfg.DefaultServer {
+				defaultCert = len(certs)
+			}
 			certs = append(certs, cert)
 			nextProtos = nextProtos.Append("http/1.1")
 			continue
@@ -66,23 +83,30 @@ func MultiTLSConfig(cfgs []config.Config) (*tls.Config, error) {
 	if len(certs) > 0 {
 		cfg.Certificates = certs
 	}
-	if len(fns) == 0 {
-		return cfg, nil
-	}
-
+	m := &multiTlsCert{cfg: cfg, fns: fns, hosts: certHosts, defaultCert: defaultCert}
 	return &tls.Config{
 		NextProtos:     nextProtos,
-		GetCertificate: (&multiTlsCert{cfg: cfg, fns: fns}).GetCertificate,
+		Certificates:   cfg.Certificates,
+		GetCertificate: m.GetCertificate,
 	}, nil
 }
 
 type multiTlsCert struct {
 	cfg *tls.Config
 	fns []func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	// hosts maps host patterns to indexes of cfg.Certificates. It may be nil.
+	hosts *util.HostMatcher
+	// defaultCert is the index of the default server's certificate, or -1.
+	defaultCert int
 }
 
 // GetCertificate implements tls.Config.GetCertificate.
 func (m *multiTlsCert) GetCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if m.hosts != nil && clientHello.ServerName != "" {
+		if i, ok := m.hosts.Match([]byte(clientHello.ServerName)); ok {
+			return &m.cfg.Certificates[i], nil
+		}
+	}
 	// NOTE: The following code is based on "crypt/tls".Config.getCertificate.
 	for _, cert := range m.cfg.Certificates {
 		if err := clientHello.SupportsCertificate(&cert); err == nil {
@@ -97,6 +121,9 @@ func (m *multiTlsCert) GetCertificate(clientHello *tls.ClientHelloInfo) (*tls.Ce
 	if len(m.cfg.Certificates) == 0 {
 		return nil, errNoCertificates
 	}
+	if m.defaultCert >= 0 {
+		return &m.cfg.Certificates[m.defaultCert], nil
+	}
 	// If nothing matches, return the first certificate.
 	return &m.cfg.Certificates[0], nil
 }
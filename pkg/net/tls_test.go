@@ -105,3 +105,85 @@ func Test_multiTlsCert_GetCertificate(t *testing.T) {
 		}
 	}
 }
+
+func TestMultiTLSConfig_HostPatterns(t *testing.T) {
+	localhost, err := tls.LoadX509KeyPair("../../examples/ssl/localhost.crt", "../../examples/ssl/localhost.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loopback, err := tls.LoadX509KeyPair("../../examples/ssl/127.0.0.1.crt", "../../examples/ssl/127.0.0.1.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfgs := []config.Config{
+		{
+			Host:    "*.example.com",
+			Aliases: []string{`~^tenant\d+\.example\.org$`},
+			SSL: config.SSL{
+				CertFile: "../../examples/ssl/localhost.crt",
+				KeyFile:  "../../examples/ssl/localhost.key",
+			},
+		}, {
+			Host:          "example.net",
+			DefaultServer: true,
+			SSL: config.SSL{
+				CertFile: "../../examples/ssl/127.0.0.1.crt",
+				KeyFile:  "../../examples/ssl/127.0.0.1.key",
+			},
+		},
+	}
+	tlsCfg, err := MultiTLSConfig(cfgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		caseName   string
+		serverName string
+		want       tls.Certificate
+	}{
+		{
+			caseName:   "wildcard",
+			serverName: "www.example.com",
+			want:       localhost,
+		}, {
+			caseName:   "regexp alias",
+			serverName: "tenant7.example.org",
+			want:       localhost,
+		}, {
+			caseName:   "exact",
+			serverName: "example.net",
+			want:       loopback,
+		}, {
+			caseName:   "unknown falls back to default server",
+			serverName: "unknown.test",
+			want:       loopback,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.caseName, func(t *testing.T) {
+			got, err := tlsCfg.GetCertificate(&tls.ClientHelloInfo{ServerName: tc.serverName})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !util.Bytes2dEqual(got.Certificate, tc.want.Certificate) {
+				t.Errorf("unexpected certificate for %q", tc.serverName)
+			}
+		})
+	}
+}
+
+func TestMultiTLSConfig_AutoCertRejectsPatterns(t *testing.T) {
+	for _, host := range []string{"*.example.com", `~^.*\.example\.com$`} {
+		cfgs := []config.Config{
+			{
+				Host:    "example.com",
+				Aliases: []string{host},
+				SSL:     config.SSL{AutoCert: true, AutoCertCacheDir: t.TempDir()},
+			},
+		}
+		if _, err := MultiTLSConfig(cfgs); !errors.Is(err, errNotSupportedWildcard) {
+			t.Errorf("MultiTLSConfig with alias %q returned %v; want %v", host, err, errNotSupportedWildcard)
+		}
+	}
+}
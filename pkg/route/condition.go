@@ -0,0 +1,160 @@
+package route
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/fasthttpd/fasthttpd/pkg/util"
+	"github.com/valyala/fasthttp"
+)
+
+// conditionSource is the part of a request a condition tests.
+type conditionSource int
+
+const (
+	sourceHeader conditionSource = iota
+	sourceQuery
+	sourceCookie
+	sourceHost
+	sourceRemoteIP
+)
+
+func (s conditionSource) String() string {
+	switch s {
+	case sourceHeader:
+		return "header"
+	case sourceQuery:
+		return "query"
+	case sourceCookie:
+		return "cookie"
+	case sourceHost:
+		return "host"
+	}
+	return "remoteIP"
+}
+
+// condition represents a condition on a request value of a route.
+type condition struct {
+	source conditionSource
+	name   []byte
+	// match is nil for the "present" condition.
+	match    func(value []byte) bool
+	prefixes util.IPPrefixes
+	not      bool
+}
+
+// newCondition creates a new condition on the source value named by
+// c.Name. Host values are compared case-insensitively.
+func newCondition(source conditionSource, c config.RouteCondition) (*condition, error) {
+	if source != sourceHost && c.Name == "" {
+		return nil, fmt.Errorf("%s condition requires name", source)
+	}
+	cond := &condition{
+		source: source,
+		name:   []byte(c.Name),
+		not:    c.Not,
+	}
+	m := c.Match
+	if m == "" {
+		m = config.MatchEqual
+		if c.Value == "" {
+			m = config.MatchPresent
+		}
+	}
+	if m == config.MatchPresent {
+		return cond, nil
+	}
+	match, _, err := newMatchFunc(m, c.Value, source == sourceHost)
+	if err != nil {
+		return nil, fmt.Errorf("%s condition %q: %w", source, c.Name, err)
+	}
+	cond.match = match
+	return cond, nil
+}
+
+// newIPCondition creates a new condition on the client IP address.
+func newIPCondition(c config.RouteIPCondition) (*condition, error) {
+	if len(c.CIDRs) == 0 {
+		return nil, fmt.Errorf("remoteIP condition requires cidrs")
+	}
+	prefixes, err := util.ParseIPPrefixes(c.CIDRs...)
+	if err != nil {
+		return nil, fmt.Errorf("remoteIP condition: %w", err)
+	}
+	return &condition{
+		source:   sourceRemoteIP,
+		prefixes: prefixes,
+		not:      c.Not,
+	}, nil
+}
+
+// newMatchFunc returns the function that matches a value with pattern by
+// m, and the compiled pattern if m is "regexp".
+func newMatchFunc(m, pattern string, fold bool) (func(value []byte) bool, *regexp.Regexp, error) {
+	switch m {
+	case config.MatchEqual:
+		eq := []byte(pattern)
+		if fold {
+			return func(value []byte) bool {
+				return bytes.EqualFold(value, eq)
+			}, nil, nil
+		}
+		return func(value []byte) bool {
+			return bytes.Equal(value, eq)
+		}, nil, nil
+	case config.MatchPrefix:
+		prefix := []byte(pattern)
+		if fold {
+			return func(value []byte) bool {
+				return len(value) >= len(prefix) && bytes.EqualFold(value[:len(prefix)], prefix)
+			}, nil, nil
+		}
+		return func(value []byte) bool {
+			return bytes.HasPrefix(value, prefix)
+		}, nil, nil
+	case config.MatchRegexp:
+		if fold {
+			pattern = "(?i)" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, nil, err
+		}
+		return re.Match, re, nil
+	}
+	return nil, nil, fmt.Errorf("unknown match: %s", m)
+}
+
+// eval reports whether the condition holds for the request.
+func (c *condition) eval(ctx *fasthttp.RequestCtx) bool {
+	return c.test(ctx) != c.not
+}
+
+func (c *condition) test(ctx *fasthttp.RequestCtx) bool {
+	var value []byte
+	switch c.source {
+	case sourceHeader:
+		value = ctx.Request.Header.PeekBytes(c.name)
+	case sourceQuery:
+		args := ctx.QueryArgs()
+		if !args.HasBytes(c.name) {
+			return false
+		}
+		if c.match == nil {
+			return true
+		}
+		value = args.PeekBytes(c.name)
+	case sourceCookie:
+		value = ctx.Request.Header.CookieBytes(c.name)
+	case sourceHost:
+		value = util.StripHostPort(ctx.Host())
+	case sourceRemoteIP:
+		return c.prefixes.Contains(util.AddrFromIP(ctx.RemoteIP()))
+	}
+	if c.match == nil {
+		return len(value) > 0
+	}
+	return c.match(value)
+}
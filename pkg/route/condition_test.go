@@ -0,0 +1,201 @@
+package route
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/mojatter/tree"
+	"github.com/valyala/fasthttp"
+)
+
+func newConditionCtx(uri, ip string, headers ...string) *fasthttp.RequestCtx {
+	req := &fasthttp.Request{}
+	req.SetRequestURI(uri)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(req, &net.TCPAddr{IP: net.ParseIP(ip), Port: 12345}, nil)
+	return ctx
+}
+
+func TestRoute_MatchConditions(t *testing.T) {
+	tests := []struct {
+		cfg     config.Route
+		uri     string
+		ip      string
+		headers []string
+		want    bool
+	}{
+		{
+			cfg: config.Route{Headers: []config.RouteCondition{{Name: "X-Canary", Value: "1"}}},
+			uri: "http://example.com/", headers: []string{"X-Canary", "1"},
+			want: true,
+		}, {
+			cfg: config.Route{Headers: []config.RouteCondition{{Name: "X-Canary", Value: "1"}}},
+			uri: "http://example.com/", headers: []string{"X-Canary", "10"},
+		}, {
+			cfg: config.Route{Headers: []config.RouteCondition{{Name: "X-Canary"}}},
+			uri: "http://example.com/", headers: []string{"X-Canary", "yes"},
+			want: true,
+		}, {
+			cfg: config.Route{Headers: []config.RouteCondition{{Name: "Authorization", Not: true}}},
+			uri: "http://example.com/", headers: []string{"Authorization", "Bearer x"},
+		}, {
+			cfg:  config.Route{Headers: []config.RouteCondition{{Name: "Authorization", Not: true}}},
+			uri:  "http://example.com/",
+			want: true,
+		}, {
+			cfg: config.Route{Headers: []config.RouteCondition{{Name: "User-Agent", Match: config.MatchRegexp, Value: `(?i)mobile`}}},
+			uri: "http://example.com/", headers: []string{"User-Agent", "Foo Mobile/1.0"},
+			want: true,
+		}, {
+			cfg:  config.Route{Queries: []config.RouteCondition{{Name: "debug"}}},
+			uri:  "http://example.com/?debug",
+			want: true,
+		}, {
+			cfg:  config.Route{Queries: []config.RouteCondition{{Name: "v", Match: config.MatchPrefix, Value: "2."}}},
+			uri:  "http://example.com/?v=2.1",
+			want: true,
+		}, {
+			cfg: config.Route{Queries: []config.RouteCondition{{Name: "v", Match: config.MatchPrefix, Value: "2."}}},
+			uri: "http://example.com/?v=1.9",
+		}, {
+			cfg: config.Route{Cookies: []config.RouteCondition{{Name: "beta", Value: "on"}}},
+			uri: "http://example.com/", headers: []string{"Cookie", "a=b; beta=on"},
+			want: true,
+		}, {
+			cfg: config.Route{Cookies: []config.RouteCondition{{Name: "beta", Value: "on"}}},
+			uri: "http://example.com/", headers: []string{"Cookie", "beta=off"},
+		}, {
+			cfg:  config.Route{Host: &config.RouteCondition{Value: "API.example.com"}},
+			uri:  "http://api.example.com:8080/",
+			want: true,
+		}, {
+			cfg:  config.Route{Host: &config.RouteCondition{Match: config.MatchRegexp, Value: `^[a-z]+\.example\.com$`}},
+			uri:  "http://WWW.example.com/",
+			want: true,
+		}, {
+			cfg: config.Route{Host: &config.RouteCondition{Value: "api.example.com", Not: true}},
+			uri: "http://api.example.com/",
+		}, {
+			cfg: config.Route{RemoteIP: &config.RouteIPCondition{CIDRs: []string{"10.0.0.0/8"}}},
+			uri: "http://example.com/", ip: "10.1.2.3",
+			want: true,
+		}, {
+			cfg: config.Route{RemoteIP: &config.RouteIPCondition{CIDRs: []string{"10.0.0.0/8"}, Not: true}},
+			uri: "http://example.com/", ip: "10.1.2.3",
+		}, {
+			cfg: config.Route{
+				Headers: []config.RouteCondition{{Name: "X-Canary", Value: "1"}},
+				Queries: []config.RouteCondition{{Name: "debug"}},
+			},
+			uri: "http://example.com/", headers: []string{"X-Canary", "1"},
+		},
+	}
+	for i, test := range tests {
+		r, err := NewRoute(test.cfg)
+		if err != nil {
+			t.Fatalf("tests[%d] error: %v", i, err)
+		}
+		ip := test.ip
+		if ip == "" {
+			ip = "127.0.0.1"
+		}
+		ctx := newConditionCtx(test.uri, ip, test.headers...)
+		if got := r.Match(ctx, ctx.Method(), ctx.Path()); got != test.want {
+			t.Errorf("tests[%d] Match returns %v; want %v", i, got, test.want)
+		}
+		if r.Match(nil, ctx.Method(), ctx.Path()) {
+			t.Errorf("tests[%d] Match returns true without request", i)
+		}
+	}
+}
+
+func TestNewRoute_ConditionErrors(t *testing.T) {
+	tests := []struct {
+		cfg    config.Route
+		errstr string
+	}{
+		{
+			cfg:    config.Route{Headers: []config.RouteCondition{{Value: "1"}}},
+			errstr: "header condition requires name",
+		}, {
+			cfg:    config.Route{Cookies: []config.RouteCondition{{Name: "a", Match: "suffix", Value: "1"}}},
+			errstr: `cookie condition "a": unknown match: suffix`,
+		}, {
+			cfg:    config.Route{Queries: []config.RouteCondition{{Name: "q", Match: config.MatchRegexp, Value: "("}}},
+			errstr: "query condition \"q\": error parsing regexp: missing closing ): `(`",
+		}, {
+			cfg:    config.Route{RemoteIP: &config.RouteIPCondition{}},
+			errstr: "remoteIP condition requires cidrs",
+		}, {
+			cfg:    config.Route{RemoteIP: &config.RouteIPCondition{CIDRs: []string{"localhost"}}},
+			errstr: `remoteIP condition: invalid ip prefix "localhost"`,
+		},
+	}
+	for i, test := range tests {
+		_, err := NewRoute(test.cfg)
+		if err == nil {
+			t.Fatalf("tests[%d] no error; want %q", i, test.errstr)
+		}
+		if got := err.Error(); !strings.HasPrefix(got, test.errstr) {
+			t.Errorf("tests[%d] error is %q; want %q", i, got, test.errstr)
+		}
+	}
+}
+
+func TestRoutes_CachedRouteCtx_Conditions(t *testing.T) {
+	rs, err := NewRoutes(config.Config{
+		Handlers: map[string]tree.Map{
+			"canary":  {},
+			"backend": {},
+		},
+		Routes: []config.Route{
+			{
+				Path:    "/api/",
+				Headers: []config.RouteCondition{{Name: "X-Canary", Value: "1"}},
+				Handler: "canary",
+			}, {
+				Path:    "/",
+				Handler: "backend",
+			},
+		},
+		RoutesCache: config.RoutesCache{Enable: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		headers []string
+		want    string
+	}{
+		{headers: []string{"X-Canary", "1"}, want: "canary"},
+		{want: "backend"},
+		{headers: []string{"X-Canary", "1"}, want: "canary"},
+		{headers: []string{"X-Canary", "2"}, want: "backend"},
+	}
+	for i, test := range tests {
+		ctx := newConditionCtx("http://example.com/api/users", "127.0.0.1", test.headers...)
+		ctx.Request.Header.SetMethod(http.MethodGet)
+		for j := 0; j < 2; j++ {
+			got := rs.CachedRouteCtx(ctx, 0)
+			if got.Handler != test.want {
+				t.Errorf("tests[%d] #%d got handler %q; want %q", i, j, got.Handler, test.want)
+			}
+			got.Release()
+		}
+	}
+	if size := rs.cache.Len(); size != 2 {
+		t.Errorf("unexpected cache size %d; want 2", size)
+	}
+
+	got := rs.CachedRoute([]byte(http.MethodGet), []byte("/api/users"), 0)
+	if got.Handler != "backend" {
+		t.Errorf("got handler %q without request; want %q", got.Handler, "backend")
+	}
+	got.Release()
+}
@@ -0,0 +1,152 @@
+package route
+
+import (
+	"bytes"
+	"regexp/syntax"
+	"slices"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+)
+
+// radixNode is a node of a radix tree keyed by the paths of the prefix
+// and equal routes.
+type radixNode struct {
+	label    []byte
+	indices  []byte
+	children []*radixNode
+	// prefixRoutes and equalRoutes are the indexes of the routes whose
+	// path ends at the node.
+	prefixRoutes []int
+	equalRoutes  []int
+}
+
+func (n *radixNode) child(c byte) *radixNode {
+	if i := bytes.IndexByte(n.indices, c); i != -1 {
+		return n.children[i]
+	}
+	return nil
+}
+
+// insert adds the route of index i whose path is path.
+func (n *radixNode) insert(path []byte, i int, prefix bool) {
+	for len(path) > 0 {
+		child := n.child(path[0])
+		if child == nil {
+			child = &radixNode{label: path}
+			n.indices = append(n.indices, path[0])
+			n.children = append(n.children, child)
+			n = child
+			path = nil
+			break
+		}
+		l := commonPrefixLen(child.label, path)
+		if l < len(child.label) {
+			// Split the edge at l.
+			split := &radixNode{
+				label:    child.label[:l],
+				indices:  []byte{child.label[l]},
+				children: []*radixNode{child},
+			}
+			child.label = child.label[l:]
+			n.children[bytes.IndexByte(n.indices, path[0])] = split
+			child = split
+		}
+		n = child
+		path = path[l:]
+	}
+	if prefix {
+		n.prefixRoutes = append(n.prefixRoutes, i)
+	} else {
+		n.equalRoutes = append(n.equalRoutes, i)
+	}
+}
+
+// appendMatches appends the indexes of the routes whose path matches path
+// to dst.
+func (n *radixNode) appendMatches(dst []int, path []byte) []int {
+	for {
+		dst = append(dst, n.prefixRoutes...)
+		if len(path) == 0 {
+			return append(dst, n.equalRoutes...)
+		}
+		child := n.child(path[0])
+		if child == nil || !bytes.HasPrefix(path, child.label) {
+			return dst
+		}
+		n = child
+		path = path[len(child.label):]
+	}
+}
+
+func commonPrefixLen(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// routeIndex selects the routes that may match a path. The prefix and
+// equal routes are looked up in a radix tree, as are the regexp routes
+// anchored to a literal prefix such as "^/view/(.+)". The other regexp
+// routes are always candidates.
+type routeIndex struct {
+	tree   *radixNode
+	others []int
+}
+
+func newRouteIndex(routes []*Route) *routeIndex {
+	idx := &routeIndex{tree: &radixNode{}}
+	for i, r := range routes {
+		switch r.match {
+		case config.MatchPrefix:
+			idx.tree.insert(r.path, i, true)
+		case config.MatchEqual:
+			idx.tree.insert(r.path, i, false)
+		default:
+			if prefix := anchoredLiteralPrefix(string(r.path)); len(prefix) > 0 {
+				idx.tree.insert(prefix, i, true)
+				continue
+			}
+			idx.others = append(idx.others, i)
+		}
+	}
+	return idx
+}
+
+// anchoredLiteralPrefix returns the literal that every match of the
+// regexp pattern starts with at the beginning of the text, or nil if
+// there is none.
+func anchoredLiteralPrefix(pattern string) []byte {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil
+	}
+	re = re.Simplify()
+	if re.Op != syntax.OpConcat || len(re.Sub) < 2 ||
+		re.Sub[0].Op != syntax.OpBeginText ||
+		re.Sub[1].Op != syntax.OpLiteral || re.Sub[1].Flags&syntax.FoldCase != 0 {
+		return nil
+	}
+	return []byte(string(re.Sub[1].Rune))
+}
+
+// appendCandidates appends the indexes of the routes from off that may
+// match path to dst in the order of the routes.
+func (idx *routeIndex) appendCandidates(dst []int, path []byte, off int) []int {
+	n := len(dst)
+	matches := idx.tree.appendMatches(dst, path)
+	dst = matches[:n]
+	for _, i := range matches[n:] {
+		if i >= off {
+			dst = append(dst, i)
+		}
+	}
+	if i, _ := slices.BinarySearch(idx.others, off); i < len(idx.others) {
+		dst = append(dst, idx.others[i:]...)
+	}
+	slices.Sort(dst[n:])
+	return dst
+}
@@ -0,0 +1,184 @@
+package route
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/mojatter/tree"
+)
+
+func TestRadixNode(t *testing.T) {
+	root := &radixNode{}
+	paths := []struct {
+		path   string
+		prefix bool
+	}{
+		{path: "/", prefix: true},
+		{path: "/api/", prefix: true},
+		{path: "/api/users", prefix: false},
+		{path: "/app", prefix: true},
+		{path: "/api/users/", prefix: true},
+		{path: "/a", prefix: false},
+		{path: "/api/", prefix: false},
+	}
+	for i, p := range paths {
+		root.insert([]byte(p.path), i, p.prefix)
+	}
+	tests := []struct {
+		path string
+		want []int
+	}{
+		{path: "/", want: []int{0}},
+		{path: "/a", want: []int{0, 5}},
+		{path: "/ap", want: []int{0}},
+		{path: "/api/", want: []int{0, 1, 6}},
+		{path: "/api/users", want: []int{0, 1, 2}},
+		{path: "/api/users/1", want: []int{0, 1, 4}},
+		{path: "/apple", want: []int{0, 3}},
+		{path: "/b", want: []int{0}},
+		{path: "", want: nil},
+	}
+	for i, test := range tests {
+		got := root.appendMatches(nil, []byte(test.path))
+		slices.Sort(got)
+		if !slices.Equal(got, test.want) {
+			t.Errorf("tests[%d] appendMatches(%q) = %v; want %v", i, test.path, got, test.want)
+		}
+	}
+}
+
+func TestRouteIndex_appendCandidates(t *testing.T) {
+	routes := []*Route{
+		{match: config.MatchPrefix, path: []byte("/")},
+		{match: config.MatchRegexp, path: []byte(`\.png$`)},
+		{match: config.MatchEqual, path: []byte("/a")},
+		{match: config.MatchRegexp, path: []byte(`/b`)},
+		{match: config.MatchPrefix, path: []byte("/a")},
+		{match: config.MatchRegexp, path: []byte(`^/c|d`)},
+		{match: config.MatchRegexp, path: []byte(`^/view/(.+)`)},
+	}
+	idx := newRouteIndex(routes)
+	tests := []struct {
+		path string
+		off  int
+		want []int
+	}{
+		{path: "/a", off: 0, want: []int{0, 1, 2, 3, 4, 5}},
+		{path: "/a", off: 2, want: []int{2, 3, 4, 5}},
+		{path: "/ab", off: 0, want: []int{0, 1, 3, 4, 5}},
+		{path: "/b", off: 1, want: []int{1, 3, 5}},
+		{path: "/b", off: 6, want: []int{}},
+		{path: "/c", off: 0, want: []int{0, 1, 3, 5}},
+		{path: "/view/1", off: 0, want: []int{0, 1, 3, 5, 6}},
+	}
+	for i, test := range tests {
+		got := idx.appendCandidates([]int{}, []byte(test.path), test.off)
+		if !slices.Equal(got, test.want) {
+			t.Errorf("tests[%d] appendCandidates(%q, %d) = %v; want %v", i, test.path, test.off, got, test.want)
+		}
+	}
+}
+
+func TestAnchoredLiteralPrefix(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		{pattern: `^/view/(.+)`, want: "/view/"},
+		{pattern: `^/re1/.*\.png$`, want: "/re1/"},
+		{pattern: `^/api$`, want: "/api"},
+		{pattern: `^/ab|^/ac`, want: ""},
+		{pattern: `^/a|b`, want: ""},
+		{pattern: `.*\.png$`, want: ""},
+		{pattern: `/view/(.+)`, want: ""},
+		{pattern: `(?i)^/view/`, want: ""},
+		{pattern: `(?m)^/view/`, want: ""},
+		{pattern: `^(`, want: ""},
+	}
+	for i, test := range tests {
+		if got := string(anchoredLiteralPrefix(test.pattern)); got != test.want {
+			t.Errorf("tests[%d] anchoredLiteralPrefix(%q) = %q; want %q", i, test.pattern, got, test.want)
+		}
+	}
+}
+
+// linearRoute is the reference of Routes.Route that matches every route
+// in order.
+func linearRoute(rs *Routes, method, path []byte, off int) *Result {
+	saved := rs.index
+	defer func() { rs.index = saved }()
+	all := make([]int, len(rs.routes))
+	for i := range all {
+		all[i] = i
+	}
+	rs.index = &routeIndex{tree: &radixNode{}, others: all}
+	return rs.Route(method, path, off)
+}
+
+func TestRoutes_IndexOrder(t *testing.T) {
+	rs, err := NewRoutes(config.Config{
+		Handlers: map[string]tree.Map{
+			"static": {}, "api": {}, "users": {}, "images": {}, "view": {}, "root": {},
+		},
+		Filters: map[string]tree.Map{
+			"auth": {}, "cors": {},
+		},
+		Routes: []config.Route{
+			{Path: "/api/", Filters: []string{"cors"}},
+			{Path: "/api/users", Match: config.MatchEqual, Handler: "users"},
+			{Path: `\.(png|jpg)$`, Match: config.MatchRegexp, Handler: "images", NextIfNotFound: true},
+			{Path: "/static/", Handler: "static", NextIfNotFound: true},
+			{Path: "/api/", Methods: []string{http.MethodPost}, Status: http.StatusMethodNotAllowed},
+			{Path: "/api/", Filters: []string{"auth"}, Handler: "api"},
+			{Path: "^/view/(.+)", Match: config.MatchRegexp, Rewrite: "/api/view/$1"},
+			{Path: "/old", Rewrite: "/static/new"},
+			{Path: "/", Match: config.MatchEqual, Handler: "root"},
+			{Path: "/", Status: http.StatusNotFound},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		for _, path := range []string{
+			"/", "/api/", "/api/users", "/api/users/1", "/api/a.png", "/static/a.png",
+			"/static/a.css", "/view/1", "/old", "/oldest", "/other",
+		} {
+			for off := 0; off <= len(rs.routes); off++ {
+				got := rs.Route([]byte(method), []byte(path), off)
+				want := linearRoute(rs, []byte(method), []byte(path), off)
+				if !got.Equal(want) || got.RouteIndex != want.RouteIndex {
+					t.Errorf("%s %s off %d: got %#v; want %#v", method, path, off, *got, *want)
+				}
+				got.Release()
+				want.Release()
+			}
+		}
+	}
+}
+
+func TestRoutes_IndexLarge(t *testing.T) {
+	cfg := newBenchmarkRoutesConfig(1000)
+	rs, err := NewRoutes(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{0, 1, 499, 998, 999, 1000} {
+		for _, path := range []string{
+			fmt.Sprintf("/api/v1/resource%d", n),
+			fmt.Sprintf("/static/%d/app.js", n),
+			fmt.Sprintf("/re%d/x.png", n),
+		} {
+			got := rs.Route([]byte(http.MethodGet), []byte(path), 0)
+			want := linearRoute(rs, []byte(http.MethodGet), []byte(path), 0)
+			if !got.Equal(want) || got.RouteIndex != want.RouteIndex {
+				t.Errorf("%s: got %#v; want %#v", path, *got, *want)
+			}
+			got.Release()
+			want.Release()
+		}
+	}
+}
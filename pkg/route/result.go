@@ -22,6 +22,12 @@ func AcquireResult() *Result {
 	return &Result{}
 }
 
+// Capture is a named capture of a matched regexp route.
+type Capture struct {
+	Name  string
+	Value []byte
+}
+
 // Result represents a result of routing.
 type Result struct {
 	StatusCode        int
@@ -31,7 +37,14 @@ type Result struct {
 	AppendQueryString bool
 	Handler           string
 	Filters           util.StringSet
-	RouteIndex        int
+	// RouteIndex is the index of the matched route in the config, or -1
+	// if no route matched.
+	RouteIndex int
+	// Captures are the named captures of the matched regexp routes.
+	Captures []Capture
+	// noCache reports whether the result depends on the request beyond
+	// the key of the routes cache.
+	noCache bool
 }
 
 // RewriteURIWithQueryString returns r.RewriteURI with queryString.
@@ -60,6 +73,22 @@ func (r *Result) Reset() {
 	r.Handler = ""
 	r.Filters = r.Filters[:0]
 	r.RouteIndex = 0
+	r.Captures = r.Captures[:0]
+	r.noCache = false
+}
+
+// appendCapture appends the capture of name to r.Captures, reusing the
+// value buffers of the released captures.
+func (r *Result) appendCapture(name string, value []byte) {
+	n := len(r.Captures)
+	if n < cap(r.Captures) {
+		r.Captures = r.Captures[:n+1]
+	} else {
+		r.Captures = append(r.Captures, Capture{})
+	}
+	c := &r.Captures[n]
+	c.Name = name
+	c.Value = append(c.Value[:0], value...)
 }
 
 // CopyTo copies all the result to dst.
@@ -73,6 +102,9 @@ func (r *Result) CopyTo(dst *Result) *Result {
 	dst.Handler = r.Handler
 	dst.Filters = append(dst.Filters[:0], r.Filters...)
 	dst.RouteIndex = r.RouteIndex
+	for _, c := range r.Captures {
+		dst.appendCapture(c.Name, c.Value)
+	}
 	return dst
 }
 
@@ -86,6 +118,14 @@ func (a *Result) Equal(b *Result) bool {
 			return false
 		}
 	}
+	if len(a.Captures) != len(b.Captures) {
+		return false
+	}
+	for i, c := range a.Captures {
+		if c.Name != b.Captures[i].Name || !bytes.Equal(c.Value, b.Captures[i].Value) {
+			return false
+		}
+	}
 	return a.StatusCode == b.StatusCode &&
 		bytes.Equal(a.StatusMessage, b.StatusMessage) &&
 		bytes.Equal(a.RewriteURI, b.RewriteURI) &&
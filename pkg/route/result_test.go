@@ -96,9 +96,12 @@ func TestResult_Equal(t *testing.T) {
 		AppendQueryString: true,
 		Handler:           "default",
 		Filters:           util.StringSet{"auth"},
+		Captures:          []Capture{{Name: "id", Value: []byte("42")}},
 	}
 	diffFilterResult := fullResult.CopyTo(&Result{})
 	diffFilterResult.Filters = util.StringSet{"no-cache"}
+	diffCaptureResult := fullResult.CopyTo(&Result{})
+	diffCaptureResult.Captures[0].Value = []byte("43")
 	tests := []struct {
 		a    *Result
 		b    *Result
@@ -114,6 +117,9 @@ func TestResult_Equal(t *testing.T) {
 		}, {
 			a: fullResult,
 			b: diffFilterResult,
+		}, {
+			a: fullResult,
+			b: diffCaptureResult,
 		},
 	}
 	for i, test := range tests {
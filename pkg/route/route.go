@@ -3,6 +3,7 @@ package route
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net/http"
 	"regexp"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/fasthttpd/fasthttpd/pkg/config"
 	"github.com/fasthttpd/fasthttpd/pkg/util"
+	"github.com/fasthttpd/fasthttpd/pkg/vars"
 	"github.com/valyala/fasthttp"
 )
 
@@ -17,21 +19,25 @@ import (
 type Route struct {
 	methodsBytes             [][]byte
 	filters                  []string
-	rewriteUriBytes          []byte
+	rewriteTemplate          *vars.Template
 	rewriteAppendQueryString bool
 	handler                  string
 	statusCode               int
 	statusMessageBytes       []byte
+	match                    string
+	path                     []byte
 	matchPath                func(path []byte) bool
 	matchPattern             *regexp.Regexp
+	captureNames             []string
 	nextIfNotFound           bool
+	conds                    []*condition
+	split                    *split
 }
 
 // NewRoute creates a new Route by the provided rcfg.
 func NewRoute(rcfg config.Route) (*Route, error) {
 	r := &Route{
 		filters:                  rcfg.Filters,
-		rewriteUriBytes:          []byte(rcfg.Rewrite),
 		rewriteAppendQueryString: rcfg.RewriteAppendQueryString,
 		handler:                  rcfg.Handler,
 		statusCode:               rcfg.Status,
@@ -51,6 +57,28 @@ func NewRoute(rcfg config.Route) (*Route, error) {
 	if err := r.initMatchPath(rcfg.Match, rcfg.Path); err != nil {
 		return nil, err
 	}
+	if rcfg.Rewrite != "" {
+		// Only a regexp route has submatches to expand, so a '$' is
+		// literal in the rewrite of the other routes.
+		if r.matchPattern != nil {
+			r.rewriteTemplate = vars.CompileExpand(rcfg.Rewrite)
+		} else {
+			r.rewriteTemplate = vars.Compile(rcfg.Rewrite)
+		}
+	}
+	if err := r.initConditions(rcfg); err != nil {
+		return nil, err
+	}
+	if rcfg.Split != nil {
+		if rcfg.Handler != "" {
+			return nil, errors.New("route cannot have both handler and split")
+		}
+		sp, err := newSplit(*rcfg.Split)
+		if err != nil {
+			return nil, err
+		}
+		r.split = sp
+	}
 	return r, nil
 }
 
@@ -61,36 +89,78 @@ func (r *Route) initMatchPath(cfgMatch, cfgPath string) error {
 	if cfgPath == "" {
 		cfgPath = "/"
 	}
-	switch cfgMatch {
-	case config.MatchEqual:
-		eq := []byte(cfgPath)
-		r.matchPath = func(path []byte) bool {
-			return bytes.Equal(path, eq)
-		}
-		return nil
-	case config.MatchPrefix:
-		prefix := []byte(cfgPath)
-		r.matchPath = func(path []byte) bool {
-			return bytes.HasPrefix(path, prefix)
+	matchPath, pattern, err := newMatchFunc(cfgMatch, cfgPath, false)
+	if err != nil {
+		return err
+	}
+	r.match = cfgMatch
+	r.path = []byte(cfgPath)
+	r.matchPath = matchPath
+	r.matchPattern = pattern
+	if pattern != nil {
+		for _, name := range pattern.SubexpNames() {
+			if name != "" {
+				r.captureNames = pattern.SubexpNames()
+				break
+			}
 		}
-		return nil
-	case config.MatchRegexp:
-		pattern, err := regexp.Compile(cfgPath)
+	}
+	return nil
+}
+
+func (r *Route) initConditions(rcfg config.Route) error {
+	if rcfg.Host != nil {
+		c, err := newCondition(sourceHost, *rcfg.Host)
 		if err != nil {
 			return err
 		}
-		r.matchPath = func(path []byte) bool {
-			return pattern.Match(path)
+		r.conds = append(r.conds, c)
+	}
+	for _, cs := range []struct {
+		source conditionSource
+		cfgs   []config.RouteCondition
+	}{
+		{source: sourceHeader, cfgs: rcfg.Headers},
+		{source: sourceQuery, cfgs: rcfg.Queries},
+		{source: sourceCookie, cfgs: rcfg.Cookies},
+	} {
+		for _, cfg := range cs.cfgs {
+			c, err := newCondition(cs.source, cfg)
+			if err != nil {
+				return err
+			}
+			r.conds = append(r.conds, c)
+		}
+	}
+	if rcfg.RemoteIP != nil {
+		c, err := newIPCondition(*rcfg.RemoteIP)
+		if err != nil {
+			return err
 		}
-		r.matchPattern = pattern
-		return nil
+		r.conds = append(r.conds, c)
 	}
-	return fmt.Errorf("unknown match: %s", cfgMatch)
+	return nil
 }
 
-// Match matches the provided method and path.
-func (r *Route) Match(method, path []byte) bool {
-	return r.matchMethods(method) && r.matchPath(path)
+// Match matches the provided method, path and the conditions on the
+// request of ctx. If ctx is nil, routes with conditions do not match.
+func (r *Route) Match(ctx *fasthttp.RequestCtx, method, path []byte) bool {
+	return r.matchMethods(method) && r.matchPath(path) && r.matchConditions(ctx)
+}
+
+func (r *Route) matchConditions(ctx *fasthttp.RequestCtx) bool {
+	if len(r.conds) == 0 {
+		return true
+	}
+	if ctx == nil {
+		return false
+	}
+	for _, c := range r.conds {
+		if !c.eval(ctx) {
+			return false
+		}
+	}
+	return true
 }
 
 func (r *Route) matchMethods(method []byte) bool {
@@ -105,11 +175,63 @@ func (r *Route) matchMethods(method []byte) bool {
 	return false
 }
 
-func (r *Route) rewrite(path []byte) []byte {
-	if len(r.rewriteUriBytes) > 0 && r.matchPattern != nil {
-		return r.matchPattern.ReplaceAll(path, r.rewriteUriBytes)
+// appendCaptures appends the named captures of the first match of the
+// pattern in path to result.
+func (r *Route) appendCaptures(result *Result, path []byte) {
+	if r.captureNames == nil {
+		return
+	}
+	m := r.matchPattern.FindSubmatchIndex(path)
+	if m == nil {
+		return
+	}
+	for i, name := range r.captureNames {
+		if name == "" || m[2*i] < 0 {
+			continue
+		}
+		result.appendCapture(name, path[m[2*i]:m[2*i+1]])
+	}
+}
+
+// rewrite returns the rewrite URI expanded for the request of ctx. For a
+// regexp route, each match of the pattern in path is replaced with the
+// expansion as regexp.Regexp.ReplaceAll does.
+func (r *Route) rewrite(ctx *fasthttp.RequestCtx, path []byte) []byte {
+	if r.rewriteTemplate == nil {
+		return nil
+	}
+	if r.matchPattern == nil {
+		if r.rewriteTemplate.IsStatic() {
+			return r.rewriteTemplate.Static()
+		}
+		return r.rewriteTemplate.Append(nil, ctx)
 	}
-	return r.rewriteUriBytes
+	var dst []byte
+	last := 0
+	for _, m := range r.matchPattern.FindAllSubmatchIndex(path, -1) {
+		dst = append(dst, path[last:m[0]]...)
+		dst = r.rewriteTemplate.AppendCaptures(dst, ctx, &submatches{re: r.matchPattern, src: path, m: m})
+		last = m[1]
+	}
+	return append(dst, path[last:]...)
+}
+
+// submatches implements vars.Captures for a match of a regexp route.
+type submatches struct {
+	re  *regexp.Regexp
+	src []byte
+	m   []int
+}
+
+func (s *submatches) Index(i int) []byte {
+	if i < 0 || 2*i+1 >= len(s.m) || s.m[2*i] < 0 {
+		return nil
+	}
+	return s.src[s.m[2*i]:s.m[2*i+1]]
+}
+
+func (s *submatches) Name(name string) []byte {
+	return s.Index(s.re.SubexpIndex(name))
 }
 
 func onResultReleased(_ util.CacheKey, value any) {
@@ -121,7 +243,11 @@ func onResultReleased(_ util.CacheKey, value any) {
 // Routes represents a list of routes that can be used to match requested URLs.
 type Routes struct {
 	routes []*Route
+	index  *routeIndex
 	cache  util.Cache
+	// hasConditions reports whether any route has conditions, whose
+	// results are then part of the cache key.
+	hasConditions bool
 }
 
 // NewRoutes creates a new Routes the provided cfg.Routes.
@@ -138,13 +264,25 @@ func NewRoutes(cfg config.Config) (*Routes, error) {
 				return nil, fmt.Errorf("unknown handler: %s", rcfg.Handler)
 			}
 		}
+		if rcfg.Split != nil {
+			for _, h := range rcfg.Split.Handlers {
+				if _, ok := cfg.Handlers[h.Handler]; !ok && h.Handler != "" {
+					return nil, fmt.Errorf("unknown handler: %s", h.Handler)
+				}
+			}
+		}
 		r, err := NewRoute(rcfg)
 		if err != nil {
 			return nil, err
 		}
 		routes[i] = r
 	}
-	rs := &Routes{routes: routes}
+	rs := &Routes{routes: routes, index: newRouteIndex(routes)}
+	for _, r := range routes {
+		if len(r.conds) > 0 {
+			rs.hasConditions = true
+		}
+	}
 	if cfg.RoutesCache.Enable {
 		rs.cache = util.NewCache(util.CacheConfig{
 			Expire:     int64(cfg.RoutesCache.Expire),
@@ -164,14 +302,32 @@ func (rs *Routes) IsNextIfNotFound(i int) bool {
 }
 
 // Route find routes by the provided method and path and returns a new Result.
+// Routes with conditions do not match.
 func (rs *Routes) Route(method, path []byte, off int) *Result {
+	return rs.route(nil, method, path, off)
+}
+
+// RouteCtx find routes by the request of ctx and returns a new Result.
+func (rs *Routes) RouteCtx(ctx *fasthttp.RequestCtx, off int) *Result {
+	return rs.route(ctx, ctx.Method(), ctx.Path(), off)
+}
+
+func (rs *Routes) route(ctx *fasthttp.RequestCtx, method, path []byte, off int) *Result {
 	result := AcquireResult()
 	if off >= len(rs.routes) {
 		result.StatusCode = fasthttp.StatusNotFound
+		result.RouteIndex = -1
 		return result
 	}
-	for i, r := range rs.routes[off:] {
-		if !r.Match(method, path) {
+	// Only the candidates of the index are matched, in the order of the
+	// routes. The candidates are looked up again when a rewrite changes
+	// the path.
+	var candidatesBuf [16]int
+	candidates := rs.index.appendCandidates(candidatesBuf[:0], path, off)
+	for k := 0; k < len(candidates); k++ {
+		i := candidates[k]
+		r := rs.routes[i]
+		if !r.Match(ctx, method, path) {
 			continue
 		}
 		if len(r.filters) > 0 {
@@ -181,8 +337,18 @@ func (rs *Routes) Route(method, path []byte, off int) *Result {
 		result.StatusCode = r.statusCode
 		result.StatusMessage = append(result.StatusMessage[:0], r.statusMessageBytes...)
 		result.Handler = r.handler
+		if r.split != nil {
+			// The handler is picked per request.
+			result.Handler = r.split.pick(ctx)
+			result.noCache = true
+		}
+		r.appendCaptures(result, path)
 
-		if rewriteUri := r.rewrite(path); len(rewriteUri) > 0 {
+		if r.rewriteTemplate != nil && r.rewriteTemplate.UsesRequest() {
+			// The rewrite depends on more than the cache key.
+			result.noCache = true
+		}
+		if rewriteUri := r.rewrite(ctx, path); len(rewriteUri) > 0 {
 			result.AppendQueryString = r.rewriteAppendQueryString
 			if util.IsHttpOrHttps(rewriteUri) || util.IsHttpStatusRedirect(result.StatusCode) {
 				result.RedirectURI = append(result.RedirectURI, rewriteUri...)
@@ -190,19 +356,34 @@ func (rs *Routes) Route(method, path []byte, off int) *Result {
 			}
 			result.RewriteURI = append(result.RewriteURI[:0], rewriteUri...)
 			path, _ = util.SplitRequestURI(rewriteUri)
+			if result.StatusCode == 0 && result.Handler == "" {
+				candidates = rs.index.appendCandidates(candidates[:0], path, i+1)
+				k = -1
+				continue
+			}
 		}
 		if result.StatusCode > 0 || result.Handler != "" {
 			return result
 		}
 	}
 	result.StatusCode = fasthttp.StatusNotFound
+	result.RouteIndex = -1
 	return result
 }
 
 // CachedRoute provides Read-Through caching for rs.Route if the cache is enabled.
 func (rs *Routes) CachedRoute(method, path []byte, off int) *Result {
+	return rs.cachedRoute(nil, method, path, off)
+}
+
+// CachedRouteCtx provides Read-Through caching for rs.RouteCtx if the cache is enabled.
+func (rs *Routes) CachedRouteCtx(ctx *fasthttp.RequestCtx, off int) *Result {
+	return rs.cachedRoute(ctx, ctx.Method(), ctx.Path(), off)
+}
+
+func (rs *Routes) cachedRoute(ctx *fasthttp.RequestCtx, method, path []byte, off int) *Result {
 	if rs.cache == nil {
-		return rs.Route(method, path, off)
+		return rs.route(ctx, method, path, off)
 	}
 
 	// Encode off into a 4-byte little-endian scratch on the stack.
@@ -220,6 +401,14 @@ func (rs *Routes) CachedRoute(method, path []byte, off int) *Result {
 	kb.Write(offBuf[:])
 	kb.Write(method)
 	kb.Write(path)
+	if rs.hasConditions {
+		// The same (method, path) resolves to different routes by the
+		// results of the conditions, so they are part of the key as a
+		// bitset. The results rather than the request values keep the
+		// number of keys bounded.
+		var bitsBuf [16]byte
+		kb.Write(rs.appendConditionBits(bitsBuf[:0], ctx, off))
+	}
 	key := kb.Sum()
 	util.ReleaseCacheKeyBuilder(kb)
 
@@ -227,12 +416,28 @@ func (rs *Routes) CachedRoute(method, path []byte, off int) *Result {
 		result := v.(*Result)
 		return result.CopyTo(AcquireResult())
 	}
-	result := rs.Route(method, path, off)
+	result := rs.route(ctx, method, path, off)
+	if result.noCache {
+		return result
+	}
 	rs.cache.Set(key, result)
 	return result.CopyTo(AcquireResult())
 }
 
-// CachedRouteCtx provides Read-Through caching for rs.Route if the cache is enabled.
-func (rs *Routes) CachedRouteCtx(ctx *fasthttp.RequestCtx, off int) *Result {
-	return rs.CachedRoute(ctx.Method(), ctx.Path(), off)
+// appendConditionBits appends the results of the conditions of the
+// routes from off to dst as a bitset. All bits are zero if ctx is nil.
+func (rs *Routes) appendConditionBits(dst []byte, ctx *fasthttp.RequestCtx, off int) []byte {
+	n := 0
+	for _, r := range rs.routes[min(off, len(rs.routes)):] {
+		for _, c := range r.conds {
+			if n%8 == 0 {
+				dst = append(dst, 0)
+			}
+			if ctx != nil && c.eval(ctx) {
+				dst[len(dst)-1] |= 1 << (n % 8)
+			}
+			n++
+		}
+	}
+	return dst
 }
@@ -1,6 +1,7 @@
 package route
 
 import (
+	"fmt"
 	"net/http"
 	"testing"
 
@@ -112,3 +113,54 @@ func BenchmarkCachedRoutes_Regexp(b *testing.B) {
 		}
 	})
 }
+
+// newBenchmarkRoutesConfig returns a config of n routes that are equal,
+// prefix and regexp routes in turn.
+func newBenchmarkRoutesConfig(n int) config.Config {
+	cfg := config.Config{
+		Handlers: map[string]tree.Map{"h": {}},
+	}
+	for i := range n {
+		var r config.Route
+		switch i % 10 {
+		case 9:
+			r = config.Route{Path: fmt.Sprintf(`^/re%d/.*\.png$`, i), Match: config.MatchRegexp}
+		case 4, 5, 6, 7, 8:
+			r = config.Route{Path: fmt.Sprintf("/static/%d/", i), Match: config.MatchPrefix}
+		default:
+			r = config.Route{Path: fmt.Sprintf("/api/v1/resource%d", i), Match: config.MatchEqual}
+		}
+		r.Handler = "h"
+		cfg.Routes = append(cfg.Routes, r)
+	}
+	return cfg
+}
+
+// BenchmarkRoutes_Size matches the last equal and prefix routes of route
+// tables of several sizes.
+func BenchmarkRoutes_Size(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		rs, err := NewRoutes(newBenchmarkRoutesConfig(n))
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, bc := range []struct {
+			name string
+			path string
+		}{
+			{name: "equal", path: fmt.Sprintf("/api/v1/resource%d", n-7)},
+			{name: "prefix", path: fmt.Sprintf("/static/%d/app.js", n-2)},
+			{name: "notFound", path: "/none"},
+		} {
+			b.Run(fmt.Sprintf("routes=%d/%s", n, bc.name), func(b *testing.B) {
+				method := []byte(http.MethodGet)
+				path := []byte(bc.path)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for b.Loop() {
+					rs.Route(method, path, 0).Release()
+				}
+			})
+		}
+	}
+}
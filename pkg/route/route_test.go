@@ -91,7 +91,7 @@ func TestRoute_Match(t *testing.T) {
 		if err != nil {
 			t.Fatalf("tests[%d] error: %v", i, err)
 		}
-		got := r.Match([]byte(test.method), []byte(test.path))
+		got := r.Match(nil, []byte(test.method), []byte(test.path))
 		if got != test.want {
 			t.Errorf("tests[%d] matchPath returns %v; want %v", i, got, test.want)
 		}
@@ -299,6 +299,148 @@ func TestRoute_NotFound(t *testing.T) {
 	}
 }
 
+func TestRoute_RewriteVariables(t *testing.T) {
+	rs, err := NewRoutes(config.Config{
+		Handlers: map[string]tree.Map{"backend": {}},
+		Routes: []config.Route{
+			{
+				Path:    `^/users/(?P<id>\d+)`,
+				Match:   config.MatchRegexp,
+				Rewrite: "/u?id=${route.capture.id}&n=$1",
+			}, {
+				Path:    "/old/",
+				Rewrite: "https://${host}/new${path}",
+				Status:  http.StatusMovedPermanently,
+			}, {
+				Path:    "/pay",
+				Rewrite: "/checkout?amount=$5&cur=$USD",
+			}, {
+				Path:    "/",
+				Handler: "backend",
+			},
+		},
+		RoutesCache: config.RoutesCache{Enable: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		uri      string
+		rewrite  string
+		redirect string
+		cached   int
+	}{
+		{uri: "http://example.com/users/42/posts", rewrite: "/u?id=42&n=42/posts", cached: 1},
+		{uri: "http://example.com/old/a", redirect: "https://example.com/new/old/a", cached: 1},
+		{uri: "http://other.example.com/old/a", redirect: "https://other.example.com/new/old/a", cached: 1},
+		{uri: "http://example.com/pay", rewrite: "/checkout?amount=$5&cur=$USD", cached: 2},
+	}
+	for i, test := range tests {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.SetRequestURI(test.uri)
+		for j := 0; j < 2; j++ {
+			got := rs.CachedRouteCtx(ctx, 0)
+			if string(got.RewriteURI) != test.rewrite || string(got.RedirectURI) != test.redirect {
+				t.Errorf("tests[%d] #%d got rewrite %q redirect %q; want %q %q",
+					i, j, got.RewriteURI, got.RedirectURI, test.rewrite, test.redirect)
+			}
+			got.Release()
+		}
+		if size := rs.cache.Len(); size != test.cached {
+			t.Errorf("tests[%d] unexpected cache size %d; want %d", i, size, test.cached)
+		}
+	}
+}
+
+func TestRoute_Captures(t *testing.T) {
+	rs, err := NewRoutes(config.Config{
+		Handlers: map[string]tree.Map{"users": {}, "backend": {}},
+		Routes: []config.Route{
+			{
+				Path:    `^/v1/(?P<rest>.+)`,
+				Match:   config.MatchRegexp,
+				Rewrite: "/$rest",
+			}, {
+				Path:    `^/users/(?P<id>\d+)(/(?P<tab>[a-z]+))?$`,
+				Match:   config.MatchRegexp,
+				Handler: "users",
+			}, {
+				Path:    `^/(\w+)`,
+				Match:   config.MatchRegexp,
+				Handler: "backend",
+			},
+		},
+		RoutesCache: config.RoutesCache{Enable: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want []Capture
+	}{
+		{path: "/users/42/posts", want: []Capture{{"id", []byte("42")}, {"tab", []byte("posts")}}},
+		{path: "/users/42", want: []Capture{{"id", []byte("42")}}},
+		{path: "/v1/users/7", want: []Capture{{"rest", []byte("users/7")}, {"id", []byte("7")}}},
+		{path: "/about", want: nil},
+	}
+	for i, test := range tests {
+		for j := 0; j < 2; j++ {
+			got := rs.CachedRoute([]byte(http.MethodGet), []byte(test.path), 0)
+			if len(got.Captures) != len(test.want) {
+				t.Fatalf("tests[%d] #%d got captures %q; want %q", i, j, got.Captures, test.want)
+			}
+			for k, c := range got.Captures {
+				if c.Name != test.want[k].Name || string(c.Value) != string(test.want[k].Value) {
+					t.Errorf("tests[%d] #%d got capture %s=%q; want %s=%q",
+						i, j, c.Name, c.Value, test.want[k].Name, test.want[k].Value)
+				}
+			}
+			got.Release()
+		}
+	}
+}
+
+func TestRoute_RouteIndex(t *testing.T) {
+	rs, err := NewRoutes(config.Config{
+		Handlers: map[string]tree.Map{
+			"static":  {},
+			"backend": {},
+		},
+		Routes: []config.Route{
+			{
+				Path:           "/static/",
+				Match:          config.MatchPrefix,
+				Handler:        "static",
+				NextIfNotFound: true,
+			}, {
+				Path:    "/",
+				Match:   config.MatchPrefix,
+				Handler: "backend",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		off  int
+		want int
+	}{
+		{path: "/static/a.png", off: 0, want: 0},
+		{path: "/static/a.png", off: 1, want: 1},
+		{path: "/static/a.png", off: 2, want: -1},
+	}
+	for i, test := range tests {
+		got := rs.Route([]byte(http.MethodGet), []byte(test.path), test.off)
+		if got.RouteIndex != test.want {
+			t.Errorf("tests[%d] got RouteIndex %d; want %d", i, got.RouteIndex, test.want)
+		}
+		got.Release()
+	}
+}
+
 func Test_onResultReleased(t *testing.T) {
 	cfg := config.Config{
 		Routes: []config.Route{
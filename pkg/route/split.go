@@ -0,0 +1,93 @@
+package route
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/fasthttpd/fasthttpd/pkg/util"
+	"github.com/valyala/fasthttp"
+)
+
+// splitRandomN returns a random number in [0, n). It is a variable so that
+// tests can replace it.
+var splitRandomN = func(n int) int {
+	return rand.IntN(n)
+}
+
+// split represents a weighted split of a route between handlers.
+type split struct {
+	handlers []string
+	// bounds are the cumulative weights of the handlers.
+	bounds []int
+	total  int
+	cookie []byte
+	header []byte
+}
+
+// newSplit creates a new split by the provided c.
+func newSplit(c config.RouteSplit) (*split, error) {
+	if len(c.Handlers) == 0 {
+		return nil, errors.New("split requires handlers")
+	}
+	s := &split{}
+	for _, h := range c.Handlers {
+		if h.Handler == "" {
+			return nil, errors.New("split handler requires handler")
+		}
+		if h.Weight < 0 {
+			return nil, fmt.Errorf("split handler %q: negative weight: %d", h.Handler, h.Weight)
+		}
+		s.total += h.Weight
+		s.handlers = append(s.handlers, h.Handler)
+		s.bounds = append(s.bounds, s.total)
+	}
+	if s.total == 0 {
+		return nil, errors.New("split requires a positive weight")
+	}
+	if c.Sticky != nil {
+		if c.Sticky.Cookie == "" && c.Sticky.Header == "" {
+			return nil, errors.New("split sticky requires cookie or header")
+		}
+		if c.Sticky.Cookie != "" {
+			s.cookie = []byte(c.Sticky.Cookie)
+		}
+		if c.Sticky.Header != "" {
+			s.header = []byte(c.Sticky.Header)
+		}
+	}
+	return s, nil
+}
+
+// pick returns the handler for the request of ctx. A request with the
+// sticky value always gets the same handler. ctx may be nil.
+func (s *split) pick(ctx *fasthttp.RequestCtx) string {
+	var n int
+	if v := s.stickyValue(ctx); len(v) > 0 {
+		n = int(util.HashFNV1a(v) % uint64(s.total))
+	} else {
+		n = splitRandomN(s.total)
+	}
+	for i, b := range s.bounds {
+		if n < b {
+			return s.handlers[i]
+		}
+	}
+	return s.handlers[len(s.handlers)-1]
+}
+
+func (s *split) stickyValue(ctx *fasthttp.RequestCtx) []byte {
+	if ctx == nil {
+		return nil
+	}
+	if s.cookie != nil {
+		if v := ctx.Request.Header.CookieBytes(s.cookie); len(v) > 0 {
+			return v
+		}
+	}
+	if s.header != nil {
+		return ctx.Request.Header.PeekBytes(s.header)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package route
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/fasthttpd/fasthttpd/pkg/config"
+	"github.com/mojatter/tree"
+)
+
+func TestNewSplit_Errors(t *testing.T) {
+	tests := []struct {
+		cfg    config.Route
+		errstr string
+	}{
+		{
+			cfg:    config.Route{Split: &config.RouteSplit{}},
+			errstr: "split requires handlers",
+		}, {
+			cfg:    config.Route{Split: &config.RouteSplit{Handlers: []config.RouteSplitHandler{{Weight: 1}}}},
+			errstr: "split handler requires handler",
+		}, {
+			cfg:    config.Route{Split: &config.RouteSplit{Handlers: []config.RouteSplitHandler{{Handler: "a", Weight: -1}}}},
+			errstr: `split handler "a": negative weight: -1`,
+		}, {
+			cfg:    config.Route{Split: &config.RouteSplit{Handlers: []config.RouteSplitHandler{{Handler: "a"}}}},
+			errstr: "split requires a positive weight",
+		}, {
+			cfg: config.Route{Split: &config.RouteSplit{
+				Handlers: []config.RouteSplitHandler{{Handler: "a", Weight: 1}},
+				Sticky:   &config.RouteSplitSticky{},
+			}},
+			errstr: "split sticky requires cookie or header",
+		}, {
+			cfg: config.Route{
+				Handler: "a",
+				Split:   &config.RouteSplit{Handlers: []config.RouteSplitHandler{{Handler: "b", Weight: 1}}},
+			},
+			errstr: "route cannot have both handler and split",
+		},
+	}
+	for i, test := range tests {
+		_, err := NewRoute(test.cfg)
+		if err == nil {
+			t.Fatalf("tests[%d] no error; want %q", i, test.errstr)
+		}
+		if got := err.Error(); got != test.errstr {
+			t.Errorf("tests[%d] error is %q; want %q", i, got, test.errstr)
+		}
+	}
+}
+
+func TestSplit_Pick(t *testing.T) {
+	saved := splitRandomN
+	defer func() { splitRandomN = saved }()
+
+	s, err := newSplit(config.RouteSplit{
+		Handlers: []config.RouteSplitHandler{
+			{Handler: "stable", Weight: 95},
+			{Handler: "off", Weight: 0},
+			{Handler: "canary", Weight: 5},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{n: 0, want: "stable"},
+		{n: 94, want: "stable"},
+		{n: 95, want: "canary"},
+		{n: 99, want: "canary"},
+	}
+	for i, test := range tests {
+		splitRandomN = func(n int) int {
+			if n != 100 {
+				t.Fatalf("tests[%d] random in [0, %d); want [0, 100)", i, n)
+			}
+			return test.n
+		}
+		if got := s.pick(nil); got != test.want {
+			t.Errorf("tests[%d] pick %q; want %q", i, got, test.want)
+		}
+	}
+}
+
+func TestSplit_Sticky(t *testing.T) {
+	s, err := newSplit(config.RouteSplit{
+		Handlers: []config.RouteSplitHandler{
+			{Handler: "stable", Weight: 50},
+			{Handler: "canary", Weight: 50},
+		},
+		Sticky: &config.RouteSplitSticky{Cookie: "session", Header: "X-User-Id"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]int{}
+	for i := range 100 {
+		cookie := newConditionCtx("http://example.com/", "127.0.0.1", "Cookie", fmt.Sprintf("session=s%d", i))
+		header := newConditionCtx("http://example.com/", "127.0.0.1", "X-User-Id", fmt.Sprintf("s%d", i))
+		want := s.pick(cookie)
+		for range 3 {
+			if got := s.pick(cookie); got != want {
+				t.Fatalf("session s%d picks %q; want %q", i, got, want)
+			}
+		}
+		if got := s.pick(header); got != want {
+			t.Errorf("header s%d picks %q; want %q", i, got, want)
+		}
+		seen[want]++
+	}
+	if seen["stable"] == 0 || seen["canary"] == 0 {
+		t.Errorf("unexpected distribution %v", seen)
+	}
+}
+
+func TestRoutes_Split(t *testing.T) {
+	saved := splitRandomN
+	defer func() { splitRandomN = saved }()
+	next := 0
+	splitRandomN = func(n int) int {
+		return next
+	}
+
+	rs, err := NewRoutes(config.Config{
+		Handlers: map[string]tree.Map{"stable": {}, "canary": {}, "backend": {}},
+		Routes: []config.Route{
+			{
+				Path: "/api/",
+				Split: &config.RouteSplit{Handlers: []config.RouteSplitHandler{
+					{Handler: "stable", Weight: 9},
+					{Handler: "canary", Weight: 1},
+				}},
+			}, {
+				Path:    "/",
+				Handler: "backend",
+			},
+		},
+		RoutesCache: config.RoutesCache{Enable: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		n    int
+		want string
+	}{
+		{path: "/api/users", n: 0, want: "stable"},
+		{path: "/api/users", n: 9, want: "canary"},
+		{path: "/api/users", n: 8, want: "stable"},
+		{path: "/about", n: 9, want: "backend"},
+	}
+	for i, test := range tests {
+		next = test.n
+		got := rs.CachedRoute([]byte(http.MethodGet), []byte(test.path), 0)
+		if got.Handler != test.want {
+			t.Errorf("tests[%d] got handler %q; want %q", i, got.Handler, test.want)
+		}
+		got.Release()
+	}
+	if size := rs.cache.Len(); size != 1 {
+		t.Errorf("unexpected cache size %d; want 1", size)
+	}
+
+	_, err = NewRoutes(config.Config{
+		Handlers: map[string]tree.Map{"stable": {}},
+		Routes: []config.Route{{
+			Split: &config.RouteSplit{Handlers: []config.RouteSplitHandler{{Handler: "canary", Weight: 1}}},
+		}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "unknown handler: canary") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -108,6 +108,10 @@ func CacheKeyOfString(s string) CacheKey {
 type Cache interface {
 	Get(key CacheKey) any
 	Set(key CacheKey, value any)
+	// GetOrSet returns the value mapped to key, or stores and returns the
+	// value created by newValue if there is none. It returns nil if the
+	// key is new and the cache is full.
+	GetOrSet(key CacheKey, newValue func() any) any
 	Del(key CacheKey)
 	Len() int
 	// OnRelease sets a callback that will be called on the key is released.
@@ -225,6 +229,26 @@ func (c *cache) Set(key CacheKey, value any) {
 	c.scheduleEvictLocked(now)
 }
 
+// GetOrSet is the atomic combination of Get and Set, so that concurrent
+// callers of a new key share a single value.
+func (c *cache) GetOrSet(key CacheKey, newValue func() any) any {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := cacheNow()
+	c.scheduleEvictLocked(now)
+	if v := c.store[key]; v != nil {
+		v.peek = now
+		return v.value
+	}
+	if c.max > 0 && len(c.store) >= c.max {
+		return nil
+	}
+	v := &cacheValue{value: newValue(), peek: now}
+	c.store[key] = v
+	return v.value
+}
+
 func (c *cache) Del(key CacheKey) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
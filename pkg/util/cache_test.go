@@ -257,6 +257,30 @@ func TestCache_MaxEntries(t *testing.T) {
 	}
 }
 
+func TestCache_GetOrSet(t *testing.T) {
+	c := NewCache(CacheConfig{MaxEntries: 1})
+	keyA := CacheKeyOfString("a")
+	keyB := CacheKeyOfString("b")
+
+	var created int
+	newValue := func() any {
+		created++
+		return created
+	}
+	if got := c.GetOrSet(keyA, newValue); got != 1 {
+		t.Errorf("first GetOrSet = %v; want 1", got)
+	}
+	if got := c.GetOrSet(keyA, newValue); got != 1 {
+		t.Errorf("second GetOrSet = %v; want 1", got)
+	}
+	if got := c.GetOrSet(keyB, newValue); got != nil {
+		t.Errorf("GetOrSet over the cap = %v; want nil", got)
+	}
+	if created != 1 {
+		t.Errorf("created %d values; want 1", created)
+	}
+}
+
 // BenchmarkCache_Get measures the steady-state cache-hit path,
 // which is the only branch reached during normal routesCache operation
 // after warmup. Must remain zero-alloc.
@@ -0,0 +1,17 @@
+package util
+
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// HashFNV1a returns the 64-bit FNV-1a hash of b. Unlike hash/fnv, it does
+// not allocate.
+func HashFNV1a(b []byte) uint64 {
+	h := uint64(fnvOffset64)
+	for _, c := range b {
+		h ^= uint64(c)
+		h *= fnvPrime64
+	}
+	return h
+}
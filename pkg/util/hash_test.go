@@ -0,0 +1,17 @@
+package util
+
+import (
+	"hash/fnv"
+	"testing"
+)
+
+func TestHashFNV1a(t *testing.T) {
+	tests := []string{"", "a", "10.0.0.1", "http://localhost:9000#1"}
+	for i, test := range tests {
+		h := fnv.New64a()
+		h.Write([]byte(test)) //nolint:errcheck
+		if got, want := HashFNV1a([]byte(test)), h.Sum64(); got != want {
+			t.Errorf("tests[%d] got %#x; want %#x", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// HostMatcher resolves a request host to the index of the virtual host that
+// serves it. Patterns are tried in the following order, like nginx's
+// server_name:
+//   - exact names ("example.com")
+//   - leading wildcards ("*.example.com"), longest suffix first
+//   - regular expressions prefixed with "~" ("~^api\d+\.example\.com$"), in
+//     the order they were added
+//
+// Host names are compared case-insensitively. When the same pattern is
+// added twice, the first index wins.
+type HostMatcher struct {
+	exact     map[string]int
+	wildcards []hostWildcard
+	regexps   []hostRegexp
+}
+
+type hostWildcard struct {
+	suffix string // includes the leading dot, e.g. ".example.com"
+	index  int
+}
+
+type hostRegexp struct {
+	re    *regexp.Regexp
+	index int
+}
+
+// NewHostMatcher creates an empty HostMatcher.
+func NewHostMatcher() *HostMatcher {
+	return &HostMatcher{exact: map[string]int{}}
+}
+
+// IsHostPattern reports whether pattern is a wildcard or regexp pattern
+// rather than a plain host name.
+func IsHostPattern(pattern string) bool {
+	return strings.HasPrefix(pattern, "*.") || strings.HasPrefix(pattern, "~")
+}
+
+// ValidateHostPattern returns an error if pattern cannot be added to a
+// HostMatcher.
+func ValidateHostPattern(pattern string) error {
+	return NewHostMatcher().Add(pattern, 0)
+}
+
+// Add registers pattern for index. An empty pattern is ignored.
+func (m *HostMatcher) Add(pattern string, index int) error {
+	switch {
+	case pattern == "":
+		return nil
+	case strings.HasPrefix(pattern, "~"):
+		re, err := regexp.Compile(pattern[1:])
+		if err != nil {
+			return fmt.Errorf("invalid host pattern %q: %w", pattern, err)
+		}
+		m.regexps = append(m.regexps, hostRegexp{re: re, index: index})
+	case strings.HasPrefix(pattern, "*."):
+		suffix := strings.ToLower(pattern[1:])
+		if len(suffix) < 2 || strings.Contains(suffix, "*") {
+			return fmt.Errorf("invalid host pattern %q", pattern)
+		}
+		for _, w := range m.wildcards {
+			if w.suffix == suffix {
+				return nil
+			}
+		}
+		m.wildcards = append(m.wildcards, hostWildcard{suffix: suffix, index: index})
+		sort.SliceStable(m.wildcards, func(i, j int) bool {
+			return len(m.wildcards[i].suffix) > len(m.wildcards[j].suffix)
+		})
+	default:
+		if strings.Contains(pattern, "*") {
+			return fmt.Errorf("invalid host pattern %q: only a leading wildcard is supported", pattern)
+		}
+		name := strings.ToLower(pattern)
+		if _, ok := m.exact[name]; ok {
+			return nil
+		}
+		m.exact[name] = index
+	}
+	return nil
+}
+
+// Match returns the index registered for the pattern that matches host.
+// host must not contain a port, see StripHostPort.
+func (m *HostMatcher) Match(host []byte) (int, bool) {
+	if hasUpper(host) {
+		host = bytes.ToLower(host)
+	}
+	if i, ok := m.exact[string(host)]; ok {
+		return i, true
+	}
+	for _, w := range m.wildcards {
+		if len(host) > len(w.suffix) && bytes.HasSuffix(host, []byte(w.suffix)) {
+			return w.index, true
+		}
+	}
+	for _, r := range m.regexps {
+		if r.re.Match(host) {
+			return r.index, true
+		}
+	}
+	return 0, false
+}
+
+// StripHostPort returns host without the port. IPv6 literals keep their
+// brackets, e.g. "[::1]:8080" becomes "[::1]".
+func StripHostPort(host []byte) []byte {
+	if len(host) > 0 && host[0] == '[' {
+		if i := bytes.IndexByte(host, ']'); i != -1 {
+			return host[:i+1]
+		}
+		return host
+	}
+	if i := bytes.IndexByte(host, ':'); i != -1 {
+		return host[:i]
+	}
+	return host
+}
+
+func hasUpper(b []byte) bool {
+	for _, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			return true
+		}
+	}
+	return false
+}
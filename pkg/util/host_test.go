@@ -0,0 +1,86 @@
+package util
+
+import "testing"
+
+func TestHostMatcher(t *testing.T) {
+	m := NewHostMatcher()
+	for i, pattern := range []string{
+		"example.com",
+		"*.example.com",
+		"*.api.example.com",
+		`~^app\d+\.example\.org$`,
+		"Example.COM", // duplicate; the first index wins
+		"",            // ignored
+	} {
+		if err := m.Add(pattern, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		host   string
+		want   int
+		wantOk bool
+	}{
+		{host: "example.com", want: 0, wantOk: true},
+		{host: "EXAMPLE.com", want: 0, wantOk: true},
+		{host: "www.example.com", want: 1, wantOk: true},
+		{host: "a.b.example.com", want: 1, wantOk: true},
+		{host: "v1.api.example.com", want: 2, wantOk: true},
+		{host: "app42.example.org", want: 3, wantOk: true},
+		{host: "app.example.org"},
+		{host: "example.org"},
+		{host: ".example.com"},
+		{host: ""},
+	}
+	for _, tc := range testCases {
+		got, ok := m.Match([]byte(tc.host))
+		if ok != tc.wantOk || got != tc.want {
+			t.Errorf("Match(%q) = %d, %v; want %d, %v", tc.host, got, ok, tc.want, tc.wantOk)
+		}
+	}
+}
+
+func TestValidateHostPattern(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		errstr  string
+	}{
+		{pattern: "example.com"},
+		{pattern: "*.example.com"},
+		{pattern: `~^(www\.)?example\.com$`},
+		{pattern: "www.*.com", errstr: `invalid host pattern "www.*.com": only a leading wildcard is supported`},
+		{pattern: "*.", errstr: `invalid host pattern "*."`},
+		{pattern: "~(", errstr: "invalid host pattern \"~(\": error parsing regexp: missing closing ): `(`"},
+	}
+	for _, tc := range testCases {
+		err := ValidateHostPattern(tc.pattern)
+		if tc.errstr == "" {
+			if err != nil {
+				t.Errorf("ValidateHostPattern(%q) returned %v", tc.pattern, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tc.errstr {
+			t.Errorf("ValidateHostPattern(%q) returned %v; want %q", tc.pattern, err, tc.errstr)
+		}
+	}
+}
+
+func TestStripHostPort(t *testing.T) {
+	testCases := []struct {
+		host string
+		want string
+	}{
+		{host: "example.com", want: "example.com"},
+		{host: "example.com:8080", want: "example.com"},
+		{host: "[::1]:8080", want: "[::1]"},
+		{host: "[::1]", want: "[::1]"},
+		{host: "", want: ""},
+	}
+	for _, tc := range testCases {
+		if got := string(StripHostPort([]byte(tc.host))); got != tc.want {
+			t.Errorf("StripHostPort(%q) = %q; want %q", tc.host, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// IPPrefixAll is the keyword that matches every IPv4 and IPv6 address.
+const IPPrefixAll = "all"
+
+var allIPPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/0"),
+	netip.MustParsePrefix("::/0"),
+}
+
+// IPPrefixes is a list of IP prefixes.
+type IPPrefixes []netip.Prefix
+
+// ParseIPPrefixes parses each of ss as a CIDR ("10.0.0.0/8"), a single
+// address ("192.0.2.1", "2001:db8::1") or IPPrefixAll.
+func ParseIPPrefixes(ss ...string) (IPPrefixes, error) {
+	var ps IPPrefixes
+	for _, s := range ss {
+		s = strings.TrimSpace(s)
+		switch {
+		case s == IPPrefixAll:
+			ps = append(ps, allIPPrefixes...)
+		case strings.Contains(s, "/"):
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ip prefix %q: %w", s, err)
+			}
+			ps = append(ps, p.Masked())
+		default:
+			a, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ip prefix %q: %w", s, err)
+			}
+			a = a.Unmap()
+			ps = append(ps, netip.PrefixFrom(a, a.BitLen()))
+		}
+	}
+	return ps, nil
+}
+
+// Contains reports whether addr is in any of ps.
+func (ps IPPrefixes) Contains(addr netip.Addr) bool {
+	for _, p := range ps {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddrFromIP converts ip, such as fasthttp.RequestCtx.RemoteIP, to a
+// netip.Addr. IPv4-mapped IPv6 addresses are converted to IPv4.
+func AddrFromIP(ip net.IP) netip.Addr {
+	a, _ := netip.AddrFromSlice(ip)
+	return a.Unmap()
+}
+
+// ClientAddr returns the address of the client that sent a request
+// received from peer. Only when peer is in trusted, the hops recorded in
+// the forwarding header values are walked from the nearest one and the
+// first address not in trusted is returned. values are X-Forwarded-For
+// style comma-separated addresses or, if forwarded is true, RFC 7239
+// Forwarded elements whose "for" parameter is used. An unparsable hop
+// stops the walk at the last trusted address.
+func ClientAddr(peer netip.Addr, values [][]byte, forwarded bool, trusted IPPrefixes) netip.Addr {
+	if !trusted.Contains(peer) {
+		return peer
+	}
+	addr := peer
+	for i := len(values) - 1; i >= 0; i-- {
+		v := values[i]
+		for len(v) > 0 {
+			var hop []byte
+			if j := bytes.LastIndexByte(v, ','); j != -1 {
+				v, hop = v[:j], v[j+1:]
+			} else {
+				v, hop = nil, v
+			}
+			hop = bytes.TrimSpace(hop)
+			if len(hop) == 0 {
+				continue
+			}
+			if forwarded {
+				hop = forwardedFor(hop)
+			}
+			a, ok := parseHopAddr(hop)
+			if !ok {
+				return addr
+			}
+			addr = a
+			if !trusted.Contains(a) {
+				return a
+			}
+		}
+	}
+	return addr
+}
+
+var forwardedForKey = []byte("for=")
+
+// forwardedFor returns the unquoted value of the "for" parameter of a
+// Forwarded element, e.g. `for="[2001:db8::1]:4711";proto=https`.
+func forwardedFor(elem []byte) []byte {
+	for len(elem) > 0 {
+		var pair []byte
+		if i := bytes.IndexByte(elem, ';'); i != -1 {
+			pair, elem = elem[:i], elem[i+1:]
+		} else {
+			pair, elem = elem, nil
+		}
+		pair = bytes.TrimSpace(pair)
+		if len(pair) > len(forwardedForKey) && bytes.EqualFold(pair[:len(forwardedForKey)], forwardedForKey) {
+			v := pair[len(forwardedForKey):]
+			if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+				v = v[1 : len(v)-1]
+			}
+			return v
+		}
+	}
+	return nil
+}
+
+// parseHopAddr parses an address optionally with a port, such as
+// "192.0.2.1", "192.0.2.1:8080", "2001:db8::1" or "[2001:db8::1]:8080".
+func parseHopAddr(b []byte) (netip.Addr, bool) {
+	if len(b) > 0 && b[0] == '[' {
+		i := bytes.IndexByte(b, ']')
+		if i == -1 {
+			return netip.Addr{}, false
+		}
+		b = b[1:i]
+	} else if i := bytes.IndexByte(b, ':'); i != -1 && bytes.IndexByte(b[i+1:], ':') == -1 {
+		b = b[:i]
+	}
+	a, err := netip.ParseAddr(string(b))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return a.Unmap(), true
+}
@@ -0,0 +1,140 @@
+package util
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestIPPrefixes(t *testing.T) {
+	ps, err := ParseIPPrefixes("10.0.0.0/8", "192.0.2.1", "2001:db8::/32", "::ffff:198.51.100.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		addr string
+		want bool
+	}{
+		{addr: "10.1.2.3", want: true},
+		{addr: "11.0.0.1"},
+		{addr: "192.0.2.1", want: true},
+		{addr: "192.0.2.2"},
+		{addr: "2001:db8::1", want: true},
+		{addr: "2001:db9::1"},
+		{addr: "198.51.100.1", want: true},
+	}
+	for _, tc := range testCases {
+		if got := ps.Contains(netip.MustParseAddr(tc.addr)); got != tc.want {
+			t.Errorf("Contains(%q) = %v; want %v", tc.addr, got, tc.want)
+		}
+	}
+
+	all, err := ParseIPPrefixes(IPPrefixAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{"203.0.113.1", "2001:db8::1"} {
+		if !all.Contains(netip.MustParseAddr(addr)) {
+			t.Errorf("all does not contain %q", addr)
+		}
+	}
+}
+
+func TestParseIPPrefixes_Error(t *testing.T) {
+	for _, s := range []string{"10.0.0.0/33", "example.com", ""} {
+		_, err := ParseIPPrefixes(s)
+		if err == nil || !strings.HasPrefix(err.Error(), "invalid ip prefix") {
+			t.Errorf("ParseIPPrefixes(%q) error %v; want invalid ip prefix", s, err)
+		}
+	}
+}
+
+func TestAddrFromIP(t *testing.T) {
+	if got := AddrFromIP(net.ParseIP("192.0.2.1")); got != netip.MustParseAddr("192.0.2.1") {
+		t.Errorf("AddrFromIP = %v; want 192.0.2.1", got)
+	}
+	if got := AddrFromIP(nil); got.IsValid() {
+		t.Errorf("AddrFromIP(nil) = %v; want invalid", got)
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	trusted, err := ParseIPPrefixes("10.0.0.0/8", "fd00::/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		caseName  string
+		peer      string
+		values    []string
+		forwarded bool
+		want      string
+	}{
+		{
+			caseName: "untrusted peer",
+			peer:     "203.0.113.1",
+			values:   []string{"198.51.100.1"},
+			want:     "203.0.113.1",
+		}, {
+			caseName: "trusted peer without header",
+			peer:     "10.0.0.1",
+			want:     "10.0.0.1",
+		}, {
+			caseName: "rightmost untrusted",
+			peer:     "10.0.0.1",
+			values:   []string{"192.0.2.9, 198.51.100.1, 10.0.0.2"},
+			want:     "198.51.100.1",
+		}, {
+			caseName: "multiple header lines",
+			peer:     "10.0.0.1",
+			values:   []string{"192.0.2.9", "10.0.0.3,10.0.0.2"},
+			want:     "192.0.2.9",
+		}, {
+			caseName: "all hops trusted",
+			peer:     "10.0.0.1",
+			values:   []string{"10.0.0.3, 10.0.0.2"},
+			want:     "10.0.0.3",
+		}, {
+			caseName: "ports and ipv6",
+			peer:     "fd00::1",
+			values:   []string{"[2001:db8::1]:4711, 10.0.0.2:8080"},
+			want:     "2001:db8::1",
+		}, {
+			caseName: "unparsable hop",
+			peer:     "10.0.0.1",
+			values:   []string{"198.51.100.1, unknown, 10.0.0.2"},
+			want:     "10.0.0.2",
+		}, {
+			caseName:  "forwarded",
+			peer:      "10.0.0.1",
+			values:    []string{`for=192.0.2.60;proto=http;by=203.0.113.43, For="[2001:db8:cafe::17]:4711"`},
+			forwarded: true,
+			want:      "2001:db8:cafe::17",
+		}, {
+			caseName:  "forwarded through trusted",
+			peer:      "10.0.0.1",
+			values:    []string{"for=192.0.2.60", "proto=https;for=10.0.0.2"},
+			forwarded: true,
+			want:      "192.0.2.60",
+		}, {
+			caseName:  "forwarded obfuscated",
+			peer:      "10.0.0.1",
+			values:    []string{"for=_hidden"},
+			forwarded: true,
+			want:      "10.0.0.1",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.caseName, func(t *testing.T) {
+			var values [][]byte
+			for _, v := range tc.values {
+				values = append(values, []byte(v))
+			}
+			got := ClientAddr(netip.MustParseAddr(tc.peer), values, tc.forwarded, trusted)
+			if got != netip.MustParseAddr(tc.want) {
+				t.Errorf("ClientAddr = %v; want %v", got, tc.want)
+			}
+		})
+	}
+}
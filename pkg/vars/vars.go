@@ -0,0 +1,352 @@
+// Package vars expands request variables such as ${host} or
+// ${header.X-Foo} in configured strings. Templates are compiled once at
+// config load so that expanding them only appends bytes.
+package vars
+
+import (
+	"encoding/hex"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+
+	"github.com/fasthttpd/fasthttpd/pkg/util"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// TimeISO8601 is the layout of ${time_iso8601}, as nginx formats it.
+	TimeISO8601 = "2006-01-02T15:04:05-07:00"
+
+	prefixQuery        = "query."
+	prefixHeader       = "header."
+	prefixCookie       = "cookie."
+	prefixRouteCapture = "route.capture."
+)
+
+// Captures provides the submatches of a matched regexp route.
+type Captures interface {
+	// Index returns the i-th submatch.
+	Index(i int) []byte
+	// Name returns the submatch of the named group.
+	Name(name string) []byte
+}
+
+type appendFunc func(dst []byte, ctx *fasthttp.RequestCtx, caps Captures) []byte
+
+// Template is a string with variables compiled for expansion.
+type Template struct {
+	raw    string
+	fns    []appendFunc
+	static []byte
+	// usesRequest reports whether the expansion depends on the request
+	// beyond its path and captures.
+	usesRequest bool
+}
+
+// Compile compiles s into a Template. The variables are written as
+// ${name}; unknown ones are left as is.
+//
+//   - ${host}: the Host without the port
+//   - ${remote_addr}: the client IP address
+//   - ${path}: the request path
+//   - ${query.NAME}: the query parameter NAME
+//   - ${header.NAME}: the request header NAME
+//   - ${cookie.NAME}: the cookie NAME
+//   - ${route.capture.NAME}: the named capture NAME of the matched route
+//   - ${request_id}: a random ID unique to the request
+//   - ${time_iso8601}: the request time in ISO 8601
+func Compile(s string) *Template {
+	return compile(s, false)
+}
+
+// CompileExpand compiles s like Compile, and also expands $1, ${1}, $name
+// and ${name} to the submatches of a regexp as regexp.Regexp.Expand does.
+// $$ is a literal $.
+func CompileExpand(s string) *Template {
+	return compile(s, true)
+}
+
+func compile(s string, expand bool) *Template {
+	t := &Template{raw: s}
+	var lit []byte
+	flush := func() {
+		if len(lit) > 0 {
+			t.fns = append(t.fns, newAppendBytes(lit))
+			lit = nil
+		}
+	}
+	for i := 0; i < len(s); {
+		if s[i] != '$' || i+1 == len(s) {
+			lit = append(lit, s[i])
+			i++
+			continue
+		}
+		if s[i+1] == '{' {
+			end := strings.IndexByte(s[i+2:], '}')
+			if end == -1 {
+				lit = append(lit, s[i:]...)
+				break
+			}
+			name := s[i+2 : i+2+end]
+			fn, usesRequest, ok := lookup(name)
+			if !ok && expand && isGroupName(name) {
+				fn, ok = newAppendSubmatch(name), true
+			}
+			if !ok {
+				lit = append(lit, s[i:i+3+end]...)
+				i += 3 + end
+				continue
+			}
+			flush()
+			t.fns = append(t.fns, fn)
+			t.usesRequest = t.usesRequest || usesRequest
+			i += 3 + end
+			continue
+		}
+		if !expand {
+			lit = append(lit, '$')
+			i++
+			continue
+		}
+		if s[i+1] == '$' {
+			lit = append(lit, '$')
+			i += 2
+			continue
+		}
+		end := i + 1
+		for end < len(s) && isGroupNameByte(s[end]) {
+			end++
+		}
+		if end == i+1 {
+			lit = append(lit, '$')
+			i++
+			continue
+		}
+		flush()
+		t.fns = append(t.fns, newAppendSubmatch(s[i+1:end]))
+		i = end
+	}
+	if len(t.fns) == 0 {
+		t.static = lit
+		if t.static == nil {
+			t.static = []byte{}
+		}
+		return t
+	}
+	flush()
+	return t
+}
+
+func isGroupNameByte(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isGroupName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isGroupNameByte(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookup returns the appendFunc of the variable name and whether it
+// depends on the request beyond its path and captures.
+func lookup(name string) (appendFunc, bool, bool) {
+	switch name {
+	case "host":
+		return appendHost, true, true
+	case "remote_addr":
+		return appendRemoteAddr, true, true
+	case "path":
+		return appendPath, false, true
+	case "request_id":
+		return appendRequestID, true, true
+	case "time_iso8601":
+		return appendTimeISO8601, true, true
+	}
+	switch {
+	case strings.HasPrefix(name, prefixQuery) && len(name) > len(prefixQuery):
+		return newAppendQuery(name[len(prefixQuery):]), true, true
+	case strings.HasPrefix(name, prefixHeader) && len(name) > len(prefixHeader):
+		return newAppendHeader(name[len(prefixHeader):]), true, true
+	case strings.HasPrefix(name, prefixCookie) && len(name) > len(prefixCookie):
+		return newAppendCookie(name[len(prefixCookie):]), true, true
+	case strings.HasPrefix(name, prefixRouteCapture) && len(name) > len(prefixRouteCapture):
+		return newAppendRouteCapture(name[len(prefixRouteCapture):]), false, true
+	}
+	return nil, false, false
+}
+
+// String returns the source of t.
+func (t *Template) String() string {
+	return t.raw
+}
+
+// IsStatic reports whether t has no variables.
+func (t *Template) IsStatic() bool {
+	return t.static != nil
+}
+
+// Static returns the value of t if it is static.
+func (t *Template) Static() []byte {
+	return t.static
+}
+
+// UsesRequest reports whether the expansion of t depends on the request
+// beyond its path and the captures of the route.
+func (t *Template) UsesRequest() bool {
+	return t.usesRequest
+}
+
+// Append appends the expansion of t for the request of ctx to dst.
+// Captures are looked up in the user values of ctx.
+func (t *Template) Append(dst []byte, ctx *fasthttp.RequestCtx) []byte {
+	return t.AppendCaptures(dst, ctx, nil)
+}
+
+// AppendCaptures appends the expansion of t to dst with caps as the
+// captures. ctx may be nil, in which case request variables are empty.
+func (t *Template) AppendCaptures(dst []byte, ctx *fasthttp.RequestCtx, caps Captures) []byte {
+	if t.static != nil {
+		return append(dst, t.static...)
+	}
+	for _, fn := range t.fns {
+		dst = fn(dst, ctx, caps)
+	}
+	return dst
+}
+
+func newAppendBytes(b []byte) appendFunc {
+	return func(dst []byte, _ *fasthttp.RequestCtx, _ Captures) []byte {
+		return append(dst, b...)
+	}
+}
+
+func appendHost(dst []byte, ctx *fasthttp.RequestCtx, _ Captures) []byte {
+	if ctx == nil {
+		return dst
+	}
+	return append(dst, util.StripHostPort(ctx.Host())...)
+}
+
+func appendRemoteAddr(dst []byte, ctx *fasthttp.RequestCtx, _ Captures) []byte {
+	if ctx == nil {
+		return dst
+	}
+	return util.AddrFromIP(ctx.RemoteIP()).AppendTo(dst)
+}
+
+func appendPath(dst []byte, ctx *fasthttp.RequestCtx, _ Captures) []byte {
+	if ctx == nil {
+		return dst
+	}
+	return append(dst, ctx.Path()...)
+}
+
+func appendTimeISO8601(dst []byte, ctx *fasthttp.RequestCtx, _ Captures) []byte {
+	if ctx == nil {
+		return dst
+	}
+	return ctx.Time().AppendFormat(dst, TimeISO8601)
+}
+
+type requestIDKey struct{}
+
+// RequestID returns the ID of the request of ctx, which is 32 hex digits
+// generated on first use.
+func RequestID(ctx *fasthttp.RequestCtx) []byte {
+	if id, ok := ctx.UserValue(requestIDKey{}).([]byte); ok {
+		return id
+	}
+	var b [16]byte
+	for i := 0; i < len(b); i += 8 {
+		v := rand.Uint64()
+		for j := range 8 {
+			b[i+j] = byte(v >> (8 * j))
+		}
+	}
+	id := make([]byte, hex.EncodedLen(len(b)))
+	hex.Encode(id, b[:])
+	ctx.SetUserValue(requestIDKey{}, id)
+	return id
+}
+
+func appendRequestID(dst []byte, ctx *fasthttp.RequestCtx, _ Captures) []byte {
+	if ctx == nil {
+		return dst
+	}
+	return append(dst, RequestID(ctx)...)
+}
+
+func newAppendQuery(name string) appendFunc {
+	key := []byte(name)
+	return func(dst []byte, ctx *fasthttp.RequestCtx, _ Captures) []byte {
+		if ctx == nil {
+			return dst
+		}
+		return append(dst, ctx.QueryArgs().PeekBytes(key)...)
+	}
+}
+
+func newAppendHeader(name string) appendFunc {
+	key := []byte(name)
+	return func(dst []byte, ctx *fasthttp.RequestCtx, _ Captures) []byte {
+		if ctx == nil {
+			return dst
+		}
+		return append(dst, ctx.Request.Header.PeekBytes(key)...)
+	}
+}
+
+func newAppendCookie(name string) appendFunc {
+	key := []byte(name)
+	return func(dst []byte, ctx *fasthttp.RequestCtx, _ Captures) []byte {
+		if ctx == nil {
+			return dst
+		}
+		return append(dst, ctx.Request.Header.CookieBytes(key)...)
+	}
+}
+
+// newAppendRouteCapture returns the appendFunc of the named capture. It is
+// looked up in caps, or in the user values of ctx without caps.
+func newAppendRouteCapture(name string) appendFunc {
+	return func(dst []byte, ctx *fasthttp.RequestCtx, caps Captures) []byte {
+		if caps != nil {
+			return append(dst, caps.Name(name)...)
+		}
+		if ctx == nil {
+			return dst
+		}
+		switch v := ctx.UserValue(name).(type) {
+		case []byte:
+			return append(dst, v...)
+		case string:
+			return append(dst, v...)
+		}
+		return dst
+	}
+}
+
+// newAppendSubmatch returns the appendFunc of a regexp submatch referred
+// by its index or name.
+func newAppendSubmatch(name string) appendFunc {
+	if i, err := strconv.Atoi(name); err == nil {
+		return func(dst []byte, _ *fasthttp.RequestCtx, caps Captures) []byte {
+			if caps == nil {
+				return dst
+			}
+			return append(dst, caps.Index(i)...)
+		}
+	}
+	return func(dst []byte, _ *fasthttp.RequestCtx, caps Captures) []byte {
+		if caps == nil {
+			return dst
+		}
+		return append(dst, caps.Name(name)...)
+	}
+}
@@ -0,0 +1,147 @@
+package vars
+
+import (
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+type testCaptures struct {
+	re  *regexp.Regexp
+	src []byte
+	m   []int
+}
+
+func (c *testCaptures) Index(i int) []byte {
+	if i < 0 || 2*i+1 >= len(c.m) || c.m[2*i] < 0 {
+		return nil
+	}
+	return c.src[c.m[2*i]:c.m[2*i+1]]
+}
+
+func (c *testCaptures) Name(name string) []byte {
+	return c.Index(c.re.SubexpIndex(name))
+}
+
+func newTestCtx() *fasthttp.RequestCtx {
+	req := &fasthttp.Request{}
+	req.SetRequestURI("http://Example.com:8080/users/42?foo=bar&empty=")
+	req.Header.Set("X-Foo", "foo value")
+	req.Header.Set("Cookie", "sid=abc; other=1")
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(req, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 12345}, nil)
+	return ctx
+}
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		s           string
+		want        string
+		static      bool
+		usesRequest bool
+	}{
+		{s: "plain", want: "plain", static: true},
+		{s: "", want: "", static: true},
+		{s: "price $5 ${unknown} ${", want: "price $5 ${unknown} ${", static: true},
+		{s: "${host}", want: "example.com", usesRequest: true},
+		{s: "${remote_addr}", want: "192.0.2.1", usesRequest: true},
+		{s: "path=${path}", want: "path=/users/42"},
+		{s: "${query.foo}/${query.empty}/${query.none}", want: "bar//", usesRequest: true},
+		{s: "[${header.X-Foo}]", want: "[foo value]", usesRequest: true},
+		{s: "${cookie.sid}", want: "abc", usesRequest: true},
+		{s: "${route.capture.id}", want: "42"},
+		{s: "${query.}", want: "${query.}", static: true},
+	}
+	for i, test := range tests {
+		ctx := newTestCtx()
+		ctx.SetUserValue("id", "42")
+		tmpl := Compile(test.s)
+		if got := string(tmpl.Append(nil, ctx)); got != test.want {
+			t.Errorf("tests[%d] Compile(%q) expands %q; want %q", i, test.s, got, test.want)
+		}
+		if tmpl.IsStatic() != test.static {
+			t.Errorf("tests[%d] IsStatic %v; want %v", i, tmpl.IsStatic(), test.static)
+		}
+		if tmpl.UsesRequest() != test.usesRequest {
+			t.Errorf("tests[%d] UsesRequest %v; want %v", i, tmpl.UsesRequest(), test.usesRequest)
+		}
+		if tmpl.String() != test.s {
+			t.Errorf("tests[%d] String %q; want %q", i, tmpl.String(), test.s)
+		}
+	}
+}
+
+func TestCompileExpand(t *testing.T) {
+	re := regexp.MustCompile(`^/users/(?P<id>\d+)`)
+	src := []byte("/users/42")
+	caps := &testCaptures{re: re, src: src, m: re.FindSubmatchIndex(src)}
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{s: "/u?id=$1", want: "/u?id=42"},
+		{s: "/u?id=${1}x", want: "/u?id=42x"},
+		{s: "/u?id=$id", want: "/u?id=42"},
+		{s: "/u?id=${id}", want: "/u?id=42"},
+		{s: "/u?id=${route.capture.id}&h=${host}", want: "/u?id=42&h=example.com"},
+		{s: "/u?id=$1x", want: "/u?id="},
+		{s: "/u?id=$9", want: "/u?id="},
+		{s: "$$1 $", want: "$1 $"},
+	}
+	for i, test := range tests {
+		want := string(re.Expand(nil, []byte(test.s), src, caps.m))
+		got := string(CompileExpand(test.s).AppendCaptures(nil, newTestCtx(), caps))
+		if got != test.want {
+			t.Errorf("tests[%d] CompileExpand(%q) expands %q; want %q", i, test.s, got, test.want)
+		}
+		if i < 4 && got != want {
+			t.Errorf("tests[%d] CompileExpand(%q) expands %q; regexp.Expand %q", i, test.s, got, want)
+		}
+	}
+}
+
+func TestTemplate_NilCtx(t *testing.T) {
+	tmpl := Compile("${host}${remote_addr}${path}${query.a}${header.a}${cookie.a}${route.capture.a}${request_id}${time_iso8601}")
+	if got := tmpl.Append(nil, nil); len(got) != 0 {
+		t.Errorf("unexpected expansion %q", got)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	ctx := newTestCtx()
+	id := string(Compile("${request_id}").Append(nil, ctx))
+	if len(id) != 32 {
+		t.Fatalf("unexpected request id %q", id)
+	}
+	if got := string(RequestID(ctx)); got != id {
+		t.Errorf("RequestID %q; want %q", got, id)
+	}
+	if got := string(RequestID(newTestCtx())); got == id {
+		t.Errorf("RequestID of another request is %q", got)
+	}
+}
+
+func TestTimeISO8601(t *testing.T) {
+	ctx := newTestCtx()
+	got := string(Compile("${time_iso8601}").Append(nil, ctx))
+	if want := ctx.Time().Format(TimeISO8601); got != want {
+		t.Errorf("time_iso8601 %q; want %q", got, want)
+	}
+	if _, err := time.Parse(time.RFC3339, got); err != nil {
+		t.Errorf("time_iso8601 %q is not RFC 3339: %v", got, err)
+	}
+}
+
+func BenchmarkTemplate_Append(b *testing.B) {
+	ctx := newTestCtx()
+	tmpl := Compile("${host}${path}?foo=${query.foo}&x=${header.X-Foo}")
+	var dst []byte
+	b.ReportAllocs()
+	b.ResetTimer()
+	for b.Loop() {
+		dst = tmpl.Append(dst[:0], ctx)
+	}
+}